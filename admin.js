@@ -0,0 +1,77 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const audit = require('./audit.js');
+const errors = require('./errors.js');
+const servicekeys = require('./servicekeys.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+function matches(token, candidate) {
+  const a = Buffer.from(token);
+  const b = Buffer.from(candidate);
+  return a.length == b.length && crypto.timingSafeEqual(a, b);
+}
+
+function bearerToken(request) {
+  const authorization = request.get('Authorization') || '';
+  return authorization.startsWith('Bearer ') ? authorization.substring('Bearer '.length) : '';
+}
+
+// Returns whether a token is one of settings.adminTokens.
+exports.allowed = function(token) {
+  const tokens = settings.adminTokens || [];
+  return !!token && tokens.some(candidate => matches(token, candidate));
+};
+
+// Middleware rejecting requests that don't carry one of settings.adminTokens
+// as a bearer token, or authenticate as a service allowed the admin
+// endpoints.  Admin endpoints are disabled when neither is configured.
+exports.required = function(request, response, next) {
+  if (exports.allowed(bearerToken(request))) {
+    audit.record('admin ' + request.method + ' ' + request.path, 'admin', '', request);
+    next();
+    return;
+  }
+  servicekeys.verify(request, 'admin').then(service => {
+    if (!service) {
+      next(new errors.Forbidden());
+      return;
+    }
+    audit.record('admin ' + request.method + ' ' + request.path, 'service:' + service, '', request);
+    next();
+  }, next);
+};
+
+// Middleware accepting App Engine cron requests and services allowed the
+// jobs as well as admin requests.  App Engine removes the X-Appengine-Cron
+// header from external requests.
+exports.cron = function(request, response, next) {
+  if (request.get('X-Appengine-Cron') == 'true') {
+    next();
+    return;
+  }
+  servicekeys.verify(request, 'jobs').then(service => {
+    if (!service) {
+      exports.required(request, response, next);
+      return;
+    }
+    audit.record('admin ' + request.method + ' ' + request.path, 'service:' + service, '', request);
+    next();
+  }, next);
+};
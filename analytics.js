@@ -0,0 +1,94 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Daily counters of application events.  Metrics never include encounter,
+// patient or user identifiers, only a name and an optional numeric value
+// (such as a wait time in seconds) that is summed so it can be averaged.
+// Each counter is split over settings.analytics.counterShards (10) records,
+// one picked at random for each event, so that busy counters don't contend
+// for the same record; the summary adds the shards up.
+
+const datastore = require('./datastore.js');
+const insights = require('./insights.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const {BigQuery} = require('@google-cloud/bigquery');
+
+var client = null;
+
+function shards() {
+  return (settings.analytics && settings.analytics.counterShards) || 10;
+}
+
+function today() {
+  return new Date().toISOString().substring(0, 10);
+}
+
+function insertRow(name, value) {
+  const table = settings.analytics && settings.analytics.bigQueryTable;
+  if (!table) {
+    return Promise.resolve();
+  }
+  if (!client) {
+    client = new BigQuery();
+  }
+  const parts = table.split('.');
+  return client.dataset(parts[0]).table(parts[1]).insert([{
+    time: new Date().toISOString(),
+    name: name,
+    value: value === undefined ? null : value,
+  }]);
+}
+
+// Records one occurrence of a named event.  Failures are logged rather than
+// returned since analytics must never break a visit.
+exports.record = function(name, value) {
+  const day = today();
+  const key = datastore.key(['Metric', day + '/' + name + '/' + crypto.randomInt(shards())]);
+  return datastore.modify(key, entity => {
+    entity = entity || { Day: day, Name: name, Count: 0, Total: 0 };
+    entity.Count += 1;
+    entity.Total += value || 0;
+    return entity;
+  }).then(() => {
+    insights.emit({type: name, value: value});
+    return insertRow(name, value);
+  }).catch(err => {
+    console.log('Failed to record metric ' + name + ': ' + err);
+  });
+};
+
+// Returns { day: { name: { count, total, average } } } for days in
+// [since, until), both given as YYYY-MM-DD.
+exports.summary = function(since, until) {
+  return datastore.list('Metric', [
+    ['Day', '>=', since],
+    ['Day', '<', until],
+  ]).then(entities => {
+    const days = {};
+    entities.forEach(entity => {
+      days[entity.Day] = days[entity.Day] || {};
+      const metric = days[entity.Day][entity.Name] || {count: 0, total: 0};
+      metric.count += entity.Count;
+      metric.total += entity.Total;
+      metric.average = metric.count ? metric.total / metric.count : 0;
+      days[entity.Day][entity.Name] = metric;
+    });
+    return days;
+  });
+};
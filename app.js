@@ -14,9 +14,85 @@
  * limitations under the License.
  */
 
+// Applies the selected environment profile before anything reads settings.
+require('./environment.js');
+
+const admin = require('./admin.js');
+const analytics = require('./analytics.js');
+const appointments = require('./appointments.js');
+const assets = require('./assets.js');
+const bodies = require('./bodies.js');
+const breaker = require('./breaker.js');
+const audit = require('./audit.js');
 const calendar = require('./calendar.js');
+const careteam = require('./careteam.js');
+const chat = require('./chat.js');
+const cleanup = require('./cleanup.js');
+const clock = require('./clock.js');
+const compression = require('./compression.js');
+const consent = require('./consent.js');
 const datastore = require('./datastore.js');
+const deadline = require('./deadline.js');
+const debug = require('./debug.js');
+const dev = require('./dev.js');
+const directory = require('./directory.js');
+const embedding = require('./embedding.js');
+const ehr = require('./ehr.js');
+const encounter = require('./encounter.js');
+const erasure = require('./erasure.js');
+const errors = require('./errors.js');
+const events = require('./events.js');
+const fallback = require('./fallback.js');
+const faults = require('./faults.js');
+const fhir = require('./fhir.js');
+const flags = require('./flags.js');
+const frontdesk = require('./frontdesk.js');
+const groups = require('./groups.js');
+const grpc = require('./grpc.js');
+const httpserver = require('./httpserver.js');
+const handoff = require('./handoff.js');
+const idempotency = require('./idempotency.js');
+const introspection = require('./introspection.js');
+const invitations = require('./invitations.js');
+const messaging = require('./messaging.js');
+const noshow = require('./noshow.js');
+const openapi = require('./openapi.js');
+const period = require('./period.js');
+const provenance = require('./provenance.js');
+const push = require('./push.js');
+const queue = require('./queue.js');
+const ratelimit = require('./ratelimit.js');
+const jobs = require('./jobs.js');
+const launchcheck = require('./launchcheck.js');
+const launchcontext = require('./launchcontext.js');
+const legalhold = require('./legalhold.js');
+const loadshed = require('./loadshed.js');
+const locks = require('./locks.js');
+const registration = require('./registration.js');
+const reload = require('./reload.js');
+const replay = require('./replay.js');
+const report = require('./report.js');
+const retention = require('./retention.js');
+const schemas = require('./schemas.js');
+const schedule = require('./schedule.js');
+const series = require('./series.js');
+const sessioncontext = require('./sessioncontext.js');
+const sessionfields = require('./sessionfields.js');
+const sessionformat = require('./sessionformat.js');
+const sessionsize = require('./sessionsize.js');
+const signatures = require('./signatures.js');
+const snapshot = require('./snapshot.js');
+const stats = require('./stats.js');
+const survey = require('./survey.js');
+const templates = require('./templates.js');
+const tenancy = require('./tenancy.js');
+const tenants = require('./tenants.js');
+const fakeGoogle = require('./testing/google.js');
 const user = require('./user.js');
+const validate = require('./validate.js');
+const verification = require('./verification.js');
+const versions = require('./versions.js');
+const wellknown = require('./wellknown.js');
 
 const settings = require('./settings.json');
 
@@ -24,20 +100,55 @@ const express = require('express');
 const session = require('cookie-session');
 
 const app = express();
-app.use(express.static('static'));
-app.use('/fhirclient', express.static('node_modules/fhirclient/build/'));
-app.use('/jquery', express.static('node_modules/jquery/dist/'));
-app.use(express.urlencoded({extended: false}));
+if (settings.trustProxy) {
+	app.set('trust proxy', settings.trustProxy);
+}
+const client = assets.create({
+	'/': 'static',
+	'/fhirclient/': 'node_modules/fhirclient/build',
+	'/jquery/': 'node_modules/jquery/dist',
+}, {reload: process.argv.indexOf('--dev') != -1, render: templates.page});
+// Pages are rendered with the session's tenant.
+app.use(embedding.middleware);
 app.use(session({
 	name: 'session',
 	keys: [settings.sessionCookieSecret],
-	maxAge: 7 * 60 * 60 * 1000,
+	maxAge: tenants.sessionDuration(tenants.DEFAULT, 'provider'),
 }));
+app.use(sessioncontext.middleware);
+app.use(tenancy.middleware);
+app.use(sessionfields.middleware);
+app.use(sessionformat.middleware);
+app.use(loadshed.middleware);
+app.use(sessionsize.middleware);
+app.use(compression.middleware);
+app.use(client);
+app.use(bodies.middleware);
+app.use(bodies.form({verify: signatures.capture}));
+app.use(stats.middleware);
+app.use(versions.middleware);
+app.use(faults.middleware);
+app.use(ratelimit.middleware);
+app.use(deadline.middleware);
+app.use(idempotency.middleware);
+
+const port = process.env.PORT || 8080;
+// Integration tests sign in and hold meetings without reaching Google.
+if (settings.mockGoogle && settings.mockGoogle.enabled) {
+	fakeGoogle.install(app, 'http://localhost:' + port);
+}
+if (process.argv.indexOf('--dev') != -1) {
+	dev.install(app, port);
+}
 
 function error(response) {
   return function(err) {
-    console.log(err);
-    response.status(500).send(err);
+    const problem = errors.classify(err);
+    if (problem.status >= 500) {
+      console.log(err);
+      analytics.record('error');
+    }
+    errors.send(response, problem);
   };
 }
 
@@ -49,43 +160,987 @@ function debugLog(message) {
 
 app.get('/hangouts/:encounterId', (request, response) => {
 	const key = datastore.key(['Encounter', request.params.encounterId]);
-	datastore.get(key).then(entity => {
+	const consented = consent.required() ? consent.given(request.params.encounterId) : Promise.resolve(true);
+	consented.then(given => {
+		if (!given) {
+			throw new errors.ConsentRequired();
+		}
+		if (verification.enabled() && !verification.verified(request, request.params.encounterId)) {
+			throw new errors.VerificationRequired();
+		}
+		return datastore.get(key);
+	}).then(entity => {
+		if (!request.session.id) {
+			sessioncontext.set(request, {role: 'patient'});
+		}
+		// Occurrences of a series only give out the series' link around the
+		// appointment.
+		if (entity && entity.WindowEnd && clock.date() > entity.WindowEnd) {
+			throw new errors.Expired('The access window for this visit has passed');
+		}
+		if (entity && entity.WindowStart && clock.date() < entity.WindowStart) {
+			response.send({});
+			return;
+		}
+		if (entity && entity.Closed) {
+			throw new errors.Expired();
+		}
+		if (entity && entity.PatientJoined &&
+			clock.now() - entity.PatientJoined.getTime() > tenants.sessionDuration(entity.Tenant, 'patient')) {
+			throw new errors.Expired('The patient session has expired');
+		}
 		if (entity) {
 			debugLog('Patient encounter ' + request.params.encounterId + ' found URL ' + entity.Url);
-			response.send({url: entity.Url});
+			audit.record('meeting-link-viewed', 'patient', request.params.encounterId, request);
+			if (!request.session.id) {
+				launchcontext.set(request, {encounterId: request.params.encounterId, meetUrl: entity.Url});
+			}
+			if (entity.PatientJoined) {
+				response.send({url: entity.Url});
+				return;
+			}
+			entity.PatientJoined = clock.date();
+			return datastore.update(key, entity).then(() => {
+				analytics.record('patient-joined');
+				events.publish('visit.joined', {encounterId: request.params.encounterId});
+				response.send({url: entity.Url});
+			});
 		} else {
 			response.send({});
 		}
 	}).catch(error(response));
 });
 
-app.post('/hangouts', (request, response) => {
+// Resolves to the meeting record fields of a new Meet conference.
+function newMeeting(client, encounterId, owner) {
+	const create = () => new Promise((resolve, reject) => {
+		calendar.createEvent(client, encounterId, (err, url, created) => {
+			if (err) {
+				debugLog('ERROR: Provider calendar event create for encounter ' + encounterId + ' failed with error ' + err);
+				analytics.record('failure/meet');
+				reject(err);
+				return;
+			}
+			debugLog('Provider created calendar event for encounter ' + encounterId + ' with URL ' + url);
+			resolve({Url: url, CalendarId: created.calendarId, EventId: created.eventId, Owner: owner});
+		});
+	});
+	const unavailable = () => new errors.MeetUnavailable('Google Calendar is not responding');
+	return breaker.get('meet').call(create, unavailable, breaker.isOutage).catch(err => {
+		throw err instanceof errors.ProblemError ? err : new errors.MeetUnavailable();
+	});
+}
+
+// Checks that the launching practitioner takes part in the encounter, either
+// warning or rejecting the request when they don't, as settings.careTeamCheck
+// says.
+function checkCareTeam(request, encounterId) {
+	const mode = careteam.mode();
+	if (mode == 'off') {
+		return Promise.resolve();
+	}
+
+	return Promise.resolve().then(() => fhir.context(request)).then(context => {
+		return careteam.includes(context, encounterId, request.body.user);
+	}).then(included => {
+		if (included) {
+			return;
+		}
+		audit.record('care-team-mismatch', 'provider', encounterId, request);
+		if (mode == 'block') {
+			throw new errors.NotOnCareTeam();
+		}
+		console.log('Practitioner ' + request.body.user + ' is not on the care team of encounter ' + encounterId);
+	});
+}
+
+// Resolves to the busy times of the provider's calendar during a new ad-hoc
+// visit, either warning or, unless the provider chose to go ahead anyway,
+// rejecting the request when there are any, as settings.freeBusyCheck says.
+// A calendar that can't be read doesn't hold up the visit.
+function checkFreeBusy(request, client, encounterId) {
+	const mode = settings.freeBusyCheck || 'off';
+	if (mode == 'off') {
+		return Promise.resolve([]);
+	}
+
+	const start = new Date();
+	const end = new Date(start.getTime() + calendar.eventDuration);
+	return new Promise(resolve => {
+		calendar.freeBusy(client, start, end, (err, busy) => {
+			if (err) {
+				console.log('Failed to read the free/busy times of encounter ' + encounterId + "'s provider: " + err);
+			}
+			resolve(busy || []);
+		});
+	}).then(busy => {
+		if (!busy.length) {
+			return busy;
+		}
+		audit.record('calendar-conflict', 'provider', encounterId, request);
+		if (mode == 'block' && request.body.allowConflicts != 'true') {
+			throw new errors.CalendarConflict('Busy ' + busy.map(interval => interval.start + ' to ' + interval.end).join(', '));
+		}
+		return busy;
+	});
+}
+
+// Checks the launch context against the EHR's records, either warning or
+// rejecting the request when they don't match, as settings.launchContextCheck
+// says.  Resolves to the problems found.
+function checkLaunchContext(request, encounterId, patientId) {
+	const mode = launchcheck.mode();
+	if (mode == 'off' || !request.get('X-FHIR-Server')) {
+		return Promise.resolve([]);
+	}
+
+	return Promise.resolve().then(() => fhir.context(request)).then(context => {
+		return launchcheck.problems(context, encounterId, patientId);
+	}).then(problems => {
+		if (!problems.length) {
+			return problems;
+		}
+		audit.record('launch-context-mismatch', request.session.id ? 'provider' : 'patient', encounterId, request);
+		if (mode == 'block') {
+			throw new errors.InvalidLaunchContext(problems.join('; '));
+		}
+		console.log('Launch context of encounter ' + encounterId + ' does not match the EHR: ' + problems.join('; '));
+		return problems;
+	});
+}
+
+// Resolves to the tenant of the FHIR server the request's access token was
+// issued by, checked by reading the encounter with the token, or the default
+// tenant without a FHIR context.  The iss in the body is only the browser's
+// say so, and would let it pick the tenant's session duration and limits.
+function launchTenant(request, encounterId) {
+	if (!request.get('X-FHIR-Server')) {
+		return Promise.resolve(tenants.DEFAULT);
+	}
+	return Promise.resolve().then(() => fhir.context(request)).then(context => {
+		return fhir.read(context, 'Encounter', encounterId).then(() => tenants.forIssuer(context.serverUrl));
+	});
+}
+
+app.post('/hangouts', validate.body(schemas.hangout), (request, response) => {
 	const encounterId = request.body.encounterId;
 	const key = datastore.key(['Encounter', encounterId]);
-	datastore.get(key).then(entity => {
-		if (entity) {
-			debugLog('Provider found existing encounter ' + request.body.encounterId + ' with URL ' + entity.Url);
-			response.send({url: entity.Url});
+	checkLaunchContext(request, encounterId, request.body.patient).then(() => {
+		return checkCareTeam(request, encounterId);
+	}).then(() => datastore.get(key)).then(existing => {
+		if (existing && !existing.Closed) {
+			debugLog('Provider found existing encounter ' + request.body.encounterId + ' with URL ' + existing.Url);
+			audit.record('meeting-link-viewed', 'provider', encounterId, request);
+			launchcontext.set(request, {encounterId: encounterId, meetUrl: existing.Url});
+			response.send({url: existing.Url, degraded: existing.Degraded});
+			return undefined;
+		}
+		return launchTenant(request, encounterId);
+	}).then(tenant => {
+		if (!tenant) {
 			return;
 		}
 
+		// Remembered so that a provider sent to sign in gets the tenant's
+		// session duration and session limit.
+		launchcontext.set(request, {
+			tenantId: tenant,
+			practitioner: request.body.user || null,
+			patientId: request.body.patient || null,
+			encounterId: encounterId,
+		});
+		user.withCredentials(request, response, client => {
+			// Only one instance creates the encounter's meeting; the others wait
+			// for it and send the meeting it created.
+			checkFreeBusy(request, client, encounterId).then(conflicts => {
+				return locks.run('meeting:' + encounterId, meetingLockTtl, meetingLockTtl / 4, lock => {
+					return datastore.get(key).then(current => {
+						if (current && !current.Closed) {
+							launchcontext.set(request, {meetUrl: current.Url});
+							response.send({url: current.Url, degraded: current.Degraded});
+							return;
+						}
+						return createMeeting(request, response, client, encounterId, tenant, lock, conflicts);
+					});
+				}, () => {
+					throw new errors.MeetUnavailable('Another request is still creating the meeting');
+				});
+			}).catch(error(response));
+		});
+	}).catch(error(response));
+});
+
+// How long creating a meeting may hold the encounter's lock.
+const meetingLockTtl = 60 * 1000;
+
+// Creates and stores the meeting of an encounter while holding its lock.
+// The provider's busy times at the visit are sent back with it.
+function createMeeting(request, response, client, encounterId, tenant, lock, conflicts) {
+	const key = datastore.key(['Encounter', encounterId]);
+	const create = () => newMeeting(client, encounterId, request.session.id);
+	var meeting;
+	if (series.enabled() && request.get('X-FHIR-Server')) {
+		meeting = Promise.resolve().then(() => series.meeting(fhir.context(request), encounterId, create));
+	} else {
+		meeting = create();
+	}
+	return meeting.catch(err => fallback.meeting(encounterId, request.session.id, err)).then(fields => {
+		if (!appointments.enabled() || !request.get('X-FHIR-Server')) {
+			return fields;
+		}
+		return appointments.link(fhir.context(request), encounterId).then(link => Object.assign(fields, link));
+	}).then(fields => {
+		const entity = Object.assign(fields, {
+			Created: new Date(),
+			Owner: request.session.id,
+			Tenant: tenant,
+			Fence: lock.token,
+		});
+		// Indexed, so the patient's visits can be found without a query.
+		if (request.body.patient) {
+			entity.Patient = request.body.patient;
+		}
+		// A closed meeting is replaced by the new one, unless the lock expired
+		// and a later holder stored a meeting meanwhile.
+		return datastore.modify(key, current => {
+			if ((current && !current.Closed) || !locks.fenced(current, lock)) {
+				return undefined;
+			}
+			return entity;
+		}).then(saved => {
+			if (!saved) {
+				const orphaned = entity.Series ? Promise.resolve() : cleanup.deleteEvent(entity);
+				return orphaned.then(() => datastore.get(key)).then(current => {
+					launchcontext.set(request, {meetUrl: current.Url});
+					response.send({url: current.Url, degraded: current.Degraded});
+				});
+			}
+			analytics.record('meeting-created');
+			audit.record('meeting-created', 'provider', encounterId, request);
+			events.publish('visit.created', {encounterId: encounterId});
+			launchcontext.set(request, {meetUrl: entity.Url});
+			response.send({url: entity.Url, degraded: entity.Degraded, conflicts: conflicts.length ? conflicts : undefined});
+		});
+	});
+}
+
+// Creates one meeting for a group visit with several patients, each with
+// their own encounter and join link.
+app.post('/groups', fhir.required, introspection.required, validate.body(schemas.group), (request, response) => {
+	const body = request.body.encounterIds;
+	const encounterIds = (Array.isArray(body) ? body : String(body || '').split(','))
+		.map(id => id.trim())
+		.filter((id, i, ids) => id && ids.indexOf(id) == i);
+	const maxPatients = (settings.groupVisits && settings.groupVisits.maxPatients) || 10;
+	if (encounterIds.length < 2 || encounterIds.length > maxPatients) {
+		errors.send(response, new errors.InvalidRequest('A group visit needs 2 to ' + maxPatients + ' encounters'));
+		return;
+	}
+
+	// Reading each Encounter checks the provider can access it.
+	Promise.all(encounterIds.map(id => fhir.read(request.fhirContext, 'Encounter', id))).then(() => {
+		return datastore.getMany(encounterIds.map(id => datastore.key(['Encounter', id])));
+	}).then(existing => {
+		if (existing.some(entity => entity && !entity.Closed)) {
+			throw new errors.InvalidRequest('An encounter already has a meeting');
+		}
+
+		const tenant = tenants.forIssuer(request.fhirContext.serverUrl);
+		launchcontext.set(request, {tenantId: tenant, practitioner: request.body.user || null});
 		user.withCredentials(request, response, client => {
-			calendar.createEvent(client, encounterId, (err, url) => {
+			calendar.createEvent(client, encounterIds[0], (err, url, created) => {
 				if (err) {
-					debugLog('ERROR: Provider calendar event create for encounter ' + request.body.encounterId + ' failed with error ' + err);
-					response.status(500).send(err);
+					analytics.record('failure/meet');
+					errors.send(response, new errors.MeetUnavailable());
 					return;
 				}
-				debugLog('Provider created calendar event for encounter ' + request.body.encounterId + ' with URL ' + url);
-				const entity = { Url: url };
-				datastore.set(key, entity).then(() => {
-					response.send({url: url});
+				groups.create(encounterIds, {
+					Url: url,
+					Created: new Date(),
+					Owner: request.session.id,
+					CalendarId: created.calendarId,
+					EventId: created.eventId,
+					Tenant: tenant,
+				}).then(group => {
+					analytics.record('meeting-created');
+					encounterIds.forEach(id => {
+						audit.record('meeting-created', 'provider', id, request);
+						events.publish('visit.created', {encounterId: id});
+					});
+					response.send({url: url, group: group, encounterIds: encounterIds});
+				}).catch(error(response));
+			});
+		});
+	}).catch(error(response));
+});
+
+app.post('/encounters/:encounterId/events', fhir.required, introspection.required, validate.body(schemas.event), (request, response) => {
+	analytics.record('event/' + request.body.event);
+	const waited = parseInt(request.body.waited, 10);
+	if (request.body.event == 'joined' && waited >= 0) {
+		analytics.record('wait-seconds', waited);
+	}
+
+	// A provider's events apply to every encounter of a group visit.
+	const encounterId = request.params.encounterId;
+	const targets = request.session.id ? groups.members(encounterId) : Promise.resolve([encounterId]);
+	targets.then(encounterIds => {
+		var recorded = Promise.resolve();
+		if (request.body.event == 'waiting') {
+			recorded = encounter.record(encounterId, {PatientWaiting: new Date()}).then(() => {
+				push.patientWaiting(encounterId);
+				chat.post(encounterId, 'patient-waiting', 'A patient is waiting');
+			});
+		}
+		if (request.body.event == 'joined') {
+			const joined = request.session.id ? {ProviderJoined: new Date()} : {PatientInMeeting: new Date()};
+			recorded = Promise.all(encounterIds.map(id => encounter.record(id, joined).then(() => {
+				if (request.session.id && frontdesk.enabled()) {
+					frontdesk.record(id, 'joined');
+				}
+				return encounter.start(id);
+			}).then(started => {
+				if (started) {
+					events.publish('visit.started', {encounterId: id});
+				}
+			})));
+		}
+		if (request.body.event == 'left') {
+			const left = request.session.id ? {ProviderLeft: new Date()} : {PatientLeft: new Date()};
+			recorded = Promise.all(encounterIds.map(id => encounter.record(id, left)));
+		}
+		if (request.body.event == 'ended') {
+			const context = request.capabilities.canWriteEncounter ? request.fhirContext : undefined;
+			const readContext = request.capabilities.canReadEncounter ? request.fhirContext : undefined;
+			recorded = Promise.all(encounterIds.map(id => {
+				events.publish('visit.ended', {encounterId: id});
+				if (frontdesk.enabled()) {
+					frontdesk.record(id, 'ended');
+				}
+				return encounter.record(id, {Ended: new Date()}).then(() => {
+					if (survey.enabled()) {
+						survey.dispatch(id, readContext);
+					}
+					return period.record(id, context);
+				});
+			}));
+		}
+		if (!settings.encounterStatusUpdates || !request.capabilities.canWriteEncounter) {
+			return recorded.then(() => ({}));
+		}
+
+		return recorded.then(() => Promise.all(encounterIds.map(id => {
+			return encounter.update(request.fhirContext, id, request.body.event).then(status => {
+				debugLog('Encounter ' + id + ' event ' + request.body.event + ' set status ' + status);
+				return status;
+			});
+		}))).then(statuses => {
+			const status = statuses[encounterIds.indexOf(encounterId)];
+			return status ? {status: status} : {};
+		});
+	}).then(body => response.send(body)).catch(error(response));
+});
+
+// Checks, straight after the SMART launch, that the EHR launched the app
+// with an Encounter and Patient that fit together.
+app.post('/encounters/:encounterId/launch-check', fhir.required, introspection.required, validate.body(schemas.launchCheck), (request, response) => {
+	checkLaunchContext(request, request.params.encounterId, request.body.patient).then(problems => {
+		response.send({problems: problems});
+	}).catch(error(response));
+});
+
+// Records the patient's consent from the consent screen.
+app.post('/encounters/:encounterId/consent', fhir.required, introspection.required, validate.body(schemas.consent), (request, response) => {
+	const encounterId = request.params.encounterId;
+	consent.record(request.fhirContext, encounterId, {
+		patient: request.body.patient,
+		recording: request.body.recording == 'true',
+		language: request.body.language,
+	}, request.capabilities.canWriteConsent).then(entity => {
+		request.session.consent = {encounterId: encounterId, given: entity.Given, recording: entity.Recording};
+		audit.record('consent-given', 'patient', encounterId, request);
+		response.send({recording: entity.Recording, resourceId: entity.ResourceId || undefined});
+	}).catch(error(response));
+});
+
+// Lists the other practitioners taking part in the encounter, who can be
+// invited to the visit.
+app.get('/encounters/:encounterId/care-team', fhir.required, introspection.required, (request, response) => {
+	careteam.members(request.fhirContext, request.params.encounterId).then(members => {
+		const self = (request.query.user || '').split('/').slice(-2).join('/');
+		response.send({members: members.filter(member => member.reference != self)});
+	}).catch(error(response));
+});
+
+function addToMeeting(client, meeting, email) {
+	const options = settings.invitations || {};
+	return new Promise(resolve => {
+		calendar.addAttendee(client, meeting.CalendarId, meeting.EventId, email, err => {
+			if (err) {
+				console.log('Failed to add ' + email + ' to the meeting event: ' + err);
+			}
+			if (!options.cohosts || !flags.enabled('meetCohosts', meeting.Tenant, datastore.name(meeting))) {
+				resolve();
+				return;
+			}
+			calendar.addCohost(client, meeting.Url, email, err => {
+				if (err) {
+					console.log('Failed to make ' + email + ' a co-host: ' + err);
+				}
+				resolve();
+			});
+		});
+	});
+}
+
+// Invites a care team member to the visit.  Only the clinician who created
+// the meeting can invite.
+app.post('/encounters/:encounterId/invitations', fhir.required, introspection.required, validate.body(schemas.invitation), (request, response) => {
+	const encounterId = request.params.encounterId;
+	const practitioner = request.body.practitioner;
+
+	const key = datastore.key(['Encounter', encounterId]);
+	Promise.all([
+		datastore.get(key),
+		request.session.id ? user.clientFor(request.session.id) : undefined,
+		careteam.members(request.fhirContext, encounterId),
+	]).then(results => {
+		const meeting = results[0];
+		const client = results[1];
+		const member = results[2].filter(member => member.reference == practitioner)[0];
+		if (!client) {
+			throw new errors.NotSignedIn();
+		}
+		if (!meeting || meeting.Closed || meeting.Owner != request.session.id) {
+			throw new errors.Forbidden('Only the clinician who created the meeting can invite');
+		}
+		if (!member) {
+			throw new errors.NotOnCareTeam(practitioner + ' does not take part in the visit');
+		}
+
+		const expires = new Date(meeting.Created.getTime() + cleanup.meetingMaxAge());
+		return invitations.create(encounterId, practitioner, member.email, request.session.id, expires).then(token => {
+			audit.record('invitation-created', 'provider', encounterId, request);
+			return (member.email ? addToMeeting(client, meeting, member.email) : Promise.resolve()).then(() => {
+				response.send({
+					url: request.protocol + '://' + request.get('host') + '/invite.html?token=' + token,
+					email: member.email,
 				});
 			});
 		});
 	}).catch(error(response));
 });
 
+// Subscribes the signed in provider's browser to push notifications.
+app.post('/push/subscriptions', bodies.json(), validate.body(schemas.pushSubscription), (request, response) => {
+	const subscription = request.body;
+	if (!push.enabled()) {
+		errors.send(response, new errors.NotFound('Push notifications are not enabled'));
+		return;
+	}
+	if (!request.session.id) {
+		errors.send(response, new errors.NotSignedIn());
+		return;
+	}
+	push.subscribe(request.session.id, subscription).then(subscribed => {
+		if (!subscribed) {
+			throw new errors.NotSignedIn('The session has expired');
+		}
+		response.send({});
+	}).catch(error(response));
+});
+
+// Sends the patient to their post-visit survey.
+app.get('/surveys/:token', (request, response) => {
+	survey.open(request.params.token).then(url => {
+		response.redirect(url || '/error.html?code=not-found');
+	}).catch(error(response));
+});
+
+// Records that a survey was completed, as reported by the survey tool.
+app.post('/surveys/:token/completed', (request, response) => {
+	survey.complete(request.params.token).then(completed => {
+		if (!completed) {
+			throw new errors.NotFound('The survey link is invalid or expired');
+		}
+		response.send({});
+	}).catch(error(response));
+});
+
+// Gives an invited clinician the meeting link.
+app.post('/invitations/redeem', validate.body(schemas.invitationRedeem), (request, response) => {
+	invitations.redeem(request.body.token, request).then(invitation => {
+		if (!invitation) {
+			throw new errors.NotFound('The invitation is invalid, expired or was used in another session');
+		}
+		// Invitations are shared by all tenants; the visit is the tenant's.
+		return tenancy.run(invitation.Tenant, () => datastore.get(datastore.key(['Encounter', invitation.Encounter]))).then(meeting => {
+			if (!meeting || meeting.Closed) {
+				throw new errors.Expired();
+			}
+			audit.record('invitation-redeemed', invitation.Practitioner, invitation.Encounter, request);
+			sessioncontext.set(request, {role: 'invitee'});
+			response.send({url: meeting.Url});
+		});
+	}).catch(error(response));
+});
+
+// Verifies the patient's identity before they are given the meeting link.
+app.post('/encounters/:encounterId/verify', fhir.required, introspection.required, validate.body(schemas.verification), (request, response) => {
+	const encounterId = request.params.encounterId;
+	verification.check(request.fhirContext, encounterId, request.body.answer).then(right => {
+		if (!right) {
+			audit.record('verification-failed', 'patient', encounterId, request);
+			throw new errors.VerificationFailed();
+		}
+		verification.markVerified(request, encounterId);
+		audit.record('patient-verified', 'patient', encounterId, request);
+		response.send({});
+	}).catch(error(response));
+});
+
+app.post('/failures', validate.body(schemas.failure), (request, response) => {
+	analytics.record('failure/' + request.body.reason);
+	response.send({});
+});
+
+// Cancels a visit from the EHR launch.  Only the clinician who created the
+// meeting can cancel it.
+app.post('/encounters/:encounterId/cancel', fhir.required, introspection.required, (request, response) => {
+	const encounterId = request.params.encounterId;
+	datastore.get(datastore.key(['Encounter', encounterId])).then(entity => {
+		if (!entity || entity.Closed) {
+			throw new errors.NotFound('The visit has no open meeting');
+		}
+		if (!request.session.id || entity.Owner != request.session.id) {
+			throw new errors.Forbidden('Only the clinician who created the meeting can cancel it');
+		}
+		return appointments.cancel(entity, request.fhirContext);
+	}).then(() => response.send({})).catch(error(response));
+});
+
+// Appointment notifications from an EHR rest-hook Subscription, with the
+// payload either the Appointment or a notification Bundle.  server names the
+// FHIR server the Subscription is on, and each server signs with its own
+// secret.  Only the IDs of the Appointments are used; they are read again
+// from the server.
+app.post('/subscriptions/appointments',
+	bodies.json({verify: signatures.capture}),
+	signatures.required('subscriptions'), (request, response) => {
+	const server = request.query.server;
+	if (!server) {
+		errors.send(response, new errors.InvalidRequest('The server parameter is required'));
+		return;
+	}
+	if (!fhir.allowed(server)) {
+		errors.send(response, new errors.UnauthorizedIssuer(server + ' is not in fhirServers'));
+		return;
+	}
+	const body = request.body || {};
+	const updated = body.resourceType == 'Bundle' ? fhir.resources(body, 'Appointment') :
+		body.resourceType == 'Appointment' ? [body] : [];
+	Promise.all(updated.map(appointment => appointments.updated(server, appointment))).then(counts => {
+		response.send({meetings: counts.reduce((a, b) => a + b, 0)});
+	}).catch(error(response));
+});
+
+// Visits whose meeting was created in [since, until), with their periods.
+app.get('/admin/visits', admin.required, (request, response) => {
+	report.query(request.query).then(result => response.send(result)).catch(error(response));
+});
+
+app.get('/admin/metrics', admin.required, (request, response) => {
+	const until = request.query.until || new Date(Date.now() + 24 * 60 * 60 * 1000).toISOString().substring(0, 10);
+	const since = request.query.since || new Date(Date.now() - 6 * 24 * 60 * 60 * 1000).toISOString().substring(0, 10);
+	analytics.summary(since, until).then(days => {
+		response.send({since: since, until: until, days: days});
+	}).catch(error(response));
+});
+
+// Live counts for an operations dashboard.
+app.get('/admin/stats', admin.required, (request, response) => {
+	stats.live().then(result => response.send(result)).catch(error(response));
+});
+
+// Hourly series over the last hours (24 by default, at most a week).
+app.get('/admin/stats/series', admin.required, (request, response) => {
+	const hours = Math.min(Math.max(parseInt(request.query.hours || '24', 10) || 24, 1), 7 * 24);
+	stats.series(hours).then(buckets => {
+		response.send({hours: hours, buckets: buckets});
+	}).catch(error(response));
+});
+
+app.get('/admin/features', admin.required, (request, response) => {
+	flags.list().then(features => response.send(features)).catch(error(response));
+});
+
+// Replaces a feature flag at runtime; other instances pick it up within
+// featureReloadSeconds.
+app.put('/admin/features/:name', admin.required, bodies.json(), validate.body(schemas.feature), (request, response) => {
+	const value = request.body;
+	flags.set(request.params.name, value).then(() => {
+		response.send(value);
+	}).catch(error(response));
+});
+
+app.get('/admin/directory', admin.required, (request, response) => {
+	directory.list().then(facilities => response.send({facilities: facilities})).catch(error(response));
+});
+
+// Seeds the directory from a FHIR server's Endpoint resources.  The access
+// token is in the body since the admin token takes the Authorization header.
+app.post('/admin/directory/seed', admin.required, bodies.json(), validate.body(schemas.directorySeed), (request, response) => {
+	directory.seed(request.body.server, request.body.accessToken, request.body.tenant).then(facilities => {
+		response.send({facilities: facilities});
+	}).catch(error(response));
+});
+
+app.patch('/admin/directory/:id', admin.required, bodies.json(), validate.body(schemas.facility), (request, response) => {
+	directory.setWorkspaceDomain(request.params.id, request.body.workspaceDomain).then(facility => {
+		if (!facility) {
+			errors.send(response, new errors.NotFound('No seeded facility ' + request.params.id));
+			return;
+		}
+		response.send(facility);
+	}).catch(error(response));
+});
+
+app.get('/admin/queues', admin.required, (request, response) => {
+	frontdesk.metrics().then(metrics => response.send({queues: metrics})).catch(error(response));
+});
+
+app.get('/admin/audit/verify', admin.required, (request, response) => {
+	audit.verify().then(result => {
+		response.send(result);
+	}).catch(error(response));
+});
+
+// Erases the data held about a patient's encounters, returning a signed
+// report for the compliance record.
+app.post('/admin/erasure', admin.required, bodies.json(), validate.body(schemas.erasure), (request, response) => {
+	erasure.erase(request.body.patient, request.body.encounterIds, request.body.dryRun).then(result => {
+		audit.record(result.report.dryRun ? 'erasure-previewed' : 'patient-erased', 'admin', '', request);
+		response.send(result);
+	}).catch(error(response));
+});
+
+app.get('/admin/holds', admin.required, (request, response) => {
+	legalhold.list().then(holds => {
+		response.send({holds: holds});
+	}).catch(error(response));
+});
+
+// Places a legal hold on a patient's or encounters' records.
+app.post('/admin/holds', admin.required, bodies.json(), validate.body(schemas.hold), (request, response) => {
+	if (!request.body.patient && !(request.body.encounterIds || []).length) {
+		errors.send(response, new errors.InvalidRequest('A hold needs a patient or encounterIds'));
+		return;
+	}
+	legalhold.place(request.body.patient, request.body.encounterIds, request.body.reason).then(hold => {
+		audit.record('hold-placed', 'admin', '', request);
+		response.status(201).send(hold);
+	}).catch(error(response));
+});
+
+app.delete('/admin/holds/:id', admin.required, (request, response) => {
+	legalhold.release(request.params.id).then(found => {
+		if (!found) {
+			errors.send(response, new errors.NotFound('No hold ' + request.params.id));
+			return;
+		}
+		audit.record('hold-released', 'admin', '', request);
+		response.send({released: request.params.id});
+	}).catch(error(response));
+});
+
+// Reports what the retention job would purge now, without purging it.
+app.get('/admin/retention', admin.required, (request, response) => {
+	retention.run(true).then(result => {
+		response.send(result);
+	}).catch(error(response));
+});
+
+// Snapshots of a FHIR user's sessions, given as identity, with their tokens
+// redacted.
+app.get('/admin/sessions', admin.required, (request, response) => {
+	if (!request.query.identity) {
+		errors.send(response, new errors.InvalidRequest('The identity parameter is required'));
+		return;
+	}
+	snapshot.forIdentity(request.query.identity).then(sessions => {
+		audit.record('session-inspected', 'admin', '', request);
+		response.send({sessions: sessions});
+	}).catch(error(response));
+});
+
+app.get('/admin/sessions/:reference', admin.required, (request, response) => {
+	snapshot.session(request.params.reference).then(session => {
+		if (!session) {
+			errors.send(response, new errors.NotFound('No session ' + request.params.reference));
+			return;
+		}
+		audit.record('session-inspected', 'admin', '', request);
+		response.send(session);
+	}).catch(error(response));
+});
+
+app.get('/admin/queue/dead', admin.required, (request, response) => {
+	queue.deadLetters().then(tasks => {
+		response.send({tasks: tasks});
+	}).catch(error(response));
+});
+
+app.post('/admin/queue/dead/:id/retry', admin.required, (request, response) => {
+	queue.retry(request.params.id).then(found => {
+		if (!found) {
+			errors.send(response, new errors.NotFound('No dead lettered task ' + request.params.id));
+			return;
+		}
+		response.send({retried: request.params.id});
+	}).catch(error(response));
+});
+
+// Reloads the settings that can change while running, on this instance.
+app.post('/admin/reload', admin.required, (request, response) => {
+	reload.run().then(result => response.send(result)).catch(error(response));
+});
+
+function debugEnabled(request, response, next) {
+	next(debug.enabled() ? undefined : new errors.NotFound('The debug endpoints are not enabled'));
+}
+
+app.get('/admin/debug/vars', debugEnabled, admin.required, (request, response) => {
+	response.send(debug.vars());
+});
+
+app.get('/admin/debug/profile', debugEnabled, admin.required, (request, response) => {
+	debug.profile(parseInt(request.query.seconds || '10', 10)).then(profile => {
+		response.set('Content-Disposition', 'attachment; filename="meet-on-fhir.cpuprofile"');
+		response.send(profile);
+	}).catch(error(response));
+});
+
+app.get('/admin/debug/heap', debugEnabled, admin.required, (request, response) => {
+	response.type('application/json');
+	response.set('Content-Disposition', 'attachment; filename="meet-on-fhir.heapsnapshot"');
+	debug.heap(response).catch(err => console.log('Failed to take a heap snapshot: ' + err));
+});
+
+app.get('/admin/debug/report', debugEnabled, admin.required, (request, response) => {
+	response.send(debug.report());
+});
+
+app.get('/jobs/:name', admin.cron, (request, response) => {
+	if (!jobs.exists(request.params.name)) {
+		errors.send(response, new errors.NotFound('Unknown job ' + request.params.name));
+		return;
+	}
+	jobs.run(request.params.name).then(result => {
+		debugLog('Job ' + request.params.name + ' finished with ' + JSON.stringify(result));
+		response.send(result);
+	}).catch(error(response));
+});
+
+// The features available with the scopes the EHR granted.
+app.get('/capabilities', fhir.required, (request, response) => {
+	response.send(request.capabilities);
+});
+
+app.get('/schedule', fhir.required, introspection.required, (request, response) => {
+	if (!request.query.practitioner) {
+		errors.send(response, new errors.InvalidRequest('The practitioner parameter is required'));
+		return;
+	}
+
+	if (!request.capabilities.canReadSchedule) {
+		errors.send(response, new errors.InsufficientScope('Listing appointments needs Appointment read access'));
+		return;
+	}
+
+	const day = request.query.date || new Date().toISOString().substring(0, 10);
+	schedule.forPractitioner(request.fhirContext, request.query.practitioner, day).then(visits => {
+		response.send({date: day, visits: visits});
+	}).catch(error(response));
+});
+
+// Middleware rejecting front desk requests unless frontDesk.enabled.
+function frontDeskEnabled(request, response, next) {
+	next(frontdesk.enabled() ? undefined : new errors.NotFound('The front desk is not enabled'));
+}
+
+// Puts the patient of an encounter in a front desk queue.  Reading the
+// Encounter checks that the caller's FHIR access covers it.
+app.post('/queues/:queue/entries', frontDeskEnabled, fhir.required, introspection.required, validate.body(schemas.queueEntry), (request, response) => {
+	const encounterId = request.body.encounterId;
+	fhir.read(request.fhirContext, 'Encounter', encounterId).then(() => {
+		return frontdesk.join(request.params.queue, encounterId);
+	}).then(entry => {
+		audit.record('queue-joined', 'patient', encounterId, request);
+		response.send(entry);
+	}).catch(error(response));
+});
+
+app.delete('/queues/:queue/entries/:encounterId', frontDeskEnabled, fhir.required, introspection.required, (request, response) => {
+	const encounterId = request.params.encounterId;
+	fhir.read(request.fhirContext, 'Encounter', encounterId).then(() => {
+		return frontdesk.leave(request.params.queue, encounterId);
+	}).then(left => {
+		if (!left) {
+			throw new errors.NotFound('No patient ' + encounterId + ' is waiting in queue ' + request.params.queue);
+		}
+		audit.record('queue-left', 'patient', encounterId, request);
+		response.send({left: encounterId});
+	}).catch(error(response));
+});
+
+app.get('/queues/:queue', frontDeskEnabled, fhir.required, introspection.required, (request, response) => {
+	frontdesk.list(request.params.queue, String(request.query.user || '')).then(queue => {
+		response.send(queue);
+	}).catch(error(response));
+});
+
+app.put('/queues/:queue/duty', frontDeskEnabled, fhir.required, introspection.required, validate.body(schemas.queueDuty), (request, response) => {
+	const onDuty = request.body.onDuty == 'true';
+	frontdesk.setDuty(request.params.queue, request.body.user, onDuty).then(() => {
+		response.send({queue: request.params.queue, user: request.body.user, onDuty: onDuty});
+	}).catch(error(response));
+});
+
+// Claims a waiting patient for the practitioner, who then creates the
+// visit's meeting with POST /hangouts.
+app.post('/queues/:queue/entries/:encounterId/claim', frontDeskEnabled, fhir.required, introspection.required, validate.body(schemas.queueClaim), (request, response) => {
+	const encounterId = request.params.encounterId;
+	frontdesk.claim(request.params.queue, encounterId, request.body.user).then(entry => {
+		audit.record('queue-claimed', 'provider', encounterId, request);
+		response.send(entry);
+	}).catch(error(response));
+});
+
+app.post('/queues/:queue/entries/:encounterId/reassign', frontDeskEnabled, fhir.required, introspection.required, validate.body(schemas.queueReassign), (request, response) => {
+	const encounterId = request.params.encounterId;
+	frontdesk.reassign(request.params.queue, encounterId, request.body.user, request.body.to).then(entry => {
+		audit.record('queue-reassigned', 'provider', encounterId, request);
+		response.send(entry);
+	}).catch(error(response));
+});
+
+// Issues a code for moving the visit to another device.  Reading the
+// Encounter checks that the caller's FHIR access covers it; a signed in
+// provider hands off their session, anyone else the patient's view.
+app.post('/handoffs', fhir.required, introspection.required, validate.body(schemas.handoff), (request, response) => {
+	const encounterId = request.body.encounterId;
+	if (!request.capabilities.canReadEncounter) {
+		errors.send(response, new errors.InsufficientScope('Handoffs need Encounter read access'));
+		return;
+	}
+
+	fhir.read(request.fhirContext, 'Encounter', encounterId).then(() => {
+		return request.session.id ? user.clientFor(request.session.id) : undefined;
+	}).then(client => {
+		const role = client ? 'provider' : 'patient';
+		const verified = verification.verified(request, encounterId);
+		return handoff.issue(encounterId, role, client ? request.session.id : '', verified).then(code => {
+			audit.record('handoff-issued', role, encounterId, request);
+			response.send({code: code});
+		});
+	}).catch(error(response));
+});
+
+// Redeems a handoff code on the new device.
+app.post('/handoffs/redeem', validate.body(schemas.handoffRedeem), (request, response) => {
+	handoff.redeem(request.body.code, handoff.client(request), request.ip).then(entity => {
+		if (!entity) {
+			throw new errors.NotFound('The code is invalid, expired or was already used');
+		}
+
+		const encounterId = entity.Encounter;
+		request.session.handoff = {encounterId: encounterId, role: entity.Role};
+		// Later requests from this device run for the visit's tenant.
+		if (entity.Tenant) {
+			launchcontext.set(request, {tenantId: entity.Tenant});
+		}
+		if (entity.Verified) {
+			verification.markVerified(request, encounterId);
+		}
+		audit.record('handoff-redeemed', entity.Role, encounterId, request);
+		if (entity.Role != 'provider') {
+			sessioncontext.set(request, {role: entity.Role});
+			response.send({encounterId: encounterId, role: entity.Role});
+			return;
+		}
+
+		return tenancy.run(entity.Tenant, () => user.signInAsSibling(request, entity.Owner).then(signedIn => {
+			if (!signedIn) {
+				throw new errors.Expired('The provider session has ended');
+			}
+			return datastore.get(datastore.key(['Encounter', encounterId]));
+		})).then(existing => {
+			const url = existing && !existing.Closed ? existing.Url : undefined;
+			response.send({encounterId: encounterId, role: entity.Role, url: url});
+		});
+	}).catch(error(response));
+});
+
+// Checks whether the browser keeps the session cookie, which browsers that
+// block third-party cookies don't in an EHR's frame.  The client POSTs to get
+// a token and then GETs with it.
+app.post('/api/cookies/check', (request, response) => {
+	response.send({token: embedding.startCheck(request)});
+});
+
+app.get('/api/cookies/check', (request, response) => {
+	response.send({cookies: embedding.check(request, request.query.token), embedded: embedding.embedded(request)});
+});
+
+// Reports how long the signed in provider's session, or with an encounterId
+// the patient's access to its meeting link, has left, so the browser can warn
+// before it expires.
+app.get('/api/session/ttl', (request, response) => {
+	// An encrypted session context answers for providers without a lookup.
+	const context = sessioncontext.get(request);
+	if (sessioncontext.enabled() && request.session.id && context.role == 'provider' && context.expires) {
+		response.send({
+			role: 'provider',
+			expires: context.expires,
+			ttl: Math.max(0, Math.floor((context.expires - clock.now()) / 1000)),
+			extendableUntil: context.extendableUntil,
+			reference: snapshot.reference(request.session.id),
+		});
+		return;
+	}
+	user.sessionTtl(request).then(status => {
+		if (status) {
+			response.send(Object.assign({role: 'provider', reference: snapshot.reference(request.session.id)}, status));
+			return;
+		}
+		if (!request.query.encounterId) {
+			throw new errors.NotSignedIn();
+		}
+		return datastore.get(datastore.key(['Encounter', request.query.encounterId])).then(entity => {
+			if (!entity || !entity.PatientJoined) {
+				response.send({role: 'patient', ttl: null});
+				return;
+			}
+			const expires = new Date(entity.PatientJoined.getTime() + tenants.sessionDuration(entity.Tenant, 'patient'));
+			response.send({
+				role: 'patient',
+				expires: expires,
+				ttl: Math.max(0, Math.floor((expires - clock.now()) / 1000)),
+			});
+		});
+	}).catch(error(response));
+});
+
+app.post('/api/session/extend', (request, response) => {
+	user.extendSession(request).then(status => {
+		if (!status) {
+			throw new errors.NotSignedIn();
+		}
+		audit.record('session-extended', 'provider', '', request);
+		response.send(Object.assign({role: 'provider'}, status));
+	}).catch(error(response));
+});
+
 app.get('/authenticate', (request, response) => {
 	user.authenticate(request, response);
 });
@@ -94,8 +1149,71 @@ app.get('/logout', (request, response) => {
 	user.logout(request, response);
 });
 
+// How long a SMART launch ID is remembered.  EHRs expire launch IDs well
+// before this.
+const launchTtl = 24 * 60 * 60 * 1000;
+
+// Records a SMART launch before authorizing so each launch ID is used once.
+app.post('/launches', validate.body(schemas.launch), (request, response) => {
+	replay.consume(replay.LAUNCH, request.body.iss + ' ' + request.body.launch, launchTtl).then(first => {
+		if (!first) {
+			audit.record('launch-replayed', 'unknown', '', request);
+			throw new errors.Replayed('The launch was already used');
+		}
+		// Pages are rendered with the branding of the tenant launched from.
+		launchcontext.set(request, {tenantId: tenants.forIssuer(request.body.iss)});
+		response.send({});
+	}).catch(error(response));
+});
+
 app.get('/settings', (request, response) => {
-  response.send({'fhirClientId': settings.fhirClientId});
+  const profile = ehr.profile(request.query.iss);
+  const tenant = tenants.forIssuer(request.query.iss);
+  registration.clientId(request.query.iss).then(clientId => {
+    response.send({
+      'fhirClientId': clientId,
+      'scope': profile.scope.concat(messaging.scopes(tenant), provenance.scopes()).join(' '),
+      'fallbackUser': profile.fallbackUser,
+      'consent': {'recordingOption': consent.recordingOption(tenant)},
+      'verification': {'enabled': verification.enabled(), 'method': verification.method()},
+      'invitations': {'enabled': !!(settings.invitations && settings.invitations.enabled) && flags.enabled('invitations', tenant)},
+      'push': {'publicKey': push.publicKey()},
+    });
+  }).catch(error(response));
 });
 
-app.listen(process.env.PORT || 8080);
+app.get('/openapi.json', (request, response) => {
+	response.send(openapi.spec());
+});
+
+app.get('/.well-known/jwks.json', (request, response) => {
+	response.type('application/jwk-set+json').send(wellknown.jwks());
+});
+
+app.get('/.well-known/oauth-client.json', (request, response) => {
+	response.send(wellknown.clientMetadata());
+});
+
+app.get('/.well-known/smart-app.json', (request, response) => {
+	response.send(wellknown.manifest());
+});
+
+app.use(client.fallback);
+app.use(errors.middleware);
+
+if (process.argv.indexOf('--dev') != -1) {
+	openapi.undocumented(app).forEach(route => console.log('Not in openapi.js: ' + route));
+}
+
+jobs.register('cleanup', 60, cleanup.run);
+jobs.register('introspection', 15, introspection.run);
+jobs.register('noshow', 15, noshow.run);
+jobs.register('overrun', 5, chat.run);
+jobs.register('meet-retry', 1, () => fallback.retry(newMeeting));
+jobs.register('queue', 1, queue.run);
+jobs.register('retention', 24 * 60, () => retention.run());
+
+httpserver.listen(app, port);
+reload.listen();
+grpc.start().catch(err => console.log('Failed to start the gRPC server: ' + err));
+jobs.start();
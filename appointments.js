@@ -0,0 +1,252 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Keeps meetings in step with changes to their Appointments.  When
+// settings.appointmentUpdates.enabled is set, each meeting record notes its
+// Appointment and the EHR notifies POST /subscriptions/appointments of
+// changes through a FHIR rest-hook Subscription.  Rescheduling moves the
+// meeting's calendar event, updating invited attendees, and either keeps the
+// meeting link or, with settings.appointmentUpdates.rotateLink, replaces it.
+// Cancelling closes the meeting.  Notifications are only trusted for the
+// Appointment they name: it is read again from the FHIR server with a
+// meeting owner's token, and its patients are notified of the change.
+
+const audit = require('./audit.js');
+const calendar = require('./calendar.js');
+const cleanup = require('./cleanup.js');
+const datastore = require('./datastore.js');
+const encounter = require('./encounter.js');
+const events = require('./events.js');
+const fhir = require('./fhir.js');
+const locks = require('./locks.js');
+const notifications = require('./notifications.js');
+const series = require('./series.js');
+const user = require('./user.js');
+
+const settings = require('./settings.json');
+
+function options() {
+  return settings.appointmentUpdates || {};
+}
+
+exports.enabled = function() {
+  return !!options().enabled;
+};
+
+// Appointment IDs are only unique within a FHIR server.
+function reference(serverUrl, id) {
+  return serverUrl.replace(/\/+$/, '') + '/Appointment/' + id;
+}
+
+// Resolves to the meeting record fields linking an encounter's meeting to
+// its Appointment.
+exports.link = function(context, encounterId) {
+  return fhir.read(context, 'Encounter', encounterId).then(encounter => {
+    const appointment = ((encounter.appointment || [])[0] || {}).reference || '';
+    if (!appointment.startsWith('Appointment/')) {
+      return {};
+    }
+    const id = appointment.substring('Appointment/'.length);
+    return fhir.read(context, 'Appointment', id).then(resource => ({
+      Appointment: reference(context.serverUrl, id),
+      AppointmentStart: resource.start ? new Date(resource.start) : new Date(0),
+    }));
+  }).catch(() => ({}));
+};
+
+// Resolves to the open meeting records of an Appointment.
+exports.meetings = function(serverUrl, id) {
+  return datastore.list('Encounter', [['Appointment', '=', reference(serverUrl, id)]]).then(entities => {
+    return entities.filter(entity => !entity.Closed);
+  });
+};
+
+function call(fn) {
+  return new Promise((resolve, reject) => {
+    fn((err, ...results) => err ? reject(err) : resolve(results));
+  });
+}
+
+// Moves a meeting to an Appointment's new time, rotating its link if
+// configured.  Resolves to the meeting record changes.
+function reschedule(entity, appointment) {
+  const start = new Date(appointment.start);
+  const end = appointment.end ? new Date(appointment.end) : new Date(start.getTime() + 30 * 60 * 1000);
+  const changes = {AppointmentStart: start};
+  if (entity.Series) {
+    // The series' meeting stays; only this occurrence's window moves.
+    return Promise.resolve(Object.assign(changes, series.accessWindow(appointment)));
+  }
+
+  return user.clientFor(entity.Owner).then(client => {
+    if (!client) {
+      console.log('Cannot move the meeting of encounter ' + datastore.name(entity) + ': its owner signed out');
+      return changes;
+    }
+    if (!options().rotateLink) {
+      return call(callback => calendar.updateEvent(client, entity.CalendarId, entity.EventId, start, end, callback))
+        .then(() => changes);
+    }
+    return call(callback => calendar.createEvent(client, datastore.name(entity), callback)).then(results => {
+      const created = results[1];
+      return call(callback => calendar.updateEvent(client, created.calendarId, created.eventId, start, end, callback)).then(() => {
+        return call(callback => calendar.deleteEvent(client, entity.CalendarId, entity.EventId, callback)).catch(err => {
+          console.log('Failed to delete replaced event ' + entity.EventId + ': ' + err);
+        });
+      }).then(() => Object.assign(changes, {
+        Url: results[0],
+        CalendarId: created.calendarId,
+        EventId: created.eventId,
+        PatientJoined: null,
+      }));
+    });
+  });
+}
+
+// Whether any other open meeting record shares a meeting's event, as group
+// visits and series do.
+function eventShared(entity) {
+  if (entity.Series) {
+    return Promise.resolve(true);
+  }
+  return datastore.list('Encounter', [['EventId', '=', entity.EventId]]).then(entities => {
+    return entities.some(other => !other.Closed && datastore.name(other) != datastore.name(entity));
+  });
+}
+
+// Cancels a visit: deletes its meeting's event unless other visits share it,
+// closes the meeting so the patient's link expires and marks the Encounter
+// cancelled.  context is the FHIR context to update the Encounter with; when
+// it isn't given the context the meeting owner's session last used is tried.
+exports.cancel = function(entity, context) {
+  const encounterId = datastore.name(entity);
+  const now = new Date();
+  return eventShared(entity).then(shared => {
+    return shared ? undefined : cleanup.deleteEvent(entity);
+  }).then(() => {
+    return datastore.modify(datastore.key(['Encounter', encounterId]), current => {
+      return current && Object.assign(current, {Closed: now, Ended: current.Ended || now, Cancelled: now});
+    });
+  }).then(() => {
+    events.publish('visit.cancelled', {encounterId: encounterId});
+    audit.record('visit-cancelled', context ? 'provider' : 'system', encounterId);
+    return context || (entity.Owner ? user.fhirContextFor(entity.Owner) : undefined);
+  }).then(fhirContext => {
+    if (!fhirContext) {
+      console.log('Encounter ' + encounterId + ' was cancelled but its status could not be updated');
+      return;
+    }
+    return encounter.cancel(fhirContext, encounterId).then(changed => {
+      return changed && encounter.record(encounterId, {Status: 'cancelled'});
+    }).catch(err => {
+      console.log('Failed to mark encounter ' + encounterId + ' cancelled: ' + err);
+    });
+  });
+};
+
+// How long applying a notification may hold its Appointment's lock.
+const notificationLockTtl = 60 * 1000;
+
+// Applies a notified Appointment to its meetings.  Resolves to the number of
+// meetings changed.  EHRs retry notifications and may send them to several
+// instances, so notifications of one Appointment are applied one at a time
+// and a repeated one finds nothing left to change.
+exports.updated = function(serverUrl, appointment) {
+  if (!appointment.id) {
+    return Promise.resolve(0);
+  }
+  const name = 'appointment:' + encodeURIComponent(serverUrl) + ':' + encodeURIComponent(appointment.id);
+  return locks.run(name, notificationLockTtl, notificationLockTtl / 2, () => apply(serverUrl, appointment.id), () => {
+    throw new Error('Appointment ' + appointment.id + ' is locked by another notification');
+  });
+};
+
+// Resolves to the FHIR context of the first owner of entities whose session
+// left one for serverUrl, or undefined.
+function ownerContext(serverUrl, entities) {
+  return entities.reduce((found, entity) => found.then(context => {
+    if (context || !entity.Owner) {
+      return context;
+    }
+    return user.fhirContextFor(entity.Owner).then(context => {
+      return context && context.serverUrl.replace(/\/+$/, '') == serverUrl.replace(/\/+$/, '') ? context : undefined;
+    });
+  }), Promise.resolve(undefined));
+}
+
+// Notifies an Appointment's patients, resolving once the notifications are
+// sent or queued.
+function notifyPatients(context, appointment, encounterId, subject, text) {
+  const patients = (appointment.participant || []).map(participant => (participant.actor || {}).reference || '')
+    .filter(reference => reference.startsWith('Patient/'));
+  return Promise.all(patients.map(reference => notifications.send({
+    kind: 'appointment',
+    to: reference,
+    encounterId: encounterId,
+    subject: subject,
+    text: text,
+  }, context)));
+}
+
+function apply(serverUrl, id) {
+  return exports.meetings(serverUrl, id).then(entities => {
+    if (entities.length == 0) {
+      return 0;
+    }
+    return ownerContext(serverUrl, entities).then(context => {
+      if (!context) {
+        console.log('No EHR token to read Appointment ' + id + ' of ' + serverUrl + ' with');
+        return 0;
+      }
+      return fhir.read(context, 'Appointment', id).then(appointment => changed(context, entities, appointment));
+    });
+  });
+}
+
+// Applies an Appointment read from the FHIR server to its meetings.
+function changed(context, entities, appointment) {
+  const first = datastore.name(entities[0]);
+  if (appointment.status == 'cancelled') {
+    return Promise.all(entities.map(entity => exports.cancel(entity))).then(() => {
+      return notifyPatients(context, appointment, first, 'Your video visit was cancelled',
+        'Your video visit has been cancelled.');
+    }).then(() => entities.length);
+  }
+  if (!appointment.start) {
+    return Promise.resolve(0);
+  }
+
+  const moved = entities.filter(entity => {
+    return !entity.AppointmentStart || entity.AppointmentStart.getTime() != new Date(appointment.start).getTime();
+  });
+  return Promise.all(moved.map(entity => {
+    const encounterId = datastore.name(entity);
+    return reschedule(entity, appointment).then(changes => {
+      return datastore.modify(datastore.key(['Encounter', encounterId]), current => {
+        return current && Object.assign(current, changes);
+      }).then(() => {
+        events.publish('visit.rescheduled', {
+          encounterId: encounterId,
+          start: appointment.start,
+          linkChanged: !!changes.Url,
+        });
+      });
+    });
+  })).then(() => {
+    return moved.length && notifyPatients(context, appointment, first, 'Your video visit has moved',
+      'Your video visit is now at ' + new Date(appointment.start).toUTCString() + '.');
+  }).then(() => moved.length);
+}
@@ -0,0 +1,157 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Serves the web client from memory.  The files under each mounted directory
+// are read at startup and hashed; references between them in HTML pages are
+// rewritten to carry the hash (?v=...), so those URLs can be cached forever
+// and a deployment is just the application with its static directory.
+// Everything else is revalidated with its ETag.  In development mode the
+// files are read again whenever they change.
+
+const crypto = require('crypto');
+const fs = require('fs');
+const path = require('path');
+
+const types = {
+  '.html': 'text/html; charset=utf-8',
+  '.js': 'application/javascript; charset=utf-8',
+  '.css': 'text/css; charset=utf-8',
+  '.json': 'application/json; charset=utf-8',
+  '.map': 'application/json; charset=utf-8',
+  '.png': 'image/png',
+  '.gif': 'image/gif',
+  '.svg': 'image/svg+xml',
+  '.ico': 'image/x-icon',
+  '.woff2': 'font/woff2',
+};
+
+const immutable = 'public, max-age=31536000, immutable';
+
+function walk(directory, prefix, files) {
+  var names;
+  try {
+    names = fs.readdirSync(directory);
+  } catch (err) {
+    return files;
+  }
+  names.forEach(name => {
+    const file = path.join(directory, name);
+    if (fs.statSync(file).isDirectory()) {
+      walk(file, prefix + name + '/', files);
+    } else {
+      files[prefix + name] = {file: file, body: fs.readFileSync(file)};
+    }
+  });
+  return files;
+}
+
+// Rewrites src and href attributes referring to known files to their hashed
+// URLs.
+function rewrite(html, page, files) {
+  return html.replace(/(src|href)="([^"?#:]+)"/g, (match, attribute, reference) => {
+    const target = reference.startsWith('/') ? reference : path.posix.join(path.posix.dirname(page), reference);
+    const asset = files[target];
+    return asset ? attribute + '="' + reference + '?v=' + asset.hash + '"' : match;
+  });
+}
+
+// Reads the files of mounts, which maps URL prefixes ending in / to
+// directories.
+function load(mounts) {
+  const files = {};
+  Object.keys(mounts).forEach(prefix => walk(mounts[prefix], prefix, files));
+  Object.keys(files).forEach(name => {
+    files[name].hash = crypto.createHash('sha256').update(files[name].body).digest('hex').substring(0, 16);
+    files[name].type = types[path.extname(name)] || 'application/octet-stream';
+    files[name].name = name;
+  });
+  // Pages are rewritten after every file is hashed.  A page's own hash
+  // doesn't change with the files it refers to, which is fine since pages
+  // are always revalidated.
+  Object.keys(files).filter(name => name.endsWith('.html')).forEach(name => {
+    files[name].body = Buffer.from(rewrite(files[name].body.toString('utf8'), name, files));
+  });
+  return files;
+}
+
+function changed(files) {
+  return Object.keys(files).some(name => {
+    try {
+      return fs.statSync(files[name].file).mtimeMs > files[name].loaded;
+    } catch (err) {
+      return true;
+    }
+  });
+}
+
+function send(request, response, asset, render) {
+  var body = asset.body;
+  var hash = asset.hash;
+  if (render && asset.name.endsWith('.html')) {
+    body = Buffer.from(render(asset.name, body.toString('utf8'), request));
+    hash = crypto.createHash('sha256').update(body).digest('hex').substring(0, 16);
+  }
+  const etag = '"' + hash + '"';
+  response.set('ETag', etag);
+  response.set('Cache-Control', request.query.v == asset.hash ? immutable : 'no-cache');
+  response.type(asset.type);
+  if (request.get('If-None-Match') == etag) {
+    response.status(304).end();
+    return;
+  }
+  response.send(body);
+}
+
+// Returns middleware serving the mounted files, with / serving /index.html.
+// With options.reload the files are reloaded when any of them changes, and
+// options.render(name, html, request) renders pages for each request.
+exports.create = function(mounts, options) {
+  options = options || {};
+  var files = load(mounts);
+  var loadedAt = Date.now();
+  Object.keys(files).forEach(name => files[name].loaded = loadedAt);
+
+  const middleware = function(request, response, next) {
+    if (request.method != 'GET' && request.method != 'HEAD') {
+      next();
+      return;
+    }
+    if (options.reload && changed(files)) {
+      files = load(mounts);
+      loadedAt = Date.now();
+      Object.keys(files).forEach(name => files[name].loaded = loadedAt);
+    }
+    const asset = files[request.path == '/' ? '/index.html' : request.path];
+    if (!asset) {
+      next();
+      return;
+    }
+    send(request, response, asset, options.render);
+  };
+
+  // Middleware serving index.html for other pages a browser asks for, so
+  // client-side routes survive a reload.  Register it after every route.
+  middleware.fallback = function(request, response, next) {
+    const wantsPage = request.method == 'GET' && request.accepts(['html', 'json']) == 'html';
+    if (!wantsPage || path.extname(request.path) || !files['/index.html']) {
+      next();
+      return;
+    }
+    send(request, response, files['/index.html'], options.render);
+  };
+
+  return middleware;
+};
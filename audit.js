@@ -0,0 +1,189 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Append-only audit log of access to visits.  Every record carries the hash of
+// the record before it, so changing, removing or reordering records breaks
+// the chain and is reported by verify.
+
+const datastore = require('./datastore.js');
+const queue = require('./queue.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const {Storage} = require('@google-cloud/storage');
+
+const headKey = datastore.key(['AuditHead', 'head']);
+// The last record removed by the retention policy, where the chain now starts.
+const prunedKey = datastore.key(['AuditHead', 'pruned']);
+
+function recordKey(sequence) {
+  // Zero padded so records sort by sequence.
+  return datastore.key(['Audit', ('000000000000' + sequence).slice(-12)]);
+}
+
+// One client for all mirrored records, since each creates its own
+// connections.
+const storage = new Storage();
+
+function hash(record) {
+  const content = JSON.stringify([
+    record.Sequence,
+    record.Time.toISOString(),
+    record.Action,
+    record.Actor,
+    record.EncounterId,
+    record.Address,
+    record.Previous,
+  ]);
+  return crypto.createHash('sha256').update(content).digest('hex');
+}
+
+function mirror(record) {
+  const bucket = settings.audit && settings.audit.bucket;
+  if (!bucket) {
+    return Promise.resolve();
+  }
+  const name = 'audit/' + recordKey(record.Sequence).path[1] + '.json';
+  return storage.bucket(bucket).file(name).save(JSON.stringify(record));
+}
+
+// How many times an append is tried while other appends keep advancing the
+// head.
+const maxAppendAttempts = 10;
+
+// Appends a record to the chain.  The record is written in the same
+// transaction that advances the chain head, so a failed write leaves neither
+// behind.  The record's key depends on the head, so the head is read first
+// and the append is tried again if another one advanced it meanwhile.
+function append(entry, attempt) {
+  attempt = attempt || 1;
+  var record;
+  return datastore.get(headKey).then(head => {
+    const sequence = (head ? head.Sequence : 0) + 1;
+    return datastore.modifyMany([headKey, recordKey(sequence)], entities => {
+      const current = entities[0] || { Sequence: 0, Hash: '' };
+      if (current.Sequence + 1 != sequence || entities[1]) {
+        return undefined;
+      }
+      record = {
+        Sequence: sequence,
+        Time: new Date(entry.time),
+        Action: entry.action,
+        Actor: entry.actor,
+        EncounterId: entry.encounterId,
+        Address: entry.address,
+        Previous: current.Hash,
+      };
+      record.Hash = hash(record);
+      return [{ Sequence: record.Sequence, Hash: record.Hash }, record];
+    });
+  }).then(written => {
+    if (written) {
+      return mirror(record);
+    }
+    if (attempt >= maxAppendAttempts) {
+      throw new Error('The audit chain head kept moving');
+    }
+    return append(entry, attempt + 1);
+  });
+}
+
+// Appends from this instance run one at a time, so that they only contend
+// for the head with other instances'.
+var appending = Promise.resolve();
+
+function appendInTurn(entry) {
+  const appended = appending.then(() => append(entry));
+  appending = appended.catch(() => {});
+  return appended;
+}
+
+// With the queue enabled, records are appended in the order they are
+// processed, which can differ slightly from the order of their times.
+queue.handle('audit', appendInTurn);
+
+// Records an action by an actor ('provider', 'patient', 'admin', 'system' or
+// 'service:' and the name of a service of settings.serviceKeys).
+exports.record = function(action, actor, encounterId, request) {
+  return queue.enqueue('audit', {
+    action: action,
+    actor: actor,
+    encounterId: encounterId || '',
+    address: request ? request.ip || '' : '',
+    time: new Date().toISOString(),
+  }).catch(err => {
+    console.log('Failed to write audit record for ' + action + ': ' + err);
+  });
+};
+
+// Checks the whole chain.  Resolves to the number of records and, if the chain
+// is broken, the sequence number where it breaks and why.
+exports.verify = function() {
+  return Promise.all([datastore.list('Audit'), datastore.get(headKey), datastore.get(prunedKey)]).then(results => {
+    const head = results[1] || { Sequence: 0, Hash: '' };
+    const pruned = results[2] || { Sequence: 0, Hash: '' };
+    const records = results[0].filter(record => record.Sequence > pruned.Sequence).sort((a, b) => a.Sequence - b.Sequence);
+    var previous = pruned.Hash;
+
+    for (var i = 0; i < records.length; i++) {
+      const record = records[i];
+      if (record.Sequence != pruned.Sequence + i + 1) {
+        return { records: records.length, valid: false, brokenAt: pruned.Sequence + i + 1, reason: 'missing record' };
+      }
+      if (record.Previous != previous) {
+        return { records: records.length, valid: false, brokenAt: record.Sequence, reason: 'previous hash mismatch' };
+      }
+      if (hash(record) != record.Hash) {
+        return { records: records.length, valid: false, brokenAt: record.Sequence, reason: 'record modified' };
+      }
+      previous = record.Hash;
+    }
+
+    if (head.Sequence != pruned.Sequence + records.length || head.Hash != previous) {
+      return { records: records.length, valid: false, brokenAt: pruned.Sequence + records.length + 1, reason: 'records removed from the end' };
+    }
+    return { records: records.length, valid: true, prunedThrough: pruned.Sequence || undefined };
+  });
+};
+
+// Removes the records written before a time from the start of the chain,
+// remembering the last one removed so the rest still verifies.  Only the
+// unbroken run of old records at the start is removed, up to the first about
+// an encounter in held.  With dryRun nothing is removed.  Resolves to the
+// number of records removed, or that would be.
+exports.prune = function(before, dryRun, held) {
+  return Promise.all([datastore.list('Audit', [['Time', '<', before]]), datastore.get(prunedKey)]).then(results => {
+    const pruned = results[1] || { Sequence: 0, Hash: '' };
+    // Records left behind by an interrupted prune are removed again.
+    const leftover = results[0].filter(record => record.Sequence <= pruned.Sequence);
+    const old = results[0].filter(record => record.Sequence > pruned.Sequence).sort((a, b) => a.Sequence - b.Sequence);
+    var count = 0;
+    while (count < old.length && old[count].Sequence == pruned.Sequence + count + 1 &&
+        !(held && held.has(old[count].EncounterId))) {
+      count++;
+    }
+    if (dryRun) {
+      return count;
+    }
+    const removed = leftover.concat(old.slice(0, count));
+    const marked = count == 0 ? Promise.resolve() :
+      datastore.upsert(prunedKey, { Sequence: old[count - 1].Sequence, Hash: old[count - 1].Hash });
+    return marked.then(() => {
+      return Promise.all(removed.map(record => datastore.delete(recordKey(record.Sequence))));
+    }).then(() => count);
+  });
+};
@@ -0,0 +1,126 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Measures the per-request cost of the session cookie hot path: opening and
+// resealing the encrypted session context and session fields.
+//
+// Usage: node benchmark.js [--iterations=100000] [--changed]
+//
+// Each iteration runs the session context and session field middleware on a
+// request carrying a sealed context cookie and sealed fields, then sends the
+// response headers, which reseals whatever changed.  With --changed every
+// request also changes a field, so it is sealed again rather than kept.  The
+// report gives the time per request and the garbage collections the run
+// needed, which grow with what each request allocates.
+
+const settings = require('./settings.json');
+
+settings.sessionContext = {encrypted: true};
+settings.sessionFields = {encrypted: true};
+
+const sessioncontext = require('./sessioncontext.js');
+const sessionfields = require('./sessionfields.js');
+
+const {PerformanceObserver, performance} = require('perf_hooks');
+
+function parseArgs(argv) {
+  const args = {};
+  argv.forEach(arg => {
+    const match = /^--([^=]+)(?:=(.*))?$/.exec(arg);
+    if (match) {
+      args[match[1]] = match[2] === undefined ? true : match[2];
+    }
+  });
+  return args;
+}
+
+const args = parseArgs(process.argv.slice(2));
+const iterations = parseInt(args.iterations || '100000', 10);
+
+function fakeRequest(session, cookie) {
+  return {
+    session: session,
+    get: name => ({'Cookie': cookie, 'Accept-Language': 'en-US,en;q=0.9'})[name],
+  };
+}
+
+function fakeResponse() {
+  const headers = {};
+  return {
+    writeHead: () => {},
+    setHeader: (name, value) => {
+      headers[name] = value;
+    },
+    getHeader: name => headers[name],
+    headers: headers,
+  };
+}
+
+// Runs one request through the middleware, resolving to the cookies it set.
+function run(session, cookie, change) {
+  const request = fakeRequest(session, cookie);
+  const response = fakeResponse();
+  sessioncontext.middleware(request, response, () => {
+    sessionfields.middleware(request, response, () => {
+      if (change) {
+        sessioncontext.set(request, {expires: Date.now()});
+        request.session.verified = request.session.verified.concat([]).reverse();
+      }
+      response.writeHead(200);
+    });
+  });
+  return response.headers['Set-Cookie'];
+}
+
+// A session as the browser sends it once the fields have been sealed.
+const session = {
+  id: 'benchmark-session-id',
+  launch: {practitioner: 'Practitioner/123', encounterId: 'encounter-1', meetUrl: 'https://meet.google.com/abc-defg-hij'},
+  verified: ['encounter-1', 'encounter-2'],
+  consent: 'encounter-1',
+};
+const first = fakeRequest(session, '');
+const firstResponse = fakeResponse();
+sessioncontext.middleware(first, firstResponse, () => {
+  sessioncontext.set(first, {tenant: 'default', role: 'provider', expires: Date.now() + 60 * 60 * 1000});
+  sessionfields.middleware(first, firstResponse, () => firstResponse.writeHead(200));
+});
+const cookie = [].concat(firstResponse.headers['Set-Cookie'])[0].split(';')[0];
+const sealed = Object.assign({}, first.session);
+
+var collections = 0;
+var collecting = 0;
+const observer = new PerformanceObserver(list => {
+  list.getEntries().forEach(entry => {
+    collections++;
+    collecting += entry.duration;
+  });
+});
+observer.observe({entryTypes: ['gc']});
+
+const start = performance.now();
+for (var i = 0; i < iterations; i++) {
+  run(Object.assign({}, sealed), cookie, args.changed);
+}
+const elapsed = performance.now() - start;
+
+// Collections are reported once the loop yields.
+setTimeout(() => {
+  observer.disconnect();
+  console.log(iterations + ' requests' + (args.changed ? ' changing the session' : '') + ':');
+  console.log('  ' + (elapsed * 1000 / iterations).toFixed(2) + ' µs per request');
+  console.log('  ' + collections + ' garbage collections taking ' + collecting.toFixed(1) + ' ms');
+}, 100);
@@ -0,0 +1,165 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Draft billing artifacts for completed visits.  With settings.billing.resource
+// set to ChargeItem or Claim, a visit whose period was recorded gets one such
+// resource with the telehealth CPT code for its length, the configured
+// modifiers (such as 95 or GT) and the place of service the Encounter class
+// maps to, for the billing team to review rather than code from scratch.
+
+const audit = require('./audit.js');
+const datastore = require('./datastore.js');
+const fhir = require('./fhir.js');
+
+const settings = require('./settings.json');
+
+const CPT = 'http://www.ama-assn.org/go/cpt';
+const PLACE_OF_SERVICE = 'https://www.cms.gov/Medicare/Coding/place-of-service-codes/Place_of_Service_Code_Set';
+
+function options() {
+  return settings.billing || {};
+}
+
+exports.enabled = function() {
+  return options().resource == 'ChargeItem' || options().resource == 'Claim';
+};
+
+// Returns the CPT code with the highest minMinutes the visit reached.
+function cptCode(minutes) {
+  const codes = (options().codes || [])
+    .filter(code => minutes >= (code.minMinutes || 0))
+    .sort((a, b) => (b.minMinutes || 0) - (a.minMinutes || 0));
+  return codes.length == 0 ? undefined : codes[0].code;
+}
+
+function placeOfService(encounter) {
+  const mapping = options().placeOfService || {};
+  const encounterClass = encounter.class && encounter.class.code;
+  return mapping[encounterClass] || mapping.default;
+}
+
+function provider(encounter) {
+  const participant = (encounter.participant || [])
+    .find(participant => participant.individual && participant.individual.reference);
+  return participant && participant.individual;
+}
+
+function chargeItem(encounter, code, period) {
+  const modifiers = options().modifiers || [];
+  const resource = {
+    resourceType: 'ChargeItem',
+    status: 'billable',
+    code: {coding: [{system: CPT, code: code}]},
+    subject: encounter.subject,
+    context: {reference: 'Encounter/' + encounter.id},
+    occurrencePeriod: {start: period.start.toISOString(), end: period.end.toISOString()},
+    quantity: {value: 1},
+  };
+  const performer = provider(encounter);
+  if (performer) {
+    resource.performer = [{actor: performer}];
+  }
+  // ChargeItem has no modifier or place of service elements, so they are
+  // noted for coders.
+  const notes = [];
+  if (modifiers.length > 0) {
+    notes.push({text: 'Modifiers: ' + modifiers.join(', ')});
+  }
+  const pos = placeOfService(encounter);
+  if (pos) {
+    notes.push({text: 'Place of service: ' + pos});
+  }
+  if (notes.length > 0) {
+    resource.note = notes;
+  }
+  return resource;
+}
+
+function claim(encounter, code, period, coverage) {
+  const item = {
+    sequence: 1,
+    productOrService: {coding: [{system: CPT, code: code}]},
+    modifier: (options().modifiers || []).map(modifier => ({coding: [{system: CPT, code: modifier}]})),
+    servicedPeriod: {start: period.start.toISOString(), end: period.end.toISOString()},
+    encounter: [{reference: 'Encounter/' + encounter.id}],
+  };
+  const pos = placeOfService(encounter);
+  if (pos) {
+    item.locationCodeableConcept = {coding: [{system: PLACE_OF_SERVICE, code: pos}]};
+  }
+  const resource = {
+    resourceType: 'Claim',
+    status: 'draft',
+    type: {coding: [{system: 'http://terminology.hl7.org/CodeSystem/claim-type', code: 'professional'}]},
+    use: 'claim',
+    patient: encounter.subject,
+    created: new Date().toISOString(),
+    priority: {coding: [{system: 'http://terminology.hl7.org/CodeSystem/processpriority', code: 'normal'}]},
+    item: [item],
+  };
+  const performer = provider(encounter);
+  if (performer) {
+    resource.provider = performer;
+  }
+  if (coverage) {
+    resource.insurance = [{sequence: 1, focal: true, coverage: {reference: 'Coverage/' + coverage.id}}];
+  }
+  return resource;
+}
+
+function activeCoverage(context, encounter) {
+  if (!encounter.subject || !encounter.subject.reference) {
+    return Promise.resolve(undefined);
+  }
+  return fhir.search(context, 'Coverage', {
+    beneficiary: encounter.subject.reference,
+    status: 'active',
+  }).then(bundle => fhir.resources(bundle, 'Coverage')[0]).catch(() => undefined);
+}
+
+// Creates the billing artifact of a visit with the given period, once.
+// Resolves to a reference to it, or undefined if there is none to create.
+exports.create = function(context, encounterId, period) {
+  const key = datastore.key(['Encounter', encounterId]);
+  return datastore.get(key).then(entity => {
+    if (!entity || entity.Billing || entity.NoShow) {
+      return undefined;
+    }
+    const code = cptCode((period.end - period.start) / 60000);
+    if (!code) {
+      return undefined;
+    }
+
+    return fhir.read(context, 'Encounter', encounterId).then(encounter => {
+      if (options().resource == 'Claim') {
+        return activeCoverage(context, encounter).then(coverage => claim(encounter, code, period, coverage));
+      }
+      return chargeItem(encounter, code, period);
+    }).then(resource => {
+      // Identified by the encounter, so a retried create finds the first.
+      const identifier = {system: 'urn:meet-on-fhir:billing', value: encounterId};
+      resource.identifier = [identifier];
+      const condition = fhir.identifierCondition(identifier);
+      return fhir.create(context, resource, condition).then(created => {
+        return created && created.id ? resource.resourceType + '/' + created.id : resource.resourceType + '?' + condition;
+      });
+    }).then(reference => {
+      audit.record('billing-created', 'system', encounterId);
+      return datastore.modify(key, current => current && Object.assign(current, {Billing: reference}))
+        .then(() => reference);
+    });
+  });
+};
@@ -0,0 +1,150 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Limits on request bodies, checked before they're parsed.  Each route takes
+// bodies of the content types in routes below, form bodies of up to
+// requestLimits.maxBytes (16 KB) unless listed, and a request whose body is of
+// another type fails with unsupported-type rather than reaching the
+// route with an empty body.  A body over the route's cap fails with
+// payload-too-large from its Content-Length, or while it is read when it has
+// none.  requestLimits.routes overrides the caps by path prefix:
+//
+//   "requestLimits": { "maxBytes": 16384, "routes": { "/admin/erasure": 65536 } }
+//
+// A request whose signature covers a Content-Digest (see servicekeys.js) is
+// refused with forbidden if the body it's parsed from doesn't match it.
+
+const errors = require('./errors.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const express = require('express');
+
+const form = 'application/x-www-form-urlencoded';
+const json = 'application/json';
+const fhirJson = 'application/fhir+json';
+
+// Routes, by path prefix after any API version, taking other bodies.
+const routes = [
+  {prefix: '/subscriptions/appointments', types: [json, fhirJson], maxBytes: 1024 * 1024},
+  {prefix: '/push/subscriptions', types: [json], maxBytes: 4096},
+  {prefix: '/surveys/', types: [form, json]},
+  {prefix: '/admin/', types: [json], maxBytes: 256 * 1024},
+];
+
+function options() {
+  return settings.requestLimits || {};
+}
+
+// Returns the rule, { types, maxBytes }, of a request path.
+function rule(path) {
+  path = path.replace(/^\/v[0-9]+(?=\/)/, '');
+  const route = routes.find(route => path.startsWith(route.prefix)) || {types: [form]};
+  const overrides = options().routes || {};
+  const override = Object.keys(overrides).filter(prefix => path.startsWith(prefix))
+    .sort((a, b) => b.length - a.length)[0];
+  return {
+    types: route.types,
+    maxBytes: override ? overrides[override] : route.maxBytes || options().maxBytes || 16 * 1024,
+  };
+}
+
+exports.rule = rule;
+
+function hasBody(request) {
+  return request.get('Transfer-Encoding') !== undefined || parseInt(request.get('Content-Length') || '0', 10) > 0;
+}
+
+// Returns the SHA-256 of a Content-Digest header value, sha-256=:<base64>:,
+// or undefined if it has none.
+exports.digestOf = function(header) {
+  const match = /(?:^|,)\s*sha-256=:([A-Za-z0-9+/]+=*):\s*(?:,|$)/.exec(header || '');
+  const digest = match && Buffer.from(match[1], 'base64');
+  return digest && digest.length == 32 ? digest : undefined;
+};
+
+function sha256(buffer) {
+  return crypto.createHash('sha256').update(buffer).digest();
+}
+
+// Has the body of the request checked against a Content-Digest header value
+// when it's parsed.  Returns false if the request has no body and the digest
+// isn't that of an empty one.
+exports.expectDigest = function(request, header) {
+  const digest = exports.digestOf(header);
+  if (!hasBody(request)) {
+    return !!digest && crypto.timingSafeEqual(digest, sha256(Buffer.alloc(0)));
+  }
+  request.expectedDigest = digest;
+  return !!digest;
+};
+
+// Wraps the verify option of parserOptions to check the body against the
+// request's expected digest first.
+function verifying(parserOptions) {
+  const verify = parserOptions && parserOptions.verify;
+  return Object.assign({}, parserOptions, {
+    verify: (request, response, buffer, encoding) => {
+      if (request.expectedDigest && !crypto.timingSafeEqual(request.expectedDigest, sha256(buffer))) {
+        throw new errors.Forbidden('The body does not match its Content-Digest');
+      }
+      if (verify) {
+        verify(request, response, buffer, encoding);
+      }
+    },
+  });
+}
+
+// Middleware rejecting bodies of the wrong type or over the cap of their
+// route.  Must be used before the body parsers.
+exports.middleware = function(request, response, next) {
+  if (!hasBody(request)) {
+    next();
+    return;
+  }
+  const limits = rule(request.path);
+  const type = (request.get('Content-Type') || '').split(';')[0].trim().toLowerCase();
+  if (limits.types.indexOf(type) == -1) {
+    next(new errors.UnsupportedMediaType((type || 'A body without a type') + ' is not accepted here, expected ' +
+      limits.types.join(' or ')));
+    return;
+  }
+  const length = parseInt(request.get('Content-Length'), 10);
+  if (length > limits.maxBytes) {
+    next(new errors.PayloadTooLarge('The body is ' + length + ' bytes, over the limit of ' + limits.maxBytes));
+    return;
+  }
+  next();
+};
+
+// Returns middleware parsing JSON bodies, of the types of the request's
+// route, up to its cap.  parserOptions are passed on to express.json.
+exports.json = function(parserOptions) {
+  return function(request, response, next) {
+    const limits = rule(request.path);
+    express.json(Object.assign({type: limits.types, limit: limits.maxBytes}, verifying(parserOptions)))(request, response, next);
+  };
+};
+
+// Returns middleware parsing form bodies up to the cap of the request's
+// route.  parserOptions are passed on to express.urlencoded.
+exports.form = function(parserOptions) {
+  return function(request, response, next) {
+    const limits = rule(request.path);
+    express.urlencoded(Object.assign({extended: false, limit: limits.maxBytes}, verifying(parserOptions)))(request, response, next);
+  };
+};
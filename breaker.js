@@ -0,0 +1,116 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Circuit breakers for calls to dependencies, so that an EHR or Google API
+// outage fails requests quickly instead of letting them pile up.  A breaker
+// opens after settings.circuitBreaker.failureThreshold (5 by default)
+// consecutive failures and then rejects calls for openSeconds (30 by
+// default).  After that one call is let through as a probe (half-open): its
+// success closes the breaker and its failure opens it again.  Transitions are
+// counted in the usage analytics and states() reports each breaker.
+
+const analytics = require('./analytics.js');
+
+const settings = require('./settings.json');
+
+const CLOSED = 'closed';
+const OPEN = 'open';
+const HALF_OPEN = 'half-open';
+
+function options() {
+  return Object.assign({failureThreshold: 5, openSeconds: 30}, settings.circuitBreaker);
+}
+
+const breakers = {};
+
+class Breaker {
+  constructor(name, metric) {
+    this.name = name;
+    this.metric = metric;
+    this.state = CLOSED;
+    this.failures = 0;
+    this.openedAt = 0;
+    this.rejected = 0;
+  }
+
+  transition(state) {
+    if (this.state != state) {
+      this.state = state;
+      analytics.record('breaker/' + this.metric + '/' + state);
+    }
+  }
+
+  // Calls run, which returns a promise, unless the breaker is open, in which
+  // case the promise rejects with unavailable().  isFailure says which errors
+  // count against the dependency.
+  call(run, unavailable, isFailure) {
+    if (this.state == OPEN) {
+      if (Date.now() - this.openedAt < options().openSeconds * 1000) {
+        this.rejected++;
+        return Promise.reject(unavailable());
+      }
+      this.transition(HALF_OPEN);
+    } else if (this.state == HALF_OPEN && this.probing) {
+      this.rejected++;
+      return Promise.reject(unavailable());
+    }
+
+    const probe = this.state == HALF_OPEN;
+    this.probing = probe;
+    return Promise.resolve().then(run).then(result => {
+      this.failures = 0;
+      this.probing = false;
+      this.transition(CLOSED);
+      return result;
+    }, err => {
+      this.probing = false;
+      if (isFailure(err)) {
+        this.failures++;
+        if (probe || this.failures >= options().failureThreshold) {
+          this.openedAt = Date.now();
+          this.transition(OPEN);
+        }
+      }
+      throw err;
+    });
+  }
+}
+
+// Returns the breaker of a dependency.  metric names it in analytics, which
+// must not identify a patient or user.
+exports.get = function(name, metric) {
+  if (!breakers[name]) {
+    breakers[name] = new Breaker(name, metric || name);
+  }
+  return breakers[name];
+};
+
+// Whether an error from an HTTP dependency means it is unavailable: no
+// response, a timeout, rate limiting or a server error.
+exports.isOutage = function(err) {
+  const status = (err && err.response && err.response.status) || (err && typeof err.code == 'number' && err.code);
+  return !status || status == 429 || status >= 500;
+};
+
+// Returns the state of each breaker.
+exports.states = function() {
+  const states = {};
+  Object.keys(breakers).forEach(name => {
+    const breaker = breakers[name];
+    states[name] = {state: breaker.state, failures: breaker.failures, rejected: breaker.rejected};
+  });
+  return states;
+};
@@ -14,13 +14,22 @@
  * limitations under the License.
  */
 
+const deadline = require('./deadline.js');
+const faults = require('./faults.js');
+const transport = require('./transport.js');
+
 const settings = require('./settings.json');
 
 const {google} = require('googleapis');
 
+// How long, in milliseconds, the events of new meetings last.
+const eventDuration = 30 * 60 * 1000;
+
+exports.eventDuration = eventDuration;
+
 exports.createEvent = function(client, encounterId, callback) {
 	const start = new Date();
-	const end = new Date(start.getTime() + 30 * 60 * 1000);
+	const end = new Date(start.getTime() + eventDuration);
 	const event = {
 		summary: 'Hangouts Meet',
 		start: {
@@ -47,27 +56,131 @@ exports.createEvent = function(client, encounterId, callback) {
       return;
     }
 
-    calendar.events.insert({
+    meet(options => calendar.events.insert({
       calendarId: id,
       conferenceDataVersion: 1,
       resource: event,
-    }, (err, result) => {
+    }, options), (err, result) => {
       var link;
+      var created;
       if (result && result.data && result.data.hangoutLink) {
         link = result.data.hangoutLink;
+        created = { calendarId: id, eventId: result.data.id };
       }
-      callback(err, link);
+      callback(err, link, created);
+    });
+  });
+};
+
+// Calls back with the busy intervals, each { start, end }, of the provider's
+// primary calendar and the meetings calendar between start and end.  Busy
+// times the calendars don't report, such as those of calendars the provider
+// can't read, are left out.
+exports.freeBusy = function(client, start, end, callback) {
+  const calendar = google.calendar({version: 'v3', auth: client});
+  withCalendarId(calendar, (err, id) => {
+    if (err) {
+      callback(err, null);
+      return;
+    }
+    const ids = id == 'primary' ? ['primary'] : ['primary', id];
+    meet(options => calendar.freebusy.query({
+      requestBody: {
+        timeMin: start.toISOString(),
+        timeMax: end.toISOString(),
+        items: ids.map(id => ({ id: id })),
+      },
+    }, options), (err, result) => {
+      if (err) {
+        callback(err, null);
+        return;
+      }
+      const calendars = (result.data && result.data.calendars) || {};
+      const busy = [].concat.apply([], Object.keys(calendars).map(id => calendars[id].busy || []));
+      callback(null, busy.sort((a, b) => a.start.localeCompare(b.start)));
+    });
+  });
+};
+
+exports.deleteEvent = function(client, calendarId, eventId, callback) {
+  const calendar = google.calendar({version: 'v3', auth: client});
+  meet(options => calendar.events.delete({ calendarId: calendarId, eventId: eventId }, options), (err) => {
+    callback(err);
+  });
+};
+
+// Moves a meeting's event, notifying its attendees.
+exports.updateEvent = function(client, calendarId, eventId, start, end, callback) {
+  const calendar = google.calendar({version: 'v3', auth: client});
+  meet(options => calendar.events.patch({
+    calendarId: calendarId,
+    eventId: eventId,
+    sendUpdates: 'all',
+    resource: { start: { dateTime: start.toISOString() }, end: { dateTime: end.toISOString() } },
+  }, options), (err) => {
+    callback(err);
+  });
+};
+
+// Adds an attendee to a meeting's event without notifying anyone.
+exports.addAttendee = function(client, calendarId, eventId, email, callback) {
+  const calendar = google.calendar({version: 'v3', auth: client});
+  meet(options => calendar.events.get({ calendarId: calendarId, eventId: eventId }, options), (err, result) => {
+    if (err) {
+      callback(err);
+      return;
+    }
+    const attendees = (result.data.attendees || []).filter(attendee => attendee.email != email);
+    meet(options => calendar.events.patch({
+      calendarId: calendarId,
+      eventId: eventId,
+      sendUpdates: 'none',
+      resource: { attendees: attendees.concat([{ email: email }]) },
+    }, options), (err) => {
+      callback(err);
     });
   });
 };
 
+// Returns the meeting code of a meeting link, its last part.
+exports.meetingCode = function(meetingUrl) {
+  return meetingUrl.split('/').pop();
+};
+
+// Makes someone a co-host of a meeting with the Meet REST API.
+exports.addCohost = function(client, meetingUrl, email, callback) {
+  const code = exports.meetingCode(meetingUrl);
+  meet(options => client.request(Object.assign({
+    url: 'https://meet.googleapis.com/v2beta/spaces/' + encodeURIComponent(code) + '/members',
+    method: 'POST',
+    data: { email: email, role: 'COHOST' },
+  }, options)), (err) => callback(err));
+};
+
+// Calls back with the Meet REST API conference records of a meeting, each
+// with its startTime and, once it ended, endTime.
+exports.conferenceRecords = function(client, meetingUrl, callback) {
+  const code = exports.meetingCode(meetingUrl);
+  meet(options => client.request(Object.assign({
+    url: 'https://meet.googleapis.com/v2/conferenceRecords',
+    params: { filter: 'space.meeting_code = "' + code + '"' },
+  }, options)), (err, result) => callback(err, result && (result.data.conferenceRecords || [])));
+};
+
+// Makes a Google API request, given the request options to pass, calling back
+// with its error or result.  The request is limited by the Meet timeout,
+// subject to fault injection and goes through the Google proxy, if any.
+function meet(request, callback) {
+  deadline.limit('meet', timeout => faults.inject('meet', '', () => request({ timeout: timeout, agent: transport.googleAgent() }))).then(result => callback(null, result), err => callback(err));
+}
+
 function withCalendarId(calendar, callback) {
   if (!settings.calendar || settings.calendar == 'primary') {
     callback(null, 'primary');
     return;
   }
 
-  calendar.calendarList.list({ minAccessRole: 'owner' }, (err, result) => {
+  meet(options => calendar.calendarList.list({ minAccessRole: 'owner' }, options), (err, result) => {
     if (result && result.data) {
       const items = result.data.items;
       for (var i = 0; i < items.length; i++) {
@@ -77,7 +190,7 @@ function withCalendarId(calendar, callback) {
         }
       }
 
-      calendar.calendars.insert({ requestBody: { summary: settings.calendar } }, (err, result) => {
+      meet(options => calendar.calendars.insert({ requestBody: { summary: settings.calendar } }, options), (err, result) => {
         var id;
         if (result && result.data && result.data.id) {
           id = result.data.id;
@@ -0,0 +1,56 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Maps the SMART scopes an EHR granted to the features they allow, so that
+// features degrade when an EHR grants fewer scopes than requested.  Both
+// SMART v1 (patient/Encounter.write) and v2 (patient/Encounter.rs) scopes are
+// understood.
+
+// Each capability needs one of the listed [resource type, access] pairs,
+// where access is 'read' or one of the SMART v2 letters c, r, u, d and s.
+const requirements = {
+  canReadPatient: [['Patient', 'r']],
+  canReadEncounter: [['Encounter', 'r']],
+  canWriteEncounter: [['Encounter', 'u']],
+  canReadSchedule: [['Appointment', 's']],
+  canSendCommunication: [['Communication', 'c']],
+  canWriteConsent: [['Consent', 'c']],
+};
+
+exports.names = Object.keys(requirements);
+
+// Returns the access letters a scope grants on a resource type.
+function access(scope, resourceType) {
+  const match = /^(patient|user|system)\/([A-Za-z]+|\*)\.(read|write|\*|[cruds]+)(\?.*)?$/.exec(scope);
+  if (!match || (match[2] != '*' && match[2] != resourceType)) {
+    return '';
+  }
+  return {read: 'rs', write: 'cud', '*': 'cruds'}[match[3]] || match[3];
+}
+
+// Returns the capabilities for a space separated scope string.  Without a
+// scope string, for clients that don't report one, everything is allowed and
+// the EHR remains the judge.
+exports.fromScope = function(scope) {
+  const result = {};
+  const scopes = scope === undefined ? undefined : scope.split(/\s+/);
+  exports.names.forEach(name => {
+    result[name] = !scopes || requirements[name].some(requirement => {
+      return scopes.some(granted => access(granted, requirement[0]).indexOf(requirement[1]) != -1);
+    });
+  });
+  return result;
+};
@@ -0,0 +1,101 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Checks that a practitioner takes part in an encounter: as an Encounter
+// participant, a participant of one of its Appointments or a member of a
+// CareTeam for it.  Participants given as PractitionerRoles match their
+// practitioner.
+
+const fhir = require('./fhir.js');
+
+const settings = require('./settings.json');
+
+// 'off', 'warn' or 'block'.
+exports.mode = function() {
+  return settings.careTeamCheck || 'off';
+};
+
+// Reduces absolute references such as fhirUser to ResourceType/id.
+function relative(reference) {
+  const match = /([A-Za-z]+\/[^\/]+)$/.exec(reference || '');
+  return match ? match[1] : '';
+}
+
+function practitionerOf(context, reference) {
+  if (!reference.startsWith('PractitionerRole/')) {
+    return Promise.resolve(reference);
+  }
+  return fhir.read(context, 'PractitionerRole', reference.substring('PractitionerRole/'.length)).then(role => {
+    return relative(role.practitioner && role.practitioner.reference);
+  }).catch(() => '');
+}
+
+function participants(context, encounterId) {
+  return fhir.read(context, 'Encounter', encounterId).then(encounter => {
+    const references = (encounter.participant || []).map(p => p.individual && p.individual.reference);
+
+    const appointments = (encounter.appointment || []).map(appointment => {
+      const id = relative(appointment.reference).split('/')[1];
+      return fhir.read(context, 'Appointment', id).then(resource => {
+        return (resource.participant || []).map(p => p.actor && p.actor.reference);
+      }).catch(() => []);
+    });
+    const careTeams = fhir.search(context, 'CareTeam', {encounter: 'Encounter/' + encounterId}).then(bundle => {
+      return [].concat.apply([], fhir.resources(bundle, 'CareTeam').map(team => {
+        return (team.participant || []).map(p => p.member && p.member.reference);
+      }));
+    }).catch(() => []);
+
+    return Promise.all(appointments.concat([careTeams])).then(results => {
+      return [].concat.apply(references, results).map(relative).filter(reference => reference);
+    });
+  });
+}
+
+// Resolves to the practitioners taking part in the encounter, each as
+// { reference, name, email } where the Practitioner resource has them.
+exports.members = function(context, encounterId) {
+  return participants(context, encounterId).then(references => {
+    return Promise.all(references.map(reference => practitionerOf(context, reference)));
+  }).then(practitioners => {
+    const unique = practitioners.filter((reference, i) => {
+      return reference.startsWith('Practitioner/') && practitioners.indexOf(reference) == i;
+    });
+    return Promise.all(unique.map(reference => {
+      return fhir.read(context, 'Practitioner', reference.substring('Practitioner/'.length)).then(practitioner => {
+        const name = (practitioner.name || [])[0] || {};
+        const email = (practitioner.telecom || []).filter(telecom => telecom.system == 'email')[0];
+        return {
+          reference: reference,
+          name: name.text || [].concat(name.prefix || [], name.given || [], name.family || []).join(' '),
+          email: email ? email.value : undefined,
+        };
+      }).catch(() => ({reference: reference}));
+    }));
+  });
+};
+
+// Resolves to whether the practitioner, a reference such as a fhirUser
+// claim, takes part in the encounter.
+exports.includes = function(context, encounterId, practitioner) {
+  const wanted = relative(practitioner);
+  if (!wanted) {
+    return Promise.resolve(false);
+  }
+  return participants(context, encounterId).then(references => {
+    return Promise.all(references.map(reference => practitionerOf(context, reference)));
+  }).then(practitioners => practitioners.indexOf(wanted) != -1);
+};
@@ -0,0 +1,92 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Google Chat and Slack notifications for care teams.  Each clinic (tenant)
+// can post visit events to an incoming webhook of a Chat space or Slack
+// channel, set as chat.webhookUrl in its tenant settings or in
+// settings.chat.  Both accept the same simple text message.  The events are:
+//
+//   patient-waiting   The patient entered the waiting room.
+//   visit-overrun     A visit is still open chat.overrunMinutes (60 by
+//                     default) after its appointment started, found by the
+//                     overrun job.
+//   delivery-failed   A notification, such as a survey link, could not be
+//                     sent.
+//
+// chat.events limits which are posted.
+
+const audit = require('./audit.js');
+const datastore = require('./datastore.js');
+const tenants = require('./tenants.js');
+
+const settings = require('./settings.json');
+
+const gaxios = require('gaxios');
+
+function options(tenant) {
+  return Object.assign({}, settings.chat, tenants.config(tenant).chat);
+}
+
+function wanted(config, event) {
+  return !!config.webhookUrl && (!config.events || config.events.indexOf(event) >= 0);
+}
+
+// Posts a visit event to the chat webhook of the encounter's tenant.
+// Failures are logged rather than returned so that they don't break visits.
+exports.post = function(encounterId, event, text) {
+  return datastore.get(datastore.key(['Encounter', encounterId])).then(entity => {
+    const config = options(entity && entity.Tenant || tenants.DEFAULT);
+    if (!wanted(config, event)) {
+      return;
+    }
+    return gaxios.request({
+      url: config.webhookUrl,
+      method: 'POST',
+      data: {text: text + ' (encounter ' + encounterId + ')'},
+    });
+  }).catch(err => {
+    console.log('Failed to post ' + event + ' to chat: ' + err);
+  });
+};
+
+function overrunMs(tenant) {
+  return (options(tenant).overrunMinutes || 60) * 60 * 1000;
+}
+
+// Posts visits that are still open past their expected length, once each.
+exports.run = function() {
+  const now = new Date();
+  // Meetings are closed well within a day.
+  const since = new Date(now.getTime() - 24 * 60 * 60 * 1000);
+  return datastore.list('Encounter', [['Created', '>', since]]).then(entities => {
+    const overrun = entities.filter(entity => {
+      const tenant = entity.Tenant || tenants.DEFAULT;
+      const start = entity.AppointmentStart || entity.Created;
+      return !entity.Ended && !entity.Closed && !entity.NoShow && !entity.Overrun && entity.PatientJoined &&
+        wanted(options(tenant), 'visit-overrun') && now - start > overrunMs(tenant);
+    });
+    return Promise.all(overrun.map(entity => {
+      const encounterId = datastore.name(entity);
+      return datastore.modify(datastore.key(['Encounter', encounterId]), current => {
+        return current && Object.assign(current, {Overrun: now});
+      }).then(() => {
+        audit.record('visit-overrun', 'system', encounterId);
+        const minutes = Math.round((now - (entity.AppointmentStart || entity.Created)) / 60000);
+        return exports.post(encounterId, 'visit-overrun', 'A visit is still running ' + minutes + ' minutes after it started');
+      });
+    })).then(() => ({overruns: overrun.length}));
+  });
+};
@@ -0,0 +1,195 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const audit = require('./audit.js');
+const calendar = require('./calendar.js');
+const clock = require('./clock.js');
+const datastore = require('./datastore.js');
+const encounter = require('./encounter.js');
+const events = require('./events.js');
+const fhirCache = require('./fhircache.js');
+const frontdesk = require('./frontdesk.js');
+const handoff = require('./handoff.js');
+const idempotency = require('./idempotency.js');
+const invitations = require('./invitations.js');
+const locks = require('./locks.js');
+const period = require('./period.js');
+const push = require('./push.js');
+const ratelimit = require('./ratelimit.js');
+const replay = require('./replay.js');
+const series = require('./series.js');
+const survey = require('./survey.js');
+const tenants = require('./tenants.js');
+const user = require('./user.js');
+
+const settings = require('./settings.json');
+
+// How long, in milliseconds, meetings are kept open.
+function meetingMaxAge() {
+  const hours = (settings.cleanup && settings.cleanup.meetingMaxAgeHours) || 6;
+  return hours * 60 * 60 * 1000;
+}
+
+exports.meetingMaxAge = meetingMaxAge;
+
+// Deletes a meeting's calendar event with its owner's credentials, if they
+// are still stored.
+function deleteEvent(entity) {
+  if (!entity.Owner || !entity.EventId) {
+    return Promise.resolve();
+  }
+
+  return user.clientFor(entity.Owner).then(client => {
+    if (!client) {
+      return;
+    }
+    return new Promise(resolve => {
+      calendar.deleteEvent(client, entity.CalendarId, entity.EventId, err => {
+        if (err) {
+          console.log('Failed to delete calendar event ' + entity.EventId + ': ' + err);
+        }
+        resolve();
+      });
+    });
+  });
+}
+
+exports.deleteEvent = deleteEvent;
+
+// Finishes an Encounter left in-progress on the EHR with the EHR token its
+// meeting owner's session last used, queued when the queue is enabled.
+// Resolves to false if there is no such token or the update failed.
+function finishEncounter(entity) {
+  const encounterId = datastore.name(entity);
+  return (entity.Owner ? user.fhirContextFor(entity.Owner) : Promise.resolve()).then(context => {
+    return context ? encounter.update(context, encounterId, 'ended').then(() => true) : false;
+  }).catch(err => {
+    console.log('Failed to finish encounter ' + encounterId + ': ' + err);
+    return false;
+  });
+}
+
+// Closes meetings older than the maximum meeting age so their links are no
+// longer handed out, deleting their calendar events while the owner's
+// credentials are still available.  Encounters that were left in-progress on
+// the EHR are finished, and those that can't be are returned for
+// reconciliation.
+function closeMeetings(now) {
+  const cutoff = new Date(now.getTime() - meetingMaxAge());
+  return datastore.list('Encounter', [['Created', '<', cutoff]]).then(entities => {
+    const open = entities.filter(entity => !entity.Closed);
+    // The encounters of a group visit share one event, and a series keeps its
+    // event until it is idle.
+    const deleted = new Set();
+    return Promise.all(open.map(entity => {
+      const key = datastore.key(['Encounter', datastore.name(entity)]);
+      const shared = deleted.has(entity.EventId) || entity.Series;
+      deleted.add(entity.EventId);
+      return (shared ? Promise.resolve() : deleteEvent(entity)).then(() => {
+        return datastore.modify(key, entity => {
+          return entity && Object.assign(entity, { Closed: now });
+        }).then(() => {
+          events.publish('visit.expired', { encounterId: datastore.name(entity) });
+          audit.record('meeting-closed', 'system', datastore.name(entity));
+          if (survey.enabled()) {
+            survey.dispatch(datastore.name(entity));
+          }
+          return entity.VisitEnd ? undefined : period.record(datastore.name(entity));
+        });
+      });
+    })).then(() => {
+      const inProgress = open.filter(entity => entity.Status == 'in-progress');
+      return Promise.all(inProgress.map(finishEncounter)).then(finished => {
+        return {
+          closed: open.length,
+          finished: inProgress.filter((entity, i) => finished[i]).map(entity => datastore.name(entity)),
+          inProgress: inProgress.filter((entity, i) => !finished[i]).map(entity => datastore.name(entity)),
+        };
+      });
+    });
+  });
+}
+
+// Deletes the meetings of series that are no longer used.
+function purgeSeries(now) {
+  return series.idle(now).then(entities => {
+    return Promise.all(entities.map(entity => {
+      return deleteEvent(entity).then(() => {
+        return datastore.delete(datastore.key(['Series', datastore.name(entity)]));
+      });
+    })).then(() => entities.length);
+  });
+}
+
+// Deletes the stored credentials of provider sessions that have expired.
+// Sessions from before expiry times were stored expire after the default
+// provider session duration.
+function purgeUsers(now) {
+  const cutoff = new Date(now.getTime() - tenants.sessionDuration(tenants.DEFAULT, 'provider'));
+  return Promise.all([
+    datastore.list('User', [['Expires', '<', now]]),
+    datastore.list('User', [['Created', '<', cutoff]]),
+  ]).then(results => {
+    const entities = results[0].concat(results[1].filter(entity => !entity.Expires));
+    return Promise.all(entities.map(entity => {
+      return user.deleteSession(entity).then(() => {
+        events.publish('session.expired');
+      });
+    })).then(() => entities.length);
+  });
+}
+
+exports.run = function() {
+  const now = clock.date();
+  return closeMeetings(now).then(meetings => {
+    return Promise.all([
+      purgeUsers(now),
+      replay.purge(now),
+      handoff.purge(now),
+      invitations.purge(now),
+      purgeSeries(now),
+      survey.purge(now),
+      push.purge(now),
+      idempotency.purge(now),
+      locks.purge(now),
+      ratelimit.purge(now),
+      fhirCache.purge(now),
+      frontdesk.purge(now),
+    ]).then(results => {
+      const users = results[0];
+      if (meetings.inProgress.length > 0) {
+        console.log('Encounters left in-progress: ' + meetings.inProgress.join(', '));
+      }
+      return {
+        closedMeetings: meetings.closed,
+        finishedEncounters: meetings.finished,
+        inProgressEncounters: meetings.inProgress,
+        purgedUsers: users,
+        purgedOneTimeValues: results[1],
+        purgedHandoffCodes: results[2],
+        purgedInvitations: results[3],
+        purgedSeries: results[4],
+        purgedSurveys: results[5],
+        purgedPushSubscriptions: results[6],
+        purgedIdempotencyKeys: results[7],
+        purgedLocks: results[8],
+        purgedRateLimits: results[9],
+        purgedFhirCacheEntries: results[10],
+        purgedQueueRecords: results[11],
+      };
+    });
+  });
+};
@@ -0,0 +1,38 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The time expiry is computed and checked against: session and link
+// lifetimes, sliding windows and the purges that collect what has expired.
+// It is the system clock unless a test replaces it with use, for example
+// with testing/clock.js, to move time forward without waiting.
+
+var source = () => Date.now();
+
+// Returns the current time in milliseconds.
+exports.now = function() {
+  return source();
+};
+
+// Returns the current time as a Date.
+exports.date = function() {
+  return new Date(source());
+};
+
+// Makes the module tell the time with now, a function returning
+// milliseconds, or go back to the system clock without one.
+exports.use = function(now) {
+  source = now || (() => Date.now());
+};
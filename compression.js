@@ -0,0 +1,138 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Compresses responses with brotli or gzip, whichever the client prefers, so
+// that pages, scripts and API responses load faster on slow patient
+// connections.  Under settings.compression:
+//
+//   * enabled (true) turns it on.
+//   * thresholdBytes (1024) is the smallest body compressed; smaller ones
+//     gain less than the headers cost.
+//   * types are the content types compressed, each a type or a prefix
+//     ending in / such as text/.  By default text, JSON, FHIR JSON, problem
+//     details, JavaScript and SVG.
+//   * brotli (true) offers brotli to clients that accept it.
+//
+// Only responses sent in one piece, as response.send does, are compressed;
+// streamed ones are left alone.  Compressed bodies are remembered by their
+// hash, so static assets are compressed once rather than on every request.
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const zlib = require('zlib');
+
+const defaultTypes = [
+  'text/',
+  'application/json',
+  'application/fhir+json',
+  'application/problem+json',
+  'application/javascript',
+  'image/svg+xml',
+];
+
+// How many compressed bodies are remembered.
+const cacheSize = 200;
+const cache = new Map();
+
+function options() {
+  return settings.compression || {};
+}
+
+function compressible(response) {
+  const type = (response.get('Content-Type') || '').split(';')[0].trim().toLowerCase();
+  const types = options().types || defaultTypes;
+  return !!type && types.some(candidate => candidate.endsWith('/') ? type.startsWith(candidate) : type == candidate);
+}
+
+function compress(coding, body) {
+  return new Promise((resolve, reject) => {
+    const done = (err, result) => err ? reject(err) : resolve(result);
+    if (coding == 'br') {
+      // Quality 5 compresses nearly as well as the default 11, many times
+      // faster, which matters for bodies compressed per request.
+      zlib.brotliCompress(body, {params: {
+        [zlib.constants.BROTLI_PARAM_QUALITY]: 5,
+        [zlib.constants.BROTLI_PARAM_SIZE_HINT]: body.length,
+      }}, done);
+    } else {
+      zlib.gzip(body, done);
+    }
+  });
+}
+
+function cached(coding, body) {
+  const key = coding + ' ' + crypto.createHash('sha256').update(body).digest('base64');
+  if (cache.has(key)) {
+    const result = cache.get(key);
+    // Map keeps insertion order, so re-inserting makes this the newest.
+    cache.delete(key);
+    cache.set(key, result);
+    return Promise.resolve(result);
+  }
+  return compress(coding, body).then(result => {
+    cache.set(key, result);
+    if (cache.size > cacheSize) {
+      cache.delete(cache.keys().next().value);
+    }
+    return result;
+  });
+}
+
+// Middleware compressing the response when it ends.  Must be used after the
+// session middleware and sessionsize, so their end hooks run on the
+// compressed response.
+exports.middleware = function(request, response, next) {
+  if (options().enabled === false) {
+    next();
+    return;
+  }
+  const codings = options().brotli === false ? ['gzip'] : ['br', 'gzip'];
+  const write = response.write;
+  const end = response.end;
+  var streamed = false;
+
+  response.write = function() {
+    streamed = true;
+    return write.apply(this, arguments);
+  };
+
+  response.end = function(chunk, encoding) {
+    response.end = end;
+    if (streamed || response.headersSent || !chunk || typeof chunk == 'function' || !compressible(response)) {
+      return end.apply(this, arguments);
+    }
+    response.vary('Accept-Encoding');
+    const body = Buffer.isBuffer(chunk) ? chunk : Buffer.from(chunk, typeof encoding == 'string' ? encoding : 'utf8');
+    const coding = request.acceptsEncodings(codings.concat(['identity']));
+    const noTransform = /no-transform/.test(response.get('Cache-Control') || '');
+    if (body.length < (options().thresholdBytes || 1024) || !codings.includes(coding) || noTransform ||
+        response.get('Content-Encoding') || response.statusCode == 204 || response.statusCode == 304) {
+      return end.apply(this, arguments);
+    }
+
+    cached(coding, body).then(compressed => {
+      response.set('Content-Encoding', coding);
+      response.set('Content-Length', String(compressed.length));
+      end.call(response, compressed);
+    }, err => {
+      console.log('Failed to compress the response to ' + request.method + ' ' + request.path + ': ' + err);
+      end.call(response, body);
+    });
+    return response;
+  };
+  next();
+};
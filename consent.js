@@ -0,0 +1,126 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Patient consent to the telehealth visit, and optionally to its recording,
+// given on the consent screen before entering the waiting room.  Consent is
+// kept in 'Consent' entities keyed by encounter and, when
+// settings.consent.writeResource is set, written to the EHR as a FHIR Consent
+// resource referring to the Encounter.  A patient who consents again, say on
+// another device or after changing their mind about recording, replaces the
+// consent, whose earlier versions are kept in its History.
+
+const datastore = require('./datastore.js');
+const fhir = require('./fhir.js');
+const flags = require('./flags.js');
+const tenants = require('./tenants.js');
+
+const settings = require('./settings.json');
+
+function options() {
+  return settings.consent || {};
+}
+
+exports.required = function() {
+  return !!options().required;
+};
+
+// Whether the patients of a tenant are asked about recording, subject to the
+// recording feature flag.
+exports.recordingOption = function(tenant) {
+  return !!options().recordingOption && flags.enabled('recording', tenant);
+};
+
+function resource(patientId, encounterId, given, recording, recordingOffered) {
+  const consent = {
+    resourceType: 'Consent',
+    status: 'active',
+    scope: {coding: [{
+      system: 'http://terminology.hl7.org/CodeSystem/consentscope',
+      code: 'treatment',
+    }]},
+    category: [{coding: [{system: 'http://loinc.org', code: '59284-0', display: 'Patient Consent'}]}],
+    patient: {reference: 'Patient/' + patientId},
+    dateTime: given.toISOString(),
+    policyRule: {coding: [{system: 'http://terminology.hl7.org/CodeSystem/v3-ActCode', code: 'OPTIN'}]},
+    provision: {
+      type: 'permit',
+      data: [{meaning: 'related', reference: {reference: 'Encounter/' + encounterId}}],
+    },
+  };
+  if (recordingOffered) {
+    consent.provision.provision = [{
+      type: recording ? 'permit' : 'deny',
+      action: [{text: 'Recording of the telehealth visit'}],
+    }];
+  }
+  return consent;
+}
+
+// The patient is taken from the Encounter where it can be read.
+function patientOf(context, encounterId, fallback) {
+  return fhir.read(context, 'Encounter', encounterId).then(encounter => {
+    const reference = (encounter.subject && encounter.subject.reference) || '';
+    return reference.startsWith('Patient/') ? reference.substring('Patient/'.length) : fallback;
+  }).catch(() => fallback);
+}
+
+// Records the patient's consent for an encounter, replacing any given before.
+// Resolves to the stored consent.  canWrite is whether the EHR granted
+// Consent write access.
+exports.record = function(context, encounterId, consent, canWrite) {
+  const given = new Date();
+  const recordingOffered = exports.recordingOption(tenants.forIssuer(context.serverUrl));
+  const entity = {
+    Given: given,
+    Recording: !!consent.recording && recordingOffered,
+    Language: consent.language || '',
+    ResourceId: '',
+  };
+
+  var written = Promise.resolve();
+  if (options().writeResource && canWrite) {
+    written = patientOf(context, encounterId, consent.patient).then(patientId => {
+      if (!patientId) {
+        return;
+      }
+      const consent = resource(patientId, encounterId, given, entity.Recording, recordingOffered);
+      const identifier = {system: 'urn:meet-on-fhir:consent', value: encounterId};
+      consent.identifier = [identifier];
+      return fhir.create(context, consent, fhir.identifierCondition(identifier)).then(created => {
+        entity.ResourceId = (created && created.id) || '';
+      });
+    });
+  }
+
+  return written.then(() => datastore.modify(datastore.key(['Consent', encounterId]), existing => {
+    if (existing) {
+      entity.Version = (existing.Version || 1) + 1;
+      entity.History = (existing.History || []).concat([{
+        Given: existing.Given,
+        Recording: existing.Recording,
+        Language: existing.Language,
+        ResourceId: existing.ResourceId,
+      }]);
+      entity.ResourceId = entity.ResourceId || existing.ResourceId;
+    }
+    return entity;
+  })).then(() => entity);
+};
+
+// Resolves to whether consent was given for an encounter.
+exports.given = function(encounterId) {
+  return datastore.get(datastore.key(['Consent', encounterId])).then(entity => !!entity);
+};
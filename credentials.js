@@ -0,0 +1,100 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Refresh tokens are kept apart from sessions in 'Credential' entities,
+// encrypted with AES-256-GCM under a key that is only used for them, so a copy
+// of the session records doesn't yield usable credentials.  Every decryption
+// is audited.
+//
+// settings.credentialKeys maps key IDs to base64 encoded 32 byte keys and
+// settings.credentialKeyId names the key new credentials are encrypted with.
+// Older keys stay listed until the credentials encrypted with them expire.
+
+const audit = require('./audit.js');
+const datastore = require('./datastore.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+function encryptionKey(id) {
+  const encoded = (settings.credentialKeys || {})[id];
+  if (!encoded) {
+    throw new Error('Credential key ' + id + ' is not configured');
+  }
+  const key = Buffer.from(encoded, 'base64');
+  if (key.length != 32) {
+    throw new Error('Credential key ' + id + ' is not 32 bytes');
+  }
+  return key;
+}
+
+function encrypt(id, token, keyId) {
+  const iv = crypto.randomBytes(12);
+  const cipher = crypto.createCipheriv('aes-256-gcm', encryptionKey(keyId), iv);
+  // Binding the ciphertext to its ID stops it being swapped into another
+  // record.
+  cipher.setAAD(Buffer.from(id));
+  const ciphertext = Buffer.concat([cipher.update(token, 'utf8'), cipher.final()]);
+  return {
+    Ciphertext: ciphertext.toString('base64'),
+    Iv: iv.toString('base64'),
+    Tag: cipher.getAuthTag().toString('base64'),
+    KeyId: keyId,
+  };
+}
+
+function decrypt(id, entity) {
+  const decipher = crypto.createDecipheriv('aes-256-gcm', encryptionKey(entity.KeyId),
+    Buffer.from(entity.Iv, 'base64'));
+  decipher.setAAD(Buffer.from(id));
+  decipher.setAuthTag(Buffer.from(entity.Tag, 'base64'));
+  return Buffer.concat([
+    decipher.update(Buffer.from(entity.Ciphertext, 'base64')),
+    decipher.final(),
+  ]).toString('utf8');
+}
+
+// Resolves to the ID of a new credential holding the token.
+exports.store = function(token) {
+  const id = crypto.randomBytes(16).toString('hex');
+  const entity = Object.assign(encrypt(id, token, settings.credentialKeyId), {Created: new Date()});
+  return datastore.set(datastore.key(['Credential', id]), entity).then(() => id);
+};
+
+// Resolves to the token of a credential, or undefined if it was deleted.
+// actor is recorded in the audit log.
+exports.load = function(id, actor) {
+  return datastore.get(datastore.key(['Credential', id])).then(entity => {
+    if (!entity) {
+      return undefined;
+    }
+    const token = decrypt(id, entity);
+    audit.record('credential-read', actor, '');
+    return token;
+  });
+};
+
+// Returns a stored credential entity re-encrypted under keyId, for copying
+// credentials to a datastore whose deployment has other keys.  It keeps its
+// ID, which the ciphertext is bound to.  Callers audit the copy.
+exports.reencrypt = function(id, entity, keyId) {
+  return Object.assign({}, entity, encrypt(id, decrypt(id, entity), keyId));
+};
+
+exports.remove = function(id) {
+  return datastore.delete(datastore.key(['Credential', id]));
+};
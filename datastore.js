@@ -14,21 +14,1031 @@
  * limitations under the License.
  */
 
+const deadline = require('./deadline.js');
+const faults = require('./faults.js');
+const instrumentation = require('./instrumentation.js');
+const tenancy = require('./tenancy.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
 const {Datastore} = require('@google-cloud/datastore');
 
-const datastore = new Datastore();
+// Every kind of record stored.  Keys are only made for these, so that tools
+// handling every kind, such as migrate.js, can't miss one.
+exports.kinds = ['User', 'Credential', 'Encounter', 'Metric', 'Audit', 'AuditHead', 'Launch', 'OAuthState',
+	'ServiceNonce', 'Handoff', 'HandoffAttempts', 'Consent', 'Verification', 'Invitation', 'Group', 'Series', 'Survey',
+	'PushSubscription', 'Stat', 'Idempotency', 'Feature', 'Room', 'Registration', 'Task', 'Hold', 'Lock', 'RateLimit',
+	'Facility', 'QueueEntry', 'QueueDuty', 'FhirCache', 'Index'];
+
+// Kinds whose records all tenants share: a deployment's own records, and
+// those found by a link or code from outside a launch, which know their
+// tenant.
+exports.sharedKinds = ['Audit', 'AuditHead', 'Metric', 'Stat', 'Feature', 'Lock', 'RateLimit', 'Hold',
+	'Launch', 'OAuthState', 'ServiceNonce', 'Registration', 'Handoff', 'HandoffAttempts', 'Invitation', 'Survey', 'Facility'];
+
+// Kinds whose records are modified together in one transaction, named by
+// group.  A sharded store keeps each group on one shard, since transactions
+// can't span databases.
+exports.groups = {
+	Audit: 'audit',
+	AuditHead: 'audit',
+};
+
+// Properties of each kind that aren't indexed, so can't be filtered on,
+// since Cloud Datastore refuses indexed strings longer than 1500 bytes.
+exports.unindexed = {
+	Credential: ['Ciphertext'],
+	Facility: ['Endpoints'],
+	FhirCache: ['Resource'],
+	Idempotency: ['Body', 'Session'],
+	PushSubscription: ['Subscription'],
+	QueueEntry: ['Assignments'],
+	Task: ['Payload', 'Agent'],
+};
+
+// The longest string Cloud Datastore indexes.
+const MAX_INDEXED_BYTES = 1500;
+
+function unindexedOf(key) {
+	return exports.unindexed[key.path[0]] || [];
+}
+
+// Returns the first indexed property of entity too long for Cloud Datastore,
+// so that the memory store refuses the same writes.
+function tooLong(key, entity) {
+	const unindexed = unindexedOf(key);
+	return Object.keys(entity).find(property => unindexed.indexOf(property) == -1 &&
+		typeof entity[property] == 'string' && Buffer.byteLength(entity[property]) > MAX_INDEXED_BYTES);
+}
+
+// The namespace the current tenant keeps records of kind in, undefined for
+// the default namespace.
+function namespaceOf(kind) {
+	if (!tenancy.enabled() || exports.sharedKinds.indexOf(kind) != -1) {
+		return undefined;
+	}
+	return tenancy.namespace(tenancy.current());
+}
+
+// Keys are backend independent so the same key can be used with every store
+// during a migration.  With tenant namespaces, keys of records that aren't
+// shared are in the namespace of the tenant they are made for.
+exports.key = (path) => {
+	if (exports.kinds.indexOf(path[0]) == -1) {
+		throw new Error('Unknown kind ' + path[0] + ': stored kinds are listed in datastore.kinds');
+	}
+	const namespace = namespaceOf(path[0]);
+	return namespace ? {path: path, namespace: namespace} : {path: path};
+};
+
+// Returns the name of the key an entity returned by list was stored under.
+exports.name = (entity) => {
+	return entity[Datastore.KEY].name;
+};
+
+// The gRPC status of a transaction that conflicted with another.
+const ABORTED = 10;
+
+// The most keys Cloud Datastore looks up, and entities it writes, at once.
+const MAX_BATCH_GET = 1000;
+const MAX_BATCH_PUT = 500;
+
+function chunks(array, size) {
+	const result = [];
+	for (var i = 0; i < array.length; i += size) {
+		result.push(array.slice(i, i + size));
+	}
+	return result;
+}
+
+function id(key) {
+	return key.path.join('/');
+}
+
+// The { key, entity } records of the entities modifyMany wrote.
+function written(keys, entities) {
+	return keys.map((key, index) => ({key: key, entity: entities[index]})).filter(record => record.entity);
+}
+
+// Returns a store backed by Cloud Datastore (or Firestore in Datastore mode)
+// with the given projectId and namespace options.
+function cloudDatastore(options) {
+	const datastore = new Datastore(options);
+	// Tenant namespaces are within the configured namespace, if any.
+	const namespaced = (namespace) => namespace && options.namespace ? options.namespace + '-' + namespace : namespace;
+	const nativeKey = (key) => {
+		return key.namespace ? datastore.key({namespace: namespaced(key.namespace), path: key.path}) : datastore.key(key.path);
+	};
+	const record = (key, entity) => {
+		return {key: nativeKey(key), data: entity, excludeFromIndexes: unindexedOf(key)};
+	};
+	const store = {};
+
+	store.get = (key) => {
+		return datastore.get(nativeKey(key)).then(entity => {
+			if (entity.length == 0) {
+				return undefined;
+			}
+			return entity[0];
+		});
+	};
+
+	store.set = (key, entity) => {
+		return datastore.insert(record(key, entity));
+	};
+
+	store.update = (key, entity) => {
+		return datastore.update(record(key, entity));
+	};
+
+	store.upsert = (key, entity) => {
+		return datastore.upsert(record(key, entity));
+	};
+
+	store.delete = (key) => {
+		return datastore.delete(nativeKey(key));
+	};
+
+	// Resolves to the entities stored under keys, in the same order, with
+	// undefined for those that don't exist.
+	store.getMany = (keys) => {
+		return Promise.all(chunks(keys, MAX_BATCH_GET).map(batch => {
+			return datastore.get(batch.map(nativeKey)).then(results => results[0]);
+		})).then(results => {
+			const found = {};
+			[].concat.apply([], results).forEach(entity => {
+				const key = entity[Datastore.KEY];
+				found[key.kind + '/' + key.name] = entity;
+			});
+			return keys.map(key => found[id(key)]);
+		});
+	};
+
+	// Upserts each { key, entity } of records.
+	store.upsertMany = (records) => {
+		return Promise.all(chunks(records, MAX_BATCH_PUT).map(batch => {
+			return datastore.upsert(batch.map(each => record(each.key, each.entity)));
+		}));
+	};
+
+	// Atomically replaces the entity stored under key with the result of
+	// calling modify with the current entity (undefined if there is none).
+	// Nothing is written if modify returns undefined.  Transactions aborted
+	// by a concurrent write are retried.
+	store.modify = (key, modify, attempt) => {
+		attempt = attempt || 1;
+		const transaction = datastore.transaction();
+		return transaction.run().then(() => transaction.get(nativeKey(key))).then(entities => {
+			const entity = modify(entities[0]);
+			if (!entity) {
+				return transaction.rollback().then(() => entity);
+			}
+			transaction.save(record(key, entity));
+			return transaction.commit().then(() => entity);
+		}).catch(err => {
+			return transaction.rollback().catch(() => {}).then(() => {
+				if (err.code == ABORTED && attempt < 5) {
+					return store.modify(key, modify, attempt + 1);
+				}
+				throw err;
+			});
+		});
+	};
+
+	// Like modify for several keys in one transaction: modify is called with
+	// the current entities in the order of keys and returns the entities to
+	// write, undefined for those left alone, or undefined to write nothing.
+	store.modifyMany = (keys, modify, attempt) => {
+		attempt = attempt || 1;
+		const transaction = datastore.transaction();
+		return transaction.run().then(() => transaction.get(keys.map(nativeKey))).then(results => {
+			const found = {};
+			results[0].forEach(entity => {
+				const key = entity[Datastore.KEY];
+				found[key.kind + '/' + key.name] = entity;
+			});
+			const entities = modify(keys.map(key => found[id(key)]));
+			if (!entities) {
+				return transaction.rollback().then(() => entities);
+			}
+			written(keys, entities).forEach(each => transaction.save(record(each.key, each.entity)));
+			return transaction.commit().then(() => entities);
+		}).catch(err => {
+			return transaction.rollback().catch(() => {}).then(() => {
+				if (err.code == ABORTED && attempt < 5) {
+					return store.modifyMany(keys, modify, attempt + 1);
+				}
+				throw err;
+			});
+		});
+	};
+
+	// Returns all entities of a kind matching the given [property, operator,
+	// value] filters.
+	store.list = (kind, filters) => {
+		const namespace = namespaceOf(kind);
+		var query = namespace ? datastore.createQuery(namespaced(namespace), kind) : datastore.createQuery(kind);
+		(filters || []).forEach(filter => {
+			query = query.filter(filter[0], filter[1], filter[2]);
+		});
+		return datastore.runQuery(query).then(results => results[0]);
+	};
+
+	return store;
+}
+
+function copy(entity, name) {
+	const result = {};
+	Object.keys(entity).forEach(property => {
+		const value = entity[property];
+		result[property] = value instanceof Date ? new Date(value.getTime()) : value;
+	});
+	if (name !== undefined) {
+		result[Datastore.KEY] = {name: name};
+	}
+	return result;
+}
+
+const comparisons = {
+	'=': (a, b) => a == b,
+	'<': (a, b) => a < b,
+	'<=': (a, b) => a <= b,
+	'>': (a, b) => a > b,
+	'>=': (a, b) => a >= b,
+};
+
+function compare(value, operator, operand) {
+	if (value instanceof Date) {
+		value = value.getTime();
+		operand = operand instanceof Date ? operand.getTime() : operand;
+	}
+	return comparisons[operator](value, operand);
+}
+
+// Returns a store that keeps records in memory, for development and tests.
+function memory() {
+	// Records by namespace and id.
+	const namespaces = {};
+	const space = (namespace) => {
+		namespaces[namespace || ''] = namespaces[namespace || ''] || {};
+		return namespaces[namespace || ''];
+	};
+	const name = (key) => key.path[key.path.length - 1];
+	const refusal = (key, entity) => {
+		const property = tooLong(key, entity);
+		return property && new Error('The value of property "' + property + '" of ' + id(key) +
+			' is longer than ' + MAX_INDEXED_BYTES + ' bytes');
+	};
+	const store = {};
+
+	store.get = (key) => {
+		const entity = space(key.namespace)[id(key)];
+		return Promise.resolve(entity ? copy(entity, name(key)) : undefined);
+	};
+
+	store.set = (key, entity) => {
+		if (space(key.namespace)[id(key)]) {
+			return Promise.reject(new Error('Entity already exists: ' + id(key)));
+		}
+		const refused = refusal(key, entity);
+		if (refused) {
+			return Promise.reject(refused);
+		}
+		space(key.namespace)[id(key)] = copy(entity);
+		return Promise.resolve();
+	};
+
+	store.update = (key, entity) => {
+		if (!space(key.namespace)[id(key)]) {
+			return Promise.reject(new Error('No entity to update: ' + id(key)));
+		}
+		const refused = refusal(key, entity);
+		if (refused) {
+			return Promise.reject(refused);
+		}
+		space(key.namespace)[id(key)] = copy(entity);
+		return Promise.resolve();
+	};
+
+	store.upsert = (key, entity) => {
+		const refused = refusal(key, entity);
+		if (refused) {
+			return Promise.reject(refused);
+		}
+		space(key.namespace)[id(key)] = copy(entity);
+		return Promise.resolve();
+	};
+
+	store.delete = (key) => {
+		delete space(key.namespace)[id(key)];
+		return Promise.resolve();
+	};
+
+	store.getMany = (keys) => {
+		return Promise.all(keys.map(store.get));
+	};
+
+	store.upsertMany = (records) => {
+		return Promise.all(records.map(record => store.upsert(record.key, record.entity)));
+	};
+
+	// JavaScript is single threaded, so reading and writing without yielding
+	// is atomic.
+	store.modify = (key, modify) => {
+		const records = space(key.namespace);
+		const current = records[id(key)];
+		const entity = modify(current ? copy(current, name(key)) : undefined);
+		const refused = entity && refusal(key, entity);
+		if (refused) {
+			return Promise.reject(refused);
+		}
+		if (entity) {
+			records[id(key)] = copy(entity);
+		}
+		return Promise.resolve(entity);
+	};
+
+	store.modifyMany = (keys, modify) => {
+		const entities = modify(keys.map(key => {
+			const current = space(key.namespace)[id(key)];
+			return current ? copy(current, name(key)) : undefined;
+		}));
+		if (!entities) {
+			return Promise.resolve(entities);
+		}
+		const refused = written(keys, entities).map(each => refusal(each.key, each.entity)).find(err => err);
+		if (refused) {
+			return Promise.reject(refused);
+		}
+		written(keys, entities).forEach(each => {
+			space(each.key.namespace)[id(each.key)] = copy(each.entity);
+		});
+		return Promise.resolve(entities);
+	};
+
+	store.list = (kind, filters) => {
+		const records = space(namespaceOf(kind));
+		const entities = Object.keys(records).filter(path => path.split('/')[0] == kind).map(path => {
+			return copy(records[path], path.substring(path.lastIndexOf('/') + 1));
+		}).filter(entity => {
+			return (filters || []).every(filter => {
+				return entity[filter[0]] !== undefined && compare(entity[filter[0]], filter[1], filter[2]);
+			});
+		});
+		return Promise.resolve(entities);
+	};
+
+	return store;
+}
+
+function logFailure(operation, key) {
+	return function(err) {
+		console.log('Secondary store ' + operation + ' of ' + key.path.join('/') + ' failed: ' + err);
+	};
+}
+
+// Returns a store that reads from primary and writes to both stores, used
+// while migrating to secondary.  Writes to secondary are upserts so records
+// that haven't been copied yet are created, and their failures are logged
+// rather than failing the request.
+function dualWrite(primary, secondary) {
+	const store = Object.assign({}, primary);
+
+	store.set = (key, entity) => {
+		return primary.set(key, entity).then(() => {
+			return secondary.upsert(key, entity).catch(logFailure('set', key));
+		});
+	};
+
+	store.update = (key, entity) => {
+		return primary.update(key, entity).then(() => {
+			return secondary.upsert(key, entity).catch(logFailure('update', key));
+		});
+	};
+
+	store.upsert = (key, entity) => {
+		return primary.upsert(key, entity).then(() => {
+			return secondary.upsert(key, entity).catch(logFailure('upsert', key));
+		});
+	};
+
+	store.delete = (key) => {
+		return primary.delete(key).then(() => {
+			return secondary.delete(key).catch(logFailure('delete', key));
+		});
+	};
+
+	store.upsertMany = (records) => {
+		return primary.upsertMany(records).then(() => {
+			return secondary.upsertMany(records).catch(err => {
+				console.log('Secondary store upsertMany of ' + records.length + ' records failed: ' + err);
+			});
+		});
+	};
+
+	store.modify = (key, modify) => {
+		return primary.modify(key, modify).then(entity => {
+			if (!entity) {
+				return entity;
+			}
+			return secondary.upsert(key, entity).catch(logFailure('modify', key)).then(() => entity);
+		});
+	};
+
+	store.modifyMany = (keys, modify) => {
+		return primary.modifyMany(keys, modify).then(entities => {
+			if (!entities) {
+				return entities;
+			}
+			return secondary.upsertMany(written(keys, entities)).catch(err => {
+				console.log('Secondary store modifyMany of ' + keys.map(id).join(', ') + ' failed: ' + err);
+			}).then(() => entities);
+		});
+	};
+
+	return store;
+}
+
+// The gRPC statuses of requests that failed because the database's region
+// is unreachable, rather than because of the request.
+const REGION_FAILURES = [4, 13, 14];
+
+function regionFailed(err) {
+	return err && REGION_FAILURES.indexOf(err.code) != -1;
+}
+
+// Returns a store keeping a copy of every record in replica, so that records
+// stay available while primary's region is down.  The options are:
+//
+//   mode: 'async' (the default) writes to primary and copies each write to
+//     replica in the background; 'dual' writes to both and succeeds if
+//     either write does.
+//   readFrom: 'primary' (the default) or 'replica', the store read first.
+//     Reads fall back to the other store when the first is unreachable or,
+//     for get, doesn't have the record yet.
+//   conflict: 'primary' (the default) keeps the primary's copy of records
+//     written to both regions; 'newest' stamps records with the time they
+//     were written, reads both copies and repairs the older one.
+//
+// Writes that fail because primary is unreachable go to replica instead.
+function replicated(primary, replica, options) {
+	options = options || {};
+	const dual = options.mode == 'dual';
+	const newest = options.conflict == 'newest';
+	const first = options.readFrom == 'replica' ? replica : primary;
+	const second = first === primary ? replica : primary;
+	const store = {};
+
+	const stamp = (entity) => newest ? Object.assign({}, entity, {Replicated: new Date()}) : entity;
+	const unstamp = (entity) => {
+		if (entity) {
+			delete entity.Replicated;
+		}
+		return entity;
+	};
+	const stamped = (entity) => entity && entity.Replicated ? entity.Replicated.getTime() : 0;
+
+	// Runs a read on the preferred store, or the other one if its region is
+	// down.
+	const read = (run) => run(first).catch(err => {
+		if (!regionFailed(err)) {
+			throw err;
+		}
+		console.log('Reading from the other region: ' + err);
+		return run(second);
+	});
+
+	// Runs a write on both stores as the mode requires.  replicate runs the
+	// copy on replica given the result of the primary write.
+	const write = (operation, key, run, replicate) => {
+		if (dual) {
+			return Promise.all([run(primary).then(result => ({result: result}), err => ({err: err})),
+				run(replica).then(result => ({result: result}), err => ({err: err}))]).then(results => {
+				const failed = results.find(result => result.err && !regionFailed(result.err));
+				if (failed || (results[0].err && results[1].err)) {
+					throw (failed || results[0]).err;
+				}
+				results.filter(result => result.err).forEach(result => logFailure(operation, key)(result.err));
+				return results[0].err ? results[1].result : results[0].result;
+			});
+		}
+		return run(primary).then(result => {
+			replicate(result).catch(logFailure(operation, key));
+			return result;
+		}, err => {
+			if (!regionFailed(err)) {
+				throw err;
+			}
+			console.log('Writing ' + key.path.join('/') + ' to the replica: ' + err);
+			return run(replica);
+		});
+	};
+
+	// Chooses between the copies of a record read from both stores, and
+	// rewrites the older one.
+	const resolve = (key, copies) => {
+		const winner = stamped(copies[1]) > stamped(copies[0]) ? 1 : 0;
+		const loser = 1 - winner;
+		if (copies[winner] && stamped(copies[winner]) != stamped(copies[loser])) {
+			const repaired = Object.assign({}, copies[winner]);
+			[primary, replica][loser].upsert(key, repaired).catch(logFailure('repair', key));
+		}
+		return copies[winner];
+	};
 
-exports.key = datastore.key;
+	store.get = (key) => {
+		if (newest) {
+			return Promise.all([primary, replica].map(store => store.get(key).catch(err => {
+				if (!regionFailed(err)) {
+					throw err;
+				}
+				return undefined;
+			}))).then(copies => unstamp(resolve(key, copies)));
+		}
+		return read(store => store.get(key)).then(entity => {
+			return entity ? entity : second.get(key).catch(() => undefined);
+		}).then(unstamp);
+	};
 
-exports.get = (key) => {
-	return datastore.get(key).then(entity => {
-		if (entity.length == 0) {
-			return undefined;
+	store.getMany = (keys) => {
+		if (newest) {
+			return Promise.all(keys.map(store.get));
 		}
-		return entity[0];
+		return read(store => store.getMany(keys)).then(entities => entities.map(unstamp));
+	};
+
+	store.list = (kind, filters) => {
+		return read(store => store.list(kind, filters)).then(entities => entities.map(unstamp));
+	};
+
+	store.set = (key, entity) => {
+		entity = stamp(entity);
+		return write('set', key, store => store.set(key, entity), () => replica.upsert(key, entity));
+	};
+
+	['update', 'upsert'].forEach(operation => {
+		store[operation] = (key, entity) => {
+			entity = stamp(entity);
+			return write(operation, key, store => store[operation](key, entity), () => replica.upsert(key, entity));
+		};
 	});
+
+	store.delete = (key) => {
+		return write('delete', key, store => store.delete(key), () => replica.delete(key));
+	};
+
+	store.upsertMany = (records) => {
+		records = records.map(record => ({key: record.key, entity: stamp(record.entity)}));
+		const key = {path: ['batch of ' + records.length]};
+		return write('upsertMany', key, store => store.upsertMany(records), () => replica.upsertMany(records));
+	};
+
+	// Transactions run in one region: the primary's, or the replica's while
+	// the primary is down.  In dual mode the result is copied to the replica.
+	store.modify = (key, modify) => {
+		const transaction = (store) => store.modify(key, current => {
+			const entity = modify(unstamp(current));
+			return entity && stamp(entity);
+		});
+		return transaction(primary).then(entity => {
+			if (entity) {
+				const copied = replica.upsert(key, entity).catch(logFailure('modify', key));
+				return (dual ? copied : Promise.resolve()).then(() => unstamp(entity));
+			}
+			return entity;
+		}, err => {
+			if (!regionFailed(err)) {
+				throw err;
+			}
+			console.log('Modifying ' + key.path.join('/') + ' in the replica: ' + err);
+			return transaction(replica).then(unstamp);
+		});
+	};
+
+	store.modifyMany = (keys, modify) => {
+		const unstampAll = (entities) => entities && entities.map(unstamp);
+		const transaction = (store) => store.modifyMany(keys, currents => {
+			const entities = modify(currents.map(unstamp));
+			return entities && entities.map(entity => entity && stamp(entity));
+		});
+		return transaction(primary).then(entities => {
+			if (entities) {
+				const copied = replica.upsertMany(written(keys, entities)).catch(logFailure('modifyMany', keys[0]));
+				return (dual ? copied : Promise.resolve()).then(() => unstampAll(entities));
+			}
+			return entities;
+		}, err => {
+			if (!regionFailed(err)) {
+				throw err;
+			}
+			console.log('Modifying ' + keys.map(id).join(', ') + ' in the replica: ' + err);
+			return transaction(replica).then(unstampAll);
+		});
+	};
+
+	return store;
+}
+
+exports.replicated = replicated;
+
+// The approximate stored size, in bytes, of entities.
+function size(entities) {
+	return [].concat(entities).reduce((total, entity) => {
+		return total + (entity ? Buffer.byteLength(JSON.stringify(entity)) : 0);
+	}, 0);
+}
+
+// The size of what each operation reads or writes, given its arguments and
+// result.
+const payloads = {
+	get: (args, result) => size(result),
+	set: (args) => size(args[1]),
+	update: (args) => size(args[1]),
+	upsert: (args) => size(args[1]),
+	delete: () => 0,
+	modify: (args, result) => size(result),
+	modifyMany: (args, result) => size(result || []),
+	list: (args, result) => size(result),
+	getMany: (args, result) => size(result),
+	upsertMany: (args) => size(args[0].map(record => record.entity)),
+	lookup: (args, result) => size(result),
 };
 
-exports.set = (key, entity) => {
-	return datastore.insert({key: key, data: entity});
+// Returns a store recording the latency, error class and payload size of
+// each of store's operations with metrics, as returned by
+// instrumentation.create.
+exports.instrumented = (store, metrics) => {
+	const instrumented = {};
+	Object.keys(payloads).filter(operation => store[operation]).forEach(operation => {
+		instrumented[operation] = (...args) => {
+			const start = process.hrtime();
+			const elapsed = () => {
+				const time = process.hrtime(start);
+				return time[0] * 1000 + time[1] / 1e6;
+			};
+			return store[operation](...args).then(result => {
+				metrics.observe(operation, elapsed(), null, payloads[operation](args, result));
+				return result;
+			}, err => {
+				metrics.observe(operation, elapsed(), err);
+				throw err;
+			});
+		};
+	});
+	return instrumented;
 };
+
+function hash(value) {
+	return crypto.createHash('md5').update(value).digest().readUInt32BE(0);
+}
+
+// Points on a consistent hash ring.  Each shard owns many points so keys
+// spread evenly and adding or removing a shard only moves the keys it owns.
+function hashRing(shards) {
+	const points = [];
+	shards.forEach((shard, index) => {
+		for (var i = 0; i < 100; i++) {
+			points.push({point: hash(shard.name + '#' + i), index: index});
+		}
+	});
+	return points.sort((a, b) => a.point - b.point);
+}
+
+function owner(shards, ring, key) {
+	const point = hash(exports.groups[key.path[0]] || key.path.join('/'));
+	const found = ring.find(candidate => candidate.point >= point) || ring[0];
+	return shards[found.index].store;
+}
+
+// Returns a store spreading keys over shards, each a { name, store }.  While
+// shards are being rebalanced, previousShards lists the old layout: records
+// missing from their new shard are read from their old one and moved to the
+// new shard when they are next modified.
+function sharded(shards, previousShards) {
+	const ring = hashRing(shards);
+	const previousRing = previousShards ? hashRing(previousShards) : null;
+	const route = (key) => owner(shards, ring, key);
+	const previous = (key) => {
+		if (!previousRing) {
+			return null;
+		}
+		const store = owner(previousShards, previousRing, key);
+		return store === route(key) ? null : store;
+	};
+	const store = {};
+
+	store.get = (key) => {
+		return route(key).get(key).then(entity => {
+			const old = previous(key);
+			return entity || !old ? entity : old.get(key);
+		});
+	};
+
+	// An update of a record that hasn't moved yet has to create it.
+	['set', 'update', 'upsert'].forEach(operation => {
+		store[operation] = (key, entity) => {
+			const old = previous(key);
+			if (!old) {
+				return route(key)[operation](key, entity);
+			}
+			const write = operation == 'set' ? route(key).set(key, entity) : route(key).upsert(key, entity);
+			return write.then(() => old.delete(key));
+		};
+	});
+
+	store.delete = (key) => {
+		const old = previous(key);
+		const deleted = route(key).delete(key);
+		return old ? deleted.then(() => old.delete(key)) : deleted;
+	};
+
+	// Keys are looked up in one batch per shard, and those missing from their
+	// new shard one by one in their old shard.
+	store.getMany = (keys) => {
+		const batches = new Map();
+		keys.forEach((key, index) => {
+			const shard = route(key);
+			batches.set(shard, (batches.get(shard) || []).concat([index]));
+		});
+		const entities = new Array(keys.length);
+		return Promise.all(Array.from(batches.entries()).map(entry => {
+			return entry[0].getMany(entry[1].map(index => keys[index])).then(found => {
+				return Promise.all(found.map((entity, i) => {
+					const index = entry[1][i];
+					const old = previous(keys[index]);
+					return (entity || !old ? Promise.resolve(entity) : old.get(keys[index])).then(entity => {
+						entities[index] = entity;
+					});
+				}));
+			});
+		})).then(() => entities);
+	};
+
+	// Records that haven't moved are written in one batch per shard.
+	store.upsertMany = (records) => {
+		const batches = new Map();
+		const moving = records.filter(record => {
+			if (previous(record.key)) {
+				return true;
+			}
+			const shard = route(record.key);
+			batches.set(shard, (batches.get(shard) || []).concat([record]));
+			return false;
+		});
+		return Promise.all(Array.from(batches.entries()).map(entry => entry[0].upsertMany(entry[1]))
+			.concat(moving.map(record => store.upsert(record.key, record.entity))));
+	};
+
+	// Moves a record that is still in its old shard to its new one, so that it
+	// can be modified there.
+	const move = (key) => {
+		const old = previous(key);
+		if (!old) {
+			return Promise.resolve();
+		}
+		return route(key).get(key).then(entity => {
+			return entity ? undefined : old.get(key);
+		}).then(moved => {
+			return moved ? route(key).upsert(key, moved).then(() => old.delete(key)) : undefined;
+		});
+	};
+
+	store.modify = (key, modify) => {
+		return move(key).then(() => route(key).modify(key, modify));
+	};
+
+	// A transaction runs in one shard, so its keys must be of one group.
+	store.modifyMany = (keys, modify) => {
+		const shard = route(keys[0]);
+		if (keys.some(key => route(key) !== shard)) {
+			return Promise.reject(new Error('Keys in different shards can\'t be modified together: ' + keys.map(id).join(', ')));
+		}
+		return Promise.all(keys.map(move)).then(() => shard.modifyMany(keys, modify));
+	};
+
+	store.list = (kind, filters) => {
+		const stores = shards.map(shard => shard.store);
+		(previousShards || []).forEach(shard => {
+			if (stores.indexOf(shard.store) == -1) {
+				stores.push(shard.store);
+			}
+		});
+		// A record being moved can briefly be in two shards.
+		return Promise.all(stores.map(store => store.list(kind, filters))).then(results => {
+			const seen = {};
+			return [].concat.apply([], results).filter(entity => {
+				const name = exports.name(entity);
+				if (seen[name]) {
+					return false;
+				}
+				seen[name] = true;
+				return true;
+			});
+		});
+	};
+
+	return store;
+}
+
+// The record of an index holding the names of the kind's records whose
+// property has value.  Values are hashed so any value makes a valid key name.
+function indexKey(kind, property, value) {
+	const digest = crypto.createHash('sha256').update(String(value)).digest('hex');
+	return exports.key(['Index', kind + ':' + property + ':' + digest]);
+}
+
+// Returns a store maintaining secondary indexes over store, so that records
+// can be looked up by a property value with a get of the index and one of
+// the records it names, which unlike a query goes to a single shard.
+// indexes maps each kind to the properties indexed.  A record is added to
+// its new index entries before it is written and removed from its old ones
+// after, and lookups skip records that no longer match, so an interrupted
+// write leaves at worst an entry that is ignored.
+function indexed(store, indexes) {
+	const properties = (key) => indexes[key.path[0]] || [];
+	const result = Object.assign({}, store);
+
+	const change = (kind, property, value, update) => {
+		if (value === undefined || value === null) {
+			return Promise.resolve();
+		}
+		return store.modify(indexKey(kind, property, value), current => {
+			const names = current ? current.Names : [];
+			const updated = update(names);
+			return updated == names ? undefined : {Kind: kind, Property: property, Names: updated};
+		});
+	};
+	const add = (kind, property, value, name) => change(kind, property, value, names => {
+		return names.indexOf(name) == -1 ? names.concat([name]) : names;
+	});
+	const remove = (kind, property, value, name) => change(kind, property, value, names => {
+		return names.indexOf(name) == -1 ? names : names.filter(other => other != name);
+	});
+
+	const changed = (key, before, after) => properties(key).filter(property => {
+		return (before && before[property]) !== (after && after[property]);
+	});
+	const added = (key, before, after) => Promise.all(changed(key, before, after).map(property => {
+		return add(key.path[0], property, after && after[property], key.path[key.path.length - 1]);
+	}));
+	const removed = (key, before, after) => Promise.all(changed(key, before, after).map(property => {
+		return remove(key.path[0], property, before && before[property], key.path[key.path.length - 1]);
+	}));
+
+	['set', 'update', 'upsert'].forEach(operation => {
+		result[operation] = (key, entity) => {
+			if (!properties(key).length) {
+				return store[operation](key, entity);
+			}
+			return store.get(key).then(before => {
+				return added(key, before, entity)
+					.then(() => store[operation](key, entity))
+					.then(() => removed(key, before, entity));
+			});
+		};
+	});
+
+	result.delete = (key) => {
+		if (!properties(key).length) {
+			return store.delete(key);
+		}
+		return store.get(key).then(before => {
+			return store.delete(key).then(() => removed(key, before, undefined));
+		});
+	};
+
+	// The indexes can only be updated once modify has decided what to write,
+	// so entries are added after the write.  The indexed values are copied
+	// before modify, which may change current in place.
+	result.modify = (key, modify) => {
+		if (!properties(key).length) {
+			return store.modify(key, modify);
+		}
+		var before;
+		return store.modify(key, current => {
+			if (current) {
+				before = {};
+				properties(key).forEach(property => {
+					before[property] = current[property];
+				});
+			}
+			return modify(current);
+		}).then(after => {
+			if (!after) {
+				return after;
+			}
+			return added(key, before, after).then(() => removed(key, before, after)).then(() => after);
+		});
+	};
+
+	result.modifyMany = (keys, modify) => {
+		if (keys.some(key => properties(key).length)) {
+			return Promise.reject(new Error('Records of indexed kinds can\'t be modified together'));
+		}
+		return store.modifyMany(keys, modify);
+	};
+
+	result.upsertMany = (records) => {
+		const plain = records.filter(record => !properties(record.key).length);
+		const others = records.filter(record => properties(record.key).length);
+		return Promise.all([store.upsertMany(plain)].concat(others.map(record => {
+			return result.upsert(record.key, record.entity);
+		})));
+	};
+
+	// Resolves to the records of kind whose property equals value, queried
+	// when the property isn't indexed.
+	result.lookup = (kind, property, value) => {
+		if ((indexes[kind] || []).indexOf(property) == -1) {
+			return store.list(kind, [[property, '=', value]]);
+		}
+		return store.get(indexKey(kind, property, value)).then(index => {
+			const names = index ? index.Names : [];
+			return store.getMany(names.map(name => exports.key([kind, name])));
+		}).then(entities => entities.filter(entity => entity && entity[property] === value));
+	};
+
+	// Adds the existing records of kind to the indexes, for records written
+	// before the kind was indexed.  Resolves to the number of records.
+	result.reindex = (kind) => {
+		return store.list(kind).then(entities => {
+			return entities.reduce((done, entity) => {
+				const key = exports.key([kind, exports.name(entity)]);
+				return done.then(() => added(key, undefined, entity));
+			}, Promise.resolve()).then(() => entities.length);
+		});
+	};
+
+	return result;
+}
+
+exports.indexed = indexed;
+
+function openShards(shards, opened) {
+	return shards.map(shard => {
+		opened[shard.name] = opened[shard.name] || exports.open(shard);
+		return {name: shard.name, store: opened[shard.name]};
+	});
+}
+
+// Opens the store configured by { projectId, namespace } options, by a list
+// of shards, each with a stable name and its own options, or an in-memory
+// store if memory is set.  A replica, opened with the same options, keeps a
+// copy of every record in another region as the replication options set.
+exports.open = (options) => {
+	options = options || {};
+	if (options.replica) {
+		const primaryOptions = Object.assign({}, options);
+		delete primaryOptions.replica;
+		delete primaryOptions.replication;
+		return replicated(exports.open(primaryOptions), exports.open(options.replica), options.replication);
+	}
+	if (options.memory) {
+		return memory();
+	}
+	if (options.shards) {
+		const opened = {};
+		const shards = openShards(options.shards, opened);
+		return sharded(shards, options.previousShards ? openShards(options.previousShards, opened) : null);
+	}
+
+	const datastoreOptions = {};
+	if (options.projectId) {
+		datastoreOptions.projectId = options.projectId;
+	}
+	if (options.namespace) {
+		datastoreOptions.namespace = options.namespace;
+	}
+	return cloudDatastore(datastoreOptions);
+};
+
+// The properties of each kind the application looks records up by.
+exports.indexes = {
+	Encounter: ['Owner', 'Patient'],
+};
+
+// Makes the module's operations use store, which must implement get, set,
+// update, upsert, delete, modify, modifyMany and list like the stores
+// returned by open.
+// Stores that don't implement the batch operations getMany and upsertMany
+// get them with one request per record.  The module maintains indexes for
+// lookup over the store.  Each operation is limited by the store timeout,
+// subject to fault injection and recorded in instrumentation.store.
+exports.use = (store) => {
+	store = Object.assign({
+		getMany: (keys) => Promise.all(keys.map(key => store.get(key))),
+		upsertMany: (records) => Promise.all(records.map(record => store.upsert(record.key, record.entity))),
+	}, store);
+	store = indexed(store, exports.indexes);
+	const limited = {};
+	Object.keys(payloads).forEach(operation => {
+		limited[operation] = (...args) => deadline.limit('store', () => faults.inject('store', operation, () => store[operation](...args)));
+	});
+	Object.assign(exports, exports.instrumented(limited, instrumentation.store));
+	exports.reindex = store.reindex;
+};
+
+const migration = settings.datastoreMigration;
+const primary = exports.open(settings.datastore);
+exports.use(migration && migration.dualWrite ? dualWrite(primary, exports.open(migration)) : primary);
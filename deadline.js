@@ -0,0 +1,93 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Deadlines and per-dependency timeouts, so that one slow dependency can't
+// hold a handler past the load balancer's timeout.  Each request gets a
+// deadline settings.timeouts.requestSeconds (25 by default) after it
+// arrived, kept in its async context so that calls made on its behalf see it
+// without it being passed around.  A call to the store, a FHIR server, an
+// OAuth server or Meet is given the dependency's own timeout
+// (storeSeconds, fhirSeconds, oauthSeconds and meetSeconds) or whatever is
+// left of the deadline, whichever is shorter.  Cron jobs and work outside a
+// request only have the dependency timeouts.
+
+const errors = require('./errors.js');
+
+const settings = require('./settings.json');
+
+const {AsyncLocalStorage} = require('async_hooks');
+
+const defaults = {
+  requestSeconds: 25,
+  storeSeconds: 5,
+  fhirSeconds: 10,
+  oauthSeconds: 10,
+  meetSeconds: 10,
+};
+
+function options() {
+  return Object.assign({}, defaults, settings.timeouts);
+}
+
+const context = new AsyncLocalStorage();
+
+// Middleware giving the request a deadline.
+exports.middleware = function(request, response, next) {
+  if (request.path.startsWith('/jobs/')) {
+    next();
+    return;
+  }
+  request.deadline = Date.now() + options().requestSeconds * 1000;
+  context.run({deadline: request.deadline}, next);
+};
+
+// Returns the milliseconds a call to dependency may take, which is zero or
+// less once the request's deadline has passed.
+exports.timeout = function(dependency) {
+  const timeout = options()[dependency + 'Seconds'] * 1000;
+  const current = context.getStore();
+  return current ? Math.min(timeout, current.deadline - Date.now()) : timeout;
+};
+
+// Calls run with the milliseconds the call to dependency may take, for
+// clients that can abandon a request themselves, and resolves to its result.
+// Rejects with a Timeout error if the result takes longer, or at once if the
+// deadline has passed.
+exports.limit = function(dependency, run) {
+  const timeout = exports.timeout(dependency);
+  if (timeout <= 0) {
+    return Promise.reject(new errors.Timeout('The request ran out of time before calling ' + dependency));
+  }
+
+  return new Promise((resolve, reject) => {
+    const timer = setTimeout(() => {
+      reject(new errors.Timeout('The ' + dependency + ' call did not complete within ' + timeout + 'ms'));
+    }, timeout);
+    Promise.resolve().then(() => run(timeout)).then(result => {
+      clearTimeout(timer);
+      resolve(result);
+    }, err => {
+      clearTimeout(timer);
+      reject(err);
+    });
+  });
+};
+
+// Calls run outside the current request's deadline, for background work that
+// only needs the dependency timeouts.
+exports.detached = function(run) {
+  return context.exit(run);
+};
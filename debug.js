@@ -0,0 +1,99 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Runtime diagnostics for latency problems in production, without a rebuild
+// or a restart with --inspect.  Only served when debugEndpoints.enabled is
+// set, to admins:
+//
+//   * vars: memory, CPU and event loop delay since the instance started, and
+//     the handles keeping the event loop busy.
+//   * profile: a CPU profile over some seconds, to open in Chrome DevTools.
+//   * heap: a heap snapshot, also for DevTools.  Taking one pauses the
+//     instance for as long as it takes to write, seconds on a large heap.
+//   * report: a diagnostic report with the JavaScript and native stacks and
+//     libuv handles, the nearest Node has to a goroutine dump.
+
+const settings = require('./settings.json');
+
+const inspector = require('inspector');
+const {monitorEventLoopDelay} = require('perf_hooks');
+
+// The longest CPU profile taken, well inside the idle timeout of the
+// connection waiting for it.
+const maxProfileSeconds = 30;
+
+// Event loop delay is sampled from startup so that vars covers the whole
+// life of the instance.
+const loopDelay = monitorEventLoopDelay({resolution: 20});
+loopDelay.enable();
+
+exports.enabled = function() {
+  return !!(settings.debugEndpoints && settings.debugEndpoints.enabled);
+};
+
+// The histogram's mean is NaN until it has a sample.
+function milliseconds(nanoseconds) {
+  return Math.round(nanoseconds / 1e4) / 100 || 0;
+}
+
+exports.vars = function() {
+  return {
+    uptimeSeconds: Math.round(process.uptime()),
+    versions: process.versions,
+    memory: process.memoryUsage(),
+    resources: process.resourceUsage(),
+    eventLoopDelayMs: {
+      mean: milliseconds(loopDelay.mean),
+      p50: milliseconds(loopDelay.percentile(50)),
+      p99: milliseconds(loopDelay.percentile(99)),
+      max: milliseconds(loopDelay.max),
+    },
+    activeResources: process.getActiveResourcesInfo ? process.getActiveResourcesInfo() : undefined,
+  };
+};
+
+function post(session, method, params) {
+  return new Promise((resolve, reject) => {
+    session.post(method, params || {}, (err, result) => err ? reject(err) : resolve(result));
+  });
+}
+
+// Resolves to the CPU profile of the next seconds, 10 by default.
+exports.profile = function(seconds) {
+  const duration = Math.min(Math.max(seconds || 10, 1), maxProfileSeconds);
+  const session = new inspector.Session();
+  session.connect();
+  return post(session, 'Profiler.enable').then(() => post(session, 'Profiler.start')).then(() => {
+    return new Promise(resolve => setTimeout(resolve, duration * 1000));
+  }).then(() => post(session, 'Profiler.stop')).then(result => result.profile).finally(() => {
+    session.disconnect();
+  });
+};
+
+// Writes a heap snapshot to a writable stream, resolving once written.
+exports.heap = function(stream) {
+  const session = new inspector.Session();
+  session.connect();
+  session.on('HeapProfiler.addHeapSnapshotChunk', message => stream.write(message.params.chunk));
+  return post(session, 'HeapProfiler.takeHeapSnapshot', {reportProgress: false}).finally(() => {
+    session.disconnect();
+    stream.end();
+  });
+};
+
+exports.report = function() {
+  return process.report.getReport();
+};
@@ -0,0 +1,134 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Development mode (npm run dev) runs the whole flow on localhost without any
+// credentials: records are kept in memory, a fake EHR with canned data
+// launches the app from /dev, and meetings are pages of the fake Meet in
+// testing/google.js.
+
+const datastore = require('./datastore.js');
+const fakeFhirServer = require('./testing/fhir-server.js');
+const fakeGoogle = require('./testing/google.js');
+const reload = require('./reload.js');
+const fakeOAuthServer = require('./testing/oauth-server.js');
+const user = require('./user.js');
+
+const settings = require('./settings.json');
+
+function today(hour) {
+  const date = new Date();
+  date.setHours(hour, 0, 0, 0);
+  return date.toISOString();
+}
+
+function resources() {
+  return [
+    {
+      resourceType: 'Patient',
+      id: 'dev-patient',
+      name: [{given: ['Pat'], family: 'Example'}],
+      birthDate: '1980-01-01',
+    },
+    {
+      resourceType: 'Practitioner',
+      id: 'dev-practitioner',
+      name: [{given: ['Dana'], family: 'Doctor', prefix: ['Dr.']}],
+    },
+    {
+      resourceType: 'Appointment',
+      id: 'dev-appointment',
+      status: 'booked',
+      description: 'Development telehealth visit',
+      start: today(9),
+      end: today(10),
+      participant: [
+        {actor: {reference: 'Patient/dev-patient', display: 'Pat Example'}, status: 'accepted'},
+        {actor: {reference: 'Practitioner/dev-practitioner', display: 'Dr. Dana Doctor'}, status: 'accepted'},
+      ],
+    },
+    {
+      resourceType: 'Encounter',
+      id: 'dev-encounter',
+      status: 'planned',
+      class: {system: 'http://terminology.hl7.org/CodeSystem/v3-ActCode', code: 'VR'},
+      subject: {reference: 'Patient/dev-patient'},
+      participant: [{individual: {reference: 'Practitioner/dev-practitioner'}}],
+      appointment: [{reference: 'Appointment/dev-appointment'}],
+    },
+  ];
+}
+
+function launcherPage() {
+  return '<html><head><title>Development EHR</title></head><body>' +
+    '<h1>Development EHR</h1>' +
+    '<p>Launch the canned encounter as the practitioner in one browser profile ' +
+    'and as the patient in another.</p>' +
+    '<p><a href="/dev/launch?user=Practitioner/dev-practitioner">Launch as practitioner</a></p>' +
+    '<p><a href="/dev/launch?user=Patient/dev-patient">Launch as patient</a></p>' +
+    '<p><a href="/dev/launch?user=Patient/dev-patient&idToken=false">Launch as patient without an id_token</a></p>' +
+    '<p><a href="/dev/api">API reference</a></p>' +
+    '</body></html>';
+}
+
+// Switches the application to development mode.  Must be called after the
+// session middleware and before any routes are registered.
+exports.install = function(app, port) {
+  const origin = 'http://localhost:' + port;
+  const base = origin + '/dev/ehr';
+  const oauth = fakeOAuthServer.create(base + '/auth', base);
+
+  datastore.use(datastore.open({memory: true}));
+  settings.fhirServers = [base];
+  reload.keep('fhirServers');
+
+  // Providers are always signed in and meetings are local pages.
+  user.withCredentials = (request, response, callback) => {
+    request.session.id = request.session.id || 'dev-user';
+    callback({});
+  };
+  user.clientFor = () => Promise.resolve({});
+  if (!fakeGoogle.installed) {
+    fakeGoogle.install(app, origin);
+  }
+
+  app.use('/dev/ehr', fakeFhirServer.create(base, oauth, resources()));
+
+  app.get('/dev', (request, response) => {
+    response.send(launcherPage());
+  });
+
+  app.get('/dev/launch', (request, response) => {
+    const launch = oauth.registerLaunch({
+      patient: 'dev-patient',
+      encounter: 'dev-encounter',
+      fhirUser: request.query.user,
+      idToken: request.query.idToken != 'false',
+    });
+    response.redirect('/launch.html?iss=' + encodeURIComponent(base) + '&launch=' + launch);
+  });
+
+  // Swagger UI for /openapi.json.
+  app.get('/dev/api', (request, response) => {
+    response.send('<html><head><title>API</title>' +
+      '<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css"></head><body>' +
+      '<div id="swagger-ui"></div>' +
+      '<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>' +
+      '<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>' +
+      '</body></html>');
+  });
+
+  console.log('Development mode: open ' + origin + '/dev to launch the app');
+};
@@ -0,0 +1,179 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The facilities of health systems with several FHIR base URLs, such as one
+// per hospital or department.  Each facility maps its FHIR endpoints to a
+// tenant and to the Google Workspace domain its providers sign in with:
+//
+//   {"id": "north", "name": "North Clinic", "endpoints": ["https://fhir.example.org/north/"],
+//    "tenant": "example-hospital", "workspaceDomain": "north.example.org"}
+//
+// Facilities are read from settings.directory.facilities and from Facility
+// records in the store, which are seeded from a FHIR server's Endpoint
+// resources with POST /admin/directory/seed.  Stored facilities are reloaded
+// every settings.directory.reloadSeconds (300 by default) and lookups use
+// what was last loaded, like feature flags.
+
+const datastore = require('./datastore.js');
+const errors = require('./errors.js');
+const fhir = require('./fhir.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+var stored = [];
+var loadedAt = 0;
+var loading = null;
+
+function options() {
+  return settings.directory || {};
+}
+
+function reloadMs() {
+  return (options().reloadSeconds || 300) * 1000;
+}
+
+function toFacility(id, entity) {
+  return {
+    id: id,
+    name: entity.Name,
+    endpoints: JSON.parse(entity.Endpoints),
+    tenant: entity.Tenant || undefined,
+    workspaceDomain: entity.WorkspaceDomain || undefined,
+    organization: entity.Organization || undefined,
+  };
+}
+
+// Reloads the stored facilities.  Resolves once loaded.
+exports.reload = function() {
+  if (!loading) {
+    loading = datastore.list('Facility', []).then(entities => {
+      stored = entities.map(entity => toFacility(datastore.name(entity), entity));
+      loadedAt = Date.now();
+    }).catch(err => {
+      console.log('Failed to load the facility directory: ' + err);
+    }).then(() => {
+      loading = null;
+    });
+  }
+  return loading;
+};
+
+function facilities() {
+  if (Date.now() - loadedAt > reloadMs()) {
+    exports.reload();
+  }
+  // Configured facilities take precedence over seeded ones with the same ID.
+  const configured = options().facilities || [];
+  return configured.concat(stored.filter(facility => !configured.some(other => other.id == facility.id)));
+}
+
+// Returns the facility with the longest endpoint the FHIR server URL starts
+// with, or undefined if it isn't in the directory.
+exports.forServer = function(serverUrl) {
+  var found;
+  var length = 0;
+  if (serverUrl) {
+    facilities().forEach(facility => {
+      (facility.endpoints || []).forEach(endpoint => {
+        if (serverUrl.startsWith(endpoint) && endpoint.length > length) {
+          found = facility;
+          length = endpoint.length;
+        }
+      });
+    });
+  }
+  return found;
+};
+
+// Returns the Workspace domain providers launching from the FHIR server sign
+// in with, if the directory has one.
+exports.workspaceDomain = function(serverUrl) {
+  const facility = exports.forServer(serverUrl);
+  return facility && facility.workspaceDomain;
+};
+
+// Resolves to every facility.
+exports.list = function() {
+  return exports.reload().then(() => facilities());
+};
+
+function withSlash(url) {
+  return url.endsWith('/') ? url : url + '/';
+}
+
+// Stores a facility for each Organization managing an active FHIR Endpoint
+// on the server, read with the access token, for the tenant given.  A
+// facility seeded before keeps its Workspace domain.  Resolves to the
+// facilities stored.
+exports.seed = function(serverUrl, accessToken, tenant) {
+  if (settings.fhirServers && !settings.fhirServers.some(prefix => serverUrl.startsWith(prefix))) {
+    return Promise.reject(new errors.UnauthorizedIssuer(serverUrl + ' is not in fhirServers'));
+  }
+  if (tenant && !(settings.tenants || {}).hasOwnProperty(tenant)) {
+    return Promise.reject(new errors.InvalidRequest('There is no tenant ' + tenant));
+  }
+  const context = {serverUrl: serverUrl.replace(/\/+$/, ''), accessToken: accessToken};
+  return fhir.search(context, 'Endpoint', {
+    'status': 'active',
+    'connection-type': 'hl7-fhir-rest',
+    '_include': 'Endpoint:organization',
+  }).then(bundle => {
+    const organizations = fhir.resources(bundle, 'Organization');
+    const byOrganization = {};
+    fhir.resources(bundle, 'Endpoint').filter(endpoint => endpoint.address).forEach(endpoint => {
+      const reference = (endpoint.managingOrganization && endpoint.managingOrganization.reference) ||
+        'Endpoint/' + endpoint.id;
+      const entry = byOrganization[reference] = byOrganization[reference] || {endpoints: [], name: endpoint.name};
+      entry.endpoints.push(withSlash(endpoint.address));
+    });
+
+    return Promise.all(Object.keys(byOrganization).map(reference => {
+      const entry = byOrganization[reference];
+      const organization = organizations.find(organization => 'Organization/' + organization.id == reference);
+      const id = crypto.createHash('sha256').update(context.serverUrl + ' ' + reference).digest('hex').substring(0, 32);
+      return datastore.modify(datastore.key(['Facility', id]), current => {
+        return {
+          Name: (organization && organization.name) || entry.name || reference,
+          Endpoints: JSON.stringify(entry.endpoints),
+          Tenant: tenant || null,
+          WorkspaceDomain: (current && current.WorkspaceDomain) || null,
+          Organization: reference.startsWith('Organization/') ? reference : null,
+          Source: context.serverUrl,
+        };
+      }).then(entity => toFacility(id, entity));
+    }));
+  }).then(seeded => {
+    stored = stored.filter(facility => !seeded.some(other => other.id == facility.id)).concat(seeded);
+    return seeded;
+  });
+};
+
+// Sets the Workspace domain of a stored facility.  Resolves to the facility,
+// or undefined if there is none with the ID.
+exports.setWorkspaceDomain = function(id, domain) {
+  return datastore.modify(datastore.key(['Facility', id]), current => {
+    return current && Object.assign(current, {WorkspaceDomain: domain || null});
+  }).then(entity => {
+    if (!entity) {
+      return undefined;
+    }
+    const facility = toFacility(id, entity);
+    stored = stored.filter(other => other.id != id).concat([facility]);
+    return facility;
+  });
+};
@@ -0,0 +1,140 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const settings = require('./settings.json');
+
+const baseScope = ['openid', 'fhirUser', 'profile', 'launch', 'launch/patient', 'launch/encounter'];
+
+// Vendor differences that the rest of the application needs to know about.
+//
+// fallbackUser describes where to find the launching user when the token
+// response has no id_token.  If resourceType is not set, the value is expected
+// to be a relative reference such as "Practitioner/123".
+//
+// encounterUpdate is either 'put' (replace the whole resource) or 'patch'
+// (JSON Patch, guarded by If-Match).
+//
+// encounterStatuses maps visit events to the Encounter status they move the
+// Encounter to.
+const defaultStatuses = {
+  waiting: 'arrived',
+  joined: 'in-progress',
+  ended: 'finished',
+};
+
+const profiles = {
+  generic: {
+    scope: baseScope,
+    fallbackUser: { field: 'fallback_user' },
+    encounterUpdate: 'put',
+    encounterStatuses: defaultStatuses,
+  },
+  epic: {
+    scope: baseScope,
+    fallbackUser: { field: 'fallback_user' },
+    encounterUpdate: 'put',
+    encounterStatuses: defaultStatuses,
+  },
+  cerner: {
+    scope: baseScope.concat([
+      'online_access',
+      'user/Encounter.read',
+      'user/Encounter.write',
+      'patient/Encounter.read',
+    ]),
+    fallbackUser: { field: 'user', resourceType: 'Practitioner' },
+    encounterUpdate: 'patch',
+    encounterStatuses: defaultStatuses,
+  },
+};
+
+// Hosts known to belong to a vendor, used when the issuer is not listed in
+// settings.ehrIssuers.
+const knownHosts = [
+  { pattern: /(^|\.)cerner\.com$/, profile: 'cerner' },
+  { pattern: /(^|\.)epic\.com$/, profile: 'epic' },
+];
+
+function profileName(iss) {
+  const issuers = settings.ehrIssuers || {};
+  if (iss) {
+    for (const prefix in issuers) {
+      if (iss.startsWith(prefix)) {
+        return issuers[prefix];
+      }
+    }
+
+    var host;
+    try {
+      host = new URL(iss).hostname;
+    } catch (err) {
+      host = '';
+    }
+    for (var i = 0; i < knownHosts.length; i++) {
+      if (knownHosts[i].pattern.test(host)) {
+        return knownHosts[i].profile;
+      }
+    }
+  }
+  return settings.ehr || 'generic';
+}
+
+exports.profileName = profileName;
+
+exports.profile = function(iss) {
+  return profiles[profileName(iss)] || profiles.generic;
+};
+
+// Returns the Encounter status a visit event moves the Encounter to, if any.
+// settings.encounterStatuses can override the mapping per profile.
+exports.encounterStatus = function(iss, event) {
+  const overrides = (settings.encounterStatuses || {})[profileName(iss)] || {};
+  const statuses = Object.assign({}, exports.profile(iss).encounterStatuses, overrides);
+  return statuses[event];
+};
+
+// Returns the method, headers and body to apply the given top-level field
+// changes to an Encounter, or another resource, using the conventions of the
+// issuer's EHR.  Either way the update only applies to the version read.
+exports.encounterUpdate = function(iss, encounter, changes) {
+  const profile = exports.profile(iss);
+  const ifMatch = encounter.meta && encounter.meta.versionId ? 'W/"' + encounter.meta.versionId + '"' : undefined;
+
+  if (profile.encounterUpdate == 'patch') {
+    const headers = { 'Content-Type': 'application/json-patch+json' };
+    if (ifMatch) {
+      headers['If-Match'] = ifMatch;
+    }
+    const ops = Object.keys(changes).map(field => {
+      return {
+        op: encounter[field] === undefined ? 'add' : 'replace',
+        path: '/' + field,
+        value: changes[field],
+      };
+    });
+    return { method: 'PATCH', headers: headers, body: ops };
+  }
+
+  const headers = { 'Content-Type': 'application/fhir+json' };
+  if (ifMatch) {
+    headers['If-Match'] = ifMatch;
+  }
+  return {
+    method: 'PUT',
+    headers: headers,
+    body: Object.assign({}, encounter, changes),
+  };
+};
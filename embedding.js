@@ -0,0 +1,79 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Cookies for clients embedded in an EHR's iframe, such as Epic's embedded
+// browser.  Browsers only send cookies to a frame on another site when they
+// are SameSite=None and Secure, and browsers partitioning third-party storage
+// (CHIPS) only keep them when they are also Partitioned.  The web client
+// sends X-Embedded: 1 when it runs in a frame, and frame navigations say so
+// in Sec-Fetch-Dest, so the cookies of those responses are rewritten with
+// these attributes.  Cookies of top-level pages keep the browser's default
+// of SameSite=Lax.  settings.embedding.partitioned set to false leaves out
+// Partitioned.
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+function options() {
+  return Object.assign({partitioned: true}, settings.embedding);
+}
+
+// Whether a request comes from a client in a frame.
+exports.embedded = function(request) {
+  return request.get('X-Embedded') == '1' || request.get('Sec-Fetch-Dest') == 'iframe';
+};
+
+// Returns a Set-Cookie header value with the attributes of embedded cookies.
+function crossSite(cookie) {
+  const attributes = cookie.split(';').map(attribute => attribute.trim())
+    .filter(attribute => !/^(samesite|secure|partitioned)(=|$)/i.test(attribute));
+  attributes.push('SameSite=None', 'Secure');
+  if (options().partitioned) {
+    attributes.push('Partitioned');
+  }
+  return attributes.join('; ');
+}
+
+// Middleware rewriting the cookies set in responses to embedded clients.
+// Must be used before the middleware setting cookies.
+exports.middleware = function(request, response, next) {
+  if (!exports.embedded(request)) {
+    next();
+    return;
+  }
+
+  const setHeader = response.setHeader;
+  response.setHeader = function(name, value) {
+    if (String(name).toLowerCase() == 'set-cookie') {
+      value = Array.isArray(value) ? value.map(crossSite) : crossSite(String(value));
+    }
+    return setHeader.call(this, name, value);
+  };
+  next();
+};
+
+// Starts a check that the browser keeps the session cookie, resolving to a
+// token that check() compares with the session's.
+exports.startCheck = function(request) {
+  request.session.cookieCheck = crypto.randomBytes(8).toString('hex');
+  return request.session.cookieCheck;
+};
+
+// Whether the session cookie set by startCheck came back.
+exports.check = function(request, token) {
+  return !!token && request.session.cookieCheck === token;
+};
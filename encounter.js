@@ -0,0 +1,90 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const datastore = require('./datastore.js');
+const ehr = require('./ehr.js');
+const fhir = require('./fhir.js');
+const queue = require('./queue.js');
+
+// Encounter statuses in the order a visit moves through them.  Transitions
+// never move an Encounter backwards.
+const order = ['planned', 'arrived', 'triaged', 'in-progress', 'onleave', 'finished'];
+
+exports.events = ['launched', 'waiting', 'joined', 'left', 'ended'];
+
+// Applies changes to the stored meeting for an encounter.  Does nothing if no
+// meeting was created.
+exports.record = function(encounterId, changes) {
+  const key = datastore.key(['Encounter', encounterId]);
+  return datastore.modify(key, entity => entity && Object.assign(entity, changes));
+};
+
+// Marks a visit started once both the provider and the patient are in the
+// meeting.  Resolves to whether this call started it.
+exports.start = function(encounterId) {
+  const key = datastore.key(['Encounter', encounterId]);
+  return datastore.modify(key, entity => {
+    if (!entity || !entity.ProviderJoined || !entity.PatientInMeeting || entity.Started) {
+      return undefined;
+    }
+    return Object.assign(entity, {Started: new Date()});
+  }).then(entity => !!entity);
+};
+
+// Marks an Encounter cancelled unless it already finished.  Resolves to
+// whether it was changed.
+exports.cancel = function(context, encounterId) {
+  return fhir.update(context, 'Encounter', encounterId, encounter => {
+    if (encounter.status == 'finished' || encounter.status == 'cancelled') {
+      return undefined;
+    }
+    return { status: 'cancelled' };
+  }).then(changes => !!changes);
+};
+
+// Writes the Encounter status for a visit event back to the FHIR server.
+// Resolves to the new status, or undefined if the Encounter was left alone.
+exports.transition = function(context, encounterId, event) {
+  const status = ehr.encounterStatus(context.serverUrl, event);
+  if (!status) {
+    return Promise.resolve(undefined);
+  }
+
+  return fhir.update(context, 'Encounter', encounterId, encounter => {
+    const current = order.indexOf(encounter.status);
+    if (current == -1 || current >= order.indexOf(status)) {
+      return undefined;
+    }
+    return { status: status };
+  }).then(changes => changes && status);
+};
+
+// Stores the status a visit event moves the Encounter to.  Resolves to the new
+// status, or undefined if the Encounter was left alone.
+function update(payload, context) {
+  return exports.transition(context, payload.encounterId, payload.event).then(status => {
+    return status && exports.record(payload.encounterId, {Status: status}).then(() => status);
+  });
+}
+
+queue.handle('encounter-status', update);
+
+// Moves the Encounter status for a visit event, queued when the queue is
+// enabled.  Resolves to the new status, or undefined if it was queued or the
+// Encounter was left alone.
+exports.update = function(context, encounterId, event) {
+  return queue.enqueue('encounter-status', {encounterId: encounterId, event: event}, context);
+};
@@ -0,0 +1,97 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Environment profiles let one build serve development, staging and
+// production.  settings.environments maps a profile name to the settings that
+// differ in that environment, typically oauth2.redirectUri, fhirClientId and
+// fhirServers.  The profile named by --environment=<name> or the
+// MEET_ENVIRONMENT variable is merged over settings.json at startup, so this
+// module must be required before any other that reads settings.
+
+const settings = require('./settings.json');
+
+function selected() {
+  const arg = process.argv.find(arg => arg.startsWith('--environment='));
+  return arg ? arg.substring('--environment='.length) : process.env.MEET_ENVIRONMENT;
+}
+
+function isObject(value) {
+  return value && typeof value == 'object' && !Array.isArray(value);
+}
+
+// Objects are merged key by key; arrays and other values are replaced.
+function merge(target, source) {
+  Object.keys(source).forEach(key => {
+    if (isObject(source[key]) && isObject(target[key])) {
+      merge(target[key], source[key]);
+    } else {
+      target[key] = source[key];
+    }
+  });
+}
+
+// A production profile refuses development mode, fault injection, the fake
+// Google sign-in and Meet and insecure redirects, so a misconfigured
+// deployment fails at startup rather than serving launches.
+function check(name, profile, values) {
+  if (!profile.production) {
+    return;
+  }
+  if (process.argv.indexOf('--dev') != -1) {
+    throw new Error('Environment ' + name + ' cannot run in development mode');
+  }
+  if (values.faultInjection && values.faultInjection.enabled) {
+    throw new Error('Environment ' + name + ' cannot inject faults');
+  }
+  if (values.mockGoogle && values.mockGoogle.enabled) {
+    throw new Error('Environment ' + name + ' cannot use the fake Google sign-in and Meet');
+  }
+  const redirectUri = values.oauth2 && values.oauth2.redirectUri;
+  if (!redirectUri || !redirectUri.startsWith('https://')) {
+    throw new Error('Environment ' + name + ' requires an https oauth2.redirectUri');
+  }
+  (values.fhirServers || []).forEach(server => {
+    if (!server.startsWith('https://')) {
+      throw new Error('Environment ' + name + ' allows an insecure FHIR server ' + server);
+    }
+  });
+}
+
+exports.name = selected() || null;
+exports.production = false;
+
+// Merges the selected profile over values, the settings as read from
+// settings.json, and checks the result.  Returns the profile, if any.
+exports.apply = function(values) {
+  if (!exports.name) {
+    return undefined;
+  }
+  const profile = (values.environments || {})[exports.name];
+  if (!profile) {
+    throw new Error('Unknown environment ' + exports.name + ', expected one of ' +
+      Object.keys(values.environments || {}).join(', '));
+  }
+  const overrides = Object.assign({}, profile);
+  delete overrides.production;
+  merge(values, overrides);
+  check(exports.name, profile, values);
+  return profile;
+};
+
+if (exports.name) {
+  exports.production = !!exports.apply(settings).production;
+  console.log('Environment ' + exports.name);
+}
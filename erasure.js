@@ -0,0 +1,145 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Erasure of the data held about a patient, for right-to-erasure requests.
+// Stored records are keyed by encounter rather than by patient, so the
+// request names the patient and the encounters of theirs to erase, as found
+// on the EHR.  For each encounter the meeting record, consent, verification
+// attempts, survey, invitations and handoff codes are deleted and the
+// encounter is removed from its group visit, and the patient's and
+// encounters' resources are dropped from the FHIR cache.  Audit records are kept, since
+// the audit log is itself a compliance record and can't be changed without
+// breaking its chain, and are counted in the report instead.  Patients have
+// no stored sessions and analytics hold no patient identifiers.  Requests
+// covered by a legal hold are refused.
+//
+// The report is signed as a JWS (HS256) under settings.erasure.signingKey, a
+// base64 encoded key, or else a key derived from the session cookie secret.
+
+const datastore = require('./datastore.js');
+const fhirCache = require('./fhircache.js');
+const legalhold = require('./legalhold.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+function signingKey() {
+  const configured = settings.erasure && settings.erasure.signingKey;
+  if (configured) {
+    return Buffer.from(configured, 'base64');
+  }
+  return Buffer.from(crypto.hkdfSync('sha256', settings.sessionCookieSecret, '', 'meet-on-fhir erasure report', 32));
+}
+
+function base64url(buffer) {
+  return buffer.toString('base64').replace(/=+$/, '').replace(/\+/g, '-').replace(/\//g, '_');
+}
+
+exports.sign = function(report) {
+  const header = base64url(Buffer.from(JSON.stringify({alg: 'HS256', typ: 'JWT'})));
+  const payload = base64url(Buffer.from(JSON.stringify(report)));
+  const signature = crypto.createHmac('sha256', signingKey()).update(header + '.' + payload).digest();
+  return header + '.' + payload + '.' + base64url(signature);
+};
+
+// Deletes the keys unless dryRun is set, resolving to how many there were.
+function remove(keys, dryRun) {
+  return (dryRun ? Promise.resolve() : Promise.all(keys.map(key => datastore.delete(key)))).then(() => keys.length);
+}
+
+function byKey(kind, encounterIds) {
+  return datastore.getMany(encounterIds.map(id => datastore.key([kind, id]))).then(entities => {
+    return encounterIds.filter((id, i) => entities[i]).map(id => datastore.key([kind, id]));
+  });
+}
+
+function byEncounter(kind, encounterIds) {
+  return Promise.all(encounterIds.map(id => datastore.list(kind, [['Encounter', '=', id]]))).then(results => {
+    return [].concat.apply([], results).map(entity => datastore.key([kind, datastore.name(entity)]));
+  });
+}
+
+// Removes the encounters from the group visits they were part of, deleting
+// groups left empty.
+function leaveGroups(encounterIds, dryRun) {
+  return datastore.getMany(encounterIds.map(id => datastore.key(['Encounter', id]))).then(entities => {
+    const groups = new Set(entities.filter(entity => entity && entity.Group).map(entity => entity.Group));
+    if (dryRun) {
+      return groups.size;
+    }
+    return Promise.all(Array.from(groups).map(id => {
+      const key = datastore.key(['Group', id]);
+      return datastore.modify(key, group => group && Object.assign(group, {
+        Encounters: group.Encounters.filter(encounterId => encounterIds.indexOf(encounterId) == -1),
+      })).then(group => group && group.Encounters.length == 0 && datastore.delete(key));
+    })).then(() => groups.size);
+  });
+}
+
+// The patient's ID, from a reference such as Patient/123 or an absolute URL
+// ending in one.
+function patientId(patient) {
+  const match = /(?:^|\/)Patient\/([^\/]+)$/.exec(patient);
+  return match ? match[1] : patient;
+}
+
+function auditRecords(encounterIds) {
+  return Promise.all(encounterIds.map(id => datastore.list('Audit', [['EncounterId', '=', id]])))
+    .then(results => results.reduce((count, records) => count + records.length, 0));
+}
+
+// Erases the data held about a patient's encounters, or with dryRun only
+// counts it.  Resolves to the signed report.
+exports.erase = function(patient, encounterIds, dryRun) {
+  const report = {
+    id: crypto.randomBytes(16).toString('hex'),
+    time: new Date().toISOString(),
+    patient: patient,
+    encounterIds: encounterIds,
+    dryRun: !!dryRun,
+  };
+  // Groups are left before the meeting records naming them are deleted.
+  return legalhold.check(patient, encounterIds).then(() => leaveGroups(encounterIds, dryRun)).then(groups => {
+    return Promise.all([
+      byKey('Encounter', encounterIds),
+      byKey('Consent', encounterIds),
+      byKey('Verification', encounterIds),
+      byEncounter('Survey', encounterIds),
+      byEncounter('Invitation', encounterIds),
+      byEncounter('Handoff', encounterIds),
+      fhirCache.keys('Patient', [patientId(patient)]),
+      fhirCache.keys('Encounter', encounterIds),
+    ]).then(keys => Promise.all(keys.map(keys => remove(keys, dryRun)))).then(counts => {
+      report.erased = {
+        meetings: counts[0],
+        consents: counts[1],
+        verifications: counts[2],
+        surveys: counts[3],
+        invitations: counts[4],
+        handoffCodes: counts[5],
+        cachedPatients: counts[6],
+        cachedEncounters: counts[7],
+        groupMemberships: groups,
+      };
+      return auditRecords(encounterIds);
+    });
+  }).then(audited => {
+    report.retained = {auditRecords: audited};
+    report.notHeld = ['sessions', 'analytics'];
+    return {report: report, signature: exports.sign(report)};
+  });
+};
@@ -0,0 +1,131 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Errors returned to clients as RFC 7807 problem details.  The code of each
+// error is stable so that the web client can branch on it.
+
+class ProblemError extends Error {
+  constructor(code, status, title, detail) {
+    super(detail || title);
+    this.code = code;
+    this.status = status;
+    this.title = title;
+    this.detail = detail;
+  }
+}
+
+function define(code, status, title) {
+  return class extends ProblemError {
+    constructor(detail) {
+      super(code, status, title, detail);
+    }
+  };
+}
+
+exports.ProblemError = ProblemError;
+
+exports.InvalidRequest = define('invalid-request', 400, 'The request is invalid');
+exports.MissingFhirContext = define('missing-fhir-context', 401, 'The request has no FHIR server or access token');
+exports.NotSignedIn = define('not-signed-in', 401, 'No provider is signed in');
+exports.TokenRevoked = define('token-revoked', 401, 'The EHR access token is no longer active');
+exports.Forbidden = define('forbidden', 403, 'The request is not authorized');
+exports.ConsentRequired = define('consent-required', 403, 'The patient has not consented to the visit');
+exports.VerificationRequired = define('verification-required', 403, "The patient's identity has not been verified");
+exports.VerificationFailed = define('verification-failed', 403, "The answer does not match the patient's record");
+exports.NotOnCareTeam = define('not-on-care-team', 403, 'The practitioner does not take part in the visit');
+exports.UnauthorizedIssuer = define('unauthorized-issuer', 403, 'The FHIR server is not allowed');
+exports.InsufficientScope = define('insufficient-scope', 403, 'The EHR did not grant the scopes this needs');
+exports.TokenExchangeFailed = define('token-exchange-failed', 403, 'The authorization code could not be exchanged for a token');
+exports.NotFound = define('not-found', 404, 'The resource does not exist');
+exports.Replayed = define('replayed', 409, 'The launch or sign-in was already used');
+exports.LegalHold = define('legal-hold', 409, 'The records are under a legal hold');
+exports.InvalidLaunchContext = define('launch-mismatch', 409, 'The launch context does not match the EHR records');
+exports.CalendarConflict = define('calendar-conflict', 409, 'The provider is busy at the time of the visit');
+exports.QueueClaimed = define('claimed', 409, 'Another clinician has claimed the patient');
+exports.IdempotencyConflict = define('idempotency-conflict', 409, 'The Idempotency-Key cannot be used for this request');
+exports.PayloadTooLarge = define('payload-too-large', 413, 'The request body is too large');
+exports.UnsupportedMediaType = define('unsupported-type', 415, 'The request body is of the wrong type');
+exports.InvalidResource = define('invalid-resource', 422, 'The resource does not meet its FHIR profile');
+exports.Expired = define('expired', 410, 'The visit has ended');
+exports.Locked = define('locked', 429, 'Too many attempts');
+exports.RateLimited = define('rate-limited', 429, 'Too many requests');
+exports.SessionQuotaExceeded = define('session-quota', 429, 'The tenant has too many active sessions');
+exports.FhirRequestFailed = define('fhir-request-failed', 502, 'The FHIR server request failed');
+exports.DelegationFailed = define('delegation-failed', 502, 'The EHR did not issue a token for the service');
+exports.MeetUnavailable = define('meet-unavailable', 502, 'The meeting could not be created');
+exports.EhrUnavailable = define('ehr-unavailable', 503, 'The EHR is not responding');
+exports.Overloaded = define('overloaded', 503, 'The server is overloaded');
+exports.StoreUnavailable = define('store-unavailable', 503, 'The datastore is unavailable');
+exports.Timeout = define('timeout', 504, 'A dependency did not respond in time');
+exports.SessionTooLarge = define('session-too-large', 500, 'The session is too large to store');
+exports.Internal = define('internal', 500, 'An unexpected error occurred');
+
+// The problems of the body parsers' errors, by their type.
+const bodyErrors = {
+  'entity.too.large': () => new exports.PayloadTooLarge(),
+  'entity.parse.failed': () => new exports.InvalidRequest('The body is not valid JSON'),
+  'encoding.unsupported': () => new exports.UnsupportedMediaType('The body has an unsupported encoding'),
+  'charset.unsupported': () => new exports.UnsupportedMediaType('The body has an unsupported charset'),
+};
+
+// Classifies errors thrown by dependencies.  FHIR requests fail with a
+// response, datastore requests with a numeric gRPC status and the body
+// parsers with a type.
+function classify(err) {
+  if (err instanceof ProblemError) {
+    return err;
+  }
+  if (err && bodyErrors[err.type]) {
+    return bodyErrors[err.type]();
+  }
+  if (err && err.response && err.config) {
+    return new exports.FhirRequestFailed('The FHIR server responded with status ' + err.response.status);
+  }
+  if (err && typeof err.code == 'number') {
+    return new exports.StoreUnavailable();
+  }
+  return new exports.Internal();
+}
+
+exports.classify = classify;
+
+// Problems with a retryAfter, in seconds, send it as the Retry-After header.
+exports.send = function(response, err) {
+  const problem = classify(err);
+  if (problem.retryAfter) {
+    response.set('Retry-After', String(problem.retryAfter));
+  }
+  response.status(problem.status).type('application/problem+json').send({
+    type: 'urn:meet-on-fhir:problem:' + problem.code,
+    code: problem.code,
+    title: problem.title,
+    status: problem.status,
+    detail: problem.detail,
+    errors: problem.errors,
+  });
+};
+
+// Express error handler rendering errors passed to next.
+exports.middleware = function(err, request, response, next) {
+  if (response.headersSent) {
+    next(err);
+    return;
+  }
+  if (!(err instanceof ProblemError)) {
+    console.log(err);
+  }
+  exports.send(response, err);
+};
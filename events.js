@@ -0,0 +1,80 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Lifecycle events for downstream systems:
+//
+//   session.created, session.destroyed, session.expired, session.revoked
+//     A provider signed in, signed out, had their credentials purged or had
+//     their oldest session revoked for exceeding the session limit.
+//   visit.created, visit.joined, visit.started, visit.ended, visit.expired
+//     A meeting was created for an encounter, the patient retrieved its link,
+//     both the provider and the patient were in the meeting, the visit was
+//     ended or the meeting was closed by the cleanup job.
+//   visit.cancelled
+//     The visit was cancelled and its meeting closed.
+//   visit.noshow
+//     The patient never joined; rebook says whether to rebook them.
+//   visit.rescheduled
+//     The visit's Appointment moved; carries the new start and whether the
+//     meeting link changed.
+//   visit.queued, visit.claimed
+//     The patient entered a front desk queue, or a clinician claimed them;
+//     carries the queue.
+//
+// Events carry the encounter ID for visits but never session IDs, since those
+// identify stored credentials.  Visit events are also sent to webhooks, and
+// every event to the de-identified insights export.
+
+const insights = require('./insights.js');
+const webhooks = require('./webhooks.js');
+
+const settings = require('./settings.json');
+
+const {PubSub} = require('@google-cloud/pubsub');
+
+// The default publisher sends events to settings.events.pubsubTopic.  Other
+// transports (such as Kafka) can be used by passing an object with a
+// publish(event) method returning a promise to setPublisher.
+function pubsubPublisher(topicName) {
+  const topic = new PubSub().topic(topicName);
+  return {
+    publish: (event) => {
+      return topic.publish(Buffer.from(JSON.stringify(event)), {type: event.type});
+    },
+  };
+}
+
+var publisher = settings.events && settings.events.pubsubTopic ?
+  pubsubPublisher(settings.events.pubsubTopic) : null;
+
+exports.setPublisher = function(replacement) {
+  publisher = replacement;
+};
+
+// Publishes an event.  Failures are logged rather than returned so that an
+// unavailable topic doesn't break visits.
+exports.publish = function(type, fields) {
+  const event = Object.assign({type: type, time: new Date().toISOString()}, fields);
+  webhooks.send(event);
+  insights.emit(event);
+  if (!publisher) {
+    return Promise.resolve();
+  }
+
+  return publisher.publish(event).catch(err => {
+    console.log('Failed to publish ' + type + ' event: ' + err);
+  });
+};
@@ -0,0 +1,85 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Exports telehealth usage for a period.
+//
+// Usage: node export.js [--format=ndjson|csv|measure] [--since=YYYY-MM-DD]
+//                       [--until=YYYY-MM-DD] [--out=-|gs://bucket/object|bq://dataset.table]
+//                       [--environment=name]
+//
+// The period defaults to the previous day and the report is written to
+// standard output.  BigQuery destinations always receive one row per visit.
+
+require('./environment.js');
+
+const report = require('./report.js');
+
+const {BigQuery} = require('@google-cloud/bigquery');
+const {Storage} = require('@google-cloud/storage');
+
+function parseArgs(argv) {
+  const args = {};
+  argv.forEach(arg => {
+    const match = /^--([^=]+)=(.*)$/.exec(arg);
+    if (match) {
+      args[match[1]] = match[2];
+    }
+  });
+  return args;
+}
+
+function render(format, visits, since, until) {
+  switch (format) {
+    case 'csv':
+      return report.csv(visits);
+    case 'measure':
+      return JSON.stringify(report.measureReport(visits, since, until), null, 2) + '\n';
+    default:
+      return report.ndjson(visits);
+  }
+}
+
+function write(out, format, visits, since, until) {
+  if (out.startsWith('bq://')) {
+    const table = out.substring('bq://'.length).split('.');
+    if (visits.length == 0) {
+      return Promise.resolve();
+    }
+    return new BigQuery().dataset(table[0]).table(table[1]).insert(visits);
+  }
+
+  const content = render(format, visits, since, until);
+  if (out.startsWith('gs://')) {
+    const path = out.substring('gs://'.length);
+    const slash = path.indexOf('/');
+    const file = new Storage().bucket(path.substring(0, slash)).file(path.substring(slash + 1));
+    return file.save(content);
+  }
+
+  process.stdout.write(content);
+  return Promise.resolve();
+}
+
+const args = parseArgs(process.argv.slice(2));
+const until = args.until ? new Date(args.until) : new Date(new Date().setUTCHours(0, 0, 0, 0));
+const since = args.since ? new Date(args.since) : new Date(until.getTime() - 24 * 60 * 60 * 1000);
+
+report.visits(since, until).then(visits => {
+  return write(args.out || '-', args.format || 'ndjson', visits, since, until);
+}).catch(err => {
+  console.log(err);
+  process.exitCode = 1;
+});
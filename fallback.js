@@ -0,0 +1,147 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Fallback meetings for when Meet can't create one, so that visits can still
+// happen during a Google API incident.  settings.meetFallback.mode is either
+// 'rooms', to hand out one of the standing meeting links in
+// settings.meetFallback.rooms that no open visit is using, or 'deferred', to
+// save the visit without a link and keep trying to create its meeting every
+// minute.  Either way the visit is marked Degraded with the mode.
+
+const analytics = require('./analytics.js');
+const audit = require('./audit.js');
+const datastore = require('./datastore.js');
+const errors = require('./errors.js');
+const user = require('./user.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+const ROOMS = 'rooms';
+const DEFERRED = 'deferred';
+
+function options() {
+  return settings.meetFallback || {};
+}
+
+exports.enabled = function() {
+  return options().mode == ROOMS || options().mode == DEFERRED;
+};
+
+// How long a room stays assigned to a visit that was never closed.
+function roomMaxAge() {
+  const hours = (settings.cleanup && settings.cleanup.meetingMaxAgeHours) || 6;
+  return hours * 60 * 60 * 1000;
+}
+
+function roomKey(url) {
+  return datastore.key(['Room', crypto.createHash('sha256').update(url).digest('hex')]);
+}
+
+// Resolves to whether the visit a room was assigned to no longer needs it.
+function released(room) {
+  if (!room || !room.Encounter || Date.now() - room.Claimed.getTime() > roomMaxAge()) {
+    return Promise.resolve(true);
+  }
+  return datastore.get(datastore.key(['Encounter', room.Encounter])).then(entity => {
+    return !entity || !!entity.Closed || entity.Room != room.Url;
+  });
+}
+
+// Resolves to the first room that could be assigned to the encounter, or
+// undefined if every room is in use.  A room is claimed only if the visit
+// found holding it still does, so two visits never get the same room.
+function claimRoom(encounterId, rooms) {
+  if (rooms.length == 0) {
+    return Promise.resolve(undefined);
+  }
+  const url = rooms[0];
+  const key = roomKey(url);
+  return datastore.get(key).then(room => {
+    return released(room).then(free => {
+      if (!free) {
+        return undefined;
+      }
+      const holder = room && room.Encounter;
+      return datastore.modify(key, current => {
+        if ((current && current.Encounter) != holder) {
+          return undefined;
+        }
+        return {Url: url, Encounter: encounterId, Claimed: new Date()};
+      });
+    });
+  }).then(claimed => claimed ? url : claimRoom(encounterId, rooms.slice(1)));
+}
+
+// Resolves to the meeting fields of a degraded visit for an encounter whose
+// meeting couldn't be created because of err.  Rejects with err if there is
+// no fallback, err doesn't mean Meet is unavailable or no room is free.
+exports.meeting = function(encounterId, owner, err) {
+  const unavailable = err instanceof errors.MeetUnavailable || err instanceof errors.Timeout;
+  if (!exports.enabled() || !unavailable) {
+    return Promise.reject(err);
+  }
+
+  const mode = options().mode;
+  const fields = mode == ROOMS ?
+    claimRoom(encounterId, options().rooms || []).then(url => url && {Url: url, Room: url}) :
+    Promise.resolve({});
+  return fields.then(fields => {
+    if (!fields) {
+      throw err;
+    }
+    analytics.record('meeting-degraded/' + mode);
+    audit.record('meeting-degraded', 'system', encounterId);
+    return Object.assign(fields, {Owner: owner, Degraded: mode});
+  });
+};
+
+// Tries again to create the meetings of deferred visits with create, which
+// is given the owner's client, encounter and owner and resolves to the
+// meeting fields.
+exports.retry = function(create) {
+  if (options().mode != DEFERRED) {
+    return Promise.resolve({waiting: 0, created: 0});
+  }
+
+  return datastore.list('Encounter', [['Degraded', '=', DEFERRED]]).then(entities => {
+    const waiting = entities.filter(entity => !entity.Url && !entity.Closed);
+    var created = 0;
+    return Promise.all(waiting.map(entity => {
+      const encounterId = datastore.name(entity);
+      return user.clientFor(entity.Owner).then(client => {
+        if (!client) {
+          return;
+        }
+        return create(client, encounterId, entity.Owner).then(fields => {
+          const key = datastore.key(['Encounter', encounterId]);
+          return datastore.modify(key, current => {
+            if (!current || current.Url || current.Closed) {
+              return undefined;
+            }
+            return Object.assign(current, fields, {Recovered: new Date()});
+          }).then(saved => {
+            if (saved) {
+              created++;
+              audit.record('meeting-created', 'system', encounterId);
+            }
+          });
+        }, err => console.log('Meeting for encounter ' + encounterId + ' is still deferred: ' + err));
+      });
+    })).then(() => ({waiting: waiting.length, created: created}));
+  });
+};
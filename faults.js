@@ -0,0 +1,126 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Fault injection for resilience testing outside production.  Calls to the
+// store, FHIR servers and Meet can be delayed or failed, so the timeout,
+// retry and circuit breaker paths can be exercised against a running server.
+// Faults come from settings.faultInjection.rules, each applying to a share of
+// calls:
+//
+//   {"target": "fhir", "status": 503, "percent": 20}
+//   {"target": "store", "operation": "modify", "error": "aborted", "latencyMs": 200}
+//
+// and, for one request, from its X-Fault-Injection header, such as
+// "fhir=503, store.get=latency:2000, meet=error".  Injected errors look like
+// those of the dependency: gRPC statuses for the store and HTTP responses
+// for FHIR and Meet.
+
+const environment = require('./environment.js');
+
+const settings = require('./settings.json');
+
+const {AsyncLocalStorage} = require('async_hooks');
+
+const context = new AsyncLocalStorage();
+
+// gRPC statuses of the store errors that can be injected.
+const storeErrors = {
+  'deadline-exceeded': 4,
+  'aborted': 10,
+  'unavailable': 14,
+};
+
+function options() {
+  return settings.faultInjection || {};
+}
+
+// Fault injection is never on in a production environment.
+exports.enabled = function() {
+  return !!options().enabled && !environment.production;
+};
+
+// Parses a header such as "fhir=503, store.get=latency:2000+aborted" into
+// rules.  Faults that can't be parsed are ignored.
+function parse(header) {
+  return header.split(',').map(part => part.trim()).filter(part => part.includes('=')).map(part => {
+    const target = part.substring(0, part.indexOf('=')).split('.');
+    const rule = {target: target[0], operation: target[1]};
+    part.substring(part.indexOf('=') + 1).split('+').forEach(fault => {
+      if (fault.startsWith('latency:')) {
+        rule.latencyMs = parseInt(fault.substring('latency:'.length), 10) || 0;
+      } else if (/^\d{3}$/.test(fault)) {
+        rule.status = parseInt(fault, 10);
+      } else if (fault) {
+        rule.error = fault;
+      }
+    });
+    return rule;
+  });
+}
+
+// Middleware applying the faults of the request's X-Fault-Injection header
+// to the calls made on its behalf.
+exports.middleware = function(request, response, next) {
+  const header = exports.enabled() && request.get('X-Fault-Injection');
+  if (!header) {
+    next();
+    return;
+  }
+  context.run({rules: parse(header)}, next);
+};
+
+function error(target, rule) {
+  if (target == 'store') {
+    const err = new Error('Injected store fault: ' + (rule.error || 'unavailable'));
+    err.code = storeErrors[rule.error] || rule.status || storeErrors.unavailable;
+    return err;
+  }
+  const status = rule.status || 503;
+  const err = new Error('Injected ' + target + ' fault: status ' + status);
+  err.response = {status: status, data: {}, headers: {}};
+  err.config = {};
+  return err;
+}
+
+function applies(rule, target, operation) {
+  return rule.target == target && (!rule.operation || rule.operation == operation) &&
+    (rule.percent === undefined || Math.random() * 100 < rule.percent);
+}
+
+// Calls run, the operation of a call to target ('store', 'fhir' or 'meet'),
+// after the latency of the faults that apply to it, and rejects with their
+// error instead if they have one.
+exports.inject = function(target, operation, run) {
+  if (!exports.enabled()) {
+    return run();
+  }
+  const current = context.getStore();
+  const rules = (options().rules || []).concat(current ? current.rules : [])
+    .filter(rule => applies(rule, target, operation));
+  if (!rules.length) {
+    return run();
+  }
+
+  const latency = Math.max.apply(null, rules.map(rule => rule.latencyMs || 0));
+  const failure = rules.find(rule => rule.status || rule.error);
+  console.log('Injecting ' + (failure ? 'a failure' : 'latency') + ' into ' + target + ' ' + operation);
+  return new Promise(resolve => setTimeout(resolve, latency)).then(() => {
+    if (failure) {
+      throw error(target, failure);
+    }
+    return run();
+  });
+};
@@ -0,0 +1,257 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const breaker = require('./breaker.js');
+const capabilities = require('./capabilities.js');
+const deadline = require('./deadline.js');
+const ehr = require('./ehr.js');
+const errors = require('./errors.js');
+const faults = require('./faults.js');
+const fhirCache = require('./fhircache.js');
+const profiles = require('./profiles.js');
+const provenance = require('./provenance.js');
+const transport = require('./transport.js');
+
+const settings = require('./settings.json');
+
+const gaxios = require('gaxios');
+
+// Whether serverUrl is in settings.fhirServers, when that is set.
+exports.allowed = function(serverUrl) {
+  return !settings.fhirServers || settings.fhirServers.some(prefix => serverUrl.startsWith(prefix));
+};
+
+// Returns the FHIR server, access token and granted scopes the browser
+// obtained during the SMART launch, passed as the X-FHIR-Server,
+// Authorization and X-FHIR-Scope headers, and the agent Provenance names.
+exports.context = function(request) {
+  const serverUrl = request.get('X-FHIR-Server');
+  const authorization = request.get('Authorization') || '';
+  if (!serverUrl || !authorization.startsWith('Bearer ')) {
+    throw new errors.MissingFhirContext();
+  }
+
+  if (!exports.allowed(serverUrl)) {
+    throw new errors.UnauthorizedIssuer(serverUrl + ' is not in fhirServers');
+  }
+
+  return {
+    serverUrl: serverUrl.replace(/\/+$/, ''),
+    accessToken: authorization.substring('Bearer '.length),
+    scope: request.get('X-FHIR-Scope'),
+    agent: provenance.agent(request),
+  };
+};
+
+// Middleware setting request.fhirContext and request.capabilities.
+exports.required = function(request, response, next) {
+  try {
+    request.fhirContext = exports.context(request);
+    request.capabilities = capabilities.fromScope(request.fhirContext.scope);
+  } catch (err) {
+    next(err);
+    return;
+  }
+  next();
+};
+
+// Writes covered by provenance are followed by their Provenance.
+exports.request = function(context, options) {
+  const result = send(context, options);
+  if (!provenance.covers(options)) {
+    return result;
+  }
+  return result.then(written => {
+    const resource = provenance.resource(options, written, context.agent);
+    if (!resource) {
+      console.log('No Provenance for ' + options.method + ' ' + options.url + ': the server returned no ID');
+      return written;
+    }
+    return send(context, {
+      url: 'Provenance',
+      method: 'POST',
+      headers: {'Content-Type': 'application/fhir+json'},
+      data: resource,
+    }).catch(err => {
+      console.log('Failed to write the Provenance of ' + resource.target[0].reference + ': ' + err);
+    }).then(() => written);
+  });
+};
+
+function send(context, options) {
+  const headers = Object.assign({
+    'Accept': 'application/fhir+json',
+    'Authorization': 'Bearer ' + context.accessToken,
+  }, options.headers);
+
+  // Each FHIR server has its own breaker.
+  const server = breaker.get('fhir ' + context.serverUrl, 'fhir');
+  return deadline.limit('fhir', timeout => server.call(() => faults.inject('fhir', options.method || 'GET', () => gaxios.request({
+    url: /^https?:/.test(options.url) ? options.url : context.serverUrl + '/' + options.url,
+    method: options.method || 'GET',
+    params: options.params,
+    headers: headers,
+    data: options.data,
+    timeout: timeout,
+    agent: transport.agent(context.serverUrl),
+  })), () => new errors.EhrUnavailable(), breaker.isOutage)).then(result => result.data, err => {
+    // Writes the EHR rejects as invalid fail with the issues it reported.
+    const outcome = err.response && err.response.data;
+    if (err.response && err.response.status == 422 && outcome && outcome.resourceType == 'OperationOutcome') {
+      const resourceType = /^[A-Z][A-Za-z]+/.exec(options.url);
+      throw profiles.problem(resourceType ? resourceType[0] : 'The resource', profiles.outcomeErrors(outcome));
+    }
+    throw err;
+  });
+}
+
+// Resolves if the resource may be written under profileValidation.
+function enforce(context, resource) {
+  if (!profiles.covers(resource.resourceType)) {
+    return Promise.resolve();
+  }
+  return profiles.enforce(resource, options => exports.request(context, options));
+}
+
+// Resources of the types in fhirCache are read through the cache.
+exports.read = function(context, resourceType, id) {
+  const read = headers => exports.request(context, { url: resourceType + '/' + encodeURIComponent(id), headers: headers });
+  if (fhirCache.covers(resourceType)) {
+    return fhirCache.read(context, resourceType, id, read);
+  }
+  return read();
+};
+
+// How many times an update is tried when the resource keeps changing
+// between reading and writing it.
+const maxUpdateAttempts = 3;
+
+// Reads a resource and writes the top-level field changes change returns
+// for it, or leaves it alone if change returns undefined.  The write only
+// applies to the version read, so an edit made in the EHR meanwhile isn't
+// overwritten: the resource is read and changed again instead.  Resolves to
+// the changes written.
+exports.update = function(context, resourceType, id, change, attempt) {
+  attempt = attempt || 1;
+  return exports.read(context, resourceType, id).then(resource => {
+    const changes = change(resource);
+    if (!changes) {
+      return undefined;
+    }
+    const update = ehr.encounterUpdate(context.serverUrl, resource, changes);
+    return enforce(context, Object.assign({}, resource, changes)).then(() => exports.request(context, {
+      url: resourceType + '/' + encodeURIComponent(id),
+      method: update.method,
+      headers: update.headers,
+      data: update.body,
+    })).then(() => changes, err => {
+      const status = err.response && err.response.status;
+      if ((status == 409 || status == 412) && attempt < maxUpdateAttempts) {
+        return exports.update(context, resourceType, id, change, attempt + 1);
+      }
+      throw err;
+    });
+  });
+};
+
+// Creates a resource unless one matching condition, a search such as
+// identifier=system|value, already exists, so that a create that is retried
+// doesn't make a duplicate.  Resolves to the created or existing resource,
+// which servers may leave out.
+exports.create = function(context, resource, condition) {
+  const headers = {'Content-Type': 'application/fhir+json'};
+  if (condition) {
+    headers['If-None-Exist'] = condition;
+  }
+  return enforce(context, resource).then(() => {
+    return exports.request(context, {url: resource.resourceType, method: 'POST', headers: headers, data: resource});
+  });
+};
+
+// Returns the If-None-Exist condition matching an identifier.
+exports.identifierCondition = function(identifier) {
+  return 'identifier=' + encodeURIComponent(identifier.system + '|' + identifier.value);
+};
+
+function searchOptions() {
+  return settings.fhirSearch || {};
+}
+
+function matches(bundle) {
+  return (bundle.entry || []).filter(entry => !entry.search || entry.search.mode != 'include').length;
+}
+
+function nextLink(bundle) {
+  const link = (bundle.link || []).find(link => link.relation == 'next');
+  return link && link.url;
+}
+
+// Returns the absolute URL of a link if it is on the FHIR server: the same
+// origin, and the server's base path itself (as in HAPI's
+// <base>?_getpages=...) or a path under it.  Returns undefined otherwise.
+function onServer(serverUrl, link) {
+  var base, url;
+  try {
+    base = new URL(serverUrl + '/');
+    url = new URL(link, base);
+  } catch (err) {
+    return undefined;
+  }
+  const path = base.pathname.replace(/\/+$/, '');
+  if (url.origin != base.origin || (url.pathname != path && !url.pathname.startsWith(path + '/'))) {
+    return undefined;
+  }
+  return url.href;
+}
+
+// Returns the searchset Bundle for the search, with the entries of every
+// page.  Next links are followed up to fhirSearch.maxPages pages and
+// fhirSearch.maxResults matches; a search stopped by either keeps the next
+// link of the last page read.  Next links must stay on the FHIR server, since
+// the access token is sent with them.
+exports.search = function(context, resourceType, params) {
+  const maxPages = searchOptions().maxPages || 10;
+  const maxResults = searchOptions().maxResults || 1000;
+  const page = (bundle, pages) => {
+    const link = nextLink(bundle);
+    if (!link) {
+      return bundle;
+    }
+    const next = onServer(context.serverUrl, link);
+    if (!next) {
+      throw new errors.FhirRequestFailed('The next page of the ' + resourceType + ' search is not on the FHIR server');
+    }
+    if (pages >= maxPages || matches(bundle) >= maxResults) {
+      console.log('Stopped reading the ' + resourceType + ' search after ' + pages + ' pages and ' +
+        matches(bundle) + ' results');
+      return bundle;
+    }
+    return exports.request(context, { url: next }).then(following => {
+      return page(Object.assign({}, bundle, {
+        entry: (bundle.entry || []).concat(following.entry || []),
+        link: following.link,
+      }), pages + 1);
+    });
+  };
+  return exports.request(context, { url: resourceType, params: params }).then(bundle => page(bundle, 1));
+};
+
+// Returns the resources in a Bundle, optionally only those of one type.
+exports.resources = function(bundle, resourceType) {
+  return (bundle.entry || [])
+    .map(entry => entry.resource)
+    .filter(resource => resource && (!resourceType || resource.resourceType == resourceType));
+};
@@ -0,0 +1,115 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A store-backed cache of read-mostly FHIR resources, such as the Patient and
+// Practitioners the care team and verification checks read again for each
+// request of a visit.  A resource is served from the cache for the TTL of its
+// type and then revalidated with If-None-Match, so an unchanged resource costs
+// the EHR a 304 rather than a read.  Entries are keyed by access token as
+// well as resource, so a resource is only served to the session that read it.
+// Each entry names its resource's type and ID so that erasure can find them.
+
+const clock = require('./clock.js');
+const datastore = require('./datastore.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+// How long, in milliseconds, an entry is kept after it was last refreshed.
+const maxAge = 24 * 60 * 60 * 1000;
+
+function options() {
+  return settings.fhirCache || {};
+}
+
+// Returns the TTL, in seconds, resources of the type are cached for, or 0
+// if they aren't.
+function ttl(resourceType) {
+  if (!options().enabled) {
+    return 0;
+  }
+  return (options().ttlSeconds || {})[resourceType] || 0;
+}
+
+exports.covers = function(resourceType) {
+  return ttl(resourceType) > 0;
+};
+
+function key(context, resourceType, id) {
+  const hash = crypto.createHash('sha256')
+    .update(context.serverUrl + ' ' + context.accessToken + ' ' + resourceType + '/' + id)
+    .digest('hex');
+  return datastore.key(['FhirCache', hash]);
+}
+
+function remember(key, resource, now, resourceType, id) {
+  return datastore.upsert(key, {
+    ResourceType: resourceType,
+    ResourceId: id,
+    Resource: JSON.stringify(resource),
+    Version: (resource.meta && resource.meta.versionId) || null,
+    Fresh: new Date(now + ttl(resourceType) * 1000),
+    Expires: new Date(now + maxAge),
+  }).catch(err => {
+    console.log('Failed to cache ' + resourceType + '/' + resource.id + ': ' + err);
+  }).then(() => resource);
+}
+
+// Resolves to the resource, from the cache while it's fresh and otherwise
+// from fetch(headers), which reads it from the EHR with the headers given.
+// A store that can't be read is treated as a miss.
+exports.read = function(context, resourceType, id, fetch) {
+  const entryKey = key(context, resourceType, id);
+  return datastore.get(entryKey).catch(err => {
+    console.log('Failed to read the FHIR cache: ' + err);
+    return undefined;
+  }).then(entry => {
+    const now = clock.now();
+    if (entry && entry.Fresh > now) {
+      return JSON.parse(entry.Resource);
+    }
+
+    const headers = {};
+    if (entry && entry.Version) {
+      headers['If-None-Match'] = 'W/"' + entry.Version + '"';
+    }
+    return fetch(headers).then(resource => remember(entryKey, resource, now, resourceType, id), err => {
+      if (entry && entry.Version && err.response && err.response.status == 304) {
+        return remember(entryKey, JSON.parse(entry.Resource), now, resourceType, id);
+      }
+      throw err;
+    });
+  });
+};
+
+// Resolves to the keys of the entries caching the resources of a type with
+// the IDs, for every access token that read them.
+exports.keys = function(resourceType, ids) {
+  return Promise.all(ids.map(id => {
+    return datastore.list('FhirCache', [['ResourceType', '=', resourceType], ['ResourceId', '=', id]]);
+  })).then(results => {
+    return [].concat.apply([], results).map(entity => datastore.key(['FhirCache', datastore.name(entity)]));
+  });
+};
+
+exports.purge = function(now) {
+  return datastore.list('FhirCache', [['Expires', '<', now]]).then(entities => {
+    return Promise.all(entities.map(entity => {
+      return datastore.delete(datastore.key(['FhirCache', datastore.name(entity)]));
+    })).then(() => entities.length);
+  });
+};
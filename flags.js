@@ -0,0 +1,107 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Feature flags.  Each flag can be switched per tenant and rolled out to a
+// percentage of visits, without a redeploy:
+//
+//   {"enabled": true, "percent": 20, "tenants": {"example-hospital": false}}
+//
+// Flags are read from settings.features and from Feature records in the
+// store, which take precedence and are changed with PUT
+// /admin/features/{name}.  Stored flags are reloaded every
+// settings.featureReloadSeconds (60 by default).  A flag that is not defined
+// is on, so flags only ever narrow a feature its own settings enabled.
+
+const datastore = require('./datastore.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+var stored = {};
+var loadedAt = 0;
+var loading = null;
+
+function reloadMs() {
+  return (settings.featureReloadSeconds || 60) * 1000;
+}
+
+// Reloads the stored flags.  Resolves once loaded.
+exports.reload = function() {
+  if (!loading) {
+    loading = datastore.list('Feature', []).then(entities => {
+      const flags = {};
+      entities.forEach(entity => {
+        flags[datastore.name(entity)] = JSON.parse(entity.Flag);
+      });
+      stored = flags;
+      loadedAt = Date.now();
+    }).catch(err => {
+      console.log('Failed to load feature flags: ' + err);
+    }).then(() => {
+      loading = null;
+    });
+  }
+  return loading;
+};
+
+function flag(name) {
+  // Flags are checked synchronously with what was last loaded.
+  if (Date.now() - loadedAt > reloadMs()) {
+    exports.reload();
+  }
+  return Object.assign({}, (settings.features || {})[name], stored[name]);
+}
+
+// Returns the bucket in [0, 100) of a subject in a flag's rollout.
+function bucket(name, subject) {
+  const digest = crypto.createHash('sha256').update(name + ' ' + subject).digest();
+  return digest.readUInt32BE(0) % 100;
+}
+
+// Returns whether a flag is on for a tenant and, for percentage rollouts, a
+// subject such as an encounter ID.
+exports.enabled = function(name, tenant, subject) {
+  const value = flag(name);
+  const tenants = value.tenants || {};
+  if (tenant && tenants.hasOwnProperty(tenant)) {
+    return !!tenants[tenant];
+  }
+  if (value.enabled === false) {
+    return false;
+  }
+  const percent = value.percent === undefined ? 100 : value.percent;
+  return percent >= 100 || bucket(name, subject || tenant || '') < percent;
+};
+
+// Resolves to every defined flag.
+exports.list = function() {
+  return exports.reload().then(() => {
+    const names = Object.keys(Object.assign({}, settings.features, stored));
+    const flags = {};
+    names.forEach(name => {
+      flags[name] = Object.assign({}, (settings.features || {})[name], stored[name]);
+    });
+    return flags;
+  });
+};
+
+// Stores a flag, replacing any stored before.
+exports.set = function(name, value) {
+  return datastore.upsert(datastore.key(['Feature', name]), {Flag: JSON.stringify(value)}).then(() => {
+    stored[name] = value;
+  });
+};
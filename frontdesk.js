@@ -0,0 +1,303 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A virtual front desk: patients wait in a shared queue, such as an urgent
+// care queue, and any on-duty clinician of the queue's pool claims the next
+// one, then creates the visit's meeting as usual.  settings.frontDesk.queues
+// configures each queue:
+//
+//   "urgent-care": {"name": "Urgent care", "tenant": "example-hospital",
+//                   "pool": ["Practitioner/123", "Practitioner/456"]}
+//
+// Each waiting patient is a QueueEntry, named by encounter, that records who
+// claimed it and every assignment since; clinicians go on duty for a queue
+// with a QueueDuty record that lapses after settings.frontDesk.dutyHours.
+
+const clock = require('./clock.js');
+const datastore = require('./datastore.js');
+const errors = require('./errors.js');
+const events = require('./events.js');
+const tenancy = require('./tenancy.js');
+const tenants = require('./tenants.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+const hourMs = 60 * 60 * 1000;
+
+// How long, in milliseconds, entries are kept after the patient joined the
+// queue, for the queue metrics.
+const entryMaxAge = 2 * 24 * hourMs;
+
+function options() {
+  return settings.frontDesk || {};
+}
+
+exports.enabled = function() {
+  return !!options().enabled;
+};
+
+// Resolves to a queue's configuration, rejecting with not-found for queues
+// that don't exist or belong to another tenant.
+function queue(name) {
+  const config = (options().queues || {})[name];
+  const tenant = tenancy.current() || tenants.DEFAULT;
+  if (!config || (config.tenant || tenants.DEFAULT) != tenant) {
+    return Promise.reject(new errors.NotFound('No queue ' + name));
+  }
+  return Promise.resolve(config);
+}
+
+// Resolves to a queue's configuration if the practitioner is in its pool.
+function pool(name, practitioner) {
+  return queue(name).then(config => {
+    if ((config.pool || []).indexOf(practitioner) == -1) {
+      throw new errors.Forbidden(practitioner + ' is not in the pool of queue ' + name);
+    }
+    return config;
+  });
+}
+
+function entryKey(encounterId) {
+  return datastore.key(['QueueEntry', encounterId]);
+}
+
+function dutyKey(name, practitioner) {
+  return datastore.key(['QueueDuty', crypto.createHash('sha256').update(name + ' ' + practitioner).digest('hex')]);
+}
+
+function toEntry(encounterId, entity, now) {
+  return {
+    encounterId: encounterId,
+    state: entity.State,
+    joined: entity.Joined,
+    waitedSeconds: Math.floor(((entity.Claimed || now) - entity.Joined) / 1000),
+    clinician: entity.Clinician || undefined,
+  };
+}
+
+// Resolves if the practitioner is in the queue's pool and on duty.
+function checkOnDuty(name, practitioner) {
+  return pool(name, practitioner).then(() => datastore.get(dutyKey(name, practitioner))).then(duty => {
+    if (!duty || duty.Expires < clock.date()) {
+      throw new errors.Forbidden(practitioner + ' is not on duty for queue ' + name);
+    }
+  });
+}
+
+// Puts a patient's encounter in a queue, unless it is already waiting or
+// claimed there.  Resolves to the entry.
+exports.join = function(name, encounterId) {
+  const now = clock.date();
+  return queue(name).then(() => datastore.modify(entryKey(encounterId), current => {
+    if (current && current.Queue == name && (current.State == 'waiting' || current.State == 'claimed')) {
+      return undefined;
+    }
+    return {
+      Queue: name,
+      State: 'waiting',
+      Joined: now,
+      Clinician: null,
+      Claimed: null,
+      Assignments: '[]',
+      Expires: new Date(now.getTime() + entryMaxAge),
+    };
+  })).then(created => {
+    if (created) {
+      events.publish('visit.queued', {encounterId: encounterId, queue: name});
+    }
+    return datastore.get(entryKey(encounterId));
+  }).then(entity => toEntry(encounterId, entity, clock.date()));
+};
+
+// Takes a waiting patient out of the queue.  Resolves to whether they were
+// waiting.
+exports.leave = function(name, encounterId) {
+  return queue(name).then(() => datastore.modify(entryKey(encounterId), current => {
+    if (!current || current.Queue != name || current.State != 'waiting') {
+      return undefined;
+    }
+    return Object.assign(current, {State: 'left', Left: clock.date()});
+  })).then(entity => !!entity);
+};
+
+// Puts a practitioner of the pool on or off duty for a queue.
+exports.setDuty = function(name, practitioner, onDuty) {
+  return pool(name, practitioner).then(() => {
+    if (!onDuty) {
+      return datastore.delete(dutyKey(name, practitioner));
+    }
+    const now = clock.date();
+    return datastore.upsert(dutyKey(name, practitioner), {
+      Queue: name,
+      Practitioner: practitioner,
+      Since: now,
+      Expires: new Date(now.getTime() + (options().dutyHours || 12) * hourMs),
+    });
+  });
+};
+
+function assign(current, to, now) {
+  const assignments = JSON.parse(current.Assignments || '[]');
+  assignments.push({to: to, at: now.toISOString()});
+  return Object.assign(current, {
+    State: to ? 'claimed' : 'waiting',
+    Clinician: to,
+    Claimed: to ? current.Claimed || now : null,
+    Assignments: JSON.stringify(assignments),
+  });
+}
+
+// Assigns a waiting patient to an on-duty practitioner of the pool.
+// Resolves to the entry, or rejects with claimed if another clinician got
+// there first.
+exports.claim = function(name, encounterId, practitioner) {
+  return checkOnDuty(name, practitioner).then(() => {
+    const now = clock.date();
+    return datastore.modify(entryKey(encounterId), current => {
+      if (!current || current.Queue != name || current.State != 'waiting') {
+        return undefined;
+      }
+      return assign(current, practitioner, now);
+    });
+  }).then(entity => {
+    if (!entity) {
+      throw new errors.QueueClaimed();
+    }
+    events.publish('visit.claimed', {encounterId: encounterId, queue: name});
+    return toEntry(encounterId, entity, clock.date());
+  });
+};
+
+// Hands a claimed patient from the clinician who has them to another
+// on-duty practitioner of the pool, or back to the queue if to is empty.
+// The patient keeps their place in the queue.  Resolves to the entry.
+exports.reassign = function(name, encounterId, practitioner, to) {
+  const checked = to ? checkOnDuty(name, to) : queue(name);
+  return checked.then(() => {
+    const now = clock.date();
+    var found;
+    return datastore.modify(entryKey(encounterId), current => {
+      found = current;
+      if (!current || current.Queue != name || current.State != 'claimed' || current.Clinician != practitioner) {
+        return undefined;
+      }
+      return assign(current, to || null, now);
+    }).then(entity => {
+      if (!entity) {
+        throw found && found.Queue == name && found.State == 'claimed' ?
+          new errors.Forbidden('Only the clinician who has the patient can reassign them') :
+          new errors.NotFound('No patient ' + encounterId + ' is claimed in queue ' + name);
+      }
+      return toEntry(encounterId, entity, clock.date());
+    });
+  });
+};
+
+// Records that the claiming clinician joined the visit or that the visit
+// ended.  Does nothing for encounters that didn't come through a queue.
+exports.record = function(encounterId, event) {
+  const now = clock.date();
+  return datastore.modify(entryKey(encounterId), current => {
+    if (!current || current.State != 'claimed') {
+      return undefined;
+    }
+    if (event == 'joined') {
+      return current.Started ? undefined : Object.assign(current, {Started: now});
+    }
+    return Object.assign(current, {State: 'done', Finished: now});
+  }).catch(err => {
+    console.log('Failed to record the queue ' + event + ' of encounter ' + encounterId + ': ' + err);
+  });
+};
+
+// Resolves to a queue's waiting patients, longest waiting first, and the
+// patients claimed from it.  Only practitioners of the pool can list it.
+exports.list = function(name, practitioner) {
+  var config;
+  return pool(name, practitioner).then(found => {
+    config = found;
+    return datastore.list('QueueEntry', [['Queue', '=', name]]);
+  }).then(entities => {
+    const now = clock.date();
+    const entries = entities.filter(entity => entity.State == 'waiting' || entity.State == 'claimed')
+      .sort((a, b) => a.Joined - b.Joined)
+      .map(entity => toEntry(datastore.name(entity), entity, now));
+    return {
+      name: config.name || name,
+      waiting: entries.filter(entry => entry.state == 'waiting'),
+      claimed: entries.filter(entry => entry.state == 'claimed'),
+    };
+  });
+};
+
+function median(values) {
+  if (!values.length) {
+    return null;
+  }
+  const sorted = values.slice().sort((a, b) => a - b);
+  return Math.round(sorted[Math.floor(sorted.length / 2)]);
+}
+
+// Resolves to the metrics of each of the tenant's queues over the last day:
+// patients waiting, claimed and in a visit now, visits done, patients who
+// left, reassignments, clinicians on duty and the median wait before a claim
+// and before the clinician joined, in seconds.
+exports.metrics = function() {
+  const now = clock.date();
+  const dayAgo = new Date(now.getTime() - 24 * hourMs);
+  const tenant = tenancy.current() || tenants.DEFAULT;
+  const names = Object.keys(options().queues || {}).filter(name => {
+    return (options().queues[name].tenant || tenants.DEFAULT) == tenant;
+  });
+  return Promise.all([
+    datastore.list('QueueEntry', [['Joined', '>', dayAgo]]),
+    datastore.list('QueueDuty', [['Expires', '>', now]]),
+  ]).then(results => {
+    const metrics = {};
+    names.forEach(name => {
+      const entries = results[0].filter(entity => entity.Queue == name);
+      const claimed = entries.filter(entity => entity.Claimed);
+      const started = entries.filter(entity => entity.Started);
+      metrics[name] = {
+        waiting: entries.filter(entity => entity.State == 'waiting').length,
+        claimed: entries.filter(entity => entity.State == 'claimed' && !entity.Started).length,
+        inVisit: entries.filter(entity => entity.State == 'claimed' && entity.Started).length,
+        done: entries.filter(entity => entity.State == 'done').length,
+        left: entries.filter(entity => entity.State == 'left').length,
+        reassignments: entries.reduce((total, entity) => {
+          return total + Math.max(0, JSON.parse(entity.Assignments || '[]').length - 1);
+        }, 0),
+        onDuty: results[1].filter(entity => entity.Queue == name).length,
+        medianWaitSeconds: median(claimed.map(entity => (entity.Claimed - entity.Joined) / 1000)),
+        medianTimeToVisitSeconds: median(started.map(entity => (entity.Started - entity.Joined) / 1000)),
+      };
+    });
+    return metrics;
+  });
+};
+
+// Deletes old entries and lapsed duty records, resolving to how many were
+// deleted.
+exports.purge = function(now) {
+  return Promise.all(['QueueEntry', 'QueueDuty'].map(kind => {
+    return datastore.list(kind, [['Expires', '<', now]]).then(entities => {
+      return Promise.all(entities.map(entity => datastore.delete(datastore.key([kind, datastore.name(entity)]))))
+        .then(() => entities.length);
+    });
+  })).then(counts => counts[0] + counts[1]);
+};
@@ -0,0 +1,51 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Group visits link one meeting to several encounters, one per patient.
+// Each encounter still has its own meeting record, so every patient's join is
+// tracked separately, and the 'Group' entity lists the encounters so that the
+// provider's visit events are applied to all of them.
+
+const datastore = require('./datastore.js');
+
+const crypto = require('crypto');
+
+// Stores a group for a new meeting, given as the fields of its meeting
+// records, and a meeting record for each encounter.  Resolves to the group
+// ID.
+exports.create = function(encounterIds, meeting) {
+  const id = crypto.randomBytes(8).toString('hex');
+  const group = Object.assign({Encounters: encounterIds}, meeting);
+  return datastore.set(datastore.key(['Group', id]), group).then(() => {
+    return datastore.upsertMany(encounterIds.map(encounterId => ({
+      key: datastore.key(['Encounter', encounterId]),
+      entity: Object.assign({Group: id}, meeting),
+    })));
+  }).then(() => id);
+};
+
+// Resolves to the encounters sharing a meeting with an encounter, including
+// itself.
+exports.members = function(encounterId) {
+  return datastore.get(datastore.key(['Encounter', encounterId])).then(entity => {
+    if (!entity || !entity.Group) {
+      return [encounterId];
+    }
+    return datastore.get(datastore.key(['Group', entity.Group])).then(group => {
+      return group ? group.Encounters : [encounterId];
+    });
+  });
+};
@@ -0,0 +1,188 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A gRPC server for the session and visit admin APIs, so that internal
+// services such as notification workers and analytics use typed clients of
+// proto/meetonfhir/v1/admin.proto rather than the REST routes.  The REST
+// routes remain the JSON interface: each method answers what its route does,
+// with the same admin tokens, audit records and problems, the problems as
+// gRPC statuses with the problem code in the problem-code trailer.
+//
+// It listens on grpc.port when set, in plaintext for the internal network
+// or behind a proxy terminating TLS.
+
+const admin = require('./admin.js');
+const audit = require('./audit.js');
+const errors = require('./errors.js');
+const report = require('./report.js');
+const snapshot = require('./snapshot.js');
+
+const settings = require('./settings.json');
+
+const grpc = require('@grpc/grpc-js');
+const protoLoader = require('@grpc/proto-loader');
+const path = require('path');
+
+const protoFile = path.join(__dirname, 'proto', 'meetonfhir', 'v1', 'admin.proto');
+
+// The gRPC statuses of the problems' HTTP statuses.
+const statuses = {
+  400: grpc.status.INVALID_ARGUMENT,
+  401: grpc.status.UNAUTHENTICATED,
+  403: grpc.status.PERMISSION_DENIED,
+  404: grpc.status.NOT_FOUND,
+  409: grpc.status.ABORTED,
+  410: grpc.status.FAILED_PRECONDITION,
+  422: grpc.status.INVALID_ARGUMENT,
+  429: grpc.status.RESOURCE_EXHAUSTED,
+  503: grpc.status.UNAVAILABLE,
+  504: grpc.status.DEADLINE_EXCEEDED,
+};
+
+function toError(err) {
+  const problem = errors.classify(err);
+  if (problem.status >= 500) {
+    console.log(err);
+  }
+  const metadata = new grpc.Metadata();
+  metadata.set('problem-code', problem.code);
+  return {code: statuses[problem.status] || grpc.status.INTERNAL, details: problem.message, metadata: metadata};
+}
+
+function timestamp(value) {
+  return value instanceof Date ? value.toISOString() : value;
+}
+
+// Converts a JSON value to a google.protobuf.Value.
+function toValue(value) {
+  if (value === null || value === undefined) {
+    return {nullValue: 'NULL_VALUE'};
+  }
+  if (value instanceof Date) {
+    return {stringValue: value.toISOString()};
+  }
+  if (Array.isArray(value)) {
+    return {listValue: {values: value.map(toValue)}};
+  }
+  switch (typeof value) {
+    case 'number':
+      return {numberValue: value};
+    case 'boolean':
+      return {boolValue: value};
+    case 'object':
+      return {structValue: toStruct(value)};
+    default:
+      return {stringValue: String(value)};
+  }
+}
+
+function toStruct(object) {
+  const fields = {};
+  Object.keys(object).forEach(name => {
+    fields[name] = toValue(object[name]);
+  });
+  return {fields: fields};
+}
+
+function toSession(session) {
+  return {
+    reference: session.reference,
+    expired: session.expired,
+    fields: toStruct(session.fields),
+    meetings: session.meetings.map(meeting => ({
+      encounterId: meeting.encounterId,
+      created: timestamp(meeting.created),
+      closed: timestamp(meeting.closed),
+      status: meeting.status,
+      degraded: meeting.degraded,
+    })),
+  };
+}
+
+// Wraps a method resolving to its response, given the call's request, in
+// the admin token check and audit record of the REST routes.
+function method(name, run) {
+  return (call, callback) => {
+    const authorization = call.metadata.get('authorization')[0] || '';
+    const token = authorization.startsWith('Bearer ') ? authorization.substring('Bearer '.length) : '';
+    if (!admin.allowed(token)) {
+      callback(toError(new errors.Forbidden()));
+      return;
+    }
+    const request = {ip: call.getPeer()};
+    audit.record('admin grpc ' + name, 'admin', '', request);
+    Promise.resolve().then(() => run(call.request, request)).then(response => callback(null, response), err => {
+      callback(toError(err));
+    });
+  };
+}
+
+const sessionService = {
+  ListSessions: method('ListSessions', (query, request) => {
+    if (!query.identity) {
+      throw new errors.InvalidRequest('The identity is required');
+    }
+    return snapshot.forIdentity(query.identity).then(sessions => {
+      audit.record('session-inspected', 'admin', '', request);
+      return {sessions: sessions.map(toSession)};
+    });
+  }),
+  GetSession: method('GetSession', (query, request) => {
+    return snapshot.session(query.reference).then(session => {
+      if (!session) {
+        throw new errors.NotFound('No session ' + query.reference);
+      }
+      audit.record('session-inspected', 'admin', '', request);
+      return toSession(session);
+    });
+  }),
+};
+
+const visitService = {
+  ListVisits: method('ListVisits', query => {
+    return report.query(query).then(result => ({
+      since: result.since.toISOString(),
+      until: result.until.toISOString(),
+      visits: result.visits,
+    }));
+  }),
+};
+
+// Starts the server if grpc.port is set.  Resolves to the server, or
+// undefined when it's not configured.
+exports.start = function() {
+  const port = settings.grpc && settings.grpc.port;
+  if (!port) {
+    return Promise.resolve(undefined);
+  }
+  return protoLoader.load(protoFile, {keepCase: false, defaults: false}).then(definition => {
+    const proto = grpc.loadPackageDefinition(definition).meetonfhir.v1;
+    const server = new grpc.Server();
+    server.addService(proto.SessionService.service, sessionService);
+    server.addService(proto.VisitService.service, visitService);
+    return new Promise((resolve, reject) => {
+      server.bindAsync('0.0.0.0:' + port, grpc.ServerCredentials.createInsecure(), err => {
+        if (err) {
+          reject(err);
+          return;
+        }
+        server.start();
+        console.log('gRPC listening on ' + port);
+        resolve(server);
+      });
+    });
+  });
+};
@@ -0,0 +1,159 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Handoff codes move a visit to another device: the provider or patient asks
+// for a short numeric code on one device and enters it on another, which is
+// given a sibling session for the same encounter.  Codes are short lived and
+// can be redeemed once.  Provider codes are 12 digits rather than 6, since
+// redeeming one signs the device in with the provider's Google credentials.
+//
+// Each browser may enter settings.handoffs.maxAttempts (5) wrong codes, and
+// each client address maxAddressAttempts (100), before it is locked out for
+// lockoutMinutes (15), whether or not rateLimit is enabled, so codes can't be
+// guessed by trying them all.  Browsers are counted by an ID in their
+// session, so that people sharing an address, as everyone does when
+// trustProxy isn't set, don't lock each other out; the higher address limit
+// stops guessing from browsers that drop their cookies.
+
+const clock = require('./clock.js');
+const datastore = require('./datastore.js');
+const errors = require('./errors.js');
+const tenancy = require('./tenancy.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+// How long a code can be redeemed for.
+const codeTtl = 5 * 60 * 1000;
+
+// The digits in the codes of each role.
+const codeDigits = {provider: 12, patient: 6};
+
+function options() {
+  return settings.handoffs || {};
+}
+
+function digits(count) {
+  return String(crypto.randomBytes(4).readUInt32BE(0) % Math.pow(10, count)).padStart(count, '0');
+}
+
+function newCode(role) {
+  const count = codeDigits[role] || codeDigits.patient;
+  return count > 6 ? digits(count - 6) + digits(6) : digits(count);
+}
+
+// Resolves to a code for the encounter.  role is 'provider' or 'patient';
+// owner is the provider's session ID for provider handoffs and verified is
+// whether the patient's identity was verified on the first device.
+exports.issue = function(encounterId, role, owner, verified, attempt) {
+  attempt = attempt || 1;
+  const code = newCode(role);
+  const now = clock.date();
+  const entity = {
+    Encounter: encounterId,
+    Tenant: tenancy.current() || '',
+    Role: role,
+    Owner: owner || '',
+    Verified: !!verified,
+    Expires: new Date(now.getTime() + codeTtl),
+  };
+  return datastore.modify(datastore.key(['Handoff', code]), existing => {
+    // Don't reuse a code that may still be redeemed.
+    return existing && !existing.Used && existing.Expires > now ? undefined : entity;
+  }).then(saved => {
+    if (saved) {
+      return code;
+    }
+    if (attempt >= 5) {
+      throw new Error('No free handoff code');
+    }
+    return exports.issue(encounterId, role, owner, verified, attempt + 1);
+  });
+};
+
+// Returns the ID the request's browser is counted by, giving it one if it
+// has none.
+exports.client = function(request) {
+  request.session.handoffClient = request.session.handoffClient || crypto.randomBytes(16).toString('hex');
+  return request.session.handoffClient;
+};
+
+// Browser IDs and client addresses are credentials of a sort, so their
+// records are named by a hash.
+function attemptsKey(counted) {
+  return datastore.key(['HandoffAttempts', crypto.createHash('sha256').update(counted).digest('hex').substring(0, 32)]);
+}
+
+// Counts a wrong code from a browser or address, locking it out after limit.
+function fail(key, limit, now) {
+  const lockout = (options().lockoutMinutes || 15) * 60 * 1000;
+  return datastore.modify(key, entity => {
+    // Wrong codes are counted over the lockout period.
+    if (!entity || entity.Expires < now) {
+      entity = {Failures: 0, LockedUntil: new Date(0)};
+    }
+    entity.Failures++;
+    entity.Expires = new Date(now.getTime() + lockout);
+    if (entity.Failures >= limit) {
+      entity.Failures = 0;
+      entity.LockedUntil = entity.Expires;
+    }
+    return entity;
+  });
+}
+
+// Resolves to the handoff for a code entered by a browser, named by the ID
+// client returned, from a client address, invalidating it, or undefined if
+// the code is unknown, expired or was already redeemed.  Rejects with Locked
+// while the browser or the address is locked out.
+exports.redeem = function(code, client, address) {
+  const now = clock.date();
+  const counters = [
+    {key: attemptsKey('client ' + client), limit: options().maxAttempts || 5},
+    {key: attemptsKey('address ' + (address || '')), limit: options().maxAddressAttempts || 100},
+  ];
+  return datastore.getMany(counters.map(counter => counter.key)).then(attempts => {
+    if (attempts.some(entity => entity && entity.LockedUntil > now)) {
+      throw new errors.Locked('Too many wrong codes, try again later');
+    }
+    return datastore.modify(datastore.key(['Handoff', String(code)]), existing => {
+      if (!existing || existing.Used || existing.Expires < now) {
+        return undefined;
+      }
+      return Object.assign(existing, {Used: now});
+    });
+  }).then(redeemed => {
+    if (redeemed) {
+      return redeemed;
+    }
+    return Promise.all(counters.map(counter => fail(counter.key, counter.limit, now))).then(() => undefined);
+  });
+};
+
+function purgeKind(kind, now) {
+  return datastore.list(kind, [['Expires', '<', now]]).then(entities => {
+    return Promise.all(entities.map(entity => {
+      return datastore.delete(datastore.key([kind, datastore.name(entity)]));
+    })).then(() => entities.length);
+  });
+}
+
+// Deletes expired codes and wrong code counts, resolving to how many codes
+// were deleted.
+exports.purge = function(now) {
+  return Promise.all([purgeKind('Handoff', now), purgeKind('HandoffAttempts', now)]).then(counts => counts[0]);
+};
@@ -0,0 +1,64 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The HTTP server, with the limits of settings.server so that slow or
+// oversized requests can't hold connections open (slowloris):
+//
+//   * headerTimeoutSeconds (10) to receive a request's headers.
+//   * readTimeoutSeconds (30) to receive a whole request.
+//   * writeTimeoutSeconds (60) of inactivity while a response is sent.
+//   * idleTimeoutSeconds (620) a keep-alive connection waits for the next
+//     request, longer than the 600 seconds of Google load balancers so they
+//     never reuse a connection the instance is closing.
+//   * maxHeaderBytes (16384) of request headers, beyond which requests fail
+//     with 431.
+//
+// HTTP/2 is negotiated with clients by the Google front end or the proxy
+// ahead of the instance, which speaks HTTP/1.1 to it: Express can't serve
+// Node's HTTP/2 requests, so the instance doesn't offer h2c.
+
+const settings = require('./settings.json');
+
+const http = require('http');
+
+function seconds(name, fallback) {
+  const options = settings.server || {};
+  return (options[name] === undefined ? fallback : options[name]) * 1000;
+}
+
+// Returns the limits as the server options they set.
+exports.options = function() {
+  return {
+    headersTimeout: seconds('headerTimeoutSeconds', 10),
+    requestTimeout: seconds('readTimeoutSeconds', 30),
+    timeout: seconds('writeTimeoutSeconds', 60),
+    keepAliveTimeout: seconds('idleTimeoutSeconds', 620),
+    maxHeaderSize: (settings.server && settings.server.maxHeaderBytes) || 16384,
+  };
+};
+
+// Starts serving the app on port.
+exports.listen = function(app, port) {
+  const options = exports.options();
+  // Connections are checked against the header and read timeouts every
+  // second, rather than every 30, so they're enforced closely.
+  const server = http.createServer({maxHeaderSize: options.maxHeaderSize, connectionsCheckingInterval: 1000}, app);
+  server.keepAliveTimeout = options.keepAliveTimeout;
+  server.headersTimeout = options.headersTimeout;
+  server.requestTimeout = options.requestTimeout;
+  server.setTimeout(options.timeout);
+  return server.listen(port);
+};
@@ -0,0 +1,182 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Idempotency keys for POST requests.  A client that may retry, such as a
+// browser on flaky hospital Wi-Fi, sends an Idempotency-Key header; the first
+// request with a key runs and its response is remembered for a day, and
+// retries with the same key and body get that response again instead
+// of creating another meeting or session.  Keys are scoped to the caller's
+// session and FHIR access token, so they can't be used to read another
+// caller's response.  The body is fingerprinted raw, so the middleware parses
+// JSON bodies itself rather than leaving them to the route.  The session
+// fields a response changed are replayed too; they are kept encrypted as a
+// credential, and the session ID is never kept.
+
+const bodies = require('./bodies.js');
+const clock = require('./clock.js');
+const credentials = require('./credentials.js');
+const datastore = require('./datastore.js');
+const errors = require('./errors.js');
+const signatures = require('./signatures.js');
+
+const crypto = require('crypto');
+
+const ttl = 24 * 60 * 60 * 1000;
+
+// A request still running when a retry arrives is given up on after this.
+const pendingTtl = 60 * 1000;
+
+function hash(value) {
+  return crypto.createHash('sha256').update(value).digest('hex');
+}
+
+function scope(request) {
+  return [request.session.id || '', request.session.invitee || '', request.get('Authorization') || ''].join(' ');
+}
+
+// The session fields a response changed from before, other than the session
+// ID, with null for those it removed.
+function sessionChanges(before, session) {
+  const changes = {};
+  Object.keys(Object.assign({}, before, session)).filter(name => name != 'id').forEach(name => {
+    if (JSON.stringify(before[name]) !== JSON.stringify(session[name])) {
+      changes[name] = session[name] === undefined ? null : session[name];
+    }
+  });
+  return changes;
+}
+
+// Resolves to the ID of the credential holding changes, or '' if there are
+// none.
+function storeChanges(changes) {
+  if (Object.keys(changes).length == 0) {
+    return Promise.resolve('');
+  }
+  return Promise.resolve().then(() => credentials.store(JSON.stringify(changes)));
+}
+
+function replay(request, response, entity) {
+  const loaded = entity.Session ? credentials.load(entity.Session, 'system') : Promise.resolve(undefined);
+  return loaded.then(changes => {
+    const stored = changes ? JSON.parse(changes) : {};
+    Object.keys(stored).forEach(name => {
+      if (stored[name] === null) {
+        delete request.session[name];
+      } else {
+        request.session[name] = stored[name];
+      }
+    });
+    response.set('Idempotent-Replayed', 'true');
+    if (entity.Location) {
+      response.set('Location', entity.Location);
+    }
+    if (entity.ContentType) {
+      response.type(entity.ContentType);
+    }
+    response.status(entity.Status).send(entity.Body);
+  });
+}
+
+function removeChanges(entity) {
+  return entity && entity.Session ? credentials.remove(entity.Session) : Promise.resolve();
+}
+
+// Middleware deduplicating POST requests with an Idempotency-Key header.
+exports.middleware = function(request, response, next) {
+  const idempotencyKey = request.get('Idempotency-Key');
+  if (request.method != 'POST' || !idempotencyKey) {
+    next();
+    return;
+  }
+  if (idempotencyKey.length > 255) {
+    errors.send(response, new errors.InvalidRequest('The Idempotency-Key is too long'));
+    return;
+  }
+
+  // Form bodies are parsed by now, and the route's JSON parser skips a body
+  // parsed here.  Both keep the raw body.
+  bodies.json({verify: signatures.capture})(request, response, err => {
+    if (err) {
+      next(err);
+      return;
+    }
+    claim(request, response, next, idempotencyKey);
+  });
+};
+
+function claim(request, response, next, idempotencyKey) {
+  const key = datastore.key(['Idempotency', hash(scope(request) + ' ' + request.path + ' ' + idempotencyKey)]);
+  const fingerprint = hash(request.rawBody || '');
+  const now = clock.date();
+  const before = Object.assign({}, request.session);
+  var existing;
+  var expired;
+  datastore.modify(key, entity => {
+    if (entity && entity.Expires > now) {
+      existing = entity;
+      return undefined;
+    }
+    expired = entity;
+    return {State: 'pending', Fingerprint: fingerprint, Expires: new Date(now.getTime() + pendingTtl)};
+  }).then(claimed => {
+    removeChanges(expired).catch(err => console.log('Failed to remove replayed session fields: ' + err));
+    if (!claimed) {
+      if (existing.Fingerprint != fingerprint) {
+        throw new errors.IdempotencyConflict('The Idempotency-Key was used with a different body');
+      }
+      if (existing.State != 'done') {
+        throw new errors.IdempotencyConflict('A request with this Idempotency-Key is still in progress');
+      }
+      return replay(request, response, existing);
+    }
+
+    var body;
+    const send = response.send;
+    response.send = function(value) {
+      body = value;
+      return send.apply(this, arguments);
+    };
+    response.on('finish', () => {
+      // Failures that may be transient can be retried with the same key.
+      if (response.statusCode >= 500) {
+        datastore.delete(key).catch(err => console.log('Failed to release an idempotency key: ' + err));
+        return;
+      }
+      storeChanges(sessionChanges(before, request.session)).then(changes => {
+        return datastore.upsert(key, {
+          State: 'done',
+          Fingerprint: fingerprint,
+          Status: response.statusCode,
+          ContentType: response.get('Content-Type') || '',
+          Location: response.get('Location') || '',
+          Body: typeof body == 'string' || Buffer.isBuffer(body) ? String(body) : JSON.stringify(body || ''),
+          Session: changes,
+          Expires: new Date(clock.now() + ttl),
+        });
+      }).catch(err => console.log('Failed to store an idempotent response: ' + err));
+    });
+    next();
+  }).catch(err => errors.send(response, err));
+}
+
+// Deletes expired keys, resolving to how many were deleted.
+exports.purge = function(now) {
+  return datastore.list('Idempotency', [['Expires', '<', now]]).then(entities => {
+    return Promise.all(entities.map(entity => {
+      return Promise.all([datastore.delete(datastore.key(['Idempotency', datastore.name(entity)])), removeChanges(entity)]);
+    })).then(() => entities.length);
+  });
+};
@@ -0,0 +1,115 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// De-identified product analytics events.  With settings.insights.enabled,
+// lifecycle events and usage counters are exported, one row each, to
+// settings.insights.bigQueryTable and settings.insights.pubsubTopic.  Only
+// the fields of the schema below leave the application:
+//
+//   event    The event or counter name, such as visit.ended or wait-seconds.
+//   hour     The time of the event, truncated to the hour.
+//   tenant   The tenant ID, which names an organisation rather than a person.
+//   visit    A pseudonym of the encounter: the first 16 hex digits of its
+//            HMAC-SHA256 under settings.insights.salt.  Events of one visit
+//            share it, and changing the salt unlinks older events.
+//   bucket   A counter's value, in seconds, generalised to a range.
+//   rebook, linkChanged
+//            The flags of visit.noshow and visit.rescheduled events.
+//
+// Names that aren't plain identifiers and every other field, including free
+// text, times and exact values, are dropped, so that rows describe groups of
+// visits rather than people.
+
+const datastore = require('./datastore.js');
+const tenants = require('./tenants.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const {BigQuery} = require('@google-cloud/bigquery');
+const {PubSub} = require('@google-cloud/pubsub');
+
+function options() {
+  return settings.insights || {};
+}
+
+const buckets = [[0, '0-59'], [60, '60-299'], [300, '300-899'], [900, '900-1799'], [1800, '1800+']];
+
+function bucket(value) {
+  if (typeof value != 'number' || !(value >= 0)) {
+    return null;
+  }
+  return buckets.filter(entry => value >= entry[0]).pop()[1];
+}
+
+exports.pseudonym = function(encounterId) {
+  if (!options().salt) {
+    throw new Error('insights.salt is not set');
+  }
+  return crypto.createHmac('sha256', options().salt).update(String(encounterId)).digest('hex').substring(0, 16);
+};
+
+function hour(time) {
+  const date = new Date(time || Date.now());
+  date.setUTCMinutes(0, 0, 0);
+  return date.toISOString();
+}
+
+function tenantOf(encounterId) {
+  if (!encounterId) {
+    return Promise.resolve(null);
+  }
+  return datastore.get(datastore.key(['Encounter', encounterId])).then(entity => {
+    return (entity && entity.Tenant) || tenants.DEFAULT;
+  });
+}
+
+// Returns the schema's fields of an event.
+function deidentify(event, tenant) {
+  return {
+    event: /^[a-z0-9][a-z0-9.\/-]{0,63}$/.test(event.type) ? event.type : 'other',
+    hour: hour(event.time),
+    tenant: tenant,
+    visit: event.encounterId ? exports.pseudonym(event.encounterId) : null,
+    bucket: bucket(event.value),
+    rebook: typeof event.rebook == 'boolean' ? event.rebook : null,
+    linkChanged: typeof event.linkChanged == 'boolean' ? event.linkChanged : null,
+  };
+}
+
+function exportRow(row) {
+  const sent = [];
+  if (options().bigQueryTable) {
+    const parts = options().bigQueryTable.split('.');
+    sent.push(new BigQuery().dataset(parts[0]).table(parts[1]).insert([row]));
+  }
+  if (options().pubsubTopic) {
+    sent.push(new PubSub().topic(options().pubsubTopic).publish(Buffer.from(JSON.stringify(row)), {event: row.event}));
+  }
+  return Promise.all(sent);
+}
+
+// Exports an event, given its type and any of time, encounterId, value and
+// the flags above.  Failures are logged rather than returned so that they
+// don't break visits.
+exports.emit = function(event) {
+  if (!options().enabled) {
+    return Promise.resolve();
+  }
+  return tenantOf(event.encounterId).then(tenant => exportRow(deidentify(event, tenant))).catch(err => {
+    console.log('Failed to export ' + event.type + ' insight: ' + err);
+  });
+};
@@ -0,0 +1,161 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Latency, error and payload size histograms of datastore operations, kept in
+// memory since the instance started so that recording them never needs the
+// datastore.  GET /admin/stats reports them for this instance.
+
+// Upper bounds of the latency buckets, in milliseconds, and of the payload
+// size buckets, in bytes.
+const LATENCY_BOUNDS = [1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000];
+const SIZE_BOUNDS = [256, 1024, 4096, 16384, 65536, 262144, 1048576];
+
+class Histogram {
+  constructor(bounds) {
+    this.bounds = bounds;
+    this.counts = new Array(bounds.length + 1).fill(0);
+    this.count = 0;
+    this.sum = 0;
+  }
+
+  add(value) {
+    const index = this.bounds.findIndex(bound => value <= bound);
+    this.counts[index == -1 ? this.bounds.length : index]++;
+    this.count++;
+    this.sum += value;
+  }
+
+  // The upper bound of the bucket holding the pth percentile.
+  percentile(p) {
+    if (this.count == 0) {
+      return null;
+    }
+    var seen = 0;
+    for (var i = 0; i < this.counts.length; i++) {
+      seen += this.counts[i];
+      if (seen >= this.count * p / 100) {
+        return i < this.bounds.length ? this.bounds[i] : null;
+      }
+    }
+    return null;
+  }
+
+  snapshot() {
+    const buckets = {};
+    this.counts.forEach((count, i) => {
+      buckets[i < this.bounds.length ? this.bounds[i] : '+Inf'] = count;
+    });
+    return {
+      count: this.count,
+      mean: this.count ? this.sum / this.count : 0,
+      p50: this.percentile(50),
+      p90: this.percentile(90),
+      p99: this.percentile(99),
+      buckets: buckets,
+    };
+  }
+}
+
+// The gRPC status codes of Cloud Datastore errors worth telling apart.
+const statusClasses = {
+  4: 'deadline-exceeded',
+  5: 'not-found',
+  6: 'already-exists',
+  8: 'resource-exhausted',
+  10: 'aborted',
+  14: 'unavailable',
+};
+
+// Returns the class of an error thrown by a store.
+exports.classify = function(err) {
+  if (err && err.code == 'timeout') {
+    return 'timeout';
+  }
+  if (err && typeof err.code == 'number') {
+    return statusClasses[err.code] || 'grpc-' + err.code;
+  }
+  if (err && /already exists/i.test(err.message)) {
+    return 'already-exists';
+  }
+  if (err && /no entity/i.test(err.message)) {
+    return 'not-found';
+  }
+  return 'other';
+};
+
+// How long, in milliseconds, recent latency is averaged over.
+const RECENT_MS = 10 * 1000;
+
+// Returns metrics recording operations, with observe(operation, milliseconds,
+// err, bytes) called once each operation completes, snapshot() returning
+// each operation's histograms and error counts and recentLatency() the mean
+// latency of every operation over the last ten seconds, or 0 if there were
+// none.
+exports.create = function() {
+  const operations = {};
+  // The latency sum and count of each recent second.
+  const recent = new Map();
+  return {
+    observe: (operation, milliseconds, err, bytes) => {
+      const second = Math.floor(Date.now() / 1000);
+      const bucket = recent.get(second) || {sum: 0, count: 0};
+      bucket.sum += milliseconds;
+      bucket.count++;
+      recent.set(second, bucket);
+
+      const metrics = operations[operation] = operations[operation] || {
+        latency: new Histogram(LATENCY_BOUNDS),
+        size: new Histogram(SIZE_BOUNDS),
+        errors: {},
+      };
+      metrics.latency.add(milliseconds);
+      if (err) {
+        const type = exports.classify(err);
+        metrics.errors[type] = (metrics.errors[type] || 0) + 1;
+      } else if (bytes !== undefined) {
+        metrics.size.add(bytes);
+      }
+    },
+    snapshot: () => {
+      const snapshot = {};
+      Object.keys(operations).forEach(operation => {
+        snapshot[operation] = {
+          latencyMs: operations[operation].latency.snapshot(),
+          bytes: operations[operation].size.snapshot(),
+          errors: Object.assign({}, operations[operation].errors),
+        };
+      });
+      return snapshot;
+    },
+    recentLatency: () => {
+      const oldest = Math.floor((Date.now() - RECENT_MS) / 1000);
+      var sum = 0;
+      var count = 0;
+      recent.forEach((bucket, second) => {
+        if (second < oldest) {
+          recent.delete(second);
+          return;
+        }
+        sum += bucket.sum;
+        count += bucket.count;
+      });
+      return count ? sum / count : 0;
+    },
+  };
+};
+
+// The metrics of the store the application uses.
+exports.store = exports.create();
@@ -0,0 +1,194 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// OAuth 2.0 token introspection (RFC 7662) for EHRs that advertise an
+// introspection_endpoint in their SMART configuration.  When
+// settings.tokenIntrospection.enabled is set, FHIR requests with a token the
+// EHR reports as inactive are rejected and the provider session making them
+// is ended.  The access token last used by each provider session is kept,
+// encrypted like refresh tokens, so the introspection job can end sessions
+// whose EHR tokens were revoked while the provider was idle.
+
+const audit = require('./audit.js');
+const credentials = require('./credentials.js');
+const datastore = require('./datastore.js');
+const deadline = require('./deadline.js');
+const errors = require('./errors.js');
+const events = require('./events.js');
+const transport = require('./transport.js');
+const user = require('./user.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const gaxios = require('gaxios');
+
+function options() {
+  return settings.tokenIntrospection || {};
+}
+
+function tokenHash(token) {
+  return crypto.createHash('sha256').update(token).digest('hex');
+}
+
+// Introspection endpoints by FHIR server, null for servers without one.
+const endpoints = new Map();
+
+function endpoint(serverUrl) {
+  if (endpoints.has(serverUrl)) {
+    return Promise.resolve(endpoints.get(serverUrl));
+  }
+  return deadline.limit('oauth', timeout => gaxios.request({
+    url: serverUrl + '/.well-known/smart-configuration',
+    headers: {'Accept': 'application/json'},
+    timeout: timeout,
+    agent: transport.agent(serverUrl),
+  })).then(result => result.data.introspection_endpoint || null, err => {
+    // A server that timed out is asked again next time.
+    if (err instanceof errors.Timeout) {
+      throw err;
+    }
+    return null;
+  }).then(url => {
+    endpoints.set(serverUrl, url);
+    return url;
+  });
+}
+
+// Recent results by token hash, so each request doesn't introspect.
+const results = new Map();
+
+// Resolves to whether the EHR reports the context's token as active, or
+// undefined if the EHR doesn't support introspection.
+exports.check = function(context) {
+  const hash = tokenHash(context.accessToken);
+  const cached = results.get(hash);
+  if (cached && cached.until > Date.now()) {
+    return Promise.resolve(cached.active);
+  }
+
+  return endpoint(context.serverUrl).then(url => {
+    if (!url) {
+      return undefined;
+    }
+    const headers = {'Accept': 'application/json'};
+    if (settings.fhirClientSecret) {
+      headers['Authorization'] = 'Basic ' +
+        Buffer.from(settings.fhirClientId + ':' + settings.fhirClientSecret).toString('base64');
+    } else {
+      headers['Authorization'] = 'Bearer ' + context.accessToken;
+    }
+    return deadline.limit('oauth', timeout => gaxios.request({
+      url: url,
+      method: 'POST',
+      headers: headers,
+      data: 'token=' + encodeURIComponent(context.accessToken),
+      timeout: timeout,
+      agent: transport.agent(context.serverUrl),
+    })).then(result => {
+      const active = result.data.active === true;
+      if (results.size > 10000) {
+        results.forEach((value, key) => value.until <= Date.now() && results.delete(key));
+      }
+      results.set(hash, {active: active, until: Date.now() + (options().cacheSeconds || 60) * 1000});
+      return active;
+    });
+  });
+};
+
+// Ends a provider session whose EHR token was revoked.
+function endSession(id) {
+  return datastore.get(datastore.key(['User', id])).then(entity => {
+    if (!entity) {
+      return;
+    }
+    return user.deleteSession(entity).then(() => {
+      events.publish('session.revoked');
+      audit.record('session-revoked', 'system', '');
+    });
+  });
+}
+
+// Keeps the token a provider session last used, so the job can check it.
+function remember(id, context) {
+  const hash = tokenHash(context.accessToken);
+  return datastore.get(datastore.key(['User', id])).then(entity => {
+    if (!entity || entity.EhrTokenHash == hash) {
+      return;
+    }
+    return credentials.store(context.accessToken).then(credential => {
+      var replaced;
+      return user.updateSession(id, current => {
+        replaced = current.EhrCredential;
+        return Object.assign(current, {EhrServer: context.serverUrl, EhrCredential: credential, EhrTokenHash: hash});
+      }).then(saved => {
+        const unused = saved ? replaced : credential;
+        return unused && credentials.remove(unused);
+      });
+    });
+  });
+}
+
+// Middleware rejecting requests with revoked EHR tokens.  Must follow
+// fhir.required.
+exports.required = function(request, response, next) {
+  if (!options().enabled) {
+    next();
+    return;
+  }
+
+  exports.check(request.fhirContext).then(active => {
+    if (active === false) {
+      const id = request.session.id;
+      request.session.id = null;
+      return (id ? endSession(id) : Promise.resolve()).then(() => {
+        throw new errors.TokenRevoked();
+      });
+    }
+    if (request.session.id) {
+      return remember(request.session.id, request.fhirContext);
+    }
+  }).then(() => next(), next);
+};
+
+// Checks the EHR tokens last used by provider sessions and ends the sessions
+// whose tokens were revoked.
+exports.run = function() {
+  if (!options().enabled) {
+    return Promise.resolve({checked: 0, revoked: 0});
+  }
+
+  return datastore.list('User').then(entities => {
+    const now = new Date();
+    const remembered = entities.filter(entity => entity.EhrCredential && !(entity.Expires < now));
+    var revoked = 0;
+    return Promise.all(remembered.map(entity => {
+      return credentials.load(entity.EhrCredential, 'system').then(token => {
+        if (!token) {
+          return;
+        }
+        return exports.check({serverUrl: entity.EhrServer, accessToken: token}).then(active => {
+          if (active === false) {
+            revoked++;
+            return endSession(datastore.name(entity));
+          }
+        });
+      }).catch(err => {
+        console.log('Failed to introspect the EHR token of a session: ' + err);
+      });
+    })).then(() => ({checked: remembered.length, revoked: revoked}));
+  });
+};
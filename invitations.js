@@ -0,0 +1,64 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Invitations of other clinicians to a visit.  The clinician who created the
+// meeting invites members of the encounter's care team; each invitation is a
+// link that gives the invitee the meeting in their own session, which the
+// first redemption binds it to, so every invitee has their own audit trail.
+
+const clock = require('./clock.js');
+const datastore = require('./datastore.js');
+const tenancy = require('./tenancy.js');
+
+const crypto = require('crypto');
+
+// Resolves to the token of a new invitation.
+exports.create = function(encounterId, practitioner, email, invitedBy, expires) {
+  const token = crypto.randomBytes(16).toString('hex');
+  return datastore.set(datastore.key(['Invitation', token]), {
+    Encounter: encounterId,
+    Tenant: tenancy.current() || '',
+    Practitioner: practitioner,
+    Email: email || '',
+    InvitedBy: invitedBy,
+    Created: clock.date(),
+    Expires: expires,
+    BoundTo: '',
+  }).then(() => token);
+};
+
+// Resolves to the invitation for a token, binding it to the request's
+// session, or undefined if it expired or is bound to another session.
+exports.redeem = function(token, request) {
+  request.session.invitee = request.session.invitee || crypto.randomBytes(16).toString('hex');
+  const session = request.session.invitee;
+  const now = clock.date();
+  return datastore.modify(datastore.key(['Invitation', String(token)]), entity => {
+    if (!entity || entity.Expires < now || (entity.BoundTo && entity.BoundTo != session)) {
+      return undefined;
+    }
+    return Object.assign(entity, {BoundTo: session});
+  });
+};
+
+// Deletes expired invitations, resolving to how many were deleted.
+exports.purge = function(now) {
+  return datastore.list('Invitation', [['Expires', '<', now]]).then(entities => {
+    return Promise.all(entities.map(entity => {
+      return datastore.delete(datastore.key(['Invitation', datastore.name(entity)]));
+    })).then(() => entities.length);
+  });
+};
@@ -0,0 +1,70 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Background jobs.  Each job is run either by App Engine cron (see cron.yaml)
+// calling /jobs/{name}, or in process every intervalMinutes when
+// settings.jobs.inProcess is set.  A job runs on one instance at a time; runs
+// that start while it is running elsewhere are skipped.  In process, only
+// the elected leader runs jobs.  With tenant namespaces a job runs once for
+// each tenant.
+
+const leader = require('./leader.js');
+const locks = require('./locks.js');
+const tenancy = require('./tenancy.js');
+
+const settings = require('./settings.json');
+
+const jobs = {};
+
+// Registers a job.  run must return a promise resolving to a JSON summary.
+exports.register = function(name, intervalMinutes, run) {
+  jobs[name] = { intervalMinutes: intervalMinutes, run: run };
+};
+
+exports.exists = function(name) {
+  return jobs.hasOwnProperty(name);
+};
+
+// A run is assumed to have died, freeing the job, after its interval or an
+// hour, whichever is shorter.
+exports.run = function(name) {
+  const job = jobs[name];
+  const ttl = Math.min(job.intervalMinutes, 60) * 60 * 1000;
+  return locks.run('job:' + name, ttl, 0, () => tenancy.each(job.run), () => {
+    return {skipped: 'The job is running on another instance'};
+  });
+};
+
+exports.start = function() {
+  if (!settings.jobs || !settings.jobs.inProcess) {
+    return;
+  }
+
+  leader.start();
+  process.once('SIGTERM', () => {
+    leader.stop().then(() => process.exit(0));
+  });
+  Object.keys(jobs).forEach(name => {
+    setInterval(() => {
+      if (!leader.isLeader()) {
+        return;
+      }
+      exports.run(name).catch(err => {
+        console.log('Job ' + name + ' failed: ' + err);
+      });
+    }, jobs[name].intervalMinutes * 60 * 1000);
+  });
+};
@@ -0,0 +1,68 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Checks the launch context an EHR passed against its own records: the
+// Encounter has to exist, be a virtual visit or one that can still become
+// one, and belong to the launch Patient.  Misconfigured EHR launches then
+// show up when the app is launched rather than as a meeting for the wrong
+// patient.
+
+const fhir = require('./fhir.js');
+
+const settings = require('./settings.json');
+
+// Encounter statuses a visit can no longer take place in.
+const closedStatuses = ['finished', 'cancelled', 'entered-in-error'];
+
+// 'off', 'warn' or 'block'.
+exports.mode = function() {
+  return settings.launchContextCheck || 'off';
+};
+
+// Encounter class codes of virtual visits.  Encounters without a class can
+// still become one.
+function virtualClasses() {
+  return settings.virtualEncounterClasses || ['VR'];
+}
+
+// Resolves to a description of each way the launch context does not match
+// the EHR's records, an empty list when it does.  The patient is the launch
+// Patient ID, if the launch had one.
+exports.problems = function(context, encounterId, patientId) {
+  return fhir.read(context, 'Encounter', encounterId).then(encounter => {
+    const problems = [];
+    if (closedStatuses.indexOf(encounter.status) != -1) {
+      problems.push('The Encounter is ' + encounter.status);
+    }
+    const classes = [].concat(encounter.class || []).map(kind => {
+      // R4 has a Coding, R5 CodeableConcepts.
+      return kind.code || ((kind.coding || [])[0] || {}).code;
+    }).filter(code => code);
+    if (classes.length && !classes.some(code => virtualClasses().indexOf(code) != -1)) {
+      problems.push('The Encounter class ' + classes.join(', ') + ' is not a virtual visit');
+    }
+    const subject = /(Patient\/[^\/]+)$/.exec((encounter.subject && encounter.subject.reference) || '');
+    if (patientId && (!subject || subject[1] != 'Patient/' + patientId)) {
+      problems.push('The Encounter does not belong to the launch Patient');
+    }
+    return problems;
+  }, err => {
+    if (err.response && (err.response.status == 404 || err.response.status == 410)) {
+      return ['The Encounter does not exist'];
+    }
+    throw err;
+  });
+};
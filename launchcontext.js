@@ -0,0 +1,90 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The launch context of a session: the patient, encounter and practitioner
+// of the visit it launched, its tenant and the meeting it was given.  The
+// fields are kept together in the session cookie's launch field, except the
+// tenant, which is part of the session context.  Handlers read and write
+// them through get and set rather than ad hoc session properties.
+
+const calendar = require('./calendar.js');
+const sessionformat = require('./sessionformat.js');
+const sessioncontext = require('./sessioncontext.js');
+
+// The fields of the launch context.
+const fields = ['patientId', 'encounterId', 'practitioner', 'tenantId', 'meetUrl', 'conferenceId'];
+
+exports.fields = fields;
+
+// Sessions from before the launch context kept the practitioner in the
+// session's identity field.
+sessionformat.register(0, session => {
+  if (session.identity !== undefined) {
+    const launch = session.launch || {};
+    if (session.identity && !launch.practitioner) {
+      launch.practitioner = session.identity;
+    }
+    delete session.identity;
+    session.launch = launch;
+  }
+});
+
+function stored(request) {
+  return request.session.launch || {};
+}
+
+// Returns the request's launch context, with null for the fields that
+// weren't set.
+exports.get = function(request) {
+  const launch = stored(request);
+  const context = {};
+  fields.forEach(field => {
+    context[field] = launch[field] || null;
+  });
+  context.tenantId = sessioncontext.get(request).tenant || null;
+  return context;
+};
+
+// Changes fields of the request's launch context.  Setting meetUrl also sets
+// or clears the conferenceId, the meeting's code.  Fields other than those of the
+// launch context are rejected, as are values other than strings and null.
+exports.set = function(request, changes) {
+  Object.keys(changes).forEach(field => {
+    const value = changes[field];
+    if (fields.indexOf(field) == -1) {
+      throw new Error('Unknown launch context field ' + field);
+    }
+    if (value !== null && value !== undefined && typeof value != 'string') {
+      throw new Error('Launch context field ' + field + ' must be a string');
+    }
+  });
+
+  if ('meetUrl' in changes) {
+    changes = Object.assign({conferenceId: changes.meetUrl ? calendar.meetingCode(changes.meetUrl) : null}, changes);
+  }
+  const launch = Object.assign({}, stored(request));
+  Object.keys(changes).filter(field => field != 'tenantId').forEach(field => {
+    if (changes[field]) {
+      launch[field] = changes[field];
+    } else {
+      delete launch[field];
+    }
+  });
+  request.session.launch = launch;
+  if ('tenantId' in changes) {
+    sessioncontext.set(request, {tenant: changes.tenantId || undefined});
+  }
+};
@@ -0,0 +1,188 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Elects one instance to run background jobs in process, as set by
+// settings.jobs.inProcess, so replicas don't each repeat them.  The leader
+// holds a lease it renews every third of settings.leader.leaseSeconds (30
+// by default); if it dies the lease expires and another instance takes over
+// on its next attempt.  The lease is a datastore lock or, with
+// settings.leader.backend set to 'kubernetes', a coordination.k8s.io Lease
+// in the pod's namespace.
+
+const locks = require('./locks.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const fs = require('fs');
+const gaxios = require('gaxios');
+const https = require('https');
+const os = require('os');
+
+function options() {
+  return settings.leader || {};
+}
+
+function leaseMs() {
+  return (options().leaseSeconds || 30) * 1000;
+}
+
+function name() {
+  return options().name || 'meet-on-fhir-jobs';
+}
+
+// Identifies this instance as a lease holder.
+const identity = os.hostname() + '-' + crypto.randomBytes(4).toString('hex');
+
+// A lease kept as a datastore lock.
+function storeLease() {
+  var lock;
+  return {
+    // Resolves to whether this instance holds the lease after trying to
+    // take or renew it.
+    hold: () => {
+      const held = lock ? locks.renew(lock, leaseMs()) : Promise.resolve(false);
+      return held.then(renewed => {
+        if (renewed) {
+          return true;
+        }
+        return locks.acquire('leader:' + name(), leaseMs()).then(acquired => {
+          lock = acquired;
+          return !!lock;
+        });
+      });
+    },
+    release: () => lock ? locks.release(lock) : Promise.resolve(),
+  };
+}
+
+const SERVICE_ACCOUNT = '/var/run/secrets/kubernetes.io/serviceaccount/';
+
+// The time format of Lease fields, RFC 3339 with microseconds.
+function microTime(date) {
+  return date.toISOString().replace(/Z$/, '000Z');
+}
+
+// A lease kept as a Kubernetes Lease, updated with the pod's service account.
+// Updates carry the resourceVersion read, so of two instances taking an
+// expired lease at once only one succeeds.
+function kubernetesLease() {
+  const namespace = options().namespace || fs.readFileSync(SERVICE_ACCOUNT + 'namespace', 'utf8').trim();
+  const url = 'https://' + process.env.KUBERNETES_SERVICE_HOST + ':' + (process.env.KUBERNETES_SERVICE_PORT || 443) +
+    '/apis/coordination.k8s.io/v1/namespaces/' + namespace + '/leases';
+  const agent = new https.Agent({ca: fs.readFileSync(SERVICE_ACCOUNT + 'ca.crt')});
+  const request = (options) => gaxios.request(Object.assign({
+    headers: {Authorization: 'Bearer ' + fs.readFileSync(SERVICE_ACCOUNT + 'token', 'utf8').trim()},
+    agent: agent,
+  }, options)).then(response => response.data);
+
+  const spec = (lease, transitions) => {
+    const now = microTime(new Date());
+    return Object.assign({}, lease, {
+      holderIdentity: identity,
+      leaseDurationSeconds: Math.ceil(leaseMs() / 1000),
+      acquireTime: lease.holderIdentity == identity ? lease.acquireTime : now,
+      renewTime: now,
+      leaseTransitions: (lease.leaseTransitions || 0) + transitions,
+    });
+  };
+  const expired = (lease) => {
+    return !lease.holderIdentity || !lease.renewTime ||
+      new Date(lease.renewTime).getTime() + (lease.leaseDurationSeconds || 0) * 1000 < Date.now();
+  };
+  // Conflicts mean another instance changed the lease first.
+  const lost = (err) => {
+    if (err.response && err.response.status == 409) {
+      return false;
+    }
+    throw err;
+  };
+
+  return {
+    hold: () => {
+      return request({url: url + '/' + name()}).then(lease => {
+        if (lease.spec.holderIdentity != identity && !expired(lease.spec)) {
+          return false;
+        }
+        const transitions = lease.spec.holderIdentity == identity ? 0 : 1;
+        return request({
+          url: url + '/' + name(),
+          method: 'PUT',
+          data: {metadata: lease.metadata, spec: spec(lease.spec, transitions)},
+        }).then(() => true, lost);
+      }, err => {
+        if (!err.response || err.response.status != 404) {
+          throw err;
+        }
+        return request({
+          url: url,
+          method: 'POST',
+          data: {apiVersion: 'coordination.k8s.io/v1', kind: 'Lease', metadata: {name: name()}, spec: spec({}, 0)},
+        }).then(() => true, lost);
+      });
+    },
+    // Giving the lease up lets another instance take over without waiting
+    // for it to expire.
+    release: () => {
+      return request({url: url + '/' + name()}).then(lease => {
+        if (lease.spec.holderIdentity != identity) {
+          return;
+        }
+        return request({
+          url: url + '/' + name(),
+          method: 'PUT',
+          data: {metadata: lease.metadata, spec: Object.assign({}, lease.spec, {holderIdentity: null})},
+        });
+      });
+    },
+  };
+}
+
+var lease;
+var leader = false;
+var timer;
+
+// Whether this instance is the leader.
+exports.isLeader = function() {
+  return leader;
+};
+
+// Keeps trying to take, then renewing, the lease.  A leader that fails to
+// renew stops leading immediately, before its lease can expire.
+exports.start = function() {
+  lease = options().backend == 'kubernetes' ? kubernetesLease() : storeLease();
+  const attempt = () => {
+    lease.hold().catch(err => {
+      console.log('Leader election failed: ' + err);
+      return false;
+    }).then(held => {
+      if (held != leader) {
+        console.log(held ? 'This instance is now running background jobs as ' + identity :
+          'This instance is no longer running background jobs');
+      }
+      leader = held;
+    });
+  };
+  attempt();
+  timer = setInterval(attempt, leaseMs() / 3);
+};
+
+// Gives up leadership, for when the instance shuts down.
+exports.stop = function() {
+  clearInterval(timer);
+  leader = false;
+  return lease ? lease.release().catch(err => console.log('Failed to release the leader lease: ' + err)) : Promise.resolve();
+};
@@ -0,0 +1,92 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Legal holds exempting records from retention purges and erasure while
+// litigation requires them.  A hold names a patient, encounters or both, with
+// the reason for it, and is kept as a 'Hold' entity until an admin releases
+// it.  Erasure requests for a held patient or encounter are refused, and the
+// retention job keeps held encounters' meeting records and stops pruning the
+// audit log at their first record.  A patient's hold covers the encounters
+// whose meeting records name the patient, as well as those it lists.
+
+const datastore = require('./datastore.js');
+const errors = require('./errors.js');
+
+const crypto = require('crypto');
+
+function holdKey(id) {
+  return datastore.key(['Hold', id]);
+}
+
+function view(id, entity) {
+  return {
+    id: id,
+    patient: entity.Patient || undefined,
+    encounterIds: entity.Encounters,
+    reason: entity.Reason,
+    created: entity.Created,
+  };
+}
+
+// Places a hold, resolving to it.
+exports.place = function(patient, encounterIds, reason) {
+  const id = crypto.randomBytes(8).toString('hex');
+  const entity = {Patient: patient || '', Encounters: encounterIds || [], Reason: reason, Created: new Date()};
+  return datastore.set(holdKey(id), entity).then(() => view(id, entity));
+};
+
+exports.list = function() {
+  return datastore.list('Hold').then(entities => entities.map(entity => view(datastore.name(entity), entity)));
+};
+
+// Releases a hold, resolving to whether it existed.
+exports.release = function(id) {
+  const key = holdKey(id);
+  return datastore.get(key).then(entity => entity ? datastore.delete(key).then(() => true) : false);
+};
+
+// The patient's ID, from a reference such as Patient/123 or an absolute URL
+// ending in one.
+function patientId(patient) {
+  const match = /(?:^|\/)Patient\/([^\/]+)$/.exec(patient);
+  return match ? match[1] : patient;
+}
+
+// Resolves to the set of held encounter IDs, those the holds list and those
+// of the held patients' stored meeting records.
+exports.encounters = function() {
+  return datastore.list('Hold').then(entities => {
+    const patients = entities.filter(entity => entity.Patient).map(entity => patientId(entity.Patient));
+    return Promise.all(patients.map(id => datastore.list('Encounter', [['Patient', '=', id]]))).then(results => {
+      const listed = [].concat.apply([], entities.map(entity => entity.Encounters || []));
+      const stored = [].concat.apply([], results).map(entity => datastore.name(entity));
+      return new Set(listed.concat(stored));
+    });
+  });
+};
+
+// Rejects with LegalHold if the patient or any of the encounters is held.
+exports.check = function(patient, encounterIds) {
+  return datastore.list('Hold').then(entities => {
+    const held = entities.find(entity => {
+      return (patient && entity.Patient == patient) ||
+        (entity.Encounters || []).some(id => encounterIds.indexOf(id) != -1);
+    });
+    if (held) {
+      throw new errors.LegalHold('Hold ' + datastore.name(held) + ' covers this patient or encounter');
+    }
+  });
+};
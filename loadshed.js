@@ -0,0 +1,92 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Admission control.  When the instance is overloaded, by the requests it
+// is serving, the recent latency of the datastore or the queued tasks it is
+// still running, new requests are refused at once with overloaded and a
+// Retry-After header rather than queueing behind the others and timing out.
+// Requests of sessions already in a visit are only refused past twice the
+// thresholds, so a spike of new launches doesn't degrade visits under way.
+
+const errors = require('./errors.js');
+const instrumentation = require('./instrumentation.js');
+const launchcontext = require('./launchcontext.js');
+const queue = require('./queue.js');
+const versions = require('./versions.js');
+
+const settings = require('./settings.json');
+
+var inFlight = 0;
+var shed = 0;
+
+function options() {
+  return Object.assign({maxInFlight: 200, maxStoreLatencyMs: 500, maxQueueDepth: 100, retryAfterSeconds: 5},
+    settings.loadShedding);
+}
+
+exports.enabled = function() {
+  return !!(settings.loadShedding && settings.loadShedding.enabled);
+};
+
+// Returns the current load with each threshold.
+exports.state = function() {
+  const limits = options();
+  return {
+    inFlight: {value: inFlight, limit: limits.maxInFlight},
+    storeLatencyMs: {value: Math.round(instrumentation.store.recentLatency()), limit: limits.maxStoreLatencyMs},
+    queueDepth: {value: queue.pending(), limit: limits.maxQueueDepth},
+    shed: shed,
+  };
+};
+
+// Returns the measurement at its threshold, scaled by factor, or undefined
+// if none is.
+function overloaded(factor) {
+  const state = exports.state();
+  return Object.keys(state).find(name => state[name].limit && state[name].value >= state[name].limit * factor);
+}
+
+// Counts requests in flight and refuses requests while the instance is
+// overloaded.  Scheduled jobs and admin requests are always let through.
+exports.middleware = function(request, response, next) {
+  const path = versions.path(request);
+  if (!exports.enabled() || path.startsWith('/jobs/') || path.startsWith('/admin/')) {
+    next();
+    return;
+  }
+
+  const inVisit = !!launchcontext.get(request).meetUrl;
+  const reason = overloaded(inVisit ? 2 : 1);
+  if (reason) {
+    shed++;
+    const err = new errors.Overloaded('The server is at its ' + reason + ' limit');
+    err.retryAfter = options().retryAfterSeconds;
+    errors.send(response, err);
+    return;
+  }
+
+  inFlight++;
+  var done = false;
+  const finish = () => {
+    if (!done) {
+      done = true;
+      inFlight--;
+    }
+  };
+  response.on('finish', finish);
+  response.on('close', finish);
+  next();
+};
@@ -0,0 +1,115 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Generates launch, meeting creation and meeting retrieval traffic against a
+// running instance and reports latency percentiles for each.
+//
+// Usage: node loadtest.js [--target=http://localhost:8080] [--concurrency=10]
+//                         [--duration=30] [--store=label] [--cookie=session=...]
+//
+// Every worker repeatedly launches (GET /v1/settings), creates a meeting for a
+// new encounter (POST /v1/hangouts) and retrieves it as the patient would (GET
+// /v1/hangouts/{id}).  Creating meetings requires a signed in provider, so run
+// against an instance in development mode or pass a provider's session
+// cookie.  --store labels the report with the datastore the instance uses,
+// so runs against different backends can be compared.
+
+const crypto = require('crypto');
+const gaxios = require('gaxios');
+
+function parseArgs(argv) {
+  const args = {};
+  argv.forEach(arg => {
+    const match = /^--([^=]+)=(.*)$/.exec(arg);
+    if (match) {
+      args[match[1]] = match[2];
+    }
+  });
+  return args;
+}
+
+const args = parseArgs(process.argv.slice(2));
+const target = (args.target || 'http://localhost:8080').replace(/\/+$/, '');
+const concurrency = parseInt(args.concurrency || '10', 10);
+const duration = parseInt(args.duration || '30', 10) * 1000;
+const headers = args.cookie ? {Cookie: args.cookie} : {};
+
+const results = {launch: [], save: [], retrieve: []};
+const errors = {launch: 0, save: 0, retrieve: 0};
+
+function timed(operation, options) {
+  const start = process.hrtime();
+  return gaxios.request(Object.assign({headers: headers, validateStatus: () => true}, options)).then(response => {
+    const elapsed = process.hrtime(start);
+    results[operation].push(elapsed[0] * 1000 + elapsed[1] / 1e6);
+    if (response.status >= 400) {
+      errors[operation]++;
+    }
+    return response;
+  }).catch(err => {
+    errors[operation]++;
+    return null;
+  });
+}
+
+function visit() {
+  const encounterId = 'load-' + crypto.randomBytes(8).toString('hex');
+  return timed('launch', {url: target + '/v1/settings'}).then(() => {
+    return timed('save', {
+      url: target + '/v1/hangouts',
+      method: 'POST',
+      headers: Object.assign({'Content-Type': 'application/x-www-form-urlencoded'}, headers),
+      data: 'encounterId=' + encounterId,
+    });
+  }).then(() => {
+    return timed('retrieve', {url: target + '/v1/hangouts/' + encounterId});
+  });
+}
+
+function worker(deadline) {
+  if (Date.now() >= deadline) {
+    return Promise.resolve();
+  }
+  return visit().then(() => worker(deadline));
+}
+
+function percentile(sorted, p) {
+  if (sorted.length == 0) {
+    return 0;
+  }
+  return sorted[Math.min(sorted.length - 1, Math.floor(sorted.length * p / 100))];
+}
+
+function report() {
+  console.log('Target ' + target + (args.store ? ' (store: ' + args.store + ')' : '') +
+    ', ' + concurrency + ' workers for ' + duration / 1000 + 's');
+  console.log('operation  requests  errors     p50     p90     p99     max  (ms)');
+  Object.keys(results).forEach(operation => {
+    const sorted = results[operation].slice().sort((a, b) => a - b);
+    const columns = [percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99), sorted[sorted.length - 1] || 0];
+    console.log(operation.padEnd(9) +
+      String(sorted.length).padStart(10) +
+      String(errors[operation]).padStart(8) +
+      columns.map(value => value.toFixed(1).padStart(8)).join(''));
+  });
+}
+
+const deadline = Date.now() + duration;
+const workers = [];
+for (var i = 0; i < concurrency; i++) {
+  workers.push(worker(deadline));
+}
+Promise.all(workers).then(report);
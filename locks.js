@@ -0,0 +1,122 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Locks coordinating instances that would otherwise repeat each other's side
+// effects, such as creating two meetings for one encounter.  A lock is a
+// 'Lock' entity holding its owner and expiry, so a holder that dies only
+// blocks others until the lock expires.
+//
+// Each acquisition gets a fencing token larger than every earlier one for
+// the same lock.  Records written under a lock keep the token, and writes
+// with an older token are refused, so a holder whose lock expired while it
+// was working can't overwrite its successor's work.
+
+const clock = require('./clock.js');
+const datastore = require('./datastore.js');
+
+const crypto = require('crypto');
+
+// How long locks are kept after they expire.  Tokens are at least the time
+// they were issued, so later tokens are larger even once a lock is deleted.
+const KEEP_MS = 24 * 60 * 60 * 1000;
+
+function key(name) {
+  return datastore.key(['Lock', name]);
+}
+
+function tryAcquire(name, ttl) {
+  const owner = crypto.randomBytes(16).toString('hex');
+  const now = clock.now();
+  return datastore.modify(key(name), current => {
+    if (current && current.Expires.getTime() > now) {
+      return undefined;
+    }
+    return {
+      Owner: owner,
+      Token: Math.max(now, current ? current.Token + 1 : 0),
+      Expires: new Date(now + ttl),
+    };
+  }).then(entity => entity && {name: name, owner: owner, token: entity.Token});
+}
+
+// Resolves to the lock { name, owner, token } once acquired for ttl
+// milliseconds, or undefined if another holder still has it after waiting
+// up to wait milliseconds.
+exports.acquire = function(name, ttl, wait) {
+  const giveUp = Date.now() + (wait || 0);
+  const attempt = () => tryAcquire(name, ttl).then(lock => {
+    if (lock || Date.now() >= giveUp) {
+      return lock;
+    }
+    return new Promise(resolve => setTimeout(resolve, 250)).then(attempt);
+  });
+  return attempt();
+};
+
+// Extends a lock for another ttl milliseconds, resolving to whether it was
+// still held.
+exports.renew = function(lock, ttl) {
+  return datastore.modify(key(lock.name), current => {
+    if (!current || current.Owner != lock.owner || current.Expires.getTime() <= clock.now()) {
+      return undefined;
+    }
+    return Object.assign(current, {Expires: new Date(clock.now() + ttl)});
+  }).then(entity => !!entity);
+};
+
+// Releases a lock unless it has expired and been taken by someone else.
+exports.release = function(lock) {
+  return datastore.modify(key(lock.name), current => {
+    if (!current || current.Owner != lock.owner) {
+      return undefined;
+    }
+    return Object.assign(current, {Expires: clock.date()});
+  });
+};
+
+// Runs run(lock) holding the lock, releasing it when run settles.  If the
+// lock can't be acquired, resolves to what busy() returns instead.
+exports.run = function(name, ttl, wait, run, busy) {
+  return exports.acquire(name, ttl, wait).then(lock => {
+    if (!lock) {
+      return busy();
+    }
+    return Promise.resolve().then(() => run(lock)).then(result => {
+      return exports.release(lock).then(() => result);
+    }, err => {
+      return exports.release(lock).then(() => {
+        throw err;
+      });
+    });
+  });
+};
+
+// Whether the holder of lock may overwrite entity, a record written under a
+// lock of the same name: only if no later holder has written it since.
+exports.fenced = function(entity, lock) {
+  return !entity || !entity.Fence || entity.Fence <= lock.token;
+};
+
+// Deletes locks that expired long enough ago, resolving to how many were
+// deleted.
+exports.purge = function(now) {
+  const cutoff = new Date(now.getTime() - KEEP_MS);
+  return datastore.list('Lock', [['Expires', '<', cutoff]]).then(entities => {
+    return Promise.all(entities.map(entity => {
+      return datastore.delete(key(datastore.name(entity)));
+    })).then(() => entities.length);
+  });
+};
@@ -0,0 +1,57 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// SMART Web Messaging between the web client and the EHR window embedding
+// it.  The EHR's token response gives the client a messaging handle and the
+// origin of the EHR window; the client only exchanges messages with origins
+// configured here, in the tenant's webMessaging or settings.webMessaging,
+// which pages are rendered with.  webMessaging.meetingActivity names the EHR
+// activity, launched with ui.launchActivity, that opens a meeting link; EHRs
+// without one have meetings opened in a new window.
+
+const tenants = require('./tenants.js');
+
+const settings = require('./settings.json');
+
+function options(tenant) {
+  return Object.assign({}, settings.webMessaging, tenants.config(tenant).webMessaging);
+}
+
+exports.enabled = function(tenant) {
+  return !!options(tenant).enabled;
+};
+
+// Returns the origins of EHR windows the tenant's clients may message.
+// Origins must be exact, such as https://ehr.example.org.
+exports.origins = function(tenant) {
+  return (options(tenant).origins || []).filter(origin => /^https:\/\/[^\s/]+$/.test(origin));
+};
+
+// Returns the SMART scopes the client requests for messaging.
+exports.scopes = function(tenant) {
+  return exports.enabled(tenant) ? ['messaging/ui.launchActivity'] : [];
+};
+
+// Returns the page variables of the bridge to a tenant's EHR.
+exports.variables = function(tenant) {
+  if (!exports.enabled(tenant)) {
+    return {messagingOrigins: '', messagingMeetingActivity: ''};
+  }
+  return {
+    messagingOrigins: exports.origins(tenant).join(' '),
+    messagingMeetingActivity: options(tenant).meetingActivity || '',
+  };
+};
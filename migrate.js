@@ -0,0 +1,210 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Copies stored records between datastores.
+//
+// Usage: node migrate.js export > records.ndjson
+//        node migrate.js import < records.ndjson
+//        node migrate.js copy
+//        node migrate.js reindex
+//        node migrate.js namespaces
+//
+// export reads from settings.datastore, import writes to
+// settings.datastoreMigration and copy does both.  Records are upserted, so
+// running a copy again after enabling dual writes is safe.  reindex adds the
+// existing records to the indexes in datastore.indexes.  namespaces moves
+// the records of each tenant kept in the default namespace to the tenant's,
+// after enabling settings.datastore.tenantNamespaces.  Every kind in
+// datastore.kinds is copied.  Credentials are decrypted and re-encrypted on
+// import under settings.datastoreMigration.credentialKeyId, or else
+// settings.credentialKeyId, so that the target can have keys of its own.
+
+require('./environment.js');
+
+const audit = require('./audit.js');
+const credentials = require('./credentials.js');
+const datastore = require('./datastore.js');
+const tenancy = require('./tenancy.js');
+const tenants = require('./tenants.js');
+
+const settings = require('./settings.json');
+
+const readline = require('readline');
+
+const kinds = datastore.kinds;
+
+// Dates don't survive JSON, so they are tagged.
+function encode(entity) {
+  const data = {};
+  Object.keys(entity).forEach(property => {
+    const value = entity[property];
+    data[property] = value instanceof Date ? {$date: value.toISOString()} : value;
+  });
+  return data;
+}
+
+function decode(data) {
+  const entity = {};
+  Object.keys(data).forEach(property => {
+    const value = data[property];
+    entity[property] = value && value.$date ? new Date(value.$date) : value;
+  });
+  return entity;
+}
+
+// With tenant namespaces each tenant's records are exported with its ID, and
+// the shared records once.
+function exportRecords(source, write) {
+  return tenancy.each(() => {
+    const tenant = tenancy.current();
+    return kinds.filter(kind => {
+      return !tenant || tenant == tenants.DEFAULT || datastore.sharedKinds.indexOf(kind) == -1;
+    }).reduce((done, kind) => {
+      return done.then(() => source.list(kind)).then(entities => {
+        entities.forEach(entity => {
+          const record = {kind: kind, name: datastore.name(entity), data: encode(entity)};
+          if (tenant && tenant != tenants.DEFAULT) {
+            record.tenant = tenant;
+          }
+          write(record);
+        });
+      });
+    }, Promise.resolve());
+  });
+}
+
+function targetKeyId() {
+  return (settings.datastoreMigration || {}).credentialKeyId || settings.credentialKeyId;
+}
+
+// Writes a record to target.  Resolves to whether it was a credential.
+function importRecord(target, record) {
+  return Promise.resolve(decode(record.data)).then(entity => {
+    const credential = record.kind == 'Credential';
+    return tenancy.run(record.tenant, () => {
+      return target.upsert(datastore.key([record.kind, record.name]),
+        credential ? credentials.reencrypt(record.name, entity, targetKeyId()) : entity);
+    }).then(() => credential);
+  });
+}
+
+// Records that credentials were decrypted to copy them, once per run rather
+// than for each credential.
+function auditCopy(writes) {
+  return Promise.all(writes).then(imported => {
+    return imported.some(credential => credential) ? audit.record('credentials-reencrypted', 'system', '') : undefined;
+  });
+}
+
+// The tenant of a record in the default namespace: its own Tenant, or that of
+// the meeting or session it belongs to.
+function tenantOf(entity, name, meetings, sessions) {
+  return entity.Tenant || meetings[entity.Encounter] || meetings[name] || sessions[name] ||
+    sessions[entity.Owner] || tenants.DEFAULT;
+}
+
+// Moves the records of tenants other than the default from the default
+// namespace to their own, then indexes each tenant's records.
+function moveToNamespaces() {
+  const meetings = {};
+  const sessions = {};
+  const movable = kinds.filter(kind => kind != 'Index' && datastore.sharedKinds.indexOf(kind) == -1);
+  return tenancy.run(tenants.DEFAULT, () => {
+    return Promise.all([datastore.list('Encounter'), datastore.list('User')]).then(results => {
+      results[0].forEach(entity => {
+        meetings[datastore.name(entity)] = entity.Tenant;
+      });
+      results[1].forEach(entity => {
+        sessions[datastore.name(entity)] = entity.Tenant;
+      });
+      return movable.reduce((done, kind) => done.then(() => datastore.list(kind)).then(entities => {
+        const moving = entities.filter(entity => {
+          return tenantOf(entity, datastore.name(entity), meetings, sessions) != tenants.DEFAULT;
+        });
+        return moving.reduce((done, entity) => done.then(() => {
+          const name = datastore.name(entity);
+          const tenant = tenantOf(entity, name, meetings, sessions);
+          return tenancy.run(tenant, () => datastore.upsert(datastore.key([kind, name]), entity)).then(() => {
+            return datastore.delete(datastore.key([kind, name]));
+          });
+        }), Promise.resolve()).then(() => {
+          console.log('Moved ' + moving.length + ' ' + kind + ' records');
+        });
+      }), Promise.resolve());
+    });
+  }).then(() => reindex());
+}
+
+function reindex() {
+  return tenancy.each(() => Object.keys(datastore.indexes).reduce((done, kind) => {
+    return done.then(() => datastore.reindex(kind)).then(count => {
+      console.log('Indexed ' + count + ' ' + kind + ' records' + (tenancy.current() ? ' of ' + tenancy.current() : ''));
+    });
+  }, Promise.resolve()));
+}
+
+function target() {
+  if (!settings.datastoreMigration) {
+    throw new Error('settings.datastoreMigration is not configured');
+  }
+  return datastore.open(settings.datastoreMigration);
+}
+
+function run(command) {
+  switch (command) {
+    case 'export':
+      return exportRecords(datastore.open(settings.datastore), record => {
+        process.stdout.write(JSON.stringify(record) + '\n');
+      });
+
+    case 'import': {
+      const store = target();
+      const writes = [];
+      const lines = readline.createInterface({input: process.stdin});
+      lines.on('line', line => {
+        if (line.trim()) {
+          writes.push(importRecord(store, JSON.parse(line)));
+        }
+      });
+      return new Promise(resolve => lines.on('close', resolve)).then(() => auditCopy(writes));
+    }
+
+    case 'copy': {
+      const store = target();
+      const writes = [];
+      return exportRecords(datastore.open(settings.datastore), record => {
+        writes.push(importRecord(store, record));
+      }).then(() => auditCopy(writes));
+    }
+
+    case 'reindex':
+      return reindex();
+
+    case 'namespaces':
+      if (!tenancy.enabled()) {
+        return Promise.reject(new Error('settings.datastore.tenantNamespaces is not enabled'));
+      }
+      return moveToNamespaces();
+
+    default:
+      return Promise.reject(new Error('Usage: node migrate.js export|import|copy|reindex|namespaces'));
+  }
+}
+
+Promise.resolve(process.argv[2]).then(run).catch(err => {
+  console.log(err);
+  process.exitCode = 1;
+});
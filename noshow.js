@@ -0,0 +1,95 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Flags visits whose patient never joined.  When neither the patient's
+// waiting room nor their retrieval of the link was seen within
+// settings.noShow.graceMinutes of the appointment start (or of the meeting's
+// creation, if later or the appointment is unknown), the visit is marked a
+// no-show: its Appointment is set to 'noshow', its Encounter optionally to
+// settings.noShow.encounterStatus, and a visit.noshow event is published,
+// asking for the patient to be rebooked when settings.noShow.rebook is set.
+
+const audit = require('./audit.js');
+const datastore = require('./datastore.js');
+const events = require('./events.js');
+const fhir = require('./fhir.js');
+const user = require('./user.js');
+
+const settings = require('./settings.json');
+
+function options() {
+  return settings.noShow || {};
+}
+
+function graceMs() {
+  return (options().graceMinutes || 15) * 60 * 1000;
+}
+
+// When the grace window of a meeting started.
+function windowStart(entity) {
+  const start = entity.AppointmentStart;
+  return start && start > entity.Created ? start : entity.Created;
+}
+
+function update(context, resourceType, id, changes) {
+  return fhir.update(context, resourceType, id, resource => {
+    return Object.keys(changes).every(field => resource[field] == changes[field]) ? undefined : changes;
+  });
+}
+
+// Writes the no-show to the EHR with the FHIR context the meeting owner's
+// session last used.
+function writeBack(entity) {
+  const encounterId = datastore.name(entity);
+  return (entity.Owner ? user.fhirContextFor(entity.Owner) : Promise.resolve()).then(context => {
+    if (!context) {
+      console.log('Encounter ' + encounterId + ' is a no-show but the EHR could not be updated');
+      return;
+    }
+    const appointmentId = (entity.Appointment || '').split('/Appointment/')[1];
+    return Promise.all([
+      appointmentId && update(context, 'Appointment', appointmentId, {status: 'noshow'}),
+      options().encounterStatus && update(context, 'Encounter', encounterId, {status: options().encounterStatus}),
+    ]);
+  }).catch(err => {
+    console.log('Failed to record no-show of encounter ' + encounterId + ': ' + err);
+  });
+}
+
+exports.run = function() {
+  if (!options().enabled) {
+    return Promise.resolve({noShows: 0});
+  }
+
+  const now = new Date();
+  const cutoff = new Date(now.getTime() - graceMs());
+  return datastore.list('Encounter', [['Created', '<', cutoff]]).then(entities => {
+    const missed = entities.filter(entity => {
+      return !entity.Closed && !entity.NoShow && !entity.PatientJoined && !entity.PatientWaiting &&
+        windowStart(entity) < cutoff;
+    });
+    return Promise.all(missed.map(entity => {
+      const encounterId = datastore.name(entity);
+      return datastore.modify(datastore.key(['Encounter', encounterId]), current => {
+        return current && Object.assign(current, {NoShow: now});
+      }).then(() => {
+        events.publish('visit.noshow', {encounterId: encounterId, rebook: !!options().rebook});
+        audit.record('visit-noshow', 'system', encounterId);
+        return writeBack(entity);
+      });
+    })).then(() => ({noShows: missed.length}));
+  });
+};
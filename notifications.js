@@ -0,0 +1,111 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Notifications to patients and clinicians.  A notification is a message
+// with a recipient (a FHIR reference), a subject, text and optionally a link,
+// sent over the channel settings.notifications.channel names:
+//
+//   fhir     A FHIR Communication to the recipient, which the EHR delivers
+//            through its patient portal or inbox.  Needs a FHIR context.
+//   webhook  A JSON POST of the message to settings.notifications.webhookUrl,
+//            for an organisation's own SMS or email gateway.
+//
+// Other channels can be added with setChannel, passing an object with a
+// send(message, context) method returning a promise.
+
+const chat = require('./chat.js');
+const fhir = require('./fhir.js');
+const queue = require('./queue.js');
+const tokenexchange = require('./tokenexchange.js');
+
+const settings = require('./settings.json');
+
+const gaxios = require('gaxios');
+
+function options() {
+  return settings.notifications || {};
+}
+
+const channels = {
+  fhir: {
+    send: (message, context) => {
+      if (!context) {
+        return Promise.reject(new Error('No FHIR context to send a Communication with'));
+      }
+      const payload = [{contentString: message.text + (message.url ? ' ' + message.url : '')}];
+      if (message.attachment) {
+        payload.push({contentAttachment: message.attachment});
+      }
+      const communication = {
+        resourceType: 'Communication',
+        status: 'completed',
+        recipient: [{reference: message.to}],
+        topic: {text: message.subject},
+        sent: new Date().toISOString(),
+        payload: payload,
+      };
+      if (message.encounterId) {
+        communication.encounter = {reference: 'Encounter/' + message.encounterId};
+      }
+      return fhir.create(context, communication);
+    },
+  },
+  webhook: {
+    send: (message) => {
+      return gaxios.request({
+        url: options().webhookUrl,
+        method: 'POST',
+        data: message,
+      });
+    },
+  },
+};
+
+exports.setChannel = function(name, channel) {
+  channels[name] = channel;
+};
+
+exports.enabled = function() {
+  return !!channels[options().channel];
+};
+
+function deliver(message, context) {
+  return tokenexchange.forService(context, 'notifications').then(context => {
+    return channels[options().channel].send(message, context);
+  });
+}
+
+function undelivered(message, err) {
+  console.log('Failed to send ' + message.kind + ' notification: ' + err);
+  return message.encounterId ?
+    chat.post(message.encounterId, 'delivery-failed', 'A ' + message.kind + ' notification to the patient could not be sent') :
+    Promise.resolve();
+}
+
+queue.handle('notification', deliver, undelivered);
+
+// Sends a notification, resolving to whether it was sent, or with the queue
+// enabled queued.  Failures are logged rather than returned so that they
+// don't break visits.  Channels are given a token exchanged for the
+// notifications service.
+exports.send = function(message, context) {
+  if (!channels[options().channel]) {
+    return Promise.resolve(false);
+  }
+  return queue.enqueue('notification', message, context).then(() => true, err => {
+    return undelivered(message, err).then(() => false);
+  });
+};
@@ -0,0 +1,369 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The OpenAPI 3.1 description of the server's REST API, served at
+// /openapi.json.  Operations are declared here next to one another rather
+// than generated from the routes, and undocumented() lists routes missing
+// from the description so drift shows up in development mode.  Request
+// bodies are described by the schemas they are validated with.
+
+const schemas = require('./schemas.js');
+
+function parameter(name, location, description, required) {
+  return {
+    name: name,
+    in: location,
+    description: description,
+    required: location == 'path' || !!required,
+    schema: {type: 'string'},
+  };
+}
+
+const encounterId = parameter('encounterId', 'path', 'The FHIR Encounter ID');
+const token = parameter('token', 'path', 'The token from the link');
+const queueName = parameter('queue', 'path', 'The front desk queue');
+
+// A form or JSON request body matching a schema from schemas.js.
+function body(schema) {
+  return {
+    content: {
+      'application/x-www-form-urlencoded': {schema: schema},
+      'application/json': {schema: schema},
+    },
+  };
+}
+
+const problem = {$ref: '#/components/responses/Problem'};
+
+function responses(description) {
+  return {
+    200: {description: description, content: {'application/json': {schema: {type: 'object'}}}},
+    default: problem,
+  };
+}
+
+// Security requirements of the three kinds of caller.
+const fhirContext = [{fhirServer: [], fhirToken: []}];
+const adminToken = [{adminToken: []}];
+
+function operation(summary, options) {
+  options = options || {};
+  const result = {summary: summary, responses: responses(options.returns || 'Success')};
+  if (options.security) {
+    result.security = options.security;
+  }
+  if (options.parameters) {
+    result.parameters = options.parameters;
+  }
+  if (options.body) {
+    result.requestBody = options.body;
+  }
+  return result;
+}
+
+const paths = {
+  '/hangouts/{encounterId}': {
+    get: operation("Returns the meeting link of a visit for the patient", {
+      parameters: [encounterId], returns: 'The meeting URL'}),
+  },
+  '/hangouts': {
+    post: operation("Creates or returns the meeting of an encounter for the signed in provider", {
+      body: body(schemas.hangout),
+      returns: 'The meeting URL, or the URL to sign in with'}),
+  },
+  '/groups': {
+    post: operation('Creates one meeting shared by several encounters', {
+      security: fhirContext,
+      body: body(schemas.group)}),
+  },
+  '/encounters/{encounterId}/events': {
+    post: operation('Records a visit event and optionally moves the Encounter status', {
+      security: fhirContext, parameters: [encounterId],
+      body: body(schemas.event)}),
+  },
+  '/encounters/{encounterId}/consent': {
+    post: operation("Records the patient's consent", {
+      security: fhirContext, parameters: [encounterId],
+      body: body(schemas.consent)}),
+  },
+  '/encounters/{encounterId}/launch-check': {
+    post: operation('Checks the launch context against the EHR records', {
+      security: fhirContext, parameters: [encounterId],
+      body: body(schemas.launchCheck)}),
+  },
+  '/encounters/{encounterId}/care-team': {
+    get: operation("Lists the encounter's care team", {
+      security: fhirContext, parameters: [encounterId, parameter('user', 'query', "The provider's FHIR reference")]}),
+  },
+  '/encounters/{encounterId}/invitations': {
+    post: operation('Invites a care team member to the meeting', {
+      security: fhirContext, parameters: [encounterId],
+      body: body(schemas.invitation)}),
+  },
+  '/encounters/{encounterId}/verify': {
+    post: operation("Verifies the patient's identity", {
+      security: fhirContext, parameters: [encounterId],
+      body: body(schemas.verification)}),
+  },
+  '/encounters/{encounterId}/cancel': {
+    post: operation('Cancels the visit and closes its meeting', {security: fhirContext, parameters: [encounterId]}),
+  },
+  '/push/subscriptions': {
+    post: operation("Subscribes the provider's browser to push notifications", {
+      body: {content: {'application/json': {schema: schemas.pushSubscription}}}}),
+  },
+  '/surveys/{token}': {
+    get: operation('Redirects the patient to their survey', {parameters: [token]}),
+  },
+  '/surveys/{token}/completed': {
+    post: operation('Records that a survey was completed', {parameters: [token]}),
+  },
+  '/invitations/redeem': {
+    post: operation('Returns the meeting link of an invitation', {body: body(schemas.invitationRedeem)}),
+  },
+  '/failures': {
+    post: operation('Counts a failure seen by the browser', {body: body(schemas.failure)}),
+  },
+  '/subscriptions/appointments': {
+    post: operation('Receives Appointment notifications from EHR Subscriptions', {
+      security: [{subscriptionToken: []}],
+      parameters: [parameter('server', 'query', 'The FHIR server the Subscription belongs to', true)],
+      body: {content: {'application/fhir+json': {schema: {type: 'object'}}}}}),
+  },
+  '/admin/visits': {
+    get: operation('Lists visits with their periods', {
+      security: adminToken,
+      parameters: [parameter('since', 'query', 'Start date'), parameter('until', 'query', 'End date'),
+        parameter('patient', 'query', 'Only the visits of this FHIR Patient ID')]}),
+  },
+  '/admin/metrics': {
+    get: operation('Returns daily usage counters', {
+      security: adminToken,
+      parameters: [parameter('since', 'query', 'Start day (YYYY-MM-DD)'), parameter('until', 'query', 'End day (YYYY-MM-DD)')]}),
+  },
+  '/admin/stats': {
+    get: operation('Returns live counts for a dashboard', {security: adminToken}),
+  },
+  '/admin/stats/series': {
+    get: operation('Returns hourly statistics', {
+      security: adminToken, parameters: [parameter('hours', 'query', 'How many hours back, 24 by default')]}),
+  },
+  '/admin/features': {
+    get: operation('Lists the feature flags', {security: adminToken}),
+  },
+  '/admin/features/{name}': {
+    put: operation('Replaces a feature flag', {
+      security: adminToken, parameters: [parameter('name', 'path', 'The flag name')],
+      body: {content: {'application/json': {schema: schemas.feature}}}}),
+  },
+  '/admin/directory': {
+    get: operation('Lists the facility directory', {security: adminToken}),
+  },
+  '/admin/directory/seed': {
+    post: operation("Stores the facilities of a FHIR server's Endpoints", {
+      security: adminToken, body: {content: {'application/json': {schema: schemas.directorySeed}}}}),
+  },
+  '/admin/directory/{id}': {
+    patch: operation('Sets the Workspace domain of a seeded facility', {
+      security: adminToken, parameters: [parameter('id', 'path', 'The facility ID')],
+      body: {content: {'application/json': {schema: schemas.facility}}}}),
+  },
+  '/admin/queues': {
+    get: operation("Returns the metrics of a tenant's front desk queues", {
+      security: adminToken, parameters: [parameter('tenant', 'query', 'The tenant')]}),
+  },
+  '/admin/reload': {
+    post: operation("Reloads the settings that can change while running, on the instance serving the request", {
+      security: adminToken}),
+  },
+  '/admin/debug/vars': {
+    get: operation('Returns memory, CPU and event loop statistics', {security: adminToken}),
+  },
+  '/admin/debug/profile': {
+    get: operation('Returns a CPU profile', {
+      security: adminToken, parameters: [parameter('seconds', 'query', 'How many seconds to profile, 10 by default')]}),
+  },
+  '/admin/debug/heap': {
+    get: operation('Returns a heap snapshot', {security: adminToken}),
+  },
+  '/admin/debug/report': {
+    get: operation('Returns a diagnostic report with the stacks and handles', {security: adminToken}),
+  },
+  '/admin/audit/verify': {
+    get: operation('Verifies the audit log hash chain', {security: adminToken}),
+  },
+  '/admin/holds': {
+    get: operation('Lists the legal holds', {security: adminToken}),
+    post: operation("Places a legal hold on a patient's or encounters' records", {
+      security: adminToken, body: {content: {'application/json': {schema: schemas.hold}}}}),
+  },
+  '/admin/holds/{id}': {
+    delete: operation('Releases a legal hold', {
+      security: adminToken, parameters: [parameter('id', 'path', 'The hold ID')]}),
+  },
+  '/admin/erasure': {
+    post: operation("Erases the data held about a patient's encounters", {
+      security: adminToken, body: {content: {'application/json': {schema: schemas.erasure}}}}),
+  },
+  '/admin/retention': {
+    get: operation('Reports what the retention policy would purge now', {security: adminToken}),
+  },
+  '/admin/sessions': {
+    get: operation("Returns snapshots of a FHIR user's sessions with their tokens redacted", {
+      security: adminToken, parameters: [parameter('identity', 'query', 'The FHIR user, such as Practitioner/123')]}),
+  },
+  '/admin/sessions/{reference}': {
+    get: operation('Returns a snapshot of a session with its tokens redacted', {
+      security: adminToken, parameters: [parameter('reference', 'path', 'The support reference of the session')]}),
+  },
+  '/admin/queue/dead': {
+    get: operation('Lists the dead lettered queue tasks', {security: adminToken}),
+  },
+  '/admin/queue/dead/{id}/retry': {
+    post: operation('Retries a dead lettered queue task', {
+      security: adminToken, parameters: [parameter('id', 'path', 'The task ID')]}),
+  },
+  '/jobs/{name}': {
+    get: operation('Runs a scheduled job', {
+      security: [{cron: []}, {adminToken: []}], parameters: [parameter('name', 'path', 'The job name')]}),
+  },
+  '/capabilities': {
+    get: operation('Returns the features the granted SMART scopes allow', {security: fhirContext}),
+  },
+  '/schedule': {
+    get: operation("Lists a practitioner's telehealth appointments for a day", {
+      security: fhirContext,
+      parameters: [parameter('practitioner', 'query', 'The Practitioner ID'), parameter('date', 'query', 'The day (YYYY-MM-DD)')]}),
+  },
+  '/queues/{queue}': {
+    get: operation("Lists a front desk queue's waiting and claimed patients", {
+      security: fhirContext,
+      parameters: [queueName, parameter('user', 'query', "The practitioner's FHIR reference", true)]}),
+  },
+  '/queues/{queue}/duty': {
+    put: operation('Puts a practitioner on or off duty for a queue', {
+      security: fhirContext, parameters: [queueName], body: body(schemas.queueDuty)}),
+  },
+  '/queues/{queue}/entries': {
+    post: operation('Puts a patient in a queue', {
+      security: fhirContext, parameters: [queueName], body: body(schemas.queueEntry)}),
+  },
+  '/queues/{queue}/entries/{encounterId}': {
+    delete: operation('Takes a waiting patient out of a queue', {
+      security: fhirContext, parameters: [queueName, encounterId]}),
+  },
+  '/queues/{queue}/entries/{encounterId}/claim': {
+    post: operation('Claims a waiting patient', {
+      security: fhirContext, parameters: [queueName, encounterId], body: body(schemas.queueClaim)}),
+  },
+  '/queues/{queue}/entries/{encounterId}/reassign': {
+    post: operation('Hands a claimed patient to another clinician or back to the queue', {
+      security: fhirContext, parameters: [queueName, encounterId], body: body(schemas.queueReassign)}),
+  },
+  '/handoffs': {
+    post: operation('Issues a code for continuing the visit on another device', {
+      security: fhirContext, body: body(schemas.handoff)}),
+  },
+  '/handoffs/redeem': {
+    post: operation('Continues a visit with a handoff code', {body: body(schemas.handoffRedeem)}),
+  },
+  '/api/session/ttl': {
+    get: operation("Returns the time left in the session or the patient's access", {
+      parameters: [parameter('encounterId', 'query', "The patient's encounter")]}),
+  },
+  '/.well-known/jwks.json': {
+    get: operation('Returns the public keys of the app as a backend service', {returns: 'The JWK Set'}),
+  },
+  '/.well-known/oauth-client.json': {
+    get: operation('Returns the OAuth client metadata to register the app with', {returns: 'RFC 7591 client metadata'}),
+  },
+  '/.well-known/smart-app.json': {
+    get: operation('Returns the SMART launch configuration of the app', {returns: 'The app manifest'}),
+  },
+  '/api/cookies/check': {
+    post: operation('Sets a session cookie to check it is kept', {returns: 'The token to check with'}),
+    get: operation('Reports whether the session cookie was kept', {
+      parameters: [parameter('token', 'query', 'The token from the POST', true)]}),
+  },
+  '/api/session/extend': {
+    post: operation("Extends the provider's session"),
+  },
+  '/authenticate': {
+    get: operation('Completes Google sign-in', {
+      parameters: [parameter('code', 'query', 'The authorization code'), parameter('state', 'query', 'The sign-in state')]}),
+  },
+  '/logout': {
+    get: operation('Signs the provider out'),
+  },
+  '/launches': {
+    post: operation('Records a SMART launch so it can only be used once', {
+      body: body(schemas.launch)}),
+  },
+  '/settings': {
+    get: operation('Returns the client settings for an EHR', {parameters: [parameter('iss', 'query', 'The FHIR server')]}),
+  },
+  '/openapi.json': {
+    get: operation('Returns this description'),
+  },
+};
+
+exports.spec = function() {
+  return {
+    openapi: '3.1.0',
+    info: {title: 'Meet on FHIR', version: '1'},
+    servers: [{url: '/v1'}],
+    paths: paths,
+    components: {
+      securitySchemes: {
+        fhirServer: {type: 'apiKey', in: 'header', name: 'X-FHIR-Server'},
+        fhirToken: {type: 'http', scheme: 'bearer', description: 'The EHR access token from the SMART launch'},
+        adminToken: {type: 'http', scheme: 'bearer', description: 'One of adminTokens'},
+        subscriptionToken: {type: 'http', scheme: 'bearer', description: 'One of the subscriptionTokens of the server parameter'},
+        cron: {type: 'apiKey', in: 'header', name: 'X-Appengine-Cron'},
+      },
+      responses: {
+        Problem: {
+          description: 'An RFC 7807 problem',
+          content: {'application/problem+json': {schema: {
+            type: 'object',
+            properties: {
+              type: {type: 'string'},
+              code: {type: 'string'},
+              title: {type: 'string'},
+              status: {type: 'integer'},
+              detail: {type: 'string'},
+            },
+          }}},
+        },
+      },
+    },
+  };
+};
+
+// Returns the "METHOD /path" of the app's routes missing from the
+// description, other than development mode's.
+exports.undocumented = function(app) {
+  const missing = [];
+  app._router.stack.filter(layer => layer.route).forEach(layer => {
+    const path = layer.route.path.replace(/:([A-Za-z]+)/g, '{$1}');
+    Object.keys(layer.route.methods).forEach(method => {
+      if (!path.startsWith('/dev') && !(paths[path] && paths[path][method])) {
+        missing.push(method.toUpperCase() + ' ' + layer.route.path);
+      }
+    });
+  });
+  return missing;
+};
@@ -0,0 +1,128 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The actual period of a visit, for time-based telehealth billing.  The visit
+// starts once both the provider and the patient have joined and ends when
+// the provider ends it, or else at the last time either joined or left: a
+// meeting closed by the cleanup job is closed hours after the visit.  With
+// settings.visitPeriod.meetRecords the start and end are taken from the Meet
+// conference records instead, which also see participants leaving.  The
+// period is stored on the meeting record and, with
+// settings.visitPeriod.writeEncounter, written to Encounter.period.  Billing
+// artifacts are created from it too, with a token exchanged for the records
+// service.
+
+const billing = require('./billing.js');
+const calendar = require('./calendar.js');
+const datastore = require('./datastore.js');
+const fhir = require('./fhir.js');
+const tokenexchange = require('./tokenexchange.js');
+const user = require('./user.js');
+
+const settings = require('./settings.json');
+
+function options() {
+  return settings.visitPeriod || {};
+}
+
+exports.meetRecords = function() {
+  return !!options().meetRecords;
+};
+
+function fromEvents(entity) {
+  if (!entity.ProviderJoined || !entity.PatientInMeeting) {
+    return undefined;
+  }
+  const start = entity.ProviderJoined > entity.PatientInMeeting ? entity.ProviderJoined : entity.PatientInMeeting;
+  const end = entity.Ended || lastActivity(entity);
+  return end && end > start ? {start: start, end: end} : undefined;
+}
+
+// The last time a participant joined or left the meeting.
+function lastActivity(entity) {
+  const times = [entity.ProviderJoined, entity.PatientInMeeting, entity.ProviderLeft, entity.PatientLeft]
+    .filter(time => time).map(time => time.getTime());
+  return times.length ? new Date(Math.max.apply(null, times)) : undefined;
+}
+
+function fromMeet(entity) {
+  if (!exports.meetRecords() || !entity.Owner || !entity.Url) {
+    return Promise.resolve(undefined);
+  }
+  return user.clientFor(entity.Owner).then(client => {
+    if (!client) {
+      return undefined;
+    }
+    return new Promise(resolve => {
+      calendar.conferenceRecords(client, entity.Url, (err, records) => {
+        if (err || !records || records.length == 0) {
+          resolve(undefined);
+          return;
+        }
+        const starts = records.map(record => new Date(record.startTime));
+        const ends = records.filter(record => record.endTime).map(record => new Date(record.endTime));
+        resolve(ends.length == 0 ? undefined : {
+          start: new Date(Math.min.apply(null, starts)),
+          end: new Date(Math.max.apply(null, ends)),
+        });
+      });
+    });
+  });
+}
+
+function writeEncounter(context, encounterId, period) {
+  return fhir.update(context, 'Encounter', encounterId, () => {
+    return {period: {start: period.start.toISOString(), end: period.end.toISOString()}};
+  });
+}
+
+// Records the period of an ended visit.  context is the FHIR context to
+// write Encounter.period with, or else the one the meeting owner's session
+// last used is tried.  Resolves to the period, or undefined if it isn't
+// known.
+exports.record = function(encounterId, context) {
+  const key = datastore.key(['Encounter', encounterId]);
+  return datastore.get(key).then(entity => {
+    if (!entity) {
+      return undefined;
+    }
+    return fromMeet(entity).then(period => period || fromEvents(entity)).then(period => {
+      if (!period) {
+        return undefined;
+      }
+      return datastore.modify(key, current => current && Object.assign(current, {
+        VisitStart: period.start,
+        VisitEnd: period.end,
+        VisitSeconds: Math.round((period.end - period.start) / 1000),
+      })).then(() => {
+        if (!options().writeEncounter && !billing.enabled()) {
+          return;
+        }
+        const fhirContext = context ? Promise.resolve(context) :
+          (entity.Owner ? user.fhirContextFor(entity.Owner) : Promise.resolve());
+        return fhirContext.then(fhirContext => tokenexchange.forService(fhirContext, 'records')).then(fhirContext => {
+          if (!fhirContext) {
+            return;
+          }
+          return (options().writeEncounter ? writeEncounter(fhirContext, encounterId, period) : Promise.resolve())
+            .then(() => billing.enabled() && billing.create(fhirContext, encounterId, period));
+        });
+      }).catch(err => {
+        console.log('Failed to write the period or billing of encounter ' + encounterId + ': ' + err);
+      }).then(() => period);
+    });
+  });
+};
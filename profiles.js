@@ -0,0 +1,166 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Validation of the resources the server writes against their profiles, so
+// that a write the EHR would reject fails with the elements at fault rather
+// than an opaque 422.  Encounters are checked against US Core and
+// Communications, which US Core doesn't profile, against the base resource.
+// Resources are checked with the constraints below or by the EHR's $validate
+// operation.
+
+const errors = require('./errors.js');
+
+const settings = require('./settings.json');
+
+// The constraints of each profile the server's writes can break, as
+// elements with their minimum cardinality and, for required bindings, their
+// codes.
+const profiles = {
+  Encounter: {
+    url: 'http://hl7.org/fhir/us/core/StructureDefinition/us-core-encounter',
+    elements: [
+      {path: 'status', min: 1, codes: ['planned', 'arrived', 'triaged', 'in-progress', 'onleave', 'finished',
+        'cancelled', 'entered-in-error', 'unknown']},
+      {path: 'class', min: 1},
+      {path: 'type', min: 1},
+      {path: 'subject', min: 1},
+    ],
+  },
+  Communication: {
+    url: 'http://hl7.org/fhir/StructureDefinition/Communication',
+    elements: [
+      {path: 'status', min: 1, codes: ['preparation', 'in-progress', 'not-done', 'on-hold', 'stopped', 'completed',
+        'entered-in-error', 'unknown']},
+      {path: 'recipient', min: 1},
+      {path: 'payload', min: 1, choice: ['contentString', 'contentAttachment', 'contentReference']},
+    ],
+  },
+};
+
+function options() {
+  return settings.profileValidation || {};
+}
+
+// 'off', 'warn' or 'block'.
+exports.mode = function() {
+  return options().mode || 'off';
+};
+
+exports.covers = function(resourceType) {
+  return exports.mode() != 'off' && !!profiles[resourceType];
+};
+
+// Returns the values at a dotted path, flattening arrays.
+function valuesAt(resource, path) {
+  return path.split('.').reduce((values, name) => {
+    return [].concat.apply([], values.map(value => [].concat(value[name] === undefined ? [] : value[name])));
+  }, [resource]);
+}
+
+// Returns the errors of a resource against the constraints of its profile,
+// each with the element it is about.
+function check(resource) {
+  const profile = profiles[resource.resourceType];
+  const problems = [];
+  profile.elements.forEach(element => {
+    const values = valuesAt(resource, element.path);
+    if (values.length < element.min) {
+      problems.push({field: element.path, message: 'is required by ' + profile.url});
+    }
+    if (element.codes) {
+      values.filter(value => element.codes.indexOf(value) == -1).forEach(value => {
+        problems.push({field: element.path, message: value + ' is not one of ' + element.codes.join(', ')});
+      });
+    }
+    if (element.choice) {
+      values.forEach((value, i) => {
+        if (element.choice.filter(name => value[name] !== undefined).length != 1) {
+          problems.push({field: element.path + '[' + i + ']', message: 'needs one of ' + element.choice.join(', ')});
+        }
+      });
+    }
+  });
+  if (resource.period && resource.period.start && resource.period.end && resource.period.start > resource.period.end) {
+    problems.push({field: 'period', message: 'ends before it starts'});
+  }
+  return problems;
+}
+
+// Returns the errors in the issues of an OperationOutcome.
+exports.outcomeErrors = function(outcome) {
+  return (outcome.issue || []).filter(issue => issue.severity == 'error' || issue.severity == 'fatal').map(issue => {
+    return {
+      field: (issue.expression || issue.location || [])[0] || '',
+      message: issue.diagnostics || (issue.details && issue.details.text) || issue.code,
+    };
+  });
+};
+
+// Returns the problem a write of a resource with these errors fails with.
+exports.problem = function(resourceType, problems) {
+  const err = new errors.InvalidResource(resourceType + ' ' +
+    problems.map(problem => (problem.field ? problem.field + ' ' : '') + problem.message).join('; '));
+  err.errors = problems;
+  return err;
+};
+
+// Resolves to the errors of a resource about to be written.  With
+// profileValidation.source 'server' the resource is sent to the EHR's
+// $validate, through request(options); an EHR that can't validate it leaves
+// it to the write.
+exports.validate = function(resource, request) {
+  if (options().source != 'server') {
+    return Promise.resolve(check(resource));
+  }
+  return request({
+    url: resource.resourceType + '/$validate',
+    method: 'POST',
+    headers: {'Content-Type': 'application/fhir+json'},
+    data: {
+      resourceType: 'Parameters',
+      parameter: [
+        {name: 'resource', resource: resource},
+        {name: 'profile', valueUri: profiles[resource.resourceType].url},
+      ],
+    },
+  }).then(outcome => exports.outcomeErrors(outcome), err => {
+    const outcome = err.response && err.response.data;
+    if (outcome && outcome.resourceType == 'OperationOutcome' && err.response.status < 500) {
+      const problems = exports.outcomeErrors(outcome);
+      if (problems.length) {
+        return problems;
+      }
+    }
+    console.log('Could not validate the ' + resource.resourceType + ' with the EHR: ' + err);
+    return [];
+  });
+};
+
+// Resolves if the resource can be written: it meets its profile, or
+// profileValidation.mode is 'warn' and the errors are logged.
+exports.enforce = function(resource, request) {
+  return exports.validate(resource, request).then(problems => {
+    if (!problems.length) {
+      return;
+    }
+    const err = exports.problem(resource.resourceType, problems);
+    if (exports.mode() == 'block') {
+      throw err;
+    }
+    console.log('Writing ' + (resource.id ? resource.resourceType + '/' + resource.id : 'a ' + resource.resourceType) +
+      ' that does not meet its profile: ' + err.message);
+  });
+};
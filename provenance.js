@@ -0,0 +1,119 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// FHIR Provenance for the resources the server writes to the EHR.  With
+// settings.provenance.enabled, every successful create or update of a
+// resource of settings.provenance.resourceTypes (Encounter, Appointment and
+// DocumentReference by default) is followed by a Provenance resource naming
+// the application as the device that made the change, the launching
+// practitioner as its author and the session, by its support reference, it
+// was made in.  A Provenance that can't be written is logged; the change it
+// describes has already been made.
+
+const launchcontext = require('./launchcontext.js');
+const snapshot = require('./snapshot.js');
+
+const settings = require('./settings.json');
+
+const defaultResourceTypes = ['Encounter', 'Appointment', 'DocumentReference'];
+
+const writes = {POST: 'CREATE', PUT: 'UPDATE', PATCH: 'UPDATE'};
+
+function options() {
+  return settings.provenance || {};
+}
+
+// The resource type and ID a request URL relative to the FHIR server names.
+function target(url) {
+  const match = /^([A-Z][A-Za-z]+)(?:\/([^\/?]+))?/.exec(url || '');
+  return match ? {resourceType: match[1], id: match[2] && decodeURIComponent(match[2])} : {};
+}
+
+// Returns whether a FHIR request, given as to fhir.request, needs a
+// Provenance once it succeeds.
+exports.covers = function(request) {
+  if (!options().enabled || !writes[request.method]) {
+    return false;
+  }
+  const resourceType = target(request.url).resourceType;
+  return resourceType != 'Provenance' && (options().resourceTypes || defaultResourceTypes).indexOf(resourceType) != -1;
+};
+
+// The scopes writing Provenance needs, requested when it is enabled.
+exports.scopes = function() {
+  return options().enabled ? ['user/Provenance.write', 'patient/Provenance.write'] : [];
+};
+
+// Returns who a request's changes are made by: the launching practitioner
+// and the session's support reference.
+exports.agent = function(request) {
+  const practitioner = launchcontext.get(request).practitioner || (request.body && request.body.user);
+  return {
+    practitioner: practitioner || undefined,
+    session: request.session && request.session.id ? snapshot.reference(request.session.id) : undefined,
+  };
+};
+
+// Returns the agent of a stored provider session, for changes made on its
+// behalf outside a request.
+exports.agentOf = function(id, practitioner) {
+  return {practitioner: practitioner || undefined, session: snapshot.reference(id)};
+};
+
+// Returns the Provenance of a write, given the request as to fhir.request,
+// the resource the server returned and the FHIR context's agent, or
+// undefined if the server didn't say what it created.
+exports.resource = function(request, written, agent) {
+  const named = target(request.url);
+  const id = (written && written.id) || named.id;
+  if (!id) {
+    return undefined;
+  }
+  const version = written && written.meta && written.meta.versionId;
+  agent = agent || {};
+
+  const device = {
+    type: {coding: [{
+      system: 'http://terminology.hl7.org/CodeSystem/provenance-participant-type',
+      code: 'device',
+    }]},
+    who: {display: options().application || 'Meet on FHIR'},
+  };
+  if (agent.session) {
+    device.who.identifier = {system: 'urn:meet-on-fhir:session', value: agent.session};
+  }
+  const agents = [device];
+  if (agent.practitioner) {
+    agents.push({
+      type: {coding: [{
+        system: 'http://terminology.hl7.org/CodeSystem/provenance-participant-type',
+        code: 'author',
+      }]},
+      who: {reference: agent.practitioner.replace(/^.*\/([A-Za-z]+\/[^\/]+)$/, '$1')},
+    });
+  }
+
+  return {
+    resourceType: 'Provenance',
+    target: [{reference: named.resourceType + '/' + id + (version ? '/_history/' + version : '')}],
+    recorded: new Date().toISOString(),
+    activity: {coding: [{
+      system: 'http://terminology.hl7.org/CodeSystem/v3-DataOperation',
+      code: writes[request.method],
+    }]},
+    agent: agents,
+  };
+};
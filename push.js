@@ -0,0 +1,131 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Web push notifications to clinicians, so the clinician who created a
+// meeting learns the moment the patient enters the waiting room even when
+// the EHR tab isn't focused.  The clinician's browser subscribes with the
+// VAPID public key in settings.push; subscriptions last as long as the
+// session they were made in.  Push services such as Firebase Cloud Messaging
+// deliver them using the Web Push protocol.
+
+const datastore = require('./datastore.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const webpush = require('web-push');
+
+function options() {
+  return settings.push || {};
+}
+
+exports.enabled = function() {
+  return !!options().publicKey && !!options().privateKey;
+};
+
+exports.publicKey = function() {
+  return exports.enabled() ? options().publicKey : undefined;
+};
+
+function key(endpoint) {
+  return datastore.key(['PushSubscription', crypto.createHash('sha256').update(endpoint).digest('hex')]);
+}
+
+// Stores a browser's push subscription for a provider session.  Resolves to
+// false if the session has expired.
+exports.subscribe = function(sessionId, subscription) {
+  return datastore.get(datastore.key(['User', sessionId])).then(entity => {
+    if (!entity || !entity.Expires || entity.Expires < new Date()) {
+      return false;
+    }
+    return datastore.upsert(key(subscription.endpoint), {
+      User: sessionId,
+      Subscription: JSON.stringify(subscription),
+      Expires: entity.Expires,
+    }).then(() => true);
+  });
+};
+
+function send(entity, payload) {
+  const vapid = {
+    subject: options().subject || 'mailto:telehealth@example.com',
+    publicKey: options().publicKey,
+    privateKey: options().privateKey,
+  };
+  const subscription = JSON.parse(entity.Subscription);
+  return webpush.sendNotification(subscription, JSON.stringify(payload), {vapidDetails: vapid}).catch(err => {
+    // The browser unsubscribed.
+    if (err.statusCode == 404 || err.statusCode == 410) {
+      return datastore.delete(key(subscription.endpoint));
+    }
+    console.log('Failed to send a push notification: ' + err);
+  });
+}
+
+// Notifies the clinician who created a meeting that its patient is waiting.
+exports.patientWaiting = function(encounterId) {
+  if (!exports.enabled()) {
+    return Promise.resolve();
+  }
+  return datastore.get(datastore.key(['Encounter', encounterId])).then(meeting => {
+    if (!meeting || !meeting.Owner) {
+      return;
+    }
+    return Promise.all([
+      datastore.get(datastore.key(['User', meeting.Owner])),
+      datastore.list('PushSubscription', [['User', '=', meeting.Owner]]),
+    ]).then(results => {
+      const session = results[0];
+      if (!session || !session.Expires || session.Expires < new Date()) {
+        return;
+      }
+      return Promise.all(results[1].map(entity => send(entity, {
+        title: options().title || 'Your patient is waiting',
+        body: options().body || 'The patient has entered the waiting room.',
+        url: meeting.Url,
+        encounterId: encounterId,
+      })));
+    });
+  }).catch(err => {
+    console.log('Failed to notify of the patient waiting in encounter ' + encounterId + ': ' + err);
+  });
+};
+
+// Deletes subscriptions of expired sessions, resolving to how many were
+// deleted.  Subscriptions of sessions that were extended are kept.
+exports.purge = function(now) {
+  return datastore.list('PushSubscription', [['Expires', '<', now]]).then(entities => {
+    return datastore.getMany(entities.map(entity => datastore.key(['User', entity.User]))).then(sessions => {
+      const extended = [];
+      const expired = [];
+      entities.forEach((entity, i) => {
+        const subscriptionKey = datastore.key(['PushSubscription', datastore.name(entity)]);
+        const session = sessions[i];
+        if (session && session.Expires && session.Expires > now) {
+          extended.push({key: subscriptionKey, entity: {
+            User: entity.User,
+            Subscription: entity.Subscription,
+            Expires: session.Expires,
+          }});
+        } else {
+          expired.push(subscriptionKey);
+        }
+      });
+      return Promise.all([datastore.upsertMany(extended)].concat(expired.map(key => datastore.delete(key))))
+        .then(() => expired.length);
+    });
+  });
+};
@@ -0,0 +1,219 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A persistent queue for work that shouldn't hold up requests: Encounter
+// status writes, notifications and audit records.  With settings.queue.enabled
+// each piece of work is stored as a 'Task' entity, attempted at once in the
+// background and, if that fails, retried by the queue job with exponential
+// backoff.  Tasks that fail settings.queue.maxAttempts times (8 by default)
+// are kept as dead letters for an admin to inspect and retry.  A task's FHIR
+// context is stored with it, its access token encrypted as a credential.
+// Without the setting, work runs inline as before.
+
+const datastore = require('./datastore.js');
+const deadline = require('./deadline.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+// Credentials are audited, and audit records are queued, so credentials.js is
+// loaded on first use rather than with this module.
+function credentials() {
+  return require('./credentials.js');
+}
+
+function options() {
+  return settings.queue || {};
+}
+
+function taskKey(id) {
+  return datastore.key(['Task', id]);
+}
+
+// How long an attempt may take before another worker may retry the task.
+function leaseMs() {
+  return (options().leaseSeconds || 60) * 1000;
+}
+
+function backoffMs(attempts) {
+  const base = (options().backoffSeconds || 30) * 1000;
+  return Math.min(base * Math.pow(2, attempts - 1), 60 * 60 * 1000);
+}
+
+const handlers = {};
+
+// Registers the handler for a type of task.  run(payload, context) returns a
+// promise; dead(payload, err), if given, is called when the task is dead
+// lettered.
+exports.handle = function(type, run, dead) {
+  handlers[type] = {run: run, dead: dead};
+};
+
+exports.enabled = function() {
+  return !!options().enabled;
+};
+
+function contextFor(task) {
+  if (!task.Credential) {
+    return Promise.resolve(undefined);
+  }
+  return credentials().load(task.Credential, 'system').then(token => {
+    return token && {
+      serverUrl: task.ServerUrl,
+      accessToken: token,
+      scope: task.Scope || undefined,
+      agent: task.Agent ? JSON.parse(task.Agent) : undefined,
+    };
+  });
+}
+
+function discard(id, task) {
+  return datastore.delete(taskKey(id)).then(() => task.Credential && credentials().remove(task.Credential));
+}
+
+function failed(id, task, err) {
+  const dead = task.Attempts >= (options().maxAttempts || 8);
+  return datastore.modify(taskKey(id), current => current && Object.assign(current, {
+    LastError: String(err),
+    Dead: dead,
+    NextAttempt: new Date(Date.now() + backoffMs(task.Attempts)),
+  })).then(() => {
+    if (!dead) {
+      return;
+    }
+    console.log('Task ' + id + ' (' + task.Type + ') failed ' + task.Attempts + ' times: ' + err);
+    const handler = handlers[task.Type];
+    return handler && handler.dead && handler.dead(JSON.parse(task.Payload), err);
+  });
+}
+
+// Claims a task and runs it.  Resolves to whether it succeeded, or undefined
+// if it wasn't due or another worker holds it.
+function attempt(id) {
+  const now = new Date();
+  return datastore.modify(taskKey(id), task => {
+    if (!task || task.Dead || task.NextAttempt > now) {
+      return undefined;
+    }
+    return Object.assign(task, {
+      Attempts: task.Attempts + 1,
+      NextAttempt: new Date(now.getTime() + leaseMs()),
+    });
+  }).then(task => {
+    if (!task) {
+      return undefined;
+    }
+    const handler = handlers[task.Type];
+    return contextFor(task).then(context => {
+      if (!handler) {
+        throw new Error('No handler for tasks of type ' + task.Type);
+      }
+      return handler.run(JSON.parse(task.Payload), context);
+    }).then(() => discard(id, task).then(() => true), err => failed(id, task, err).then(() => false));
+  });
+}
+
+// Tasks this instance is running in the background.
+var pending = 0;
+
+// Attempts a task outside the request that queued it.
+function background(id) {
+  pending++;
+  deadline.detached(() => attempt(id)).catch(err => console.log('Failed to run task ' + id + ': ' + err)).then(() => {
+    pending--;
+  });
+}
+
+// Returns how many queued tasks this instance is still running.
+exports.pending = function() {
+  return pending;
+};
+
+// Queues a task, or with the queue disabled runs it, given its JSON payload
+// and optionally the FHIR context to run it with.  Resolves once the task is
+// stored; the task itself runs in the background.
+exports.enqueue = function(type, payload, context) {
+  if (!exports.enabled()) {
+    return Promise.resolve(handlers[type].run(payload, context));
+  }
+
+  const id = crypto.randomBytes(16).toString('hex');
+  const now = new Date();
+  return (context ? credentials().store(context.accessToken) : Promise.resolve('')).then(credential => {
+    return datastore.set(taskKey(id), {
+      Type: type,
+      Payload: JSON.stringify(payload),
+      ServerUrl: context ? context.serverUrl : '',
+      Scope: (context && context.scope) || '',
+      Agent: context && context.agent ? JSON.stringify(context.agent) : '',
+      Credential: credential,
+      Attempts: 0,
+      NextAttempt: now,
+      Created: now,
+      Dead: false,
+      LastError: '',
+    });
+  }).then(() => {
+    background(id);
+  });
+};
+
+// Runs the tasks that are due and deletes dead letters older than
+// settings.queue.deadLetterDays (7 by default).
+exports.run = function() {
+  const now = new Date();
+  const retention = (options().deadLetterDays || 7) * 24 * 60 * 60 * 1000;
+  return datastore.list('Task', [['NextAttempt', '<=', now]]).then(tasks => {
+    const due = tasks.filter(task => !task.Dead);
+    const expired = tasks.filter(task => task.Dead && task.Created < new Date(now.getTime() - retention));
+    return Promise.all(due.map(task => attempt(datastore.name(task)))).then(results => {
+      return Promise.all(expired.map(task => discard(datastore.name(task), task))).then(() => ({
+        attempted: results.filter(result => result !== undefined).length,
+        succeeded: results.filter(result => result === true).length,
+        purged: expired.length,
+      }));
+    });
+  });
+};
+
+// Resolves to the dead lettered tasks, without their credentials.
+exports.deadLetters = function() {
+  return datastore.list('Task', [['Dead', '=', true]]).then(tasks => tasks.map(task => ({
+    id: datastore.name(task),
+    type: task.Type,
+    payload: JSON.parse(task.Payload),
+    attempts: task.Attempts,
+    created: task.Created,
+    lastError: task.LastError,
+  })));
+};
+
+// Makes a dead lettered task due again with a fresh set of attempts.
+// Resolves to whether there was such a task.
+exports.retry = function(id) {
+  return datastore.modify(taskKey(id), task => task && task.Dead ? Object.assign(task, {
+    Dead: false,
+    Attempts: 0,
+    NextAttempt: new Date(),
+  }) : undefined).then(task => {
+    if (!task) {
+      return false;
+    }
+    background(id);
+    return true;
+  });
+};
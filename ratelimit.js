@@ -0,0 +1,116 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Rate limits kept in the datastore, so they hold across every instance
+// behind the load balancer.  Each client, a signed in provider's session or
+// else an IP address, has a token bucket per tenant refilling at
+// requestsPerMinute up to burst requests; with tenantRequestsPerMinute set,
+// the tenant's requests together also share one.  settings.rateLimit sets
+// the limits and each tenant's rateLimit overrides them.
+
+const clock = require('./clock.js');
+const datastore = require('./datastore.js');
+const errors = require('./errors.js');
+const sessioncontext = require('./sessioncontext.js');
+const tenants = require('./tenants.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+exports.enabled = function() {
+  return !!(settings.rateLimit && settings.rateLimit.enabled);
+};
+
+// The limits of a tenant.
+function limits(tenant) {
+  return Object.assign({requestsPerMinute: 300, burst: 100}, settings.rateLimit, tenants.config(tenant).rateLimit);
+}
+
+// Session IDs are credentials, so buckets are named by a hash of the client.
+function bucketName(tenant, client) {
+  return tenant + ':' + crypto.createHash('sha256').update(client).digest('hex').substring(0, 32);
+}
+
+// Takes a request from a bucket, resolving to 0 if it was allowed or else to
+// how many milliseconds until it would be.
+function take(name, ratePerMinute, burst) {
+  const now = clock.now();
+  const msPerToken = 60 * 1000 / ratePerMinute;
+  var wait = 0;
+  return datastore.modify(datastore.key(['RateLimit', name]), current => {
+    const elapsed = current ? now - current.Updated.getTime() : Infinity;
+    const tokens = Math.min(burst, (current ? current.Tokens : burst) + elapsed / msPerToken);
+    if (tokens < 1) {
+      wait = Math.ceil((1 - tokens) * msPerToken);
+      return undefined;
+    }
+    return {
+      Tokens: tokens - 1,
+      Updated: new Date(now),
+      // When the bucket is full again and the record can be deleted.
+      Expires: new Date(now + (burst - tokens + 1) * msPerToken),
+    };
+  }).then(() => wait);
+}
+
+// Resolves to how many milliseconds the request has to wait before it is
+// allowed, 0 if it is allowed now.  Requests refused by the client's limit
+// don't count towards the tenant's.
+exports.check = function(request) {
+  const tenant = sessioncontext.get(request).tenant || tenants.forIssuer(request.get('X-FHIR-Server'));
+  const options = limits(tenant);
+  const client = request.session.id || request.ip || '';
+  return take(bucketName(tenant, client), options.requestsPerMinute, options.burst).then(wait => {
+    if (wait || !options.tenantRequestsPerMinute) {
+      return wait;
+    }
+    return take(tenant, options.tenantRequestsPerMinute, options.tenantBurst || options.tenantRequestsPerMinute);
+  });
+};
+
+// Rejects requests over their limits with rate-limited and a Retry-After
+// header.  Scheduled jobs are not limited, and requests are let through when
+// the datastore can't be reached rather than failing twice.
+exports.middleware = function(request, response, next) {
+  if (!exports.enabled() || request.path.startsWith('/jobs/')) {
+    next();
+    return;
+  }
+
+  exports.check(request).then(wait => {
+    if (!wait) {
+      next();
+      return;
+    }
+    const err = new errors.RateLimited();
+    err.retryAfter = Math.ceil(wait / 1000);
+    errors.send(response, err);
+  }, err => {
+    console.log('Rate limit check failed: ' + err);
+    next();
+  });
+};
+
+// Deletes the buckets of clients that haven't made requests since they
+// refilled, resolving to how many were deleted.
+exports.purge = function(now) {
+  return datastore.list('RateLimit', [['Expires', '<', now]]).then(entities => {
+    return Promise.all(entities.map(entity => {
+      return datastore.delete(datastore.key(['RateLimit', datastore.name(entity)]));
+    })).then(() => entities.length);
+  });
+};
@@ -0,0 +1,135 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Dynamic client registration (RFC 7591) with EHR authorization servers that
+// advertise a registration_endpoint in their SMART configuration, so a new
+// health system doesn't need the app registered by hand.  With
+// settings.dynamicRegistration.enabled, the first launch from an allowed FHIR
+// server registers the app as a public client with the metadata served at
+// /.well-known/oauth-client.json, and later launches use the client ID it was
+// issued.  Registrations are kept per issuer in 'Registration' entities, with
+// any client secret and registration access token stored as credentials.
+// Servers that don't support registration, or fail to register the app, use
+// settings.fhirClientId.  A tenant's dynamicRegistration.initialAccessToken
+// is sent to servers that require one.
+
+const credentials = require('./credentials.js');
+const datastore = require('./datastore.js');
+const deadline = require('./deadline.js');
+const tenants = require('./tenants.js');
+const transport = require('./transport.js');
+const wellknown = require('./wellknown.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const gaxios = require('gaxios');
+
+function options(tenant) {
+  return Object.assign({}, settings.dynamicRegistration, tenants.config(tenant).dynamicRegistration);
+}
+
+function issuerKey(iss) {
+  return datastore.key(['Registration', crypto.createHash('sha256').update(iss).digest('hex')]);
+}
+
+// Registration only happens with servers the deployment already trusts.
+function allowed(iss) {
+  if (settings.fhirServers) {
+    return settings.fhirServers.some(prefix => iss.startsWith(prefix));
+  }
+  return tenants.forIssuer(iss) != tenants.DEFAULT;
+}
+
+// When each server without a registration endpoint was last asked, so that
+// launches from it don't all fetch its SMART configuration.
+const unsupported = new Map();
+const unsupportedTtl = 60 * 60 * 1000;
+
+function registrationEndpoint(iss) {
+  if (Date.now() - (unsupported.get(iss) || 0) < unsupportedTtl) {
+    return Promise.resolve(undefined);
+  }
+  return deadline.limit('oauth', timeout => gaxios.request({
+    url: iss + '/.well-known/smart-configuration',
+    headers: {'Accept': 'application/json'},
+    timeout: timeout,
+    agent: transport.agent(iss),
+  })).then(result => {
+    if (!result.data.registration_endpoint) {
+      unsupported.set(iss, Date.now());
+    }
+    return result.data.registration_endpoint;
+  });
+}
+
+function register(iss, tenant) {
+  return registrationEndpoint(iss).then(endpoint => {
+    if (!endpoint) {
+      return undefined;
+    }
+    const headers = {'Accept': 'application/json', 'Content-Type': 'application/json'};
+    if (options(tenant).initialAccessToken) {
+      headers['Authorization'] = 'Bearer ' + options(tenant).initialAccessToken;
+    }
+    // The browser exchanges the authorization code, so the client is public.
+    const metadata = Object.assign(wellknown.clientMetadata(), {token_endpoint_auth_method: 'none'});
+    return deadline.limit('oauth', timeout => gaxios.request({
+      url: endpoint,
+      method: 'POST',
+      headers: headers,
+      data: metadata,
+      timeout: timeout,
+      agent: transport.agent(iss),
+    })).then(result => {
+      const issued = result.data;
+      return Promise.all([
+        issued.client_secret ? credentials.store(issued.client_secret) : '',
+        issued.registration_access_token ? credentials.store(issued.registration_access_token) : '',
+      ]).then(stored => {
+        const entity = {
+          Issuer: iss,
+          ClientId: issued.client_id,
+          SecretCredential: stored[0],
+          RegistrationCredential: stored[1],
+          RegistrationUri: issued.registration_client_uri || '',
+          Created: new Date(),
+        };
+        // Another instance may have registered the app at the same time.
+        return datastore.set(issuerKey(iss), entity).then(() => entity, () => {
+          return Promise.all(stored.filter(id => id).map(id => credentials.remove(id)))
+            .then(() => datastore.get(issuerKey(iss)));
+        });
+      });
+    });
+  });
+}
+
+// Resolves to the client ID to launch from a FHIR server with.
+exports.clientId = function(iss) {
+  const tenant = tenants.forIssuer(iss);
+  if (!iss || !options(tenant).enabled || !allowed(iss)) {
+    return Promise.resolve(settings.fhirClientId);
+  }
+
+  iss = iss.replace(/\/+$/, '');
+  return datastore.get(issuerKey(iss)).then(entity => entity || register(iss, tenant)).then(entity => {
+    return (entity && entity.ClientId) || settings.fhirClientId;
+  }).catch(err => {
+    console.log('Dynamic registration with ' + iss + ' failed: ' + err);
+    return settings.fhirClientId;
+  });
+};
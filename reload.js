@@ -0,0 +1,102 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Reloads the settings that are safe to change while running, on SIGHUP or
+// POST /admin/reload, so that a changed issuer allowlist, feature flag,
+// notification text or rate limit doesn't need a restart, which would lose
+// the instance's caches and in-flight work.  settings.json is read again
+// with the environment profile merged over it and checked as at startup; if
+// it can't be read or fails the checks nothing changes.  The values of the
+// keys below replace the running ones, which every module reads when it
+// uses them.  Other keys, like the datastore or the session secret, shape
+// what was set up at startup, so changes to them are reported as needing a
+// restart and left alone.
+
+const environment = require('./environment.js');
+const errors = require('./errors.js');
+
+const settings = require('./settings.json');
+
+const fs = require('fs');
+const path = require('path');
+
+const file = path.join(__dirname, 'settings.json');
+
+const reloadable = [
+  'fhirServers',
+  'ehrIssuers',
+  'features',
+  'notifications',
+  'branding',
+  'chat',
+  'survey',
+  'rateLimit',
+  'loadShedding',
+  'timeouts',
+  'careTeamCheck',
+  'launchContextCheck',
+  'freeBusyCheck',
+  'profileValidation',
+  'debugLogging',
+];
+
+// Keys changed at startup, whose values a reload keeps.
+const kept = new Set();
+
+// Keeps a setting that was changed at startup, such as development mode's
+// fhirServers, from being reloaded.
+exports.keep = function(key) {
+  kept.add(key);
+};
+
+function same(a, b) {
+  return JSON.stringify(a) === JSON.stringify(b);
+}
+
+// Resolves to the reloaded keys, as changed, and the other keys that differ
+// from the running settings, as restartRequired.
+exports.run = function() {
+  var values;
+  try {
+    values = JSON.parse(fs.readFileSync(file, 'utf8'));
+    environment.apply(values);
+  } catch (err) {
+    return Promise.reject(new errors.InvalidRequest('settings.json was not reloaded: ' + err.message));
+  }
+
+  const changed = reloadable.filter(key => !kept.has(key) && !same(settings[key], values[key]));
+  changed.forEach(key => {
+    if (values[key] === undefined) {
+      delete settings[key];
+    } else {
+      settings[key] = values[key];
+    }
+  });
+  const keys = new Set(Object.keys(settings).concat(Object.keys(values)));
+  const restartRequired = Array.from(keys).filter(key => {
+    return reloadable.indexOf(key) == -1 && !kept.has(key) && !same(settings[key], values[key]);
+  });
+  console.log('Reloaded settings' + (changed.length ? ', changing ' + changed.join(', ') : ' without changes') +
+    (restartRequired.length ? '; restart to change ' + restartRequired.join(', ') : ''));
+  return Promise.resolve({changed: changed, restartRequired: restartRequired});
+};
+
+// Reloads the settings whenever the process receives SIGHUP.
+exports.listen = function() {
+  process.on('SIGHUP', () => {
+    exports.run().catch(err => console.log(err.message));
+  });
+};
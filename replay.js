@@ -0,0 +1,77 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// One-time values that must not be accepted twice: SMART launch IDs, so a
+// captured launch URL can't start a second session, and the OAuth state of
+// Google sign-ins, so a captured redirect can't be replayed, and the nonces
+// of signed service requests.  Each is remembered in the store until it
+// expires.
+
+const clock = require('./clock.js');
+const datastore = require('./datastore.js');
+
+const crypto = require('crypto');
+
+exports.LAUNCH = 'Launch';
+exports.OAUTH_STATE = 'OAuthState';
+exports.SERVICE_NONCE = 'ServiceNonce';
+
+// Values are hashed since they can be long and contain any character.
+function key(kind, value) {
+  return datastore.key([kind, crypto.createHash('sha256').update(value).digest('hex')]);
+}
+
+// Resolves to true the first time a value is seen and false if it was already
+// seen within ttl milliseconds.
+exports.consume = function(kind, value, ttl) {
+  const now = clock.date();
+  return datastore.modify(key(kind, value), existing => {
+    if (existing && existing.Expires > now) {
+      return undefined;
+    }
+    return {Expires: new Date(now.getTime() + ttl), Used: now};
+  }).then(entity => entity !== undefined);
+};
+
+// Resolves to a new random value that can be redeemed once within ttl
+// milliseconds.
+exports.issue = function(kind, ttl) {
+  const value = crypto.randomBytes(16).toString('hex');
+  return datastore.set(key(kind, value), {Expires: new Date(clock.now() + ttl)}).then(() => value);
+};
+
+// Resolves to true if the value was issued, has not expired and was not
+// redeemed before.
+exports.redeem = function(kind, value) {
+  const now = clock.date();
+  return datastore.modify(key(kind, value), existing => {
+    if (!existing || existing.Used || existing.Expires < now) {
+      return undefined;
+    }
+    return Object.assign(existing, {Used: now});
+  }).then(entity => entity !== undefined);
+};
+
+// Deletes expired values, resolving to how many were deleted.
+exports.purge = function(now) {
+  return Promise.all([exports.LAUNCH, exports.OAUTH_STATE, exports.SERVICE_NONCE].map(kind => {
+    return datastore.list(kind, [['Expires', '<', now]]).then(entities => {
+      return Promise.all(entities.map(entity => {
+        return datastore.delete(datastore.key([kind, datastore.name(entity)]));
+      })).then(() => entities.length);
+    });
+  })).then(counts => counts.reduce((a, b) => a + b, 0));
+};
@@ -0,0 +1,138 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const datastore = require('./datastore.js');
+const errors = require('./errors.js');
+const settings = require('./settings.json');
+
+const columns = ['encounterId', 'created', 'patientJoined', 'ended', 'durationMinutes', 'participants', 'cancelled',
+  'noShow', 'visitStart', 'visitEnd', 'visitSeconds', 'surveySent', 'surveyCompleted', 'degraded'];
+
+// Returns when the patient first joined: by fetching the meeting link, or on a
+// device a handoff code moved the visit to, where only the meeting reports it.
+function patientJoined(entity) {
+  const times = [entity.PatientJoined, entity.PatientInMeeting].filter(time => time);
+  return times.length ? new Date(Math.min.apply(null, times)) : null;
+}
+
+function toVisit(entity) {
+  const joined = patientJoined(entity);
+  var duration = null;
+  if (joined && entity.Ended) {
+    duration = Math.round((entity.Ended.getTime() - joined.getTime()) / 60000);
+  }
+  return {
+    encounterId: datastore.name(entity),
+    created: entity.Created.toISOString(),
+    patientJoined: joined ? joined.toISOString() : null,
+    ended: entity.Ended ? entity.Ended.toISOString() : null,
+    durationMinutes: duration,
+    participants: joined ? 2 : 1,
+    cancelled: !!entity.Cancelled,
+    // A cancelled visit wasn't missed.
+    noShow: !joined && !entity.Cancelled,
+    visitStart: entity.VisitStart ? entity.VisitStart.toISOString() : null,
+    visitEnd: entity.VisitEnd ? entity.VisitEnd.toISOString() : null,
+    visitSeconds: entity.VisitSeconds === undefined ? null : entity.VisitSeconds,
+    surveySent: !!entity.SurveySent,
+    surveyCompleted: !!entity.SurveyCompleted,
+    degraded: entity.Degraded || null,
+  };
+}
+
+// Returns the visits whose meeting was created in [since, until).
+exports.visits = function(since, until) {
+  return datastore.list('Encounter', [
+    ['Created', '>=', since],
+    ['Created', '<', until],
+  ]).then(entities => entities.map(toVisit));
+};
+
+// Returns the patient's visits whose meeting was created in [since, until).
+exports.forPatient = function(patientId, since, until) {
+  return datastore.lookup('Encounter', 'Patient', patientId).then(entities => {
+    return entities.filter(entity => entity.Created >= since && entity.Created < until).map(toVisit);
+  });
+};
+
+// Resolves to the visits of the admin APIs' query, { since, until, patient },
+// with the window it covered: the last 7 days and the next day by default.
+exports.query = function(query) {
+  const until = new Date(query.until || Date.now() + 24 * 60 * 60 * 1000);
+  const since = new Date(query.since || Date.now() - 7 * 24 * 60 * 60 * 1000);
+  if (isNaN(since) || isNaN(until)) {
+    return Promise.reject(new errors.InvalidRequest('since and until must be dates'));
+  }
+  const visits = query.patient ? exports.forPatient(query.patient, since, until) : exports.visits(since, until);
+  return visits.then(visits => ({since: since, until: until, visits: visits}));
+};
+
+exports.ndjson = function(visits) {
+  return visits.map(visit => JSON.stringify(visit) + '\n').join('');
+};
+
+function csvValue(value) {
+  if (value === null || value === undefined) {
+    return '';
+  }
+  const text = String(value);
+  if (/[",\n]/.test(text)) {
+    return '"' + text.replace(/"/g, '""') + '"';
+  }
+  return text;
+}
+
+exports.csv = function(visits) {
+  const lines = [columns.join(',')];
+  visits.forEach(visit => {
+    lines.push(columns.map(column => csvValue(visit[column])).join(','));
+  });
+  return lines.join('\n') + '\n';
+};
+
+function population(code, count) {
+  return {
+    code: { coding: [{ system: 'http://terminology.hl7.org/CodeSystem/measure-population', code: code }] },
+    count: count,
+  };
+}
+
+// Returns a summary FHIR MeasureReport for the visits against the Measure in
+// settings.usageReport.measure.  Cancelled visits aren't in the population.
+exports.measureReport = function(visits, since, until) {
+  const measure = (settings.usageReport || {}).measure;
+  if (!measure) {
+    throw new Error('usageReport.measure must be set to the Measure MeasureReports are for');
+  }
+  const scheduled = visits.filter(visit => !visit.cancelled);
+  const completed = scheduled.filter(visit => !visit.noShow);
+  return {
+    resourceType: 'MeasureReport',
+    status: 'complete',
+    type: 'summary',
+    measure: measure,
+    date: new Date().toISOString(),
+    period: { start: since.toISOString(), end: until.toISOString() },
+    group: [{
+      code: { text: 'Telehealth visits' },
+      population: [
+        population('initial-population', scheduled.length),
+        population('numerator', completed.length),
+        population('numerator-exclusion', scheduled.length - completed.length),
+      ],
+    }],
+  };
+};
@@ -0,0 +1,80 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Retention windows for stored data, for data minimisation policies.
+// settings.retention sets how many days each class of data is kept:
+//
+//   sessions    Provider session records and their credentials, from sign-in,
+//               even if the session could otherwise still be extended.
+//   audit       Audit log records, from the start of the chain.
+//   attendance  Closed meeting records, with their join times and visit
+//               periods, from when the meeting was created.
+//
+// Records of encounters under a legal hold are kept, and classes without a
+// window are kept as before.  The retention job purges what is past its
+// window, or with settings.retention.dryRun only reports it.
+
+const audit = require('./audit.js');
+const clock = require('./clock.js');
+const datastore = require('./datastore.js');
+const legalhold = require('./legalhold.js');
+const user = require('./user.js');
+
+const settings = require('./settings.json');
+
+function options() {
+  return settings.retention || {};
+}
+
+const day = 24 * 60 * 60 * 1000;
+
+// Each class resolves to the number of records past the cutoff, purging them
+// unless dryRun is set.
+const classes = {
+  sessions: (cutoff, dryRun) => {
+    return datastore.list('User', [['Created', '<', cutoff]]).then(entities => {
+      return dryRun ? entities.length :
+        Promise.all(entities.map(entity => user.deleteSession(entity))).then(() => entities.length);
+    });
+  },
+  audit: (cutoff, dryRun, held) => audit.prune(cutoff, dryRun, held),
+  attendance: (cutoff, dryRun, held) => {
+    return datastore.list('Encounter', [['Created', '<', cutoff]]).then(entities => {
+      const closed = entities.filter(entity => entity.Closed && !held.has(datastore.name(entity)));
+      return dryRun ? closed.length : Promise.all(closed.map(entity => {
+        return datastore.delete(datastore.key(['Encounter', datastore.name(entity)]));
+      })).then(() => closed.length);
+    });
+  },
+};
+
+// Resolves to a report of each class with a window: its window in days, the
+// cutoff and how many records were purged, or with dryRun would be.
+exports.run = function(dryRun) {
+  dryRun = dryRun || !!options().dryRun;
+  const now = clock.now();
+  const names = Object.keys(classes).filter(name => options()[name] > 0);
+  return legalhold.encounters().then(held => Promise.all(names.map(name => {
+    const cutoff = new Date(now - options()[name] * day);
+    return classes[name](cutoff, dryRun, held).then(count => ({days: options()[name], cutoff: cutoff, records: count}));
+  }))).then(results => {
+    const report = {dryRun: dryRun};
+    names.forEach((name, i) => {
+      report[name] = results[i];
+    });
+    return report;
+  });
+};
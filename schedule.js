@@ -0,0 +1,89 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const datastore = require('./datastore.js');
+const fhir = require('./fhir.js');
+
+const settings = require('./settings.json');
+
+// Whether an appointment is a telehealth visit.  Without a configured list of
+// virtual appointment or service type codes every appointment counts.
+function isVirtual(appointment) {
+  const codes = settings.virtualAppointmentCodes;
+  if (!codes || codes.length == 0) {
+    return true;
+  }
+
+  const concepts = [appointment.appointmentType].concat(appointment.serviceType || []);
+  return concepts.some(concept => {
+    return concept && (concept.coding || []).some(coding => codes.indexOf(coding.code) != -1);
+  });
+}
+
+function participantDisplay(appointment, resourceType) {
+  const participant = (appointment.participant || []).find(participant => {
+    return participant.actor && participant.actor.reference &&
+      participant.actor.reference.startsWith(resourceType + '/');
+  });
+  return participant ? participant.actor.display || participant.actor.reference : null;
+}
+
+function joinStatus(entity) {
+  if (!entity) {
+    return 'not-started';
+  }
+  return entity.PatientJoined ? 'patient-joined' : 'started';
+}
+
+// Returns the virtual appointments of the practitioner on a day (YYYY-MM-DD)
+// together with their encounter, join status and Meet link.
+exports.forPractitioner = function(context, practitioner, day) {
+  return fhir.search(context, 'Appointment', {
+    practitioner: practitioner,
+    date: day,
+    _revinclude: 'Encounter:appointment',
+    _count: 100,
+  }).then(bundle => {
+    const encounters = fhir.resources(bundle, 'Encounter');
+    const appointments = fhir.resources(bundle, 'Appointment').filter(isVirtual);
+
+    const visits = appointments.map(appointment => {
+      const encounter = encounters.find(encounter => {
+        return (encounter.appointment || []).some(reference => reference.reference == 'Appointment/' + appointment.id);
+      });
+      return {
+        appointmentId: appointment.id,
+        start: appointment.start,
+        end: appointment.end,
+        description: appointment.description,
+        patient: participantDisplay(appointment, 'Patient'),
+        encounterId: encounter ? encounter.id : null,
+        status: joinStatus(null),
+        url: null,
+      };
+    });
+
+    // The meetings of the schedule are read in one batch.
+    const listed = visits.filter(visit => visit.encounterId);
+    return datastore.getMany(listed.map(visit => datastore.key(['Encounter', visit.encounterId]))).then(entities => {
+      entities.forEach((entity, i) => {
+        listed[i].status = joinStatus(entity);
+        listed[i].url = entity ? entity.Url : null;
+      });
+      return visits;
+    });
+  }).then(visits => visits.sort((a, b) => (a.start || '').localeCompare(b.start || '')));
+};
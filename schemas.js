@@ -0,0 +1,144 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// JSON Schemas of the API's request bodies, used both to validate requests
+// and to describe them in /openapi.json.  Form fields arrive as strings.
+
+const encounter = require('./encounter.js');
+
+function object(properties, required) {
+  return {type: 'object', properties: properties, required: required || []};
+}
+
+// Relative or absolute FHIR references.
+const reference = {type: 'string', minLength: 1, maxLength: 2048};
+
+const id = {type: 'string', minLength: 1, maxLength: 64, pattern: '^[A-Za-z0-9\\-\\.]+$'};
+
+function described(schema, description) {
+  return Object.assign({description: description}, schema);
+}
+
+exports.hangout = object({
+  encounterId: described(id, 'The FHIR Encounter ID'),
+  iss: {type: 'string', maxLength: 2048, description: 'The FHIR server'},
+  user: described(reference, "The provider's FHIR reference"),
+  patient: described(id, 'The FHIR Patient ID of the launch'),
+  allowConflicts: {type: 'string', enum: ['true', 'false'], description: "Whether to create the meeting when the provider's calendar is busy"},
+}, ['encounterId']);
+
+exports.launchCheck = object({
+  patient: described(id, 'The FHIR Patient ID of the launch'),
+});
+
+exports.queueEntry = object({
+  encounterId: described(id, "The FHIR Encounter ID of the patient's visit"),
+}, ['encounterId']);
+
+exports.queueDuty = object({
+  user: described(reference, "The practitioner's FHIR reference"),
+  onDuty: {type: 'string', enum: ['true', 'false'], description: 'Whether the practitioner is on duty'},
+}, ['user', 'onDuty']);
+
+exports.queueClaim = object({
+  user: described(reference, "The practitioner's FHIR reference"),
+}, ['user']);
+
+exports.queueReassign = object({
+  user: described(reference, "The FHIR reference of the practitioner who has the patient"),
+  to: described(reference, 'The practitioner to hand the patient to, or none to put them back in the queue'),
+}, ['user']);
+
+exports.group = object({
+  encounterIds: {
+    type: ['string', 'array'],
+    items: id,
+    description: 'The FHIR Encounter IDs, as an array or comma-separated',
+  },
+}, ['encounterIds']);
+
+exports.event = object({
+  event: {type: 'string', enum: encounter.events, description: 'The visit event'},
+  waited: {type: 'string', pattern: '^[0-9]{1,7}$', description: 'Seconds the patient waited, with joined'},
+}, ['event']);
+
+exports.consent = object({
+  patient: described(reference, "The patient's FHIR reference"),
+  recording: {type: 'string', enum: ['true', 'false'], description: 'Whether recording was consented to'},
+  language: {type: 'string', pattern: '^[a-z]{2}(-[A-Za-z]{2})?$', description: 'The language of the consent screen'},
+});
+
+exports.invitation = object({
+  practitioner: described(reference, 'The FHIR reference of the invitee'),
+}, ['practitioner']);
+
+exports.verification = object({
+  answer: {type: 'string', minLength: 1, maxLength: 64, description: 'The birth date or identifier entered'},
+}, ['answer']);
+
+exports.failure = object({
+  reason: {type: 'string', pattern: '^[a-z0-9-]{1,40}$', description: 'The failure reason'},
+}, ['reason']);
+
+exports.invitationRedeem = object({
+  token: {type: 'string', pattern: '^[0-9a-f]{32}$', description: 'The invitation token'},
+}, ['token']);
+
+exports.handoff = object({
+  encounterId: described(id, 'The FHIR Encounter ID'),
+}, ['encounterId']);
+
+exports.handoffRedeem = object({
+  code: {type: 'string', pattern: '^([0-9]{6}|[0-9]{12})$', description: 'The 6-digit patient or 12-digit provider code'},
+}, ['code']);
+
+exports.launch = object({
+  iss: {type: 'string', minLength: 1, maxLength: 2048, description: 'The FHIR server'},
+  launch: {type: 'string', minLength: 1, maxLength: 2048, description: 'The launch ID'},
+}, ['iss', 'launch']);
+
+exports.feature = object({
+  enabled: {type: 'boolean', description: 'Whether the feature is on unless a tenant says otherwise'},
+  percent: {type: 'integer', minimum: 0, maximum: 100, description: 'The percentage of subjects it is on for'},
+  tenants: {type: 'object', description: 'Tenant IDs mapped to whether the feature is on for them'},
+});
+
+exports.directorySeed = object({
+  server: {type: 'string', pattern: '^https?://', maxLength: 2048, description: 'The FHIR server to read Endpoints from'},
+  accessToken: {type: 'string', minLength: 1, description: 'An access token for the FHIR server'},
+  tenant: {type: 'string', maxLength: 64, description: 'The tenant the facilities belong to'},
+}, ['server', 'accessToken']);
+
+exports.facility = object({
+  workspaceDomain: {type: 'string', maxLength: 253, description: "The Workspace domain of the facility's providers"},
+});
+
+exports.pushSubscription = object({
+  endpoint: {type: 'string', pattern: '^https://', maxLength: 2048, description: 'The push service endpoint'},
+  keys: object({p256dh: {type: 'string'}, auth: {type: 'string'}}, ['p256dh', 'auth']),
+}, ['endpoint', 'keys']);
+
+exports.hold = object({
+  patient: described(reference, "The patient's FHIR reference"),
+  encounterIds: {type: 'array', items: id, description: 'The FHIR Encounter IDs'},
+  reason: {type: 'string', minLength: 1, maxLength: 500, description: 'Why the records are held'},
+}, ['reason']);
+
+exports.erasure = object({
+  patient: described(reference, "The patient's FHIR reference"),
+  encounterIds: {type: 'array', items: id, description: "The patient's FHIR Encounter IDs"},
+  dryRun: {type: 'boolean', description: 'Whether to only report what would be erased'},
+}, ['patient', 'encounterIds']);
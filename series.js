@@ -0,0 +1,114 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Recurring appointment series, such as weekly therapy visits, share one
+// durable meeting so the patient keeps the same link.  An Appointment belongs
+// to a series through its R5 originatingAppointment (or the R4 extension for
+// it) or else, when settings.recurringSeries.byBasedOn is set, through the
+// ServiceRequest it is based on.  Each occurrence's meeting record gets an
+// access window around the appointment; the patient is only given the link
+// within it.
+
+const datastore = require('./datastore.js');
+const fhir = require('./fhir.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+const originatingExtension = 'http://hl7.org/fhir/5.0/StructureDefinition/extension-Appointment.originatingAppointment';
+
+function options() {
+  return settings.recurringSeries || {};
+}
+
+exports.enabled = function() {
+  return !!options().enabled;
+};
+
+function seriesReference(appointment) {
+  if (appointment.originatingAppointment && appointment.originatingAppointment.reference) {
+    return appointment.originatingAppointment.reference;
+  }
+  const extension = (appointment.extension || []).filter(extension => extension.url == originatingExtension)[0];
+  if (extension && extension.valueReference) {
+    return extension.valueReference.reference;
+  }
+  if (options().byBasedOn && appointment.basedOn && appointment.basedOn[0]) {
+    return appointment.basedOn[0].reference;
+  }
+  return undefined;
+}
+
+// The window in which the patient can retrieve the link, in minutes around
+// the appointment.
+exports.accessWindow = function(appointment) {
+  const before = (options().windowBeforeMinutes || 15) * 60 * 1000;
+  const after = (options().windowAfterMinutes || 60) * 60 * 1000;
+  const start = appointment.start ? new Date(appointment.start) : new Date();
+  const end = appointment.end ? new Date(appointment.end) : start;
+  return {WindowStart: new Date(start.getTime() - before), WindowEnd: new Date(end.getTime() + after)};
+};
+
+function appointmentOf(context, encounterId) {
+  return fhir.read(context, 'Encounter', encounterId).then(encounter => {
+    const reference = ((encounter.appointment || [])[0] || {}).reference || '';
+    if (!reference.startsWith('Appointment/')) {
+      return undefined;
+    }
+    return fhir.read(context, 'Appointment', reference.substring('Appointment/'.length));
+  });
+}
+
+// Resolves to the meeting fields for an encounter: the series' meeting and
+// the occurrence's access window if the encounter's Appointment belongs to a
+// series, or else the fields create resolves to.  The first occurrence of a
+// series creates its meeting.
+exports.meeting = function(context, encounterId, create) {
+  return appointmentOf(context, encounterId).then(appointment => {
+    const reference = appointment && seriesReference(appointment);
+    if (!reference) {
+      return create();
+    }
+
+    const id = crypto.createHash('sha256').update(context.serverUrl + ' ' + reference).digest('hex');
+    const key = datastore.key(['Series', id]);
+    return datastore.get(key).then(series => {
+      if (series) {
+        return datastore.update(key, Object.assign(series, {LastUsed: new Date()})).then(() => series);
+      }
+      return create().then(fields => {
+        series = Object.assign({Created: new Date(), LastUsed: new Date()}, fields);
+        return datastore.set(key, series).then(() => series);
+      });
+    }).then(series => {
+      return Object.assign({
+        Url: series.Url,
+        CalendarId: series.CalendarId,
+        EventId: series.EventId,
+        Series: id,
+      }, exports.accessWindow(appointment));
+    });
+  });
+};
+
+// Resolves to the meeting records of series unused for
+// settings.recurringSeries.idleDays (30 by default), whose meetings can be
+// deleted.
+exports.idle = function(now) {
+  const cutoff = new Date(now.getTime() - (options().idleDays || 30) * 24 * 60 * 60 * 1000);
+  return datastore.list('Series', [['LastUsed', '<', cutoff]]);
+};
@@ -0,0 +1,173 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Keys for services calling internal endpoints without a browser session or
+// an admin token, such as a scheduler triggering the cleanup job or an
+// interface engine posting appointment notifications.
+// settings.serviceKeys maps each service's name to:
+//
+//   endpoints  What it may call: jobs (GET /jobs/{name}), admin (the admin
+//              API) or the name of a callback whose scheme is service.
+//   keys       Its keys, or
+//   secret     A Secret Manager secret, such as projects/p/secrets/pm-keys,
+//              whose latest version holds its keys one per line.  Secrets are
+//              reloaded every serviceKeyReloadSeconds (300 by default), so a
+//              key is rotated by adding a version with the new key and the
+//              old one, then one without the old.
+//
+// A service authenticates with an X-Api-Key header of its name, a colon and a
+// key, or signs each request instead so the key is never sent: X-Service is
+// its name, X-Timestamp the time in seconds since the epoch, X-Nonce a value
+// it never sends twice, Content-Digest the sha-256 of the raw body (of an
+// empty one without a body) and X-Signature the hex HMAC-SHA256 under a key
+// of the timestamp, nonce, method, URL path with its query and digest, joined
+// by newlines.  Signatures over 5 minutes off are refused, and so are nonces
+// already used within that window, so a captured request can't be replayed.
+// The body is checked against the digest when it's parsed (see bodies.js).
+
+const bodies = require('./bodies.js');
+const replay = require('./replay.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const {SecretManagerServiceClient} = require('@google-cloud/secret-manager');
+
+// How far a signature's timestamp may be from the time it's checked.
+const maxSkewSeconds = 5 * 60;
+
+var client = null;
+var secretKeys = {};
+var loadedAt = 0;
+var loading = null;
+
+function services() {
+  return settings.serviceKeys || {};
+}
+
+function reloadMs() {
+  return (settings.serviceKeyReloadSeconds || 300) * 1000;
+}
+
+function matches(value, candidate) {
+  const a = Buffer.from(value || '');
+  const b = Buffer.from(candidate || '');
+  return a.length > 0 && a.length == b.length && crypto.timingSafeEqual(a, b);
+}
+
+function loadSecret(name) {
+  if (!client) {
+    client = new SecretManagerServiceClient();
+  }
+  return client.accessSecretVersion({name: services()[name].secret + '/versions/latest'}).then(result => {
+    return result[0].payload.data.toString('utf8').split('\n').map(key => key.trim()).filter(key => key);
+  }).catch(err => {
+    // The keys last loaded keep working until the secret can be read.
+    console.log('Failed to load the keys of service ' + name + ': ' + err);
+    return secretKeys[name] || [];
+  });
+}
+
+// Reloads the keys kept in Secret Manager.  Resolves once loaded.
+exports.reload = function() {
+  if (!loading) {
+    const names = Object.keys(services()).filter(name => services()[name].secret);
+    loading = Promise.all(names.map(loadSecret)).then(keys => {
+      const loaded = {};
+      names.forEach((name, i) => {
+        loaded[name] = keys[i];
+      });
+      secretKeys = loaded;
+      loadedAt = Date.now();
+      loading = null;
+    });
+  }
+  return loading;
+};
+
+// Resolves to a service's keys.  Until they're first loaded requests wait for
+// them; after that they're reloaded in the background.
+function keysOf(name) {
+  const service = services()[name];
+  if (!service.secret) {
+    return Promise.resolve(service.keys || []);
+  }
+  if (!loadedAt) {
+    return exports.reload().then(() => secretKeys[name] || []);
+  }
+  if (Date.now() - loadedAt > reloadMs()) {
+    exports.reload();
+  }
+  return Promise.resolve(secretKeys[name] || []);
+}
+
+// Returns the service a request claims to be and, given one of its keys,
+// whether the request proves it.
+function credentials(request) {
+  const apiKey = request.get('X-Api-Key');
+  if (apiKey) {
+    const separator = apiKey.indexOf(':');
+    return {
+      service: apiKey.substring(0, separator),
+      proves: key => separator > 0 && matches(apiKey.substring(separator + 1), key),
+    };
+  }
+  const signature = request.get('X-Signature');
+  const timestamp = request.get('X-Timestamp') || '';
+  const nonce = request.get('X-Nonce') || '';
+  const digest = request.get('Content-Digest') || '';
+  if (!request.get('X-Service') || !signature || !/^[0-9]+$/.test(timestamp) ||
+      Math.abs(Date.now() / 1000 - parseInt(timestamp, 10)) > maxSkewSeconds ||
+      !/^[\x21-\x7e]{16,128}$/.test(nonce) || !bodies.digestOf(digest)) {
+    return undefined;
+  }
+  const signed = [timestamp, nonce, request.method, request.originalUrl, digest].join('\n');
+  return {
+    service: request.get('X-Service'),
+    nonce: nonce,
+    digest: digest,
+    proves: key => matches(signature, crypto.createHmac('sha256', key).update(signed).digest('hex')),
+  };
+}
+
+// Resolves to whether a signed request's nonce is seen for the first time
+// and its body, if it has none, matches its digest.  A body is left to
+// bodies.js to check once it's read.
+function fresh(request, claimed) {
+  if (!claimed.nonce) {
+    return Promise.resolve(true);
+  }
+  if (!bodies.expectDigest(request, claimed.digest)) {
+    return Promise.resolve(false);
+  }
+  return replay.consume(replay.SERVICE_NONCE, claimed.service + ' ' + claimed.nonce, 2 * maxSkewSeconds * 1000);
+}
+
+// Resolves to the name of the service a request authenticates as, if it's
+// allowed to call endpoint, or undefined.
+exports.verify = function(request, endpoint) {
+  const claimed = credentials(request);
+  const service = claimed && services().hasOwnProperty(claimed.service) && services()[claimed.service];
+  if (!service || (service.endpoints || []).indexOf(endpoint) == -1) {
+    return Promise.resolve(undefined);
+  }
+  return keysOf(claimed.service).then(keys => {
+    if (!keys.some(claimed.proves)) {
+      return undefined;
+    }
+    return fresh(request, claimed).then(first => first ? claimed.service : undefined);
+  });
+};
@@ -0,0 +1,188 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Session context that isn't sensitive (the tenant, locale and role, and when
+// a provider's session expires) carried in the browser rather than looked up
+// in the datastore.  The session cookie is signed but readable, so with
+// settings.sessionContext.encrypted the context is instead kept in its own
+// 'context' cookie, encrypted with AES-256-GCM and bound to the session ID so
+// it can't be moved to another session.  It is encrypted with the first of
+// sessionContext.keys (32 bytes, base64) and decrypted with any of them, so
+// keys can be rotated; without keys one is derived from
+// sessionCookieSecret.  Without encryption only the tenant is kept, in the
+// session cookie, as before.
+
+const clock = require('./clock.js');
+const tenants = require('./tenants.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+const COOKIE = 'context';
+const VERSION = 'v1';
+
+function options() {
+  return settings.sessionContext || {};
+}
+
+exports.enabled = function() {
+  return !!options().encrypted;
+};
+
+// Keys are decoded or derived once for each configuration rather than on
+// every request.
+var cachedKeys;
+var cachedFor;
+
+function keys() {
+  const configured = options().keys && options().keys.length ? options().keys : null;
+  const source = configured ? 'keys ' + configured.join(' ') : 'secret ' + settings.sessionCookieSecret;
+  if (source !== cachedFor) {
+    cachedKeys = configured ? configured.map(key => Buffer.from(key, 'base64')) :
+      [Buffer.from(crypto.hkdfSync('sha256', settings.sessionCookieSecret, '', 'meet-on-fhir session context', 32))];
+    cachedFor = source;
+  }
+  return cachedKeys;
+}
+
+// Binds the context to the session it was issued to.
+function associatedData(request) {
+  return Buffer.from('session ' + (request.session.id || ''));
+}
+
+// The IV, tag and ciphertext are written into one buffer.  GCM encrypts as
+// it goes, so final adds nothing to the ciphertext.
+function seal(request, context) {
+  const plaintext = Buffer.from(JSON.stringify(context));
+  const sealed = Buffer.allocUnsafe(28 + plaintext.length);
+  const iv = crypto.randomFillSync(sealed, 0, 12).subarray(0, 12);
+  const cipher = crypto.createCipheriv('aes-256-gcm', keys()[0], iv);
+  cipher.setAAD(associatedData(request));
+  cipher.update(plaintext).copy(sealed, 28);
+  cipher.final();
+  cipher.getAuthTag().copy(sealed, 12);
+  return VERSION + '.' + sealed.toString('base64url');
+}
+
+// Returns the context in a cookie value, or undefined if it wasn't issued to
+// the request's session, was tampered with or has expired.
+function open(request, value) {
+  if (!value || !value.startsWith(VERSION + '.')) {
+    return undefined;
+  }
+  const data = Buffer.from(value.substring(VERSION.length + 1), 'base64url');
+  if (data.length < 28) {
+    return undefined;
+  }
+  for (const key of keys()) {
+    try {
+      const decipher = crypto.createDecipheriv('aes-256-gcm', key, data.subarray(0, 12));
+      decipher.setAAD(associatedData(request));
+      decipher.setAuthTag(data.subarray(12, 28));
+      const plaintext = decipher.update(data.subarray(28));
+      decipher.final();
+      const context = JSON.parse(plaintext.toString());
+      return context.exp > clock.now() ? context : undefined;
+    } catch (err) {
+      // Sealed with another key, or not by us.
+    }
+  }
+  return undefined;
+}
+
+function cookieValue(request) {
+  const cookies = (request.get('Cookie') || '').split(';');
+  for (const cookie of cookies) {
+    const index = cookie.indexOf('=');
+    if (index > 0 && cookie.substring(0, index).trim() == COOKIE) {
+      return decodeURIComponent(cookie.substring(index + 1).trim());
+    }
+  }
+  return undefined;
+}
+
+// The browser's preferred language from Accept-Language, if it's a valid tag.
+function locale(request) {
+  const tag = (request.get('Accept-Language') || '').split(',')[0].split(';')[0].trim();
+  return /^[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*$/.test(tag) ? tag : undefined;
+}
+
+// Middleware reading the context cookie, and writing it when the context
+// changed, bound to the session ID as it is when the response is sent.  Must
+// be used after the session middleware.
+exports.middleware = function(request, response, next) {
+  if (!exports.enabled()) {
+    next();
+    return;
+  }
+
+  const context = open(request, cookieValue(request));
+  request.sessionContext = context || {};
+  if (!request.sessionContext.locale && locale(request)) {
+    exports.set(request, {locale: locale(request)});
+  }
+
+  const writeHead = response.writeHead;
+  response.writeHead = function() {
+    if (request.sessionContextChanged) {
+      const context = Object.assign({}, request.sessionContext);
+      delete context.exp;
+      const maxAge = tenants.maxSessionLifetime(context.tenant || tenants.DEFAULT);
+      context.exp = clock.now() + maxAge;
+      const cookie = COOKIE + '=' + seal(request, context) + '; Path=/; Max-Age=' + Math.floor(maxAge / 1000) +
+        '; HttpOnly; SameSite=Lax' + (request.secure ? '; Secure' : '');
+      response.setHeader('Set-Cookie', [].concat(response.getHeader('Set-Cookie') || [], cookie));
+    }
+    return writeHead.apply(this, arguments);
+  };
+  next();
+};
+
+// Returns the request's context: its tenant, locale and role, and for a
+// provider, when their session expires and can be extended until.  Fields
+// that weren't set are undefined.
+exports.get = function(request) {
+  if (exports.enabled()) {
+    const context = Object.assign({}, request.sessionContext);
+    delete context.exp;
+    ['expires', 'extendableUntil'].forEach(field => {
+      if (context[field]) {
+        context[field] = new Date(context[field]);
+      }
+    });
+    return context;
+  }
+  return {tenant: request.session.tenant};
+};
+
+// Changes fields of the request's context.
+exports.set = function(request, fields) {
+  if (!exports.enabled()) {
+    if ('tenant' in fields) {
+      request.session.tenant = fields.tenant;
+    }
+    return;
+  }
+
+  Object.keys(fields).forEach(field => {
+    const value = fields[field] instanceof Date ? fields[field].getTime() : fields[field];
+    if (request.sessionContext[field] !== value) {
+      request.sessionContext[field] = value;
+      request.sessionContextChanged = true;
+    }
+  });
+};
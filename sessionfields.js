@@ -0,0 +1,163 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Field-level encryption of identifiers kept in the session cookie.  The
+// cookie is signed but readable, so tools that can read session metadata see
+// its fields.  With settings.sessionFields.encrypted, the fields that
+// identify people or visits (the launch context, verified encounters,
+// consent and handoff) are each sealed with AES-256-GCM under a key used for nothing
+// else, bound to the field name and session ID.  sessionFields.keys lists
+// base64 encoded 32 byte keys: the first encrypts and all of them decrypt.
+// Without keys one is derived from sessionCookieSecret, distinct from the
+// session context key.  Handlers see the fields decrypted.
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+const VERSION = 'f1';
+
+// Fields sealed unless settings.sessionFields.fields lists others.  identity
+// is only found in sessions from before the launch context.
+const defaults = ['launch', 'identity', 'verified', 'consent', 'handoff'];
+
+function options() {
+  return settings.sessionFields || {};
+}
+
+function fields() {
+  return options().fields || defaults;
+}
+
+// Keys are decoded or derived once for each configuration rather than on
+// every request.
+var cachedKeys;
+var cachedFor;
+
+function keys() {
+  const configured = options().keys && options().keys.length ? options().keys : null;
+  const source = configured ? 'keys ' + configured.join(' ') : 'secret ' + settings.sessionCookieSecret;
+  if (source !== cachedFor) {
+    cachedKeys = configured ? configured.map(key => Buffer.from(key, 'base64')) :
+      [Buffer.from(crypto.hkdfSync('sha256', settings.sessionCookieSecret, '', 'meet-on-fhir session fields', 32))];
+    cachedFor = source;
+  }
+  return cachedKeys;
+}
+
+function associatedData(field, sessionId) {
+  return Buffer.from(field + ' ' + (sessionId || ''));
+}
+
+// The IV, tag and ciphertext are written into one buffer, as for the
+// session context.
+function seal(field, sessionId, plaintext) {
+  const data = Buffer.from(plaintext);
+  const sealed = Buffer.allocUnsafe(28 + data.length);
+  const iv = crypto.randomFillSync(sealed, 0, 12).subarray(0, 12);
+  const cipher = crypto.createCipheriv('aes-256-gcm', keys()[0], iv);
+  cipher.setAAD(associatedData(field, sessionId));
+  cipher.update(data).copy(sealed, 28);
+  cipher.final();
+  cipher.getAuthTag().copy(sealed, 12);
+  return VERSION + '.' + sealed.toString('base64url');
+}
+
+// Returns the JSON sealed in a value, or undefined if it can't be opened.
+function open(field, sessionId, value) {
+  const data = Buffer.from(value.substring(VERSION.length + 1), 'base64url');
+  if (data.length < 28) {
+    return undefined;
+  }
+  for (const key of keys()) {
+    try {
+      const decipher = crypto.createDecipheriv('aes-256-gcm', key, data.subarray(0, 12));
+      decipher.setAAD(associatedData(field, sessionId));
+      decipher.setAuthTag(data.subarray(12, 28));
+      const plaintext = decipher.update(data.subarray(28));
+      decipher.final();
+      return plaintext.toString();
+    } catch (err) {
+      // Sealed with another key or for another session.
+    }
+  }
+  return undefined;
+}
+
+function isSealed(value) {
+  return typeof value == 'string' && value.startsWith(VERSION + '.');
+}
+
+// Middleware opening the sealed fields of the session for the request and
+// sealing them again when the response is sent.  A field that is unchanged
+// keeps its ciphertext, so the session cookie is only rewritten when the
+// session changed.  Fields that can't be opened are dropped.  Must be used
+// after the session middleware.
+exports.middleware = function(request, response, next) {
+  if (!options().encrypted) {
+    next();
+    return;
+  }
+
+  const sessionId = request.session.id;
+  const opened = {};
+  fields().forEach(field => {
+    const value = request.session[field];
+    if (!isSealed(value)) {
+      return;
+    }
+    const plaintext = open(field, sessionId, value);
+    if (plaintext === undefined) {
+      request.session[field] = null;
+      return;
+    }
+    opened[field] = {plaintext: plaintext, sealed: value};
+    request.session[field] = JSON.parse(plaintext);
+  });
+
+  const writeHead = response.writeHead;
+  response.writeHead = function() {
+    fields().forEach(field => {
+      const value = request.session[field];
+      if (value === undefined || value === null || isSealed(value)) {
+        return;
+      }
+      const plaintext = JSON.stringify(value);
+      const previous = opened[field];
+      request.session[field] = previous && previous.plaintext == plaintext && request.session.id == sessionId ?
+        previous.sealed : seal(field, request.session.id, plaintext);
+    });
+    return writeHead.apply(this, arguments);
+  };
+  next();
+};
+
+// Returns a copy of a session with its fields as they will be stored, or with
+// placeholders of the same length for fields that will be sealed, so the
+// size of the cookie can be known before it is written.
+exports.stored = function(session) {
+  const copy = Object.assign({}, session);
+  if (options().encrypted) {
+    fields().forEach(field => {
+      const value = copy[field];
+      if (value !== undefined && value !== null && !isSealed(value)) {
+        const length = 28 + Buffer.byteLength(JSON.stringify(value));
+        copy[field] = VERSION + '.' + 'x'.repeat(Math.ceil(length * 4 / 3));
+      }
+    });
+  }
+  return copy;
+};
@@ -0,0 +1,81 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Versions of what the session cookie holds.  Sessions record the version
+// they were written in as their format field, and those written in an older
+// one are upgraded when they are read by the registered upgrades, one
+// version at a time, so a release that changes the session's fields doesn't
+// end the sessions of everyone signed in.  Sessions from before versions were
+// recorded are version 0.  Sessions written by a newer release, as the
+// instances still running the previous one see during a rolling deploy, are
+// passed through unchanged.
+
+// upgrades[n] changes a version n session into a version n + 1 one.
+const upgrades = [];
+
+// Registers the upgrade of sessions from version from to from + 1.  Upgrades
+// are called with the session and change it in place.
+exports.register = function(from, upgrade) {
+  if (upgrades[from]) {
+    throw new Error('Session format ' + from + ' already has an upgrade');
+  }
+  upgrades[from] = upgrade;
+};
+
+// The version sessions are written in.
+exports.current = function() {
+  return upgrades.length;
+};
+
+// Upgrades a session to the current version, returning whether it changed.
+exports.upgrade = function(session) {
+  const version = session.format || 0;
+  if (version >= exports.current()) {
+    return false;
+  }
+  for (var from = version; from < exports.current(); from++) {
+    if (!upgrades[from]) {
+      throw new Error('Session format ' + from + ' has no upgrade');
+    }
+    upgrades[from](session);
+  }
+  session.format = exports.current();
+  return true;
+};
+
+// Middleware upgrading the request's session, and recording the version in
+// sessions that don't have one yet when the response is sent.  Must be used
+// after the session fields are opened.
+exports.middleware = function(request, response, next) {
+  if (Object.keys(request.session).length) {
+    try {
+      exports.upgrade(request.session);
+    } catch (err) {
+      next(err);
+      return;
+    }
+  }
+
+  const writeHead = response.writeHead;
+  response.writeHead = function() {
+    const session = request.session;
+    if (session && session.format === undefined && Object.keys(session).length) {
+      session.format = exports.current();
+    }
+    return writeHead.apply(this, arguments);
+  };
+  next();
+};
@@ -0,0 +1,64 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A cap on the size of the session cookie.  Browsers drop cookies over about
+// 4096 bytes without telling the server, which signs the provider out or loses
+// a patient's verification with no error anywhere.  Instead, a request that
+// would grow the session past settings.maxSessionBytes (3800 by default,
+// leaving room for the cookie's name and attributes) fails with
+// session-too-large and leaves the session as it was.  Bulky data belongs in
+// the datastore, with only its key in the session.
+
+const errors = require('./errors.js');
+const sessionfields = require('./sessionfields.js');
+
+const settings = require('./settings.json');
+
+function maxBytes() {
+  return settings.maxSessionBytes || 3800;
+}
+
+// The length of the session cookie value cookie-session will write: the
+// base64 encoded JSON of the session, with its sealed fields.
+function cookieLength(session) {
+  return Math.ceil(Buffer.byteLength(JSON.stringify(sessionfields.stored(session))) / 3) * 4;
+}
+
+exports.cookieLength = cookieLength;
+
+// Middleware checking the session when the response ends, before its cookie
+// is written.  Must be used after the session middleware.
+exports.middleware = function(request, response, next) {
+  const original = JSON.stringify(request.session);
+  const end = response.end;
+  response.end = function() {
+    response.end = end;
+    const length = request.session ? cookieLength(request.session) : 0;
+    if (length <= maxBytes() || response.headersSent) {
+      return end.apply(this, arguments);
+    }
+
+    console.log('Session of ' + length + ' bytes is over maxSessionBytes with ' +
+      Object.keys(request.session).join(', ') + ' for ' + request.method + ' ' + request.path);
+    const restored = JSON.parse(original);
+    Object.keys(request.session).forEach(field => {
+      delete request.session[field];
+    });
+    Object.assign(request.session, restored);
+    errors.send(response, new errors.SessionTooLarge(length + ' bytes is over the limit of ' + maxBytes()));
+  };
+  next();
+};
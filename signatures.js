@@ -0,0 +1,159 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Verification of inbound callbacks, so that each integration calling back
+// into the application doesn't authenticate its requests its own way.
+// settings.callbacks maps each callback endpoint to the scheme its caller
+// signs requests with:
+//
+//   bearer  One of tokens as a bearer Authorization header.
+//   pubsub  A Google-signed OIDC token from a Cloud Pub/Sub push
+//           subscription, for audience and, if set, from serviceAccount.
+//   twilio  An X-Twilio-Signature header signed with authToken over the
+//           request URL and form parameters.
+//   hmac    An HMAC of the raw body under one of secrets in header (by
+//           default X-Signature), with algorithm (sha256), encoding (hex) and
+//           an optional prefix such as "sha256=".
+//   service The key or signature of a service of settings.serviceKeys
+//           allowed the endpoint (see servicekeys.js).
+//
+// Callbacks from several FHIR servers, which name theirs in the server query
+// parameter, can give each server its own options, such as its own tokens or
+// secrets, in servers keyed by base URL.  Servers that aren't listed are
+// refused.
+//
+// Endpoints verifying the body must parse it with capture as the parser's
+// verify option, and verify after parsing.
+
+const errors = require('./errors.js');
+const servicekeys = require('./servicekeys.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const {google} = require('googleapis');
+
+// Schemes endpoints use when settings.callbacks doesn't name one, so that
+// deployments configured before settings.callbacks keep working.
+// settings.subscriptionTokens maps each FHIR server to its tokens.
+const defaults = {
+  subscriptions: () => {
+    const tokens = settings.subscriptionTokens || {};
+    return {scheme: 'bearer', servers: Object.keys(tokens).reduce((servers, server) => {
+      servers[server] = {tokens: tokens[server]};
+      return servers;
+    }, {})};
+  },
+};
+
+function config(name, request) {
+  const configured = (settings.callbacks || {})[name];
+  const options = configured || (defaults[name] ? defaults[name]() : {});
+  if (!options.servers) {
+    return options;
+  }
+  const server = String(request.query.server || '').replace(/\/+$/, '');
+  const match = Object.keys(options.servers).find(candidate => candidate.replace(/\/+$/, '') == server);
+  return match ? Object.assign({}, options, options.servers[match]) : {};
+}
+
+function matches(value, candidate) {
+  const a = Buffer.from(value || '');
+  const b = Buffer.from(candidate || '');
+  return a.length > 0 && a.length == b.length && crypto.timingSafeEqual(a, b);
+}
+
+function bearerToken(request) {
+  const authorization = request.get('Authorization') || '';
+  return authorization.startsWith('Bearer ') ? authorization.substring('Bearer '.length) : '';
+}
+
+// The URL the caller signed.  Behind a load balancer the request's own
+// protocol and host may not be the public ones, so the public origin is taken
+// from the Google sign-in redirect.
+function publicUrl(request) {
+  return new URL(settings.oauth2.redirectUri).origin + request.originalUrl;
+}
+
+const schemes = {
+  bearer: (options, request) => {
+    const token = bearerToken(request);
+    return Promise.resolve((options.tokens || []).some(candidate => matches(token, candidate)));
+  },
+
+  pubsub: (options, request) => {
+    const token = bearerToken(request);
+    if (!token) {
+      return Promise.resolve(false);
+    }
+    return new google.auth.OAuth2().verifyIdToken({idToken: token, audience: options.audience}).then(ticket => {
+      const claims = ticket.getPayload();
+      return !options.serviceAccount || (claims.email == options.serviceAccount && claims.email_verified);
+    }, () => false);
+  },
+
+  twilio: (options, request) => {
+    const params = request.body || {};
+    const signed = Object.keys(params).sort().reduce((data, name) => data + name + params[name], publicUrl(request));
+    const expected = crypto.createHmac('sha1', options.authToken || '').update(signed).digest('base64');
+    return Promise.resolve(!!options.authToken && matches(request.get('X-Twilio-Signature'), expected));
+  },
+
+  hmac: (options, request) => {
+    if (!request.rawBody) {
+      return Promise.reject(new Error('The raw body was not captured'));
+    }
+    const signature = request.get(options.header || 'X-Signature') || '';
+    const prefix = options.prefix || '';
+    if (!signature.startsWith(prefix)) {
+      return Promise.resolve(false);
+    }
+    return Promise.resolve((options.secrets || []).some(secret => {
+      const expected = crypto.createHmac(options.algorithm || 'sha256', secret)
+        .update(request.rawBody).digest(options.encoding || 'hex');
+      return matches(signature.substring(prefix.length), expected);
+    }));
+  },
+
+  service: (options, request, name) => servicekeys.verify(request, name).then(service => !!service),
+};
+
+// Body parser verify option keeping the raw body for signature checks.
+exports.capture = function(request, response, buffer) {
+  request.rawBody = buffer;
+};
+
+// Middleware rejecting requests to the callback endpoint name that aren't
+// signed as settings.callbacks says.  Endpoints without a scheme are disabled.
+exports.required = function(name) {
+  return function(request, response, next) {
+    const options = config(name, request);
+    const scheme = schemes[options.scheme];
+    if (!scheme) {
+      next(new errors.Forbidden('The ' + name + ' callback is not configured'));
+      return;
+    }
+    scheme(options, request, name).then(valid => {
+      next(valid ? undefined : new errors.Forbidden('The ' + name + ' callback is not signed'));
+    }, next);
+  };
+};
+
+// Adds a scheme, given a function of the scheme's options, the request and
+// the endpoint's name resolving to whether the request is signed.
+exports.setScheme = function(name, verify) {
+  schemes[name] = verify;
+};
@@ -0,0 +1,121 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Sanitized snapshots of provider sessions for troubleshooting launches.  A
+// session is referred to by a reference derived from its ID, since the ID
+// itself signs the provider in; the reference is sent with the session's
+// status so a provider can quote it in a support ticket.  Snapshots show
+// every stored field of the session, with tokens replaced by a fingerprint
+// and, for JWTs, their expiry.
+
+const credentials = require('./credentials.js');
+const datastore = require('./datastore.js');
+
+const crypto = require('crypto');
+
+function sha256(value) {
+  return crypto.createHash('sha256').update(value).digest('hex');
+}
+
+// Returns the support reference of a session ID.
+exports.reference = function(id) {
+  return sha256('session:' + id).substring(0, 16);
+};
+
+// The expiry of a JWT, without verifying it, or undefined for other tokens.
+function jwtExpiry(token) {
+  const parts = token.split('.');
+  if (parts.length != 3) {
+    return undefined;
+  }
+  try {
+    const claims = JSON.parse(Buffer.from(parts[1], 'base64').toString('utf8'));
+    return typeof claims.exp == 'number' ? new Date(claims.exp * 1000) : undefined;
+  } catch (err) {
+    return undefined;
+  }
+}
+
+function describeToken(token) {
+  if (!token) {
+    return {present: false};
+  }
+  return {present: true, fingerprint: sha256(token).substring(0, 12), length: token.length, expires: jwtExpiry(token)};
+}
+
+// Describes a stored credential.  Reading it is audited like any other.
+function describeCredential(id) {
+  return datastore.get(datastore.key(['Credential', id])).then(entity => {
+    if (!entity) {
+      return {present: false, deleted: true};
+    }
+    return credentials.load(id, 'admin').then(token => {
+      return Object.assign(describeToken(token), {keyId: entity.KeyId, stored: entity.Created});
+    });
+  });
+}
+
+// The session fields holding secrets, and how each is shown.
+const secrets = {
+  Credential: describeCredential,
+  EhrCredential: describeCredential,
+  Token: token => Promise.resolve(describeToken(token)),
+  Sibling: id => Promise.resolve(exports.reference(id)),
+};
+
+function snapshot(entity) {
+  const id = datastore.name(entity);
+  const now = new Date();
+  const names = Object.keys(entity);
+  const fields = {};
+  return Promise.all(names.map(field => {
+    return secrets[field] ? secrets[field](entity[field]) : entity[field];
+  })).then(values => {
+    names.forEach((field, i) => {
+      fields[field] = values[i];
+    });
+    return datastore.lookup('Encounter', 'Owner', id);
+  }).then(encounters => {
+    return {
+      reference: exports.reference(id),
+      expired: !!(entity.Expires && entity.Expires < now),
+      fields: fields,
+      meetings: encounters.map(encounter => ({
+        encounterId: datastore.name(encounter),
+        created: encounter.Created,
+        closed: encounter.Closed,
+        status: encounter.Status,
+        degraded: encounter.Degraded,
+      })),
+    };
+  });
+}
+
+// Resolves to the snapshot of the session with a reference, or undefined if
+// there is none.  Sessions have no index by reference, so all are read.
+exports.session = function(reference) {
+  return datastore.list('User').then(entities => {
+    const entity = entities.find(entity => exports.reference(datastore.name(entity)) == reference);
+    return entity && snapshot(entity);
+  });
+};
+
+// Resolves to the snapshots of a FHIR user's sessions.
+exports.forIdentity = function(identity) {
+  return datastore.list('User', [['Identity', '=', identity]]).then(entities => {
+    return Promise.all(entities.map(snapshot));
+  });
+};
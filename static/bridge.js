@@ -0,0 +1,109 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// SMART Web Messaging with the EHR window embedding the client.  The page is
+// rendered with the origins the client may message, and messages are only
+// sent to, and accepted from, the EHR window at the origin its token response
+// names if it is one of them.
+const bridge = (function() {
+  const timeout = 10000;
+  const pending = {};
+  var host = null;
+  var origin = null;
+  var handle = null;
+
+  function meta(name) {
+    return $('meta[name="' + name + '"]').attr('content') || '';
+  }
+
+  function onMessage(event) {
+    if (event.source !== host || event.origin !== origin || !event.data) {
+      return;
+    }
+    const request = pending[event.data.responseToMessageId];
+    if (request) {
+      delete pending[event.data.responseToMessageId];
+      window.clearTimeout(request.timer);
+      request.resolve(event.data.payload || {});
+    }
+  }
+
+  // Sends a message to the EHR, resolving to the payload of its response.
+  function send(messageType, payload) {
+    if (!host) {
+      return Promise.reject(new Error('Not connected to the EHR'));
+    }
+    const messageId = Math.random().toString(36).substring(2) + Date.now().toString(36);
+    return new Promise((resolve, reject) => {
+      const timer = window.setTimeout(() => {
+        delete pending[messageId];
+        reject(new Error('The EHR did not answer ' + messageType));
+      }, timeout);
+      pending[messageId] = { resolve: resolve, timer: timer };
+      host.postMessage({
+        messageId: messageId,
+        messagingHandle: handle,
+        messageType: messageType,
+        payload: payload || {},
+      }, origin);
+    });
+  }
+
+  // Connects to the EHR window a SMART client was launched from, resolving to
+  // whether the EHR answered the handshake.
+  function connect(client) {
+    const token = (client.state && client.state.tokenResponse) || {};
+    const allowed = meta('smart-web-messaging-origins').split(' ').filter(o => o);
+    const parent = window.opener || (window.parent !== window ? window.parent : null);
+    if (!token.smart_web_messaging_handle || !parent || allowed.indexOf(token.smart_web_messaging_origin) == -1) {
+      return Promise.resolve(false);
+    }
+    host = parent;
+    origin = token.smart_web_messaging_origin;
+    handle = token.smart_web_messaging_handle;
+    window.addEventListener('message', onMessage);
+    return send('status.handshake').then(() => true, () => {
+      host = null;
+      return false;
+    });
+  }
+
+  // The launch context the EHR gave the client.
+  function launchContext(client) {
+    const token = (client.state && client.state.tokenResponse) || {};
+    return { patient: token.patient, encounter: token.encounter, fhirContext: token.fhirContext };
+  }
+
+  // Opens a meeting, with the EHR's meeting activity if it has one, or else
+  // in a new window since meetings can't run in the EHR's frame.  Resolves to
+  // the window, or undefined if the EHR shows the meeting.
+  function openMeeting(url) {
+    const activity = meta('smart-web-messaging-meeting-activity');
+    if (host && activity) {
+      return send('ui.launchActivity', { activityType: activity, activityParameters: { url: url } })
+        .then(() => undefined, () => window.open(url, '_blank') || undefined);
+    }
+    return Promise.resolve(window.open(url, '_blank') || undefined);
+  }
+
+  return {
+    connect: connect,
+    send: send,
+    launchContext: launchContext,
+    openMeeting: openMeeting,
+    done: () => send('ui.done'),
+  };
+})();
@@ -3,6 +3,8 @@ var languageAssets = {
   en: {
     continueButton: "Continue",
     joinButton: "Join appointment",
+    handoffButton: "Continue on another device",
+    handoffMessage: "Within 5 minutes, open this address on your other device and enter the code:",
     welcomeMessage: "Welcome",
     waitingRoomMessage: "Your appointment will begin soon.<br />Thank you for your patience.",
     consentMessage: "<h1>Before you enter the waiting room, please review the following information about televisits, via MyChart:</h1>" +        
@@ -11,12 +13,19 @@ var languageAssets = {
         "<li>You understand there are potential risks to this technology, including interruptions, unauthorized access and technical difficulties.  You or your provider may need to discontinue the televisit at any time.</li>" +
         "<li>By continuing to participate in this telehealth visit, you are providing verbal consent for treatment.</li>" +
       "</ol>",
-    languageSelect: "Select your language:"
+    languageSelect: "Select your language:",
+    recordingConsent: "I agree to this visit being recorded",
+    verifyBirthDate: "To protect your privacy, please enter your date of birth (MM/DD/YYYY):",
+    verifyIdentifier: "To protect your privacy, please enter the last 4 characters of your medical record number:",
+    inviteButton: "Invite",
+    invitationsMessage: "Invite other members of the care team, then join the visit:"
   },
   // Spanish
   es: {
     continueButton: "Seguir",
     joinButton: "Iniciar su cita",
+    handoffButton: "Continuar en otro dispositivo",
+    handoffMessage: "Dentro de 5 minutos, abra esta dirección en su otro dispositivo e ingrese el código:",
     welcomeMessage: "Bienvenidos",
     waitingRoomMessage: "Tu cita comenzará pronto.<br/>agradecemos tu paciencia.",
     consentMessage: "<h1>Antes de entrar a la sala de espera, revise la siguiente información sobre las televisitas, a través de MyCHArt:</h1>" +        
@@ -25,7 +34,12 @@ var languageAssets = {
         "<li>Usted entiende que existen posibles riesgos con esta tecnología, como interrupciones, acceso no autorizado y dificultades técnicas. Es posible que usted o su proveedor tengan que interrumpir la televisita en cualquier momento.</li>" +
         "<li>Al continuar con esta televisita, usted da su consentimiento verbal para el tratamiento.</li>" +
       "</ol>",
-    languageSelect: "Elige tu idioma:"
+    languageSelect: "Elige tu idioma:",
+    recordingConsent: "Acepto que esta visita sea grabada",
+    verifyBirthDate: "Para proteger su privacidad, ingrese su fecha de nacimiento (MM/DD/AAAA):",
+    verifyIdentifier: "Para proteger su privacidad, ingrese los últimos 4 caracteres de su número de historia clínica:",
+    inviteButton: "Invitar",
+    invitationsMessage: "Invite a otros miembros del equipo de atención y luego únase a la visita:"
   }
 }
 
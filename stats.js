@@ -0,0 +1,144 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Live operational statistics for an admin dashboard.  Current counts are
+// computed from the stored sessions and meetings; requests carrying a FHIR
+// context, and how many of those failed, are counted per EHR profile in
+// hourly buckets so error rates can be charted.  Like the usage analytics,
+// none of this includes encounter, patient or user identifiers.
+
+const breaker = require('./breaker.js');
+const datastore = require('./datastore.js');
+const instrumentation = require('./instrumentation.js');
+const loadshed = require('./loadshed.js');
+const ehr = require('./ehr.js');
+const tenants = require('./tenants.js');
+
+const hourMs = 60 * 60 * 1000;
+
+function hourOf(date) {
+  return date.toISOString().substring(0, 13);
+}
+
+function record(ehrName, failed) {
+  const hour = hourOf(new Date());
+  const key = datastore.key(['Stat', hour + '/' + ehrName]);
+  return datastore.modify(key, entity => {
+    entity = entity || {Hour: hour, Ehr: ehrName, Requests: 0, Errors: 0};
+    entity.Requests += 1;
+    entity.Errors += failed ? 1 : 0;
+    return entity;
+  }).catch(err => {
+    console.log('Failed to record request statistics: ' + err);
+  });
+}
+
+// Middleware counting the outcome of requests from EHR launches.
+exports.middleware = function(request, response, next) {
+  const serverUrl = request.get('X-FHIR-Server');
+  if (serverUrl) {
+    response.on('finish', () => record(ehr.profileName(serverUrl), response.statusCode >= 500));
+  }
+  next();
+};
+
+function startOfDay(now) {
+  const day = new Date(now);
+  day.setUTCHours(0, 0, 0, 0);
+  return day;
+}
+
+function waiting(entity) {
+  return entity.PatientWaiting && !entity.ProviderJoined && !entity.Ended && !entity.Closed;
+}
+
+// Resolves to the current counts and the last day's error rates by EHR.
+exports.live = function() {
+  const now = new Date();
+  const dayAgo = new Date(now.getTime() - 24 * hourMs);
+  return Promise.all([
+    datastore.list('User', [['Expires', '>', now]]),
+    datastore.list('Encounter', [['Created', '>', dayAgo]]),
+    datastore.list('Stat', [['Hour', '>=', hourOf(dayAgo)]]),
+  ]).then(results => {
+    const errorRates = {};
+    results[2].forEach(entity => {
+      const rate = errorRates[entity.Ehr] = errorRates[entity.Ehr] || {requests: 0, errors: 0};
+      rate.requests += entity.Requests;
+      rate.errors += entity.Errors;
+    });
+    Object.keys(errorRates).forEach(name => {
+      errorRates[name].rate = errorRates[name].errors / errorRates[name].requests;
+    });
+    const byTenant = {};
+    results[0].forEach(entity => {
+      const tenant = entity.Tenant || tenants.DEFAULT;
+      byTenant[tenant] = (byTenant[tenant] || 0) + 1;
+    });
+    const today = startOfDay(now);
+    return {
+      time: now,
+      activeSessions: results[0].length,
+      activeSessionsByTenant: byTenant,
+      waitingPatients: results[1].filter(waiting).length,
+      visitsToday: results[1].filter(entity => entity.Created >= today).length,
+      errorRates: errorRates,
+      circuitBreakers: breaker.states(),
+      store: instrumentation.store.snapshot(),
+      load: loadshed.state(),
+    };
+  });
+};
+
+function bucket(series, start, date) {
+  const index = Math.floor((date - start) / hourMs);
+  return index >= 0 && index < series.length ? series[index] : undefined;
+}
+
+// Resolves to hourly buckets over the last hours: meetings created, patients
+// joined and requests and errors by EHR.
+exports.series = function(hours) {
+  const now = new Date();
+  const start = new Date(now.getTime() - hours * hourMs);
+  start.setUTCMinutes(0, 0, 0);
+  const series = [];
+  for (var time = start.getTime(); time <= now.getTime(); time += hourMs) {
+    series.push({start: new Date(time), visitsCreated: 0, patientsJoined: 0, requests: {}, errors: {}});
+  }
+  return Promise.all([
+    datastore.list('Encounter', [['Created', '>=', start]]),
+    datastore.list('Stat', [['Hour', '>=', hourOf(start)]]),
+  ]).then(results => {
+    results[0].forEach(entity => {
+      const created = bucket(series, start, entity.Created);
+      if (created) {
+        created.visitsCreated += 1;
+      }
+      const joined = entity.PatientJoined && bucket(series, start, entity.PatientJoined);
+      if (joined) {
+        joined.patientsJoined += 1;
+      }
+    });
+    results[1].forEach(entity => {
+      const hour = bucket(series, start, new Date(entity.Hour + ':00:00Z'));
+      if (hour) {
+        hour.requests[entity.Ehr] = (hour.requests[entity.Ehr] || 0) + entity.Requests;
+        hour.errors[entity.Ehr] = (hour.errors[entity.Ehr] || 0) + entity.Errors;
+      }
+    });
+    return series;
+  });
+};
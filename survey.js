@@ -0,0 +1,159 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Post-visit patient experience surveys.  With settings.survey.enabled, the
+// patient of a visit that ended after they joined is sent a link to the
+// survey through the notification channel.  The link goes through
+// /surveys/{token}, which records that it was opened, and the survey tool
+// reports completion to POST /surveys/{token}/completed.
+
+const datastore = require('./datastore.js');
+const encounter = require('./encounter.js');
+const fhir = require('./fhir.js');
+const notifications = require('./notifications.js');
+const tenancy = require('./tenancy.js');
+const user = require('./user.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+function options() {
+  return settings.survey || {};
+}
+
+exports.enabled = function() {
+  return !!options().enabled && !!options().url && notifications.enabled();
+};
+
+// How long a survey link can be used.
+function lifetime() {
+  return (options().expiresDays || 14) * 24 * 60 * 60 * 1000;
+}
+
+function key(token) {
+  return datastore.key(['Survey', crypto.createHash('sha256').update(String(token)).digest('hex')]);
+}
+
+function patient(context, encounterId) {
+  return fhir.read(context, 'Encounter', encounterId).then(resource => {
+    return resource.subject && resource.subject.reference;
+  });
+}
+
+// The survey links are on the same origin as the Google sign-in redirect.
+function origin() {
+  return new URL(settings.oauth2.redirectUri).origin;
+}
+
+// Sends the survey for an ended visit, once.  context is the FHIR context to
+// find the patient with, or else the one the meeting owner's session last
+// used is tried.  Resolves to whether it was sent.
+exports.dispatch = function(encounterId, context) {
+  const now = new Date();
+  return datastore.modify(datastore.key(['Encounter', encounterId]), entity => {
+    if (!entity || !entity.PatientJoined || entity.NoShow || entity.SurveySent) {
+      return undefined;
+    }
+    return Object.assign(entity, {SurveySent: now});
+  }).then(entity => {
+    if (!entity) {
+      return false;
+    }
+    const fhirContext = context ? Promise.resolve(context) :
+      (entity.Owner ? user.fhirContextFor(entity.Owner) : Promise.resolve());
+    return fhirContext.then(fhirContext => {
+      if (!fhirContext) {
+        console.log('No EHR token to send the survey of encounter ' + encounterId + ' with');
+        return false;
+      }
+      return patient(fhirContext, encounterId).then(reference => {
+        if (!reference) {
+          return false;
+        }
+        const token = crypto.randomBytes(16).toString('hex');
+        return datastore.set(key(token), {
+          Encounter: encounterId,
+          Tenant: tenancy.current() || '',
+          Sent: now,
+          Expires: new Date(now.getTime() + lifetime()),
+        }).then(() => {
+          const message = {
+            kind: 'survey',
+            to: reference,
+            encounterId: encounterId,
+            subject: options().subject || 'How was your visit?',
+            text: options().message || 'Please tell us about your video visit:',
+            url: origin() + '/surveys/' + token,
+          };
+          if (options().questionnaire) {
+            message.attachment = {url: options().questionnaire, title: message.subject};
+          }
+          return notifications.send(message, fhirContext);
+        });
+      });
+    });
+  }).catch(err => {
+    console.log('Failed to send the survey of encounter ' + encounterId + ': ' + err);
+    return false;
+  });
+};
+
+// Resolves to the URL of the survey for a token, recording that it was
+// opened, or undefined if the token is unknown or expired.
+exports.open = function(token) {
+  const now = new Date();
+  return datastore.modify(key(token), entity => {
+    if (!entity || entity.Expires < now) {
+      return undefined;
+    }
+    return Object.assign(entity, {Opened: entity.Opened || now});
+  }).then(entity => {
+    if (!entity) {
+      return undefined;
+    }
+    return options().url.replace('{token}', encodeURIComponent(token));
+  });
+};
+
+// Records that the survey for a token was completed, resolving to false if
+// the token is unknown or expired.
+exports.complete = function(token) {
+  const now = new Date();
+  return datastore.modify(key(token), entity => {
+    if (!entity || entity.Expires < now) {
+      return undefined;
+    }
+    return Object.assign(entity, {Completed: entity.Completed || now});
+  }).then(entity => {
+    if (!entity) {
+      return false;
+    }
+    // Survey links are shared by all tenants; the visit is the tenant's.
+    return tenancy.run(entity.Tenant, () => {
+      return encounter.record(entity.Encounter, {SurveyCompleted: entity.Completed});
+    }).then(() => true);
+  });
+};
+
+// Deletes expired survey links, resolving to how many were deleted.
+exports.purge = function(now) {
+  return datastore.list('Survey', [['Expires', '<', now]]).then(entities => {
+    return Promise.all(entities.map(entity => {
+      return datastore.delete(datastore.key(['Survey', datastore.name(entity)]));
+    })).then(() => entities.length);
+  });
+};
@@ -0,0 +1,89 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Server-side rendering of the patient pages with each tenant's branding.
+// The HTML pages under static/ may refer to variables as {{name}}, which are
+// replaced with their HTML-escaped values, or left empty if unknown.  The
+// branding variables are:
+//
+//   clinicName     The clinic's name, for titles and the logo's alt text.
+//   logoUrl        The logo, an https: URL or a path on this server.
+//   brandingStyle  CSS applying primaryColor (a #rrggbb colour) to buttons.
+//
+// They come from settings.branding, overridden by the tenant's branding.
+// Pages also get the variables of the SMART Web Messaging bridge from
+// messaging.js.
+
+const messaging = require('./messaging.js');
+const sessioncontext = require('./sessioncontext.js');
+const tenants = require('./tenants.js');
+
+const settings = require('./settings.json');
+
+const defaults = {
+  clinicName: 'Telehealth visit',
+  logoUrl: 'assets/logo.png',
+};
+
+function escape(value) {
+  return String(value)
+    .replace(/&/g, '&amp;')
+    .replace(/</g, '&lt;')
+    .replace(/>/g, '&gt;')
+    .replace(/"/g, '&quot;')
+    .replace(/'/g, '&#39;');
+}
+
+exports.render = function(source, variables) {
+  return source.replace(/\{\{\s*([A-Za-z]+)\s*\}\}/g, (match, name) => {
+    return variables[name] === undefined || variables[name] === null ? '' : escape(variables[name]);
+  });
+};
+
+// Returns the branding variables of a tenant.  Values that could break out of
+// their context are dropped.
+exports.branding = function(tenant) {
+  const branding = Object.assign({}, defaults, settings.branding, tenants.config(tenant).branding);
+  const variables = {clinicName: branding.clinicName, logoUrl: defaults.logoUrl, brandingStyle: ''};
+  if (/^(https:\/\/|\/|[a-z])[^\s"'()<>]*$/.test(branding.logoUrl || '') && !/^javascript:/i.test(branding.logoUrl)) {
+    variables.logoUrl = branding.logoUrl;
+  }
+  if (/^#[0-9a-fA-F]{6}$/.test(branding.primaryColor || '')) {
+    variables.brandingStyle = 'button { background-color: ' + branding.primaryColor +
+      '; border-color: ' + branding.primaryColor + '; }';
+  }
+  return variables;
+};
+
+// Messages of the error page, by problem code.
+const errorMessages = {
+  'expired': 'This visit has ended.',
+  'not-found': 'This link is invalid or has expired.',
+  'replayed': 'This link was already used.  Please launch the visit again from your patient portal.',
+  'locked': 'Too many attempts, please try again later.',
+  'unexpected': 'An unexpected error occurred.  Please try again or contact your clinic.',
+};
+
+// Renders a page for a request, with the branding of the tenant the browser
+// launched from and the page's own query variables.
+exports.page = function(name, html, request) {
+  const tenant = sessioncontext.get(request).tenant || tenants.DEFAULT;
+  const variables = Object.assign(exports.branding(tenant), messaging.variables(tenant));
+  if (name == '/error.html') {
+    variables.errorMessage = errorMessages[request.query.code] || errorMessages.unexpected;
+  }
+  return exports.render(html, variables);
+};
@@ -0,0 +1,92 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The tenant a request or job runs for, kept in its async context like the
+// request deadline so that the datastore can keep each tenant's records in
+// their own namespace without the tenant being passed around.
+
+const sessioncontext = require('./sessioncontext.js');
+const tenants = require('./tenants.js');
+const versions = require('./versions.js');
+
+const settings = require('./settings.json');
+
+const {AsyncLocalStorage} = require('async_hooks');
+const crypto = require('crypto');
+
+const context = new AsyncLocalStorage();
+
+// Whether records are kept in a namespace for each tenant, as
+// settings.datastore.tenantNamespaces says.
+exports.enabled = function() {
+  return !!(settings.datastore && settings.datastore.tenantNamespaces);
+};
+
+// Returns the tenant the current request or job runs for, or undefined
+// outside of one.
+exports.current = function() {
+  const current = context.getStore();
+  return current && current.tenant;
+};
+
+// Calls run for tenant and resolves to its result.
+exports.run = function(tenant, run) {
+  return context.run({tenant: tenant || tenants.DEFAULT}, () => Promise.resolve().then(run));
+};
+
+// Calls run once for every tenant, one after the other, and resolves to
+// their results by tenant.  Without tenant namespaces it is called once
+// and resolves to its result.
+exports.each = function(run) {
+  if (!exports.enabled()) {
+    return Promise.resolve().then(run);
+  }
+  const ids = [tenants.DEFAULT].concat(Object.keys(settings.tenants || {}));
+  const results = {};
+  return ids.reduce((done, id) => {
+    return done.then(() => exports.run(id, run)).then(result => {
+      results[id] = result;
+    });
+  }, Promise.resolve()).then(() => results);
+};
+
+// Returns the datastore namespace of a tenant.  The default tenant's records
+// stay where they were kept before tenant namespaces, and tenant IDs that
+// aren't valid namespace names are hashed.
+exports.namespace = function(tenant) {
+  if (!tenant || tenant == tenants.DEFAULT) {
+    return undefined;
+  }
+  if (/^[0-9A-Za-z._-]{1,64}$/.test(tenant) && !tenant.startsWith('__')) {
+    return tenant;
+  }
+  return crypto.createHash('sha256').update(tenant).digest('hex').substring(0, 32);
+};
+
+// Middleware running the request for its tenant: that of its FHIR server,
+// else the one it launched from.  Admin requests choose one with a tenant
+// parameter.
+exports.middleware = function(request, response, next) {
+  var tenant;
+  if (versions.path(request).startsWith('/admin/')) {
+    tenant = request.query.tenant;
+  } else if (request.get('X-FHIR-Server')) {
+    tenant = tenants.forIssuer(request.get('X-FHIR-Server'));
+  } else {
+    tenant = sessioncontext.get(request).tenant;
+  }
+  context.run({tenant: tenant || tenants.DEFAULT}, next);
+};
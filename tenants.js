@@ -0,0 +1,88 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Tenants are the health systems sharing a deployment.  settings.tenants maps
+// each tenant ID to its configuration, including the FHIR server URL prefixes
+// (issuers) it launches from.  Launches from servers in the facility
+// directory belong to the facility's tenant, and launches from other servers
+// to the default tenant.
+
+const settings = require('./settings.json');
+
+// directory.js uses the datastore, which loads this module through
+// tenancy.js, so it is loaded on first use rather than with this module.
+function directory() {
+  return require('./directory.js');
+}
+
+exports.DEFAULT = 'default';
+
+// Minutes.
+const defaultDurations = {
+  provider: 7 * 60,
+  patient: 30,
+};
+
+exports.forIssuer = function(iss) {
+  const tenants = settings.tenants || {};
+  if (iss) {
+    for (const id in tenants) {
+      if ((tenants[id].issuers || []).some(prefix => iss.startsWith(prefix))) {
+        return id;
+      }
+    }
+    const facility = directory().forServer(iss);
+    if (facility && facility.tenant) {
+      return facility.tenant;
+    }
+  }
+  return exports.DEFAULT;
+};
+
+exports.config = function(id) {
+  return (settings.tenants || {})[id] || {};
+};
+
+// Returns how long, in milliseconds, a session for role ('provider' or
+// 'patient') lasts in a tenant.  Provider sessions are how long a provider
+// stays signed in; patient sessions are how long after first receiving the
+// meeting link a patient can keep retrieving it.
+exports.sessionDuration = function(id, role) {
+  const durations = Object.assign({}, defaultDurations, settings.sessionDurations,
+    exports.config(id).sessionDurations);
+  return durations[role] * 60 * 1000;
+};
+
+// Returns how long, in milliseconds, a provider session can be extended to
+// last in total.
+exports.maxSessionLifetime = function(id) {
+  const minutes = exports.config(id).maxSessionLifetime || settings.maxSessionLifetime || 12 * 60;
+  return minutes * 60 * 1000;
+};
+
+// Returns how many provider sessions can be active at once in a tenant, or 0
+// if there is no quota.
+exports.sessionQuota = function(id) {
+  const quota = exports.config(id).maxActiveSessions;
+  return (quota !== undefined ? quota : settings.maxActiveSessions) || 0;
+};
+
+// Returns how many provider sessions one user can have at once in a tenant,
+// or 0 if there is no limit.
+exports.sessionLimit = function(id) {
+  const limit = exports.config(id).maxConcurrentSessions;
+  return (limit !== undefined ? limit : settings.maxConcurrentSessions) || 0;
+};
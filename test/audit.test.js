@@ -0,0 +1,65 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+// Tests of the hash chain of audit.js, over the fake store.
+
+const audit = require('../audit.js');
+const datastore = require('../datastore.js');
+const fakeStore = require('../testing/store.js');
+
+const assert = require('assert');
+
+function recordKey(sequence) {
+  return datastore.key(['Audit', ('000000000000' + sequence).slice(-12)]);
+}
+
+exports['records appended at once form one chain'] = async () => {
+  datastore.use(fakeStore.create());
+  await Promise.all(Array.from({length: 10}, (_, i) => audit.record('action-' + i, 'system', 'encounter-1')));
+  assert.deepStrictEqual(await audit.verify(), {records: 10, valid: true, prunedThrough: undefined});
+};
+
+exports['a changed record breaks the chain'] = async () => {
+  datastore.use(fakeStore.create());
+  for (var i = 0; i < 3; i++) {
+    await audit.record('action-' + i, 'system', 'encounter-1');
+  }
+  await datastore.modify(recordKey(2), record => Object.assign(record, {Actor: 'provider'}));
+  const result = await audit.verify();
+  assert.strictEqual(result.valid, false);
+  assert.strictEqual(result.brokenAt, 2);
+  assert.strictEqual(result.reason, 'record modified');
+};
+
+exports['a failed append leaves no gap'] = async () => {
+  const store = fakeStore.create();
+  datastore.use(store);
+  await audit.record('action-1', 'system', 'encounter-1');
+  store.fail('modifyMany', new Error('Injected failure'), 1);
+  await audit.record('action-2', 'system', 'encounter-1');
+  await audit.record('action-3', 'system', 'encounter-1');
+  assert.deepStrictEqual(await audit.verify(), {records: 2, valid: true, prunedThrough: undefined});
+};
+
+exports['pruning keeps the rest of the chain valid'] = async () => {
+  datastore.use(fakeStore.create());
+  for (var i = 0; i < 4; i++) {
+    await audit.record('action-' + i, 'system', 'encounter-' + i);
+  }
+  assert.strictEqual(await audit.prune(new Date(Date.now() + 1000), false, new Set(['encounter-2'])), 2);
+  assert.deepStrictEqual(await audit.verify(), {records: 2, valid: true, prunedThrough: 2});
+};
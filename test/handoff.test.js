@@ -0,0 +1,74 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+// Tests of the lockout of handoff.js after wrong codes, over the fake store
+// and clock.
+
+const datastore = require('../datastore.js');
+const fakeClock = require('../testing/clock.js');
+const fakeStore = require('../testing/store.js');
+const handoff = require('../handoff.js');
+
+const assert = require('assert');
+
+function withClock(test) {
+  return async () => {
+    const clock = fakeClock.create(new Date('2020-05-01T09:00:00Z'));
+    clock.install();
+    datastore.use(fakeStore.create());
+    try {
+      await test(clock);
+    } finally {
+      clock.uninstall();
+    }
+  };
+}
+
+function wrongCodes(client, address, count) {
+  return Array.from({length: count}).reduce((done) => {
+    return done.then(() => handoff.redeem('000000', client, address));
+  }, Promise.resolve());
+}
+
+exports['a code is redeemed once'] = withClock(async () => {
+  const code = await handoff.issue('encounter-1', 'patient');
+  assert.strictEqual(code.length, 6);
+  assert.strictEqual((await handoff.redeem(code, 'browser-1', '10.0.0.1')).Encounter, 'encounter-1');
+  assert.strictEqual(await handoff.redeem(code, 'browser-1', '10.0.0.1'), undefined);
+});
+
+exports['a browser is locked out after five wrong codes'] = withClock(async (clock) => {
+  await wrongCodes('browser-1', '10.0.0.1', 5);
+  const code = await handoff.issue('encounter-1', 'patient');
+  await assert.rejects(handoff.redeem(code, 'browser-1', '10.0.0.1'), err => err.code == 'locked');
+
+  // Others behind the same address can still redeem their codes.
+  assert.strictEqual((await handoff.redeem(code, 'browser-2', '10.0.0.1')).Encounter, 'encounter-1');
+
+  clock.advance(16 * 60 * 1000);
+  const later = await handoff.issue('encounter-2', 'patient');
+  assert.strictEqual((await handoff.redeem(later, 'browser-1', '10.0.0.1')).Encounter, 'encounter-2');
+});
+
+exports['an address is locked out after many wrong codes from new browsers'] = withClock(async () => {
+  for (var i = 0; i < 100; i++) {
+    await handoff.redeem('000000', 'browser-' + i, '10.0.0.1');
+  }
+  const code = await handoff.issue('encounter-1', 'patient');
+  await assert.rejects(handoff.redeem(code, 'browser-new', '10.0.0.1'), err => err.code == 'locked');
+  assert.strictEqual((await handoff.redeem(code, 'browser-new', '10.0.0.2')).Encounter, 'encounter-1');
+});
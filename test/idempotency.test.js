@@ -0,0 +1,115 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+// Tests of the replay of idempotent requests by idempotency.js, over the fake
+// store.
+
+const datastore = require('../datastore.js');
+const fakeStore = require('../testing/store.js');
+const idempotency = require('../idempotency.js');
+
+const assert = require('assert');
+const {EventEmitter} = require('events');
+
+function request(session, body) {
+  const headers = {'Idempotency-Key': 'key-1'};
+  return {
+    method: 'POST',
+    path: '/v1/encounters',
+    session: session,
+    body: JSON.parse(body),
+    rawBody: Buffer.from(body),
+    // Parsed already, so the middleware's parser passes it through.
+    _body: true,
+    headers: {},
+    get: name => headers[name],
+  };
+}
+
+function response() {
+  const sent = new EventEmitter();
+  sent.headers = {};
+  sent.statusCode = 200;
+  sent.set = (name, value) => {
+    sent.headers[name] = value;
+    return sent;
+  };
+  sent.get = name => sent.headers[name];
+  sent.type = type => sent.set('Content-Type', type);
+  sent.status = status => {
+    sent.statusCode = status;
+    return sent;
+  };
+  sent.send = body => {
+    sent.body = body;
+    sent.emit('sent');
+    setImmediate(() => sent.emit('finish'));
+    return sent;
+  };
+  return sent;
+}
+
+// Runs a request through the middleware to handler, resolving to the
+// response once it is stored.
+function run(sent, handled, handler) {
+  return new Promise(resolve => {
+    sent.on('sent', () => setTimeout(() => resolve(sent), 20));
+    idempotency.middleware(handled, sent, () => handler(handled, sent));
+  });
+}
+
+exports['a retry gets the first response and its session changes'] = async () => {
+  datastore.use(fakeStore.create());
+  var runs = 0;
+  const handler = (handled, sent) => {
+    runs++;
+    handled.session.consent = {encounterId: '1'};
+    sent.status(201).send({encounterId: '1'});
+  };
+  await run(response(), request({id: 'session-1'}, '{"patient":"1"}'), handler);
+
+  const retry = request({id: 'session-1'}, '{"patient":"1"}');
+  const replayed = await run(response(), retry, handler);
+  assert.strictEqual(runs, 1);
+  assert.strictEqual(replayed.statusCode, 201);
+  assert.strictEqual(replayed.headers['Idempotent-Replayed'], 'true');
+  assert.deepStrictEqual(JSON.parse(replayed.body), {encounterId: '1'});
+  assert.deepStrictEqual(retry.session, {id: 'session-1', consent: {encounterId: '1'}});
+};
+
+exports['the stored session changes leave out the session ID'] = async () => {
+  datastore.use(fakeStore.create());
+  await run(response(), request({}, '{}'), (handled, sent) => {
+    handled.session.id = 'signed-in';
+    handled.session.handoff = {encounterId: '1'};
+    sent.send({});
+  });
+  const stored = await datastore.list('Idempotency');
+  assert.strictEqual(stored.length, 1);
+  assert.ok(stored[0].Session.indexOf('signed-in') == -1);
+  const credentials = await datastore.list('Credential');
+  assert.strictEqual(credentials.length, 1);
+  assert.ok(credentials[0].Ciphertext.indexOf('signed-in') == -1);
+};
+
+exports['a retry with another body conflicts'] = async () => {
+  datastore.use(fakeStore.create());
+  await run(response(), request({}, '{"patient":"1"}'), (handled, sent) => sent.send({}));
+  const conflict = await run(response(), request({}, '{"patient":"2"}'), () => assert.fail('ran twice'));
+  assert.strictEqual(conflict.statusCode, 409);
+  assert.strictEqual(conflict.body.code, 'idempotency-conflict');
+};
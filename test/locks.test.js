@@ -0,0 +1,82 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+// Tests of the expiry and fencing tokens of locks.js, over the fake store and
+// clock.
+
+const datastore = require('../datastore.js');
+const fakeClock = require('../testing/clock.js');
+const fakeStore = require('../testing/store.js');
+const locks = require('../locks.js');
+
+const assert = require('assert');
+
+function withClock(test) {
+  return async () => {
+    const clock = fakeClock.create(new Date('2020-05-01T09:00:00Z'));
+    clock.install();
+    datastore.use(fakeStore.create());
+    try {
+      await test(clock);
+    } finally {
+      clock.uninstall();
+    }
+  };
+}
+
+exports['a held lock is not acquired again'] = withClock(async () => {
+  const lock = await locks.acquire('meeting:1', 1000);
+  assert.ok(lock);
+  assert.strictEqual(await locks.acquire('meeting:1', 1000), undefined);
+  assert.ok(await locks.acquire('meeting:2', 1000));
+  await locks.release(lock);
+  assert.ok(await locks.acquire('meeting:1', 1000));
+});
+
+exports['an expired lock goes to the next caller with a larger token'] = withClock(async clock => {
+  const first = await locks.acquire('meeting:1', 1000);
+  clock.advance(1001);
+  const second = await locks.acquire('meeting:1', 1000);
+  assert.ok(second);
+  assert.ok(second.token > first.token);
+
+  // The first holder can no longer renew or release the lock.
+  assert.strictEqual(await locks.renew(first, 1000), false);
+  await locks.release(first);
+  assert.strictEqual(await locks.acquire('meeting:1', 1000), undefined);
+  assert.strictEqual(await locks.renew(second, 1000), true);
+});
+
+exports['records written by a later holder are fenced off'] = withClock(async clock => {
+  const first = await locks.acquire('meeting:1', 1000);
+  clock.advance(1001);
+  const second = await locks.acquire('meeting:1', 1000);
+  const written = {Url: 'https://meet/2', Fence: second.token};
+  assert.strictEqual(locks.fenced(written, first), false);
+  assert.strictEqual(locks.fenced(written, second), true);
+  assert.strictEqual(locks.fenced(undefined, first), true);
+  assert.strictEqual(locks.fenced({Url: 'https://meet/0'}, first), true);
+});
+
+exports['run releases the lock when run settles'] = withClock(async () => {
+  const busy = () => 'busy';
+  assert.strictEqual(await locks.run('job', 1000, 0, () => 'done', busy), 'done');
+  await assert.rejects(locks.run('job', 1000, 0, () => {
+    throw new Error('failed');
+  }, busy), /failed/);
+  assert.strictEqual(await locks.run('job', 1000, 0, () => locks.run('job', 1000, 0, () => 'inner', busy), busy), 'busy');
+});
@@ -0,0 +1,102 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+// Tests of the visit periods of period.js and the billing artifacts
+// billing.js creates from them, over the fake store with FHIR requests
+// stubbed.
+
+const datastore = require('../datastore.js');
+const fakeStore = require('../testing/store.js');
+const fhir = require('../fhir.js');
+const period = require('../period.js');
+
+const settings = require('../settings.json');
+
+const assert = require('assert');
+
+const context = {serverUrl: 'https://ehr.example.com/fhir', accessToken: 'token'};
+
+function at(minutes) {
+  return new Date(Date.UTC(2020, 4, 1, 9, minutes));
+}
+
+function meeting(encounterId, entity) {
+  return datastore.set(datastore.key(['Encounter', encounterId]), entity);
+}
+
+// Runs test with billing configured and the FHIR operations billing uses
+// recording what they are given.
+function withBilling(test) {
+  return async () => {
+    const saved = {billing: settings.billing, read: fhir.read, create: fhir.create};
+    const created = [];
+    settings.billing = {resource: 'ChargeItem', modifiers: ['95'], codes: [
+      {code: '99212', minMinutes: 10},
+      {code: '99213', minMinutes: 20},
+    ]};
+    fhir.read = (readContext, type, id) => Promise.resolve({resourceType: type, id: id, subject: {reference: 'Patient/1'}});
+    fhir.create = (createContext, resource) => {
+      created.push(resource);
+      return Promise.resolve({id: String(created.length)});
+    };
+    datastore.use(fakeStore.create());
+    try {
+      await test(created);
+    } finally {
+      settings.billing = saved.billing;
+      fhir.read = saved.read;
+      fhir.create = saved.create;
+    }
+  };
+}
+
+exports['a visit runs from when both joined until it was ended'] = async () => {
+  datastore.use(fakeStore.create());
+  await meeting('1', {ProviderJoined: at(0), PatientInMeeting: at(5), Ended: at(30)});
+  assert.deepStrictEqual(await period.record('1'), {start: at(5), end: at(30)});
+  assert.strictEqual((await datastore.get(datastore.key(['Encounter', '1']))).VisitSeconds, 25 * 60);
+};
+
+exports['a visit that was not ended runs until the last activity'] = async () => {
+  datastore.use(fakeStore.create());
+  await meeting('1', {ProviderJoined: at(0), PatientInMeeting: at(5), PatientLeft: at(20), Closed: at(360)});
+  assert.deepStrictEqual(await period.record('1'), {start: at(5), end: at(20)});
+};
+
+exports['a visit nobody joined has no period'] = async () => {
+  datastore.use(fakeStore.create());
+  await meeting('1', {ProviderJoined: at(0), Ended: at(30)});
+  assert.strictEqual(await period.record('1'), undefined);
+};
+
+exports['billing codes the visit by its length, once'] = withBilling(async (created) => {
+  await meeting('1', {ProviderJoined: at(0), PatientInMeeting: at(0), Ended: at(25)});
+  await period.record('1', context);
+  assert.strictEqual(created.length, 1);
+  assert.strictEqual(created[0].resourceType, 'ChargeItem');
+  assert.strictEqual(created[0].code.coding[0].code, '99213');
+  assert.deepStrictEqual(created[0].note, [{text: 'Modifiers: 95'}]);
+
+  await period.record('1', context);
+  assert.strictEqual(created.length, 1);
+});
+
+exports['visits too short for a code are not billed'] = withBilling(async (created) => {
+  await meeting('1', {ProviderJoined: at(0), PatientInMeeting: at(0), Ended: at(5)});
+  await period.record('1', context);
+  assert.strictEqual(created.length, 0);
+});
@@ -0,0 +1,112 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+// Tests of the retries and dead letters of queue.js, over the fake store.
+
+const datastore = require('../datastore.js');
+const fakeStore = require('../testing/store.js');
+const queue = require('../queue.js');
+
+const settings = require('../settings.json');
+
+const assert = require('assert');
+
+// Resolves once the tasks running in the background have settled.
+function settled() {
+  return new Promise(resolve => {
+    const poll = () => queue.pending() ? setTimeout(poll, 5) : resolve();
+    poll();
+  });
+}
+
+// Makes the stored tasks due now rather than after their backoff.
+function due() {
+  return datastore.list('Task').then(tasks => Promise.all(tasks.map(task => {
+    return datastore.modify(datastore.key(['Task', datastore.name(task)]), current => {
+      return Object.assign(current, {NextAttempt: new Date(Date.now() - 1)});
+    });
+  })));
+}
+
+function withQueue(queueSettings, test) {
+  return async () => {
+    const saved = settings.queue;
+    settings.queue = queueSettings;
+    datastore.use(fakeStore.create());
+    try {
+      await test();
+    } finally {
+      settings.queue = saved;
+    }
+  };
+}
+
+exports['a failed task is retried by the queue job'] = withQueue({enabled: true}, async () => {
+  var runs = 0;
+  queue.handle('test-flaky', payload => {
+    runs++;
+    assert.deepStrictEqual(payload, {n: 1});
+    return runs == 1 ? Promise.reject(new Error('unavailable')) : Promise.resolve();
+  });
+  await queue.enqueue('test-flaky', {n: 1});
+  await settled();
+  const [task] = await datastore.list('Task');
+  assert.strictEqual(task.Attempts, 1);
+  assert.strictEqual(task.LastError, 'Error: unavailable');
+  assert.ok(task.NextAttempt > new Date());
+
+  // Not due yet, so the job leaves it alone.
+  assert.deepStrictEqual(await queue.run(), {attempted: 0, succeeded: 0, purged: 0});
+  await due();
+  assert.deepStrictEqual(await queue.run(), {attempted: 1, succeeded: 1, purged: 0});
+  assert.strictEqual(runs, 2);
+  assert.deepStrictEqual(await datastore.list('Task'), []);
+});
+
+exports['a task failing every attempt is dead lettered and can be retried'] = withQueue({enabled: true, maxAttempts: 2}, async () => {
+  const dead = [];
+  var fail = true;
+  queue.handle('test-failing', () => fail ? Promise.reject(new Error('rejected')) : Promise.resolve(),
+    (payload, err) => dead.push([payload, String(err)]));
+  await queue.enqueue('test-failing', {n: 2});
+  await settled();
+  await due();
+  await queue.run();
+  assert.deepStrictEqual(dead, [[{n: 2}, 'Error: rejected']]);
+
+  const letters = await queue.deadLetters();
+  assert.strictEqual(letters.length, 1);
+  assert.strictEqual(letters[0].attempts, 2);
+  await due();
+  assert.strictEqual((await queue.run()).attempted, 0);
+
+  fail = false;
+  assert.strictEqual(await queue.retry(letters[0].id), true);
+  await settled();
+  assert.deepStrictEqual(await datastore.list('Task'), []);
+  assert.strictEqual(await queue.retry(letters[0].id), false);
+});
+
+exports['tasks run inline with the queue disabled'] = withQueue({enabled: false}, async () => {
+  var ran = false;
+  queue.handle('test-inline', () => {
+    ran = true;
+  });
+  await queue.enqueue('test-inline', {});
+  assert.strictEqual(ran, true);
+  assert.deepStrictEqual(await datastore.list('Task'), []);
+});
@@ -0,0 +1,80 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+// Tests of the token buckets of ratelimit.js, over the fake store and clock.
+
+const datastore = require('../datastore.js');
+const fakeClock = require('../testing/clock.js');
+const fakeStore = require('../testing/store.js');
+const ratelimit = require('../ratelimit.js');
+
+const settings = require('../settings.json');
+
+const assert = require('assert');
+
+function request(ip, session) {
+  return {ip: ip, session: session || {}, get: () => undefined};
+}
+
+function withLimits(limits, test) {
+  return async () => {
+    const saved = settings.rateLimit;
+    settings.rateLimit = Object.assign({enabled: true}, limits);
+    const clock = fakeClock.create(new Date('2020-05-01T09:00:00Z'));
+    clock.install();
+    datastore.use(fakeStore.create());
+    try {
+      await test(clock);
+    } finally {
+      clock.uninstall();
+      settings.rateLimit = saved;
+    }
+  };
+}
+
+exports['a client may make a burst of requests, then waits for a token'] = withLimits({requestsPerMinute: 60, burst: 2}, async clock => {
+  const client = request('192.0.2.1');
+  assert.strictEqual(await ratelimit.check(client), 0);
+  assert.strictEqual(await ratelimit.check(client), 0);
+  assert.strictEqual(await ratelimit.check(client), 1000);
+  clock.advance(400);
+  assert.strictEqual(await ratelimit.check(client), 600);
+  clock.advance(600);
+  assert.strictEqual(await ratelimit.check(client), 0);
+  assert.strictEqual(await ratelimit.check(client), 1000);
+});
+
+exports['clients have buckets of their own'] = withLimits({requestsPerMinute: 60, burst: 1}, async () => {
+  assert.strictEqual(await ratelimit.check(request('192.0.2.1')), 0);
+  assert.strictEqual(await ratelimit.check(request('192.0.2.2')), 0);
+  // A signed in provider is counted by session rather than address.
+  assert.strictEqual(await ratelimit.check(request('192.0.2.1', {id: 'session'})), 0);
+  assert.strictEqual(await ratelimit.check(request('192.0.2.1')), 1000);
+});
+
+exports['a tenant shares a bucket across its clients'] = withLimits({requestsPerMinute: 60, burst: 10, tenantRequestsPerMinute: 60, tenantBurst: 2}, async () => {
+  assert.strictEqual(await ratelimit.check(request('192.0.2.1')), 0);
+  assert.strictEqual(await ratelimit.check(request('192.0.2.2')), 0);
+  assert.strictEqual(await ratelimit.check(request('192.0.2.3')), 1000);
+});
+
+exports['buckets that have refilled are purged'] = withLimits({requestsPerMinute: 60, burst: 2}, async clock => {
+  await ratelimit.check(request('192.0.2.1'));
+  assert.strictEqual(await ratelimit.purge(new Date(clock.now())), 0);
+  clock.advance(1001);
+  assert.strictEqual(await ratelimit.purge(new Date(clock.now())), 1);
+});
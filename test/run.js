@@ -0,0 +1,65 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+// Runs the tests in this directory.  Each *.test.js module exports its tests
+// by name, as functions that may return a promise, and they run one at a
+// time in file order.  `npm test` runs them all and `npm test -- queue` only
+// those of the files whose names contain "queue".  The modules under test
+// read settings.json as the application does; here they are given the
+// checked-in test/settings.json instead, so the tests run from a clean
+// checkout and don't depend on a developer's own settings.
+
+const Module = require('module');
+const fs = require('fs');
+const path = require('path');
+
+const settingsFile = path.join(__dirname, '..', 'settings.json');
+const testSettingsFile = path.join(__dirname, 'settings.json');
+
+const resolveFilename = Module._resolveFilename;
+Module._resolveFilename = function(request, parent) {
+  if (parent && parent.filename && request.startsWith('.') &&
+      path.resolve(path.dirname(parent.filename), request) == settingsFile) {
+    return testSettingsFile;
+  }
+  return resolveFilename.apply(this, arguments);
+};
+
+const filter = process.argv[2] || '';
+const files = fs.readdirSync(__dirname).filter(file => file.endsWith('.test.js') && file.indexOf(filter) != -1).sort();
+
+var failures = 0;
+var count = 0;
+
+function runFile(file) {
+  const tests = require(path.join(__dirname, file));
+  return Object.keys(tests).reduce((previous, name) => previous.then(() => {
+    count++;
+    return Promise.resolve().then(() => tests[name]()).then(() => {
+      console.log('ok      ' + file + ': ' + name);
+    }, err => {
+      failures++;
+      console.log('FAILED  ' + file + ': ' + name);
+      console.log(err && err.stack ? err.stack : err);
+    });
+  }), Promise.resolve());
+}
+
+files.reduce((previous, file) => previous.then(() => runFile(file)), Promise.resolve()).then(() => {
+  console.log(count + ' tests, ' + failures + ' failed');
+  process.exit(failures ? 1 : 0);
+});
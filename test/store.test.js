@@ -0,0 +1,130 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+// Tests of the store backends datastore.js opens, and of the fault injection
+// of testing/store.js.
+
+const datastore = require('../datastore.js');
+const fakeStore = require('../testing/store.js');
+
+const assert = require('assert');
+
+function key(name) {
+  return datastore.key(['Encounter', name]);
+}
+
+// Names enough records that every shard gets some.
+function names(count) {
+  return Array.from({length: count}, (_, i) => 'encounter-' + i);
+}
+
+exports['memory store refuses to set a record twice'] = async () => {
+  const store = datastore.open({memory: true});
+  await store.set(key('1'), {Url: 'a'});
+  await assert.rejects(store.set(key('1'), {Url: 'b'}));
+  await store.upsert(key('1'), {Url: 'c'});
+  assert.strictEqual((await store.get(key('1'))).Url, 'c');
+};
+
+exports['memory store modify writes only what the callback returns'] = async () => {
+  const store = datastore.open({memory: true});
+  assert.strictEqual(await store.modify(key('1'), () => undefined), undefined);
+  assert.strictEqual(await store.get(key('1')), undefined);
+  await store.modify(key('1'), current => ({Count: (current ? current.Count : 0) + 1}));
+  await store.modify(key('1'), current => ({Count: (current ? current.Count : 0) + 1}));
+  assert.strictEqual((await store.get(key('1'))).Count, 2);
+};
+
+exports['memory store modifies several records together or not at all'] = async () => {
+  const store = datastore.open({memory: true});
+  await store.modifyMany([key('1'), key('2')], () => [{Url: 'a'}, undefined]);
+  assert.strictEqual((await store.get(key('1'))).Url, 'a');
+  assert.strictEqual(await store.get(key('2')), undefined);
+  await assert.rejects(store.modifyMany([key('1'), key('2')], () => [{Url: 'b'}, {Url: 'x'.repeat(1501)}]));
+  assert.strictEqual((await store.get(key('1'))).Url, 'a');
+};
+
+exports['sharded store keeps a group of kinds on one shard'] = async () => {
+  const store = datastore.open({shards: [{name: 'a', memory: true}, {name: 'b', memory: true}]});
+  const keys = names(20).map(name => datastore.key(['Audit', name])).concat([datastore.key(['AuditHead', 'head'])]);
+  await store.modifyMany(keys, () => keys.map(() => ({Sequence: 1})));
+  await assert.rejects(store.modifyMany(names(20).map(key), () => []), /different shards/);
+};
+
+exports['memory store lists records of a kind matching the filters'] = async () => {
+  const store = datastore.open({memory: true});
+  await store.set(key('1'), {Owner: 'a', Created: new Date(1000)});
+  await store.set(key('2'), {Owner: 'b', Created: new Date(2000)});
+  await store.set(datastore.key(['Consent', '1']), {Owner: 'a'});
+  const owned = await store.list('Encounter', [['Owner', '=', 'a']]);
+  assert.deepStrictEqual(owned.map(datastore.name), ['1']);
+  const later = await store.list('Encounter', [['Created', '>', new Date(1500)]]);
+  assert.deepStrictEqual(later.map(datastore.name), ['2']);
+};
+
+exports['memory store refuses indexed strings Cloud Datastore would'] = async () => {
+  const store = datastore.open({memory: true});
+  await assert.rejects(store.set(key('1'), {Url: 'x'.repeat(1501)}), /longer than 1500 bytes/);
+  await assert.rejects(store.modify(key('1'), () => ({Url: 'x'.repeat(1501)})), /longer than 1500 bytes/);
+  assert.strictEqual(await store.get(key('1')), undefined);
+};
+
+exports['unindexed properties take values over 1500 bytes'] = async () => {
+  const store = datastore.open({memory: true});
+  const long = 'x'.repeat(4000);
+  await store.upsert(datastore.key(['FhirCache', '1']), {Resource: long, ResourceType: 'Patient'});
+  await store.set(datastore.key(['Idempotency', '1']), {Body: long, Session: long});
+  await store.modify(datastore.key(['Task', '1']), () => ({Payload: long, Type: 'audit'}));
+  await store.upsertMany([{key: datastore.key(['Credential', '1']), entity: {Ciphertext: long}}]);
+  assert.strictEqual((await store.get(datastore.key(['FhirCache', '1']))).Resource, long);
+  assert.strictEqual((await store.get(datastore.key(['Idempotency', '1']))).Session, long);
+  assert.strictEqual((await store.get(datastore.key(['Task', '1']))).Payload, long);
+  assert.strictEqual((await store.get(datastore.key(['Credential', '1']))).Ciphertext, long);
+  await assert.rejects(store.upsert(datastore.key(['FhirCache', '1']), {Resource: long, ResourceType: long}));
+};
+
+exports['sharded store finds every record it stores'] = async () => {
+  const store = datastore.open({shards: [{name: 'a', memory: true}, {name: 'b', memory: true}]});
+  await Promise.all(names(20).map(name => store.set(key(name), {Url: name})));
+  assert.strictEqual((await store.list('Encounter')).length, 20);
+  const found = await store.getMany(names(20).map(key));
+  assert.deepStrictEqual(found.map(entity => entity.Url), names(20));
+};
+
+exports['replicated store writes to the replica while the primary is down'] = async () => {
+  const primary = fakeStore.create();
+  const replica = fakeStore.create();
+  const store = datastore.replicated(primary, replica, {});
+  primary.fail('*', Object.assign(new Error('Unavailable'), {code: 14}), 2);
+  await store.upsert(key('1'), {Url: 'a'});
+  assert.strictEqual((await store.get(key('1'))).Url, 'a');
+  assert.strictEqual((await replica.get(key('1'))).Url, 'a');
+};
+
+exports['fake store fails and delays operations as told'] = async () => {
+  const store = fakeStore.create();
+  datastore.use(store);
+  store.fail('get', Object.assign(new Error('Unavailable'), {code: 14}), 1);
+  await assert.rejects(datastore.get(key('1')), err => err.code == 14);
+  assert.strictEqual(await datastore.get(key('1')), undefined);
+
+  store.delay('set', 50);
+  const start = Date.now();
+  await datastore.set(key('1'), {Url: 'a'});
+  assert.ok(Date.now() - start >= 45);
+  store.reset();
+};
@@ -0,0 +1,64 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+// Tests of the session records user.js keeps for signed in providers.
+
+const credentials = require('../credentials.js');
+const datastore = require('../datastore.js');
+const fakeStore = require('../testing/store.js');
+const user = require('../user.js');
+
+const assert = require('assert');
+
+function response() {
+  return {send: function(body) {
+    this.body = body;
+    this.sent();
+  }};
+}
+
+function logout(request) {
+  const sent = response();
+  return new Promise(resolve => {
+    sent.sent = resolve;
+    user.logout(request, sent);
+  }).then(() => sent);
+}
+
+exports['logout deletes the session record and its credentials'] = async () => {
+  datastore.use(fakeStore.create());
+  const credential = await credentials.store('refresh token');
+  const ehrCredential = await credentials.store('EHR access token');
+  await datastore.set(datastore.key(['User', 'session-1']), {
+    Credential: credential, EhrCredential: ehrCredential, Created: new Date(),
+  });
+
+  const request = {session: {id: 'session-1'}, ip: ''};
+  const sent = await logout(request);
+  assert.strictEqual(sent.body, 'You have been logged out');
+  assert.strictEqual(request.session.id, null);
+  assert.strictEqual(await datastore.get(datastore.key(['User', 'session-1'])), undefined);
+  assert.strictEqual(await credentials.load(credential, 'system'), undefined);
+  assert.strictEqual(await credentials.load(ehrCredential, 'system'), undefined);
+};
+
+exports['logout without a session still signs out'] = async () => {
+  datastore.use(fakeStore.create());
+  const request = {session: {}, ip: ''};
+  const sent = await logout(request);
+  assert.strictEqual(sent.body, 'You have been logged out');
+};
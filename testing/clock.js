@@ -0,0 +1,51 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A clock that only moves when told to.  Install it before exercising expiry:
+//
+//   const clock = fakeClock.create(new Date('2020-05-01T09:00:00Z'));
+//   clock.install();
+//   clock.advance(31 * 60 * 1000);  // the patient session has now expired
+
+const realClock = require('../clock.js');
+
+exports.create = function(start) {
+  var time = start === undefined ? Date.now() : new Date(start).getTime();
+  const fake = {};
+
+  fake.now = function() {
+    return time;
+  };
+
+  // Moves the clock forward by milliseconds.
+  fake.advance = function(milliseconds) {
+    time += milliseconds;
+  };
+
+  fake.set = function(date) {
+    time = new Date(date).getTime();
+  };
+
+  fake.install = function() {
+    realClock.use(fake.now);
+  };
+
+  fake.uninstall = function() {
+    realClock.use();
+  };
+
+  return fake;
+};
@@ -0,0 +1,172 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A minimal in-memory FHIR R4 server advertising SMART authorization.
+//
+// It supports read, create, update (PUT), JSON Patch and searches.  Searches
+// match resources whose JSON contains every non-underscore parameter value,
+// which is enough for references such as practitioner=Practitioner/1.
+// Requests must carry a token issued by the fake authorization server.
+
+const express = require('express');
+
+function applyPatch(resource, operations) {
+  operations.forEach(operation => {
+    const path = operation.path.split('/').slice(1);
+    var target = resource;
+    for (var i = 0; i < path.length - 1; i++) {
+      target = target[path[i]];
+    }
+    const field = path[path.length - 1];
+    if (operation.op == 'remove') {
+      delete target[field];
+    } else {
+      target[field] = operation.value;
+    }
+  });
+  return resource;
+}
+
+function bundle(resources) {
+  return {
+    resourceType: 'Bundle',
+    type: 'searchset',
+    total: resources.length,
+    entry: resources.map(resource => ({resource: resource})),
+  };
+}
+
+// Returns an express router to mount at base, the absolute URL it will be
+// reachable at.  oauth is the fake authorization server, mounted at base +
+// '/auth', and resources are loaded into the server.
+exports.create = function(base, oauth, resources) {
+  const router = express.Router();
+  const store = {};
+
+  router.use((request, response, next) => {
+    response.set('Access-Control-Allow-Origin', '*');
+    response.set('Access-Control-Allow-Headers', 'Authorization, Content-Type, If-Match');
+    response.set('Access-Control-Allow-Methods', 'GET, POST, PUT, PATCH');
+    next();
+  });
+
+  // Stores a resource, assigning an id and version.
+  router.save = function(resource) {
+    store[resource.resourceType] = store[resource.resourceType] || {};
+    resource.id = resource.id || String(Object.keys(store[resource.resourceType]).length + 1);
+    const previous = store[resource.resourceType][resource.id];
+    const version = previous ? parseInt(previous.meta.versionId, 10) + 1 : 1;
+    resource.meta = {versionId: String(version), lastUpdated: new Date().toISOString()};
+    store[resource.resourceType][resource.id] = resource;
+    return resource;
+  };
+
+  (resources || []).forEach(resource => router.save(resource));
+
+  router.get('/.well-known/smart-configuration', (request, response) => {
+    response.send({
+      authorization_endpoint: base + '/auth/authorize',
+      token_endpoint: base + '/auth/token',
+      capabilities: ['launch-ehr', 'client-public', 'context-ehr-patient', 'context-ehr-encounter', 'sso-openid-connect'],
+    });
+  });
+
+  router.get('/metadata', (request, response) => {
+    response.send({
+      resourceType: 'CapabilityStatement',
+      status: 'active',
+      fhirVersion: '4.0.1',
+      format: ['json'],
+      rest: [{
+        mode: 'server',
+        security: {
+          extension: [{
+            url: 'http://fhir-registry.smarthealthit.org/StructureDefinition/oauth-uris',
+            extension: [
+              {url: 'authorize', valueUri: base + '/auth/authorize'},
+              {url: 'token', valueUri: base + '/auth/token'},
+            ],
+          }],
+        },
+      }],
+    });
+  });
+
+  router.use('/auth', oauth);
+
+  const authorized = (request, response, next) => {
+    const authorization = request.get('Authorization') || '';
+    if (!oauth.tokenContext(authorization.replace(/^Bearer /, ''))) {
+      response.status(401).send({resourceType: 'OperationOutcome', issue: [{severity: 'error', code: 'login'}]});
+      return;
+    }
+    next();
+  };
+
+  const body = express.json({type: ['application/json', 'application/fhir+json', 'application/json-patch+json']});
+
+  router.get('/:type/:id', authorized, (request, response) => {
+    const resource = (store[request.params.type] || {})[request.params.id];
+    if (!resource) {
+      response.status(404).send({resourceType: 'OperationOutcome', issue: [{severity: 'error', code: 'not-found'}]});
+      return;
+    }
+    response.set('ETag', 'W/"' + resource.meta.versionId + '"');
+    response.send(resource);
+  });
+
+  router.get('/:type', authorized, (request, response) => {
+    const values = Object.keys(request.query).filter(name => !name.startsWith('_')).map(name => request.query[name]);
+    const matches = Object.values(store[request.params.type] || {}).filter(resource => {
+      const json = JSON.stringify(resource);
+      return values.every(value => json.indexOf(String(value)) != -1);
+    });
+    response.send(bundle(matches));
+  });
+
+  router.post('/:type', authorized, body, (request, response) => {
+    const resource = Object.assign({}, request.body, {resourceType: request.params.type});
+    delete resource.id;
+    response.status(201).send(router.save(resource));
+  });
+
+  router.put('/:type/:id', authorized, body, (request, response) => {
+    const existing = (store[request.params.type] || {})[request.params.id];
+    const match = request.get('If-Match');
+    if (existing && match && match != 'W/"' + existing.meta.versionId + '"') {
+      response.status(412).send({resourceType: 'OperationOutcome', issue: [{severity: 'error', code: 'conflict'}]});
+      return;
+    }
+    const resource = Object.assign({}, request.body, {resourceType: request.params.type, id: request.params.id});
+    response.send(router.save(resource));
+  });
+
+  router.patch('/:type/:id', authorized, body, (request, response) => {
+    const resource = (store[request.params.type] || {})[request.params.id];
+    if (!resource) {
+      response.status(404).send({resourceType: 'OperationOutcome', issue: [{severity: 'error', code: 'not-found'}]});
+      return;
+    }
+    const match = request.get('If-Match');
+    if (match && match != 'W/"' + resource.meta.versionId + '"') {
+      response.status(412).send({resourceType: 'OperationOutcome', issue: [{severity: 'error', code: 'conflict'}]});
+      return;
+    }
+    response.send(router.save(applyPatch(JSON.parse(JSON.stringify(resource)), request.body)));
+  });
+
+  return router;
+};
@@ -0,0 +1,220 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A fake Google sign-in and Meet for end-to-end tests without network access.
+// Enable it with mockGoogle.enabled, or create and install it directly:
+//
+//   const google = fakeGoogle.install(app, 'http://localhost:8080');
+//   google.signIn('dr.doctor@example.com');  // the account the next sign-in picks
+//   google.setBusy([{start: '2020-05-01T09:00:00Z', end: '2020-05-01T10:00:00Z'}]);
+//   google.events();                          // the meetings created so far
+//
+// Sign-in sends the provider to /mock/google/authorize, which redirects
+// straight back to oauth2.redirectUri with a code the fake OAuth client
+// exchanges for tokens.  Meetings are events kept in memory whose links are
+// pages under /mock/google/meet.
+
+const calendar = require('../calendar.js');
+const user = require('../user.js');
+
+const settings = require('../settings.json');
+
+const crypto = require('crypto');
+const express = require('express');
+
+function random() {
+  return crypto.randomBytes(16).toString('hex');
+}
+
+function overlaps(interval, start, end) {
+  return new Date(interval.start) < end && new Date(interval.end) > start;
+}
+
+// Returns an express router to mount at base, the absolute URL it will be
+// reachable at.
+exports.create = function(base) {
+  const router = express.Router();
+  const redirectUri = (settings.oauth2 && settings.oauth2.redirectUri) || new URL(base).origin + '/authenticate';
+  const codes = {};
+  const events = {};
+  const records = {};
+  var account = (settings.mockGoogle && settings.mockGoogle.account) || 'provider@example.com';
+  var busy = [];
+
+  // Sets the account the next sign-in completes as.
+  router.signIn = function(email) {
+    account = email;
+  };
+
+  // Sets the busy intervals, each { start, end }, of every calendar.
+  router.setBusy = function(intervals) {
+    busy = intervals.slice();
+  };
+
+  // Sets the conference records, each { startTime, endTime }, of a meeting.
+  router.setConferenceRecords = function(meetingUrl, conferences) {
+    records[calendar.meetingCode(meetingUrl)] = conferences.slice();
+  };
+
+  // Returns the meetings' events, each { eventId, calendarId, encounterId,
+  // account, meetingUrl, start, end, attendees, cohosts }.
+  router.events = function() {
+    return Object.keys(events).map(id => events[id]);
+  };
+
+  function client() {
+    var credentials = {};
+    return {
+      generateAuthUrl: options => base + '/authorize?' + new URLSearchParams({
+        state: options.state,
+        scope: [].concat(options.scope).join(' '),
+        redirect_uri: redirectUri,
+      }),
+      getToken: code => {
+        const email = codes[code];
+        delete codes[code];
+        if (!email) {
+          return Promise.reject(new Error('invalid_grant'));
+        }
+        // An unsigned id_token, as user.js doesn't check the signature.
+        const claims = {
+          iss: 'https://accounts.google.com',
+          aud: settings.oauth2 && settings.oauth2.clientId,
+          sub: crypto.createHash('sha256').update(email).digest('hex').substring(0, 21),
+          email: email,
+        };
+        return Promise.resolve({tokens: {
+          access_token: random(),
+          refresh_token: 'mock-' + Buffer.from(email).toString('hex'),
+          id_token: 'e30.' + Buffer.from(JSON.stringify(claims)).toString('base64url') + '.',
+          expiry_date: Date.now() + 3600 * 1000,
+        }});
+      },
+      setCredentials: value => {
+        credentials = value;
+      },
+      get credentials() {
+        return credentials;
+      },
+      on: () => {},
+    };
+  }
+
+  function accountOf(client) {
+    const token = client && client.credentials && client.credentials.refresh_token;
+    return token && token.startsWith('mock-') ? Buffer.from(token.substring(5), 'hex').toString() : account;
+  }
+
+  function find(calendarId, eventId, callback) {
+    const event = events[eventId];
+    if (!event || event.calendarId != calendarId) {
+      callback(Object.assign(new Error('Not Found'), {code: 404}));
+      return undefined;
+    }
+    return event;
+  }
+
+  // Replaces the Google OAuth client and the Calendar and Meet calls with
+  // the fakes.
+  router.install = function() {
+    user.newClient = client;
+    calendar.createEvent = (client, encounterId, callback) => {
+      const id = random().substring(0, 10);
+      const start = new Date();
+      events[id] = {
+        eventId: id,
+        calendarId: 'primary',
+        encounterId: encounterId,
+        account: accountOf(client),
+        meetingUrl: base + '/meet/' + id,
+        start: start.toISOString(),
+        end: new Date(start.getTime() + calendar.eventDuration).toISOString(),
+        attendees: [],
+        cohosts: [],
+      };
+      callback(null, events[id].meetingUrl, {calendarId: 'primary', eventId: id});
+    };
+    calendar.deleteEvent = (client, calendarId, eventId, callback) => {
+      if (find(calendarId, eventId, callback)) {
+        delete events[eventId];
+        callback(null);
+      }
+    };
+    calendar.updateEvent = (client, calendarId, eventId, start, end, callback) => {
+      const event = find(calendarId, eventId, callback);
+      if (event) {
+        event.start = start.toISOString();
+        event.end = end.toISOString();
+        callback(null);
+      }
+    };
+    calendar.addAttendee = (client, calendarId, eventId, email, callback) => {
+      const event = find(calendarId, eventId, callback);
+      if (event) {
+        event.attendees = event.attendees.filter(attendee => attendee != email).concat([email]);
+        callback(null);
+      }
+    };
+    calendar.addCohost = (client, meetingUrl, email, callback) => {
+      const event = events[calendar.meetingCode(meetingUrl)];
+      if (event) {
+        event.cohosts = event.cohosts.filter(cohost => cohost != email).concat([email]);
+      }
+      callback(null);
+    };
+    calendar.freeBusy = (client, start, end, callback) => {
+      callback(null, busy.filter(interval => overlaps(interval, start, end))
+        .sort((a, b) => a.start.localeCompare(b.start)));
+    };
+    calendar.conferenceRecords = (client, meetingUrl, callback) => {
+      callback(null, records[calendar.meetingCode(meetingUrl)] || []);
+    };
+    return router;
+  };
+
+  router.get('/authorize', (request, response) => {
+    const redirect = new URL(request.query.redirect_uri);
+    const code = random();
+    codes[code] = account;
+    redirect.searchParams.set('code', code);
+    redirect.searchParams.set('state', request.query.state);
+    response.redirect(redirect.toString());
+  });
+
+  router.get('/meet/:id', (request, response) => {
+    const id = request.params.id.replace(/[^0-9a-f]/g, '');
+    if (!events[id]) {
+      response.status(404).send('No such meeting');
+      return;
+    }
+    response.send('<html><body><h1>Meeting ' + id + '</h1>' +
+      '<p>In production this would be a Google Meet conference.</p></body></html>');
+  });
+
+  return router;
+};
+
+// The fake installed by install, if any.
+exports.installed = null;
+
+// Creates the fake, mounts it at /mock/google of app, served at origin, and
+// installs it.
+exports.install = function(app, origin) {
+  const google = exports.create(origin + '/mock/google');
+  app.use('/mock/google', google);
+  exports.installed = google.install();
+  return google;
+};
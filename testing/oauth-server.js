@@ -0,0 +1,112 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A fake SMART authorization server that approves every request.
+//
+// Launches are registered with registerLaunch, which returns the launch
+// parameter to pass to launch.html.  The token response carries the
+// launch's patient and encounter and an unsigned id_token with its fhirUser,
+// or the user as fallback_user when the launch sets idToken to false, like
+// older EHRs.
+
+const crypto = require('crypto');
+const express = require('express');
+
+function base64url(value) {
+  return Buffer.from(JSON.stringify(value)).toString('base64')
+    .replace(/=+$/, '').replace(/\+/g, '-').replace(/\//g, '_');
+}
+
+function random() {
+  return crypto.randomBytes(16).toString('hex');
+}
+
+// Returns an express router to mount at issuer, the absolute URL it will be
+// reachable at, for the FHIR server at fhirBase.
+exports.create = function(issuer, fhirBase) {
+  const router = express.Router();
+  const launches = {};
+  const codes = {};
+  const tokens = {};
+
+  router.use((request, response, next) => {
+    response.set('Access-Control-Allow-Origin', '*');
+    response.set('Access-Control-Allow-Headers', 'Authorization, Content-Type');
+    next();
+  });
+
+  // context is { patient, encounter, fhirUser, idToken }.
+  router.registerLaunch = function(context) {
+    const launch = random();
+    launches[launch] = context;
+    return launch;
+  };
+
+  // Returns the launch context an access token was issued for.
+  router.tokenContext = function(token) {
+    return tokens[token];
+  };
+
+  router.get('/authorize', (request, response) => {
+    const context = launches[request.query.launch];
+    const redirect = new URL(request.query.redirect_uri);
+    if (!context) {
+      redirect.searchParams.set('error', 'invalid_request');
+    } else {
+      const code = random();
+      codes[code] = Object.assign({scope: request.query.scope, clientId: request.query.client_id}, context);
+      redirect.searchParams.set('code', code);
+    }
+    redirect.searchParams.set('state', request.query.state);
+    response.redirect(redirect.toString());
+  });
+
+  router.post('/token', express.urlencoded({extended: false}), (request, response) => {
+    const context = codes[request.body.code];
+    delete codes[request.body.code];
+    if (request.body.grant_type != 'authorization_code' || !context) {
+      response.status(400).send({error: 'invalid_grant'});
+      return;
+    }
+
+    const token = random();
+    tokens[token] = context;
+    const body = {
+      access_token: token,
+      token_type: 'Bearer',
+      expires_in: 3600,
+      scope: context.scope,
+      patient: context.patient,
+      encounter: context.encounter,
+    };
+    if (context.idToken === false) {
+      body.fallback_user = context.fhirUser;
+    } else {
+      const now = Math.floor(Date.now() / 1000);
+      body.id_token = base64url({alg: 'none', typ: 'JWT'}) + '.' + base64url({
+        iss: issuer,
+        sub: context.fhirUser,
+        aud: context.clientId,
+        fhirUser: fhirBase + '/' + context.fhirUser,
+        iat: now,
+        exp: now + 3600,
+      }) + '.';
+    }
+    response.send(body);
+  });
+
+  return router;
+};
@@ -0,0 +1,77 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// An in-memory store with fault injection.  Install it with
+// datastore.use(store) before exercising the application:
+//
+//   const store = fakeStore.create();
+//   datastore.use(store);
+//   store.fail('get', {code: 14}, 1);  // the next get fails as unavailable
+//   store.delay('*', 200);             // every operation takes 200ms longer
+
+const datastore = require('../datastore.js');
+
+const operations = ['get', 'set', 'update', 'upsert', 'delete', 'modify', 'modifyMany', 'list'];
+
+exports.create = function() {
+  const store = datastore.open({memory: true});
+  var faults = [];
+  var delays = {};
+  const fake = {};
+
+  function takeFault(operation) {
+    const index = faults.findIndex(fault => fault.operation == operation || fault.operation == '*');
+    if (index == -1) {
+      return undefined;
+    }
+    const fault = faults[index];
+    if (--fault.times <= 0) {
+      faults.splice(index, 1);
+    }
+    return fault.error;
+  }
+
+  operations.forEach(operation => {
+    fake[operation] = function() {
+      const args = arguments;
+      const latency = (delays[operation] || 0) + (delays['*'] || 0);
+      return new Promise(resolve => setTimeout(resolve, latency)).then(() => {
+        const err = takeFault(operation);
+        if (err) {
+          throw err;
+        }
+        return store[operation].apply(store, args);
+      });
+    };
+  });
+
+  // Makes the next times calls of an operation ('*' for any) fail with err.
+  fake.fail = function(operation, err, times) {
+    faults.push({operation: operation, error: err || new Error('Injected failure'), times: times || 1});
+  };
+
+  // Adds latency in milliseconds to an operation ('*' for every operation).
+  fake.delay = function(operation, latency) {
+    delays[operation] = latency;
+  };
+
+  fake.reset = function() {
+    faults = [];
+    delays = {};
+  };
+
+  return fake;
+};
@@ -0,0 +1,156 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// OAuth 2.0 token exchange (RFC 8693) for EHRs whose SMART configuration
+// lists the token exchange grant.  With settings.tokenExchange.enabled, the
+// provider's EHR token is exchanged for a narrowly scoped one before it is
+// handed to a downstream service, such as a notification channel or the visit
+// record write-back, so those services never hold the provider's full token.
+// settings.tokenExchange.services maps each service to the audience and
+// scope to request for it.  Servers without the grant are given the original
+// token, unless settings.tokenExchange.required is set.
+
+const deadline = require('./deadline.js');
+const errors = require('./errors.js');
+const registration = require('./registration.js');
+const transport = require('./transport.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const gaxios = require('gaxios');
+
+const GRANT_TYPE = 'urn:ietf:params:oauth:grant-type:token-exchange';
+const ACCESS_TOKEN = 'urn:ietf:params:oauth:token-type:access_token';
+
+function options() {
+  return settings.tokenExchange || {};
+}
+
+// Token endpoints by FHIR server, null for servers without the grant.
+const endpoints = new Map();
+
+function endpoint(serverUrl) {
+  if (endpoints.has(serverUrl)) {
+    return Promise.resolve(endpoints.get(serverUrl));
+  }
+  return deadline.limit('oauth', timeout => gaxios.request({
+    url: serverUrl + '/.well-known/smart-configuration',
+    headers: {'Accept': 'application/json'},
+    timeout: timeout,
+    agent: transport.agent(serverUrl),
+  })).then(result => {
+    const grants = result.data.grant_types_supported || [];
+    return grants.indexOf(GRANT_TYPE) != -1 && result.data.token_endpoint || null;
+  }, err => {
+    // A server that timed out is asked again next time.
+    if (err instanceof errors.Timeout) {
+      throw err;
+    }
+    return null;
+  }).then(url => {
+    endpoints.set(serverUrl, url);
+    return url;
+  });
+}
+
+// Exchanged tokens by service and subject token hash, until shortly before
+// they expire.
+const issued = new Map();
+
+function cacheKey(service, context) {
+  return service + ' ' + crypto.createHash('sha256').update(context.accessToken).digest('hex');
+}
+
+function prune() {
+  const now = Date.now();
+  issued.forEach((delegated, key) => {
+    if (delegated.expires < now) {
+      issued.delete(key);
+    }
+  });
+}
+
+function exchange(tokenEndpoint, context, service) {
+  const config = options().services[service];
+  const params = {
+    grant_type: GRANT_TYPE,
+    subject_token: context.accessToken,
+    subject_token_type: ACCESS_TOKEN,
+    requested_token_type: ACCESS_TOKEN,
+  };
+  if (config.audience) {
+    params.audience = config.audience;
+  }
+  if (config.scope) {
+    params.scope = config.scope;
+  }
+  return registration.clientId(context.serverUrl).then(clientId => {
+    params.client_id = clientId;
+    return deadline.limit('oauth', timeout => gaxios.request({
+      url: tokenEndpoint,
+      method: 'POST',
+      headers: {'Content-Type': 'application/x-www-form-urlencoded', 'Accept': 'application/json'},
+      data: Object.keys(params).map(name => name + '=' + encodeURIComponent(params[name])).join('&'),
+      timeout: timeout,
+      agent: transport.agent(context.serverUrl),
+    }));
+  }).then(result => {
+    if (!result.data.access_token) {
+      throw new errors.DelegationFailed('The token endpoint returned no access token');
+    }
+    return {
+      serverUrl: context.serverUrl,
+      accessToken: result.data.access_token,
+      scope: result.data.scope || config.scope,
+      expires: Date.now() + (result.data.expires_in || 300) * 1000,
+    };
+  });
+}
+
+// Resolves to the FHIR context to give a downstream service, with a token
+// exchanged for the service's audience and scope where the EHR supports it.
+exports.forService = function(context, service) {
+  if (!context || !options().enabled || !(options().services || {})[service]) {
+    return Promise.resolve(context);
+  }
+
+  const key = cacheKey(service, context);
+  const cached = issued.get(key);
+  if (cached && cached.expires - 30 * 1000 > Date.now()) {
+    return Promise.resolve(cached);
+  }
+
+  return endpoint(context.serverUrl).then(tokenEndpoint => {
+    if (!tokenEndpoint) {
+      if (options().required) {
+        throw new errors.DelegationFailed(context.serverUrl + ' does not support token exchange');
+      }
+      return context;
+    }
+    return exchange(tokenEndpoint, context, service).then(delegated => {
+      prune();
+      issued.set(key, delegated);
+      return delegated;
+    }, err => {
+      if (err instanceof errors.ProblemError) {
+        throw err;
+      }
+      throw new errors.DelegationFailed(context.serverUrl + ' refused the token exchange: ' + err);
+    });
+  });
+};
+
@@ -0,0 +1,164 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Outbound connections on hospital networks.
+//
+// FHIR servers behind a private PKI are configured in settings.fhirTls, which
+// maps FHIR server URL prefixes to the CA bundle to trust and the client
+// certificate and key to present for mutual TLS:
+//
+//   "fhirTls": {
+//     "https://fhir.hospital.internal/": {
+//       "ca": "certs/hospital-ca.pem",
+//       "cert": "certs/client.pem",
+//       "key": "certs/client-key.pem"
+//     }
+//   }
+//
+// Each value is a PEM file path, relative to the application directory, or
+// the PEM itself.  Requests to the FHIR server and to the authorization server
+// it advertises use the agent of the longest matching prefix.
+//
+// settings.proxy.fhir and settings.proxy.google are the HTTP proxies for EHR
+// traffic and for the Calendar and Meet APIs, since hospital egress often
+// separates internal and internet traffic.  Either falls back to the
+// HTTPS_PROXY variable, and hosts in settings.proxy.noProxy or NO_PROXY are
+// connected to directly.
+
+const settings = require('./settings.json');
+
+const fs = require('fs');
+const http = require('http');
+const https = require('https');
+const path = require('path');
+const tls = require('tls');
+
+function pem(value) {
+  if (!value || value.startsWith('-----BEGIN')) {
+    return value;
+  }
+  return fs.readFileSync(path.resolve(__dirname, value));
+}
+
+function proxyOptions() {
+  return settings.proxy || {};
+}
+
+function environment(name) {
+  return process.env[name] || process.env[name.toLowerCase()];
+}
+
+// Whether a host is excluded from proxying, matching entries as NO_PROXY
+// does: '*', the host itself or, for entries starting with a dot or not, its
+// subdomains.
+function direct(host) {
+  const entries = (proxyOptions().noProxy || []).concat((environment('NO_PROXY') || '').split(','))
+    .map(entry => entry.trim().toLowerCase().replace(/:\d+$/, ''))
+    .filter(entry => entry);
+  host = host.toLowerCase();
+  return entries.some(entry => {
+    return entry == '*' || host == entry.replace(/^\./, '') || host.endsWith(entry.startsWith('.') ? entry : '.' + entry);
+  });
+}
+
+function proxyFor(destination, url) {
+  const proxy = proxyOptions()[destination] || environment('HTTPS_PROXY');
+  if (!proxy || direct(new URL(url).hostname)) {
+    return undefined;
+  }
+  return proxy;
+}
+
+// An HTTPS agent tunnelling its connections through an HTTP proxy with
+// CONNECT.  TLS options of the agent, such as a CA or client certificate,
+// apply to the tunnelled connection.
+class ProxyAgent extends https.Agent {
+  constructor(proxy, options) {
+    super(options);
+    this.proxy = new URL(proxy);
+  }
+
+  createConnection(options, callback) {
+    const headers = {'Host': options.host + ':' + options.port};
+    if (this.proxy.username) {
+      headers['Proxy-Authorization'] = 'Basic ' + Buffer.from(
+        decodeURIComponent(this.proxy.username) + ':' + decodeURIComponent(this.proxy.password)).toString('base64');
+    }
+    const connect = http.request({
+      host: this.proxy.hostname,
+      port: this.proxy.port || 80,
+      method: 'CONNECT',
+      path: options.host + ':' + options.port,
+      headers: headers,
+    });
+    connect.once('connect', (response, socket) => {
+      if (response.statusCode != 200) {
+        socket.destroy();
+        callback(new Error('The proxy refused the connection with status ' + response.statusCode));
+        return;
+      }
+      callback(null, tls.connect(Object.assign({}, options, {
+        socket: socket,
+        servername: options.servername || options.host,
+      })));
+    });
+    connect.once('error', callback);
+    connect.end();
+  }
+}
+
+// Agents by TLS configuration and proxy, created on first use so that a
+// missing file only breaks the server it belongs to.
+const agents = new Map();
+
+function agentFor(tlsPrefix, proxy) {
+  const key = (tlsPrefix || '') + ' ' + (proxy || '');
+  if (!agents.has(key)) {
+    const config = tlsPrefix ? settings.fhirTls[tlsPrefix] : {};
+    const options = {
+      ca: pem(config.ca),
+      cert: pem(config.cert),
+      key: pem(config.key),
+      passphrase: config.passphrase,
+      keepAlive: true,
+    };
+    agents.set(key, proxy ? new ProxyAgent(proxy, options) : new https.Agent(options));
+  }
+  return agents.get(key);
+}
+
+// Returns the HTTPS agent for requests on behalf of a FHIR server, or
+// undefined to use the default transport.
+exports.agent = function(serverUrl) {
+  if (!serverUrl || !serverUrl.startsWith('https:')) {
+    return undefined;
+  }
+  const prefixes = Object.keys(settings.fhirTls || {})
+    .filter(prefix => serverUrl.startsWith(prefix))
+    .sort((a, b) => b.length - a.length);
+  const proxy = proxyFor('fhir', serverUrl);
+  if (prefixes.length == 0 && !proxy) {
+    return undefined;
+  }
+  return agentFor(prefixes[0], proxy);
+};
+
+// Returns the HTTPS agent for Calendar and Meet API requests, or undefined to
+// use the default transport.
+exports.googleAgent = function() {
+  const proxy = proxyFor('google', 'https://www.googleapis.com/');
+  return proxy && agentFor(undefined, proxy);
+};
@@ -14,71 +14,472 @@
  * limitations under the License.
  */
 
+const audit = require('./audit.js');
+const clock = require('./clock.js');
+const credentials = require('./credentials.js');
 const datastore = require('./datastore.js');
+const deadline = require('./deadline.js');
+const directory = require('./directory.js');
+const errors = require('./errors.js');
+const events = require('./events.js');
+const launchcontext = require('./launchcontext.js');
+const locks = require('./locks.js');
+const provenance = require('./provenance.js');
+const replay = require('./replay.js');
+const sessioncontext = require('./sessioncontext.js');
+const tenants = require('./tenants.js');
 
 const settings = require('./settings.json');
 
 const crypto = require('crypto');
 const {google} = require('googleapis');
 
-function newClient() {
+// Returns a Google OAuth client.  testing/google.js replaces it with a fake.
+exports.newClient = function() {
   return new google.auth.OAuth2(
     settings.oauth2.clientId,
     settings.oauth2.clientSecret,
     settings.oauth2.redirectUri,
   );
-}
+};
+
+// How long a provider has to complete Google sign-in.
+const signInTimeout = 10 * 60 * 1000;
 
-function getLoginUrl() {
-  return newClient().generateAuthUrl({
-    access_type: 'offline',
-    prompt: 'select_account consent',
-    scope: [
+// Sends the URL to sign in with, with a one-time state bound to the session.
+function sendLoginUrl(request, response) {
+  replay.issue(replay.OAUTH_STATE, signInTimeout).then(state => {
+    request.session.oauthState = state;
+    // openid has Google return an id_token naming the account signed in.
+    const scope = [
+      'openid',
       'https://www.googleapis.com/auth/calendar',
       'https://www.googleapis.com/auth/calendar.events',
-    ]
+    ];
+    if ((settings.invitations && settings.invitations.cohosts) ||
+        (settings.visitPeriod && settings.visitPeriod.meetRecords)) {
+      scope.push('https://www.googleapis.com/auth/meetings.space.created');
+    }
+    const options = {
+      access_type: 'offline',
+      prompt: 'select_account consent',
+      state: state,
+      scope: scope,
+    };
+    // The facility's Workspace domain narrows the accounts Google offers.
+    const domain = directory.workspaceDomain(request.get('X-FHIR-Server'));
+    if (domain) {
+      options.hd = domain;
+    }
+    response.send({url: exports.newClient().generateAuthUrl(options)});
+  }).catch(err => errors.send(response, err));
+}
+
+// Sessions created before refresh tokens were stored separately hold the
+// token itself; they expire within a session duration.
+function hasCredentials(entity) {
+  return entity && (entity.Credential || entity.Token);
+}
+
+function refreshToken(entity, actor) {
+  return entity.Credential ? credentials.load(entity.Credential, actor) : Promise.resolve(entity.Token);
+}
+
+// Deletes a stored session and its credentials.
+exports.deleteSession = function(entity) {
+  return datastore.delete(datastore.key(['User', datastore.name(entity)])).then(() => {
+    return Promise.all([entity.Credential, entity.EhrCredential]
+      .filter(id => id)
+      .map(id => credentials.remove(id)));
+  });
+};
+
+// Changes to a session record are read-modify-write sequences, some with
+// asynchronous work between the read and the write, such as storing a
+// credential.  They run one at a time per session: in order within the
+// instance and, with settings.sessionLocks.store, under a datastore lock
+// across instances.  Each write also checks that the record's Version is the
+// one read, so a change whose lock expired meanwhile is dropped rather than
+// overwriting a later one.
+const sessionQueues = new Map();
+
+function sessionLocks() {
+  return settings.sessionLocks || {};
+}
+
+function applyUpdate(id, update) {
+  const key = datastore.key(['User', id]);
+  return datastore.get(key).then(entity => {
+    if (!entity) {
+      return undefined;
+    }
+    const version = entity.Version || 0;
+    return Promise.resolve(update(entity)).then(changed => {
+      if (!changed) {
+        return undefined;
+      }
+      return datastore.modify(key, current => {
+        if (!current || (current.Version || 0) != version) {
+          return undefined;
+        }
+        return Object.assign(changed, {Version: version + 1});
+      });
+    });
+  });
+}
+
+function lockedUpdate(id, update) {
+  if (!sessionLocks().store) {
+    return applyUpdate(id, update);
+  }
+  const ttl = (sessionLocks().ttlSeconds || 10) * 1000;
+  // Session IDs sign providers in, so the lock is named by a hash.
+  const name = 'session:' + crypto.createHash('sha256').update(id).digest('hex').substring(0, 32);
+  return locks.run(name, ttl, ttl, () => applyUpdate(id, update), () => {
+    throw new errors.StoreUnavailable('The session is locked by another request');
+  });
+}
+
+// Resolves to a session record as changed by update(entity), which returns
+// the changed record or a promise of it.  Resolves to undefined, leaving the
+// record unchanged, if the session doesn't exist, update returns undefined
+// or another change was written first.  Every change to an existing session
+// record must be made through this.
+exports.updateSession = function(id, update) {
+  const run = (sessionQueues.get(id) || Promise.resolve()).then(() => lockedUpdate(id, update));
+  const done = run.catch(() => {});
+  sessionQueues.set(id, done);
+  done.then(() => {
+    if (sessionQueues.get(id) === done) {
+      sessionQueues.delete(id);
+    }
+  });
+  return run;
+};
+
+// Returns the Google account a token response was issued for, the subject of
+// its id_token, or undefined without one.  The id_token came straight from
+// Google's token endpoint, so its signature isn't checked.
+function accountOf(token) {
+  const parts = (token.id_token || '').split('.');
+  if (parts.length != 3) {
+    return undefined;
+  }
+  try {
+    const claims = JSON.parse(Buffer.from(parts[1], 'base64url').toString());
+    return claims.aud == settings.oauth2.clientId && claims.sub ? String(claims.sub) : undefined;
+  } catch (err) {
+    return undefined;
+  }
+}
+
+// Rejects with session-quota if signing a user in would take the tenant past
+// its quota of active sessions.  Signing in revokes the account's sessions
+// beyond their own limit, so only those that will remain are counted.
+function checkQuota(tenant, account) {
+  const quota = tenants.sessionQuota(tenant);
+  if (!quota) {
+    return Promise.resolve();
+  }
+
+  const now = clock.date();
+  return datastore.list('User', [['Expires', '>', now]]).then(entities => {
+    const active = entities.filter(entity => (entity.Tenant || tenants.DEFAULT) == tenant);
+    const own = account ? active.filter(entity => entity.Account == account).length : 0;
+    const limit = tenants.sessionLimit(tenant);
+    const count = active.length - own + (limit ? Math.min(own, limit - 1) : own);
+    if (count < quota) {
+      return;
+    }
+    const next = Math.min.apply(null, active.map(entity => entity.Expires.getTime()));
+    const err = new errors.SessionQuotaExceeded(tenant + ' has ' + count + ' of its ' + quota +
+      ' active sessions; the next one expires at ' + new Date(next).toISOString());
+    err.retryAfter = Math.max(1, Math.ceil((next - now.getTime()) / 1000));
+    audit.record('session-quota-exceeded', 'provider', '');
+    throw err;
+  });
+}
+
+// Revokes the oldest sessions of a Google account beyond the tenant's session
+// limit.  Sessions are counted by the account signed in rather than the FHIR
+// user, which the browser names.
+function limitSessions(tenant, account) {
+  const limit = tenants.sessionLimit(tenant);
+  if (!account || !limit) {
+    return Promise.resolve();
+  }
+
+  return datastore.list('User', [['Account', '=', account]]).then(entities => {
+    const sessions = entities
+      .filter(entity => entity.Tenant == tenant)
+      .sort((a, b) => b.Created - a.Created);
+    return Promise.all(sessions.slice(limit).map(entity => {
+      return exports.deleteSession(entity).then(() => {
+        events.publish('session.revoked');
+        audit.record('session-revoked', 'system', '');
+      });
+    }));
   });
 }
 
 exports.authenticate = function(request, response) {
-  const client = newClient();
-  client.getToken(request.query.code, (err, token) => {
+  const state = request.query.state;
+  if (!state || state !== request.session.oauthState) {
+    errors.send(response, new errors.Replayed('The sign-in state does not match this session'));
+    return;
+  }
+  request.session.oauthState = null;
+
+  replay.redeem(replay.OAUTH_STATE, state).then(redeemed => {
+    if (!redeemed) {
+      errors.send(response, new errors.Replayed('The sign-in was already completed or has expired'));
+      return;
+    }
+    exchangeCode(request, response);
+  }).catch(err => errors.send(response, err));
+};
+
+// Exchanges an authorization code for tokens, limited by the OAuth timeout.
+function getToken(client, code, callback) {
+  deadline.limit('oauth', () => client.getToken(code)).then(result => callback(null, result.tokens), err => callback(err));
+}
+
+function exchangeCode(request, response) {
+  const client = exports.newClient();
+  getToken(client, request.query.code, (err, token) => {
+    if (err instanceof errors.Timeout) {
+      errors.send(response, err);
+      return;
+    }
     if (err || !token.refresh_token) {
-      response.status(403).send(err);
+      errors.send(response, new errors.TokenExchangeFailed(err ? String(err) : 'No refresh token was issued'));
       return;
     }
 
+    // The tenant and FHIR user were remembered when the provider was sent to
+    // sign in.
+    const launch = launchcontext.get(request);
+    const tenant = launch.tenantId || tenants.DEFAULT;
+    const identity = launch.practitioner;
+    const account = accountOf(token);
+    const duration = tenants.sessionDuration(tenant, 'provider');
     const id = crypto.randomBytes(16).toString('base64');
     const key = datastore.key(['User', id]);
-    const entity = { Token: token.refresh_token };
-    datastore.set(key, entity).then(() => {
+    const now = clock.date();
+    checkQuota(tenant, account).then(() => credentials.store(token.refresh_token)).then(credential => {
+      const entity = {
+        Credential: credential,
+        Created: now,
+        Expires: new Date(now.getTime() + duration),
+        Tenant: tenant,
+      };
+      if (identity) {
+        entity.Identity = identity;
+      }
+      if (account) {
+        entity.Account = account;
+      }
+      return datastore.set(key, entity);
+    }).then(() => limitSessions(tenant, account)).then(() => {
       request.session.id = id;
+      request.sessionOptions.maxAge = duration;
+      sessioncontext.set(request, Object.assign({tenant: tenant, role: 'provider'},
+        contextStatus(sessionStatus({Created: now, Expires: new Date(now.getTime() + duration), Tenant: tenant}))));
+      events.publish('session.created');
+      audit.record('session-created', 'provider', '', request);
       response.redirect('/index.html');
+    }).catch(err => errors.send(response, err));
+  });
+}
+
+// Resolves to an authorized client for a signed in user, or undefined if the
+// user's session has expired or their credentials are no longer stored.
+exports.clientFor = function(id) {
+  const key = datastore.key(['User', id]);
+  return datastore.get(key).then(entity => {
+    if (!hasCredentials(entity) || (entity.Expires && entity.Expires < clock.date())) {
+      return undefined;
+    }
+
+    return refreshToken(entity, 'provider').then(token => {
+      if (!token) {
+        return undefined;
+      }
+      const client = exports.newClient();
+      client.setCredentials({refresh_token: token});
+      client.on('tokens', tokens => {
+        if (tokens.refresh_token && tokens.refresh_token != token) {
+          rotateRefreshToken(id, tokens.refresh_token).catch(err => {
+            console.log('Failed to store a rotated refresh token: ' + err);
+          });
+        }
+      });
+      return client;
+    });
+  });
+};
+
+// Replaces a session's refresh token with the one Google rotated it to.
+function rotateRefreshToken(id, token) {
+  var replaced;
+  return credentials.store(token).then(credential => {
+    return exports.updateSession(id, current => {
+      replaced = current.Credential;
+      return Object.assign(current, {Credential: credential});
+    }).then(saved => {
+      const unused = saved ? replaced : credential;
+      return unused && credentials.remove(unused);
+    });
+  });
+}
+
+// Resolves to the FHIR context a provider session last used, as kept for
+// token introspection, or undefined if none is kept.  The access token may
+// have expired since.
+exports.fhirContextFor = function(id) {
+  return datastore.get(datastore.key(['User', id])).then(entity => {
+    if (!entity || !entity.EhrCredential) {
+      return undefined;
+    }
+    return credentials.load(entity.EhrCredential, 'system').then(token => {
+      return token && {serverUrl: entity.EhrServer, accessToken: token, agent: provenance.agentOf(id, entity.Identity)};
+    });
+  });
+};
+
+// Signs the request in with a sibling of another provider's session, with a
+// copy of its credentials and the same expiry.  Resolves to false if that session has expired.
+exports.signInAsSibling = function(request, id) {
+  return datastore.get(datastore.key(['User', id])).then(entity => {
+    if (!hasCredentials(entity) || (entity.Expires && entity.Expires < clock.date())) {
+      return false;
+    }
+
+    const tenant = entity.Tenant || tenants.DEFAULT;
+    const expires = entity.Expires ||
+      new Date(entity.Created.getTime() + tenants.sessionDuration(tenant, 'provider'));
+    const siblingId = crypto.randomBytes(16).toString('base64');
+    return checkQuota(tenant, entity.Account).then(() => refreshToken(entity, 'provider')).then(token => {
+      if (!token) {
+        return false;
+      }
+      return credentials.store(token).then(credential => {
+        const sibling = {
+          Credential: credential,
+          Created: clock.date(),
+          Expires: expires,
+          Tenant: tenant,
+          Sibling: id,
+        };
+        if (entity.Identity) {
+          sibling.Identity = entity.Identity;
+        }
+        if (entity.Account) {
+          sibling.Account = entity.Account;
+        }
+        return datastore.set(datastore.key(['User', siblingId]), sibling);
+      }).then(() => {
+        request.session.id = siblingId;
+        request.sessionOptions.maxAge = expires.getTime() - clock.now();
+        sessioncontext.set(request, Object.assign({tenant: tenant, role: 'provider'},
+          contextStatus(sessionStatus({Created: entity.Created, Expires: expires, Tenant: tenant}))));
+        events.publish('session.created');
+        audit.record('session-created', 'provider', '', request);
+        return true;
+      });
+    });
+  });
+};
+
+function activeSession(id) {
+  if (!id) {
+    return Promise.resolve(undefined);
+  }
+  return datastore.get(datastore.key(['User', id])).then(entity => {
+    if (!hasCredentials(entity) || !entity.Expires || entity.Expires < clock.date()) {
+      return undefined;
+    }
+    return entity;
+  });
+}
+
+// The fields of a session status kept in the session context.
+function contextStatus(status) {
+  return {expires: status.expires, extendableUntil: status.extendableUntil};
+}
+
+function sessionStatus(entity) {
+  const maximum = new Date(entity.Created.getTime() + tenants.maxSessionLifetime(entity.Tenant));
+  return {
+    expires: entity.Expires,
+    ttl: Math.max(0, Math.floor((entity.Expires - clock.now()) / 1000)),
+    extendableUntil: maximum,
+  };
+}
+
+// Resolves to the expiry of the request's provider session, or undefined if
+// no provider is signed in.
+exports.sessionTtl = function(request) {
+  return activeSession(request.session.id).then(entity => entity && sessionStatus(entity));
+};
+
+// Extends the request's provider session by the tenant's session duration,
+// but no further than the tenant's maximum session lifetime.  Resolves to the
+// new expiry, or undefined if no provider is signed in.
+exports.extendSession = function(request) {
+  return activeSession(request.session.id).then(entity => {
+    if (!entity) {
+      return undefined;
+    }
+
+    const tenant = entity.Tenant || tenants.DEFAULT;
+    return exports.updateSession(request.session.id, current => {
+      const maximum = current.Created.getTime() + tenants.maxSessionLifetime(tenant);
+      const extended = Math.min(clock.now() + tenants.sessionDuration(tenant, 'provider'), maximum);
+      current.Expires = new Date(Math.max(extended, current.Expires.getTime()));
+      return current;
+    }).then(updated => {
+      if (!updated) {
+        return undefined;
+      }
+      request.sessionOptions.maxAge = updated.Expires.getTime() - clock.now();
+      const status = sessionStatus(updated);
+      sessioncontext.set(request, contextStatus(status));
+      return status;
     });
   });
 };
 
 exports.withCredentials = function(request, response, callback) {
   if (!request.session.id) {
-    response.send({url: getLoginUrl()});
+    sendLoginUrl(request, response);
     return;
   }
 
-  const key = datastore.key(['User', request.session.id]);
-  datastore.get(key).then(entity => {
-    if (!entity || !entity.Token) {
-      response.send({url: getLoginUrl()});
+  exports.clientFor(request.session.id).then(client => {
+    if (!client) {
+      sendLoginUrl(request, response);
       return;
     }
 
-    const token = entity.Token;
-    const client = newClient();
-    client.setCredentials({refresh_token: token});
     callback(client);
-  });
+  }).catch(err => errors.send(response, err));
 };
 
+// Signs the request out, deleting its session record and the credentials
+// stored for it so they can't be used after the cookie is gone.
 exports.logout = function(request, response) {
-  request.session.id = null;
-  response.send('You have been logged out');
+  const id = request.session.id;
+  const deleted = id ? datastore.get(datastore.key(['User', id])).then(entity => {
+    return entity && exports.deleteSession(entity);
+  }) : Promise.resolve();
+  deleted.then(() => {
+    if (id) {
+      events.publish('session.destroyed');
+      audit.record('session-destroyed', 'provider', '', request);
+    }
+    request.session.id = null;
+    sessioncontext.set(request, {role: undefined, expires: undefined, extendableUntil: undefined});
+    response.send('You have been logged out');
+  }).catch(err => errors.send(response, err));
 };
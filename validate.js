@@ -0,0 +1,99 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Validation of request bodies against the JSON Schemas in schemas.js.  Only
+// the keywords those schemas use are supported: type, properties, required,
+// items, enum, pattern, minLength, maxLength, minimum and maximum.  Failures are returned as an
+// invalid-request problem listing each field's error.
+
+const errors = require('./errors.js');
+
+function typeOf(value) {
+  if (Array.isArray(value)) {
+    return 'array';
+  }
+  if (Number.isInteger(value)) {
+    return 'integer';
+  }
+  return value === null ? 'null' : typeof value;
+}
+
+// Returns the errors of a value, each with the field it is about.
+function check(schema, value, field, errors) {
+  const types = [].concat(schema.type || []);
+  const type = typeOf(value);
+  if (types.length > 0 && types.indexOf(type) == -1 && !(type == 'integer' && types.indexOf('number') != -1)) {
+    errors.push({field: field, message: 'must be of type ' + types.join(' or ')});
+    return errors;
+  }
+
+  if (schema.enum && schema.enum.indexOf(value) == -1) {
+    errors.push({field: field, message: 'must be one of ' + schema.enum.join(', ')});
+  }
+  if (typeof value == 'string') {
+    if (schema.minLength !== undefined && value.length < schema.minLength) {
+      errors.push({field: field, message: 'must be at least ' + schema.minLength + ' characters'});
+    }
+    if (schema.maxLength !== undefined && value.length > schema.maxLength) {
+      errors.push({field: field, message: 'must be at most ' + schema.maxLength + ' characters'});
+    }
+    if (schema.pattern && !new RegExp(schema.pattern).test(value)) {
+      errors.push({field: field, message: 'is not in the expected format'});
+    }
+  }
+  if (typeof value == 'number') {
+    if (schema.minimum !== undefined && value < schema.minimum) {
+      errors.push({field: field, message: 'must be at least ' + schema.minimum});
+    }
+    if (schema.maximum !== undefined && value > schema.maximum) {
+      errors.push({field: field, message: 'must be at most ' + schema.maximum});
+    }
+  }
+  if (Array.isArray(value) && schema.items) {
+    value.forEach((item, i) => check(schema.items, item, field + '[' + i + ']', errors));
+  }
+  if (typeOf(value) == 'object') {
+    (schema.required || []).forEach(name => {
+      if (value[name] === undefined || value[name] === '') {
+        errors.push({field: field ? field + '.' + name : name, message: 'is required'});
+      }
+    });
+    Object.keys(schema.properties || {}).forEach(name => {
+      if (value[name] !== undefined && value[name] !== '') {
+        check(schema.properties[name], value[name], field ? field + '.' + name : name, errors);
+      }
+    });
+  }
+  return errors;
+}
+
+exports.check = function(schema, value) {
+  return check(schema, value, '', []);
+};
+
+// Middleware rejecting requests whose body doesn't match the schema.
+exports.body = function(schema) {
+  return function(request, response, next) {
+    const problems = exports.check(schema, request.body || {});
+    if (problems.length == 0) {
+      next();
+      return;
+    }
+    const err = new errors.InvalidRequest(problems.map(problem => problem.field + ' ' + problem.message).join('; '));
+    err.errors = problems;
+    next(err);
+  };
+};
@@ -0,0 +1,121 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Optional verification of the patient's identity before they are given the
+// meeting link: the patient answers with their date of birth, or the last 4
+// characters of one of their identifiers, and the answer is checked against
+// their Patient resource.  Each encounter allows settings.verification
+// .maxAttempts wrong answers before it is locked for lockoutMinutes.
+
+const datastore = require('./datastore.js');
+const errors = require('./errors.js');
+const fhir = require('./fhir.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+function options() {
+  return settings.verification || {};
+}
+
+exports.enabled = function() {
+  return !!options().enabled;
+};
+
+// 'birthDate' or 'identifier'.
+exports.method = function() {
+  return options().method || 'birthDate';
+};
+
+function answers(patient) {
+  if (exports.method() == 'identifier') {
+    return (patient.identifier || [])
+      .map(identifier => String(identifier.value || ''))
+      .filter(value => value.length >= 4)
+      .map(value => value.slice(-4).toLowerCase());
+  }
+  return patient.birthDate ? [patient.birthDate] : [];
+}
+
+function normalize(answer) {
+  answer = String(answer || '').trim().toLowerCase();
+  if (exports.method() == 'birthDate') {
+    // Accept MM/DD/YYYY as well as YYYY-MM-DD.
+    const match = /^(\d{1,2})\/(\d{1,2})\/(\d{4})$/.exec(answer);
+    if (match) {
+      return match[3] + '-' + match[1].padStart(2, '0') + '-' + match[2].padStart(2, '0');
+    }
+  }
+  return answer;
+}
+
+function matches(expected, answer) {
+  const a = Buffer.from(expected);
+  const b = Buffer.from(answer);
+  return a.length == b.length && crypto.timingSafeEqual(a, b);
+}
+
+function patientOf(context, encounterId) {
+  return fhir.read(context, 'Encounter', encounterId).then(encounter => {
+    const reference = (encounter.subject && encounter.subject.reference) || '';
+    if (!reference.startsWith('Patient/')) {
+      throw new errors.InvalidRequest('The encounter has no patient');
+    }
+    return fhir.read(context, 'Patient', reference.substring('Patient/'.length));
+  });
+}
+
+// Checks the patient's answer for an encounter.  Resolves to true if it is
+// right; rejects with Locked once too many wrong answers were given.
+exports.check = function(context, encounterId, answer) {
+  const key = datastore.key(['Verification', encounterId]);
+  const now = new Date();
+  return datastore.get(key).then(entity => {
+    if (entity && entity.LockedUntil > now) {
+      throw new errors.Locked('Too many wrong answers, try again later');
+    }
+    return patientOf(context, encounterId);
+  }).then(patient => {
+    const given = normalize(answer);
+    const right = answers(patient).some(expected => matches(expected, given));
+    return datastore.modify(key, entity => {
+      entity = entity || {Attempts: 0, LockedUntil: new Date(0)};
+      if (right) {
+        return Object.assign(entity, {Attempts: 0});
+      }
+      entity.Attempts++;
+      if (entity.Attempts >= (options().maxAttempts || 5)) {
+        entity.Attempts = 0;
+        entity.LockedUntil = new Date(now.getTime() + (options().lockoutMinutes || 15) * 60 * 1000);
+      }
+      return entity;
+    }).then(() => right);
+  });
+};
+
+// Whether the request's session verified the patient of an encounter.
+exports.verified = function(request, encounterId) {
+  return (request.session.verified || []).indexOf(encounterId) != -1;
+};
+
+exports.markVerified = function(request, encounterId) {
+  const verified = request.session.verified || [];
+  if (verified.indexOf(encounterId) == -1) {
+    // Keep the cookie small.
+    request.session.verified = verified.concat([encounterId]).slice(-10);
+  }
+};
@@ -0,0 +1,101 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Versions of the REST API.  Routes are registered once, unversioned, and
+// requests reach them under /v1/ or, for clients from before versioning, at
+// the bare path.  Later versions register a router with override(): its
+// routes take precedence for requests under /v<version>/ and anything it
+// doesn't handle falls through to the shared routes.
+//
+// Unversioned requests, and requests for a version with a sunset in
+// settings.apiVersions, get Deprecation and Sunset headers and a Link to the
+// successor, so EHR-embedded clients on old versions keep working while
+// their owners are warned.
+
+const errors = require('./errors.js');
+
+const settings = require('./settings.json');
+
+const express = require('express');
+
+exports.CURRENT = 1;
+
+// Paths that are part of URLs handed out beyond the API, such as the Google
+// sign-in redirect, cron jobs and links sent to patients, which stay
+// unversioned.
+const unversioned = ['/authenticate', '/logout', '/jobs/', '/surveys/', '/dev', '/openapi.json', '/.well-known/'];
+
+const overrides = {};
+
+// Returns the router whose routes replace the shared ones in a version.
+exports.override = function(version) {
+  overrides[version] = overrides[version] || express.Router();
+  return overrides[version];
+};
+
+function policy(version) {
+  return (settings.apiVersions || {})[version] || {};
+}
+
+function deprecate(response, sunset, successor) {
+  response.set('Deprecation', 'true');
+  if (sunset) {
+    response.set('Sunset', new Date(sunset).toUTCString());
+  }
+  if (successor) {
+    response.set('Link', '<' + successor + '>; rel="successor-version"');
+  }
+}
+
+// Returns the path of a request without its version prefix, for middleware
+// that runs before this module's.
+exports.path = function(request) {
+  const match = /^\/v\d+(\/.*)$/.exec(request.path);
+  return match ? match[1] : request.path;
+};
+
+// Middleware routing versioned requests.  Must be registered before the
+// API routes.
+exports.middleware = function(request, response, next) {
+  const match = /^\/v(\d+)(\/.*)$/.exec(request.path);
+  if (!match) {
+    if (!unversioned.some(prefix => request.path.startsWith(prefix))) {
+      request.apiVersion = 1;
+      deprecate(response, policy('unversioned').sunset, '/v' + exports.CURRENT + request.path);
+    }
+    next();
+    return;
+  }
+
+  const version = parseInt(match[1], 10);
+  if (version < 1 || version > exports.CURRENT) {
+    errors.send(response, new errors.NotFound('API version ' + version + ' does not exist'));
+    return;
+  }
+
+  request.apiVersion = version;
+  const sunset = policy(version).sunset;
+  if (sunset) {
+    deprecate(response, sunset, version < exports.CURRENT ? '/v' + exports.CURRENT + match[2] : undefined);
+  }
+  // Strip the prefix, leaving the query string.
+  request.url = request.url.substring(match[0].length - match[2].length);
+  if (overrides[version]) {
+    overrides[version](request, response, next);
+    return;
+  }
+  next();
+};
@@ -0,0 +1,116 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Outbound webhooks for visit lifecycle events, so that practice management
+// and other systems can follow visits without Pub/Sub.  settings.webhooks
+// lists webhooks receiving the events of every tenant and a tenant's own
+// webhooks receive only its visits' events.  Each webhook has a url, a
+// secret and optionally the events it wants, by default every visit event.
+//
+// Each delivery is a JSON POST of the event with its tenant and a delivery
+// id, signed with HMAC-SHA256 under the webhook's secret:
+//
+//   X-Meet-Event: visit.ended
+//   X-Meet-Delivery: 5f0c...
+//   X-Meet-Signature: t=1589875200,v1=<hex HMAC of "<t>.<body>">
+//
+// Failed deliveries are retried three times at once or, with the queue
+// enabled, with its backoff and dead letters.
+
+const datastore = require('./datastore.js');
+const queue = require('./queue.js');
+const tenants = require('./tenants.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+const gaxios = require('gaxios');
+
+function hooks(tenant) {
+  return (settings.webhooks || []).concat(tenants.config(tenant).webhooks || []);
+}
+
+function wanted(hook, type) {
+  return !!hook.url && (hook.events ? hook.events.indexOf(type) != -1 : type.startsWith('visit.'));
+}
+
+exports.sign = function(secret, timestamp, body) {
+  return 't=' + timestamp + ',v1=' + crypto.createHmac('sha256', secret).update(timestamp + '.' + body).digest('hex');
+};
+
+function post(hook, delivery) {
+  const body = JSON.stringify(delivery);
+  const timestamp = Math.floor(Date.now() / 1000);
+  return gaxios.request({
+    url: hook.url,
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+      'X-Meet-Event': delivery.type,
+      'X-Meet-Delivery': delivery.id,
+      'X-Meet-Signature': exports.sign(hook.secret || '', timestamp, body),
+    },
+    data: body,
+    timeout: 10 * 1000,
+  });
+}
+
+function delay(ms) {
+  return new Promise(resolve => setTimeout(resolve, ms));
+}
+
+// Delivers to the webhook of the tenant with the URL.  The hook is looked up
+// again so that its secret isn't stored with queued deliveries.
+function deliver(payload) {
+  const hook = hooks(payload.delivery.tenant).find(hook => hook.url == payload.url);
+  if (!hook) {
+    return Promise.resolve();
+  }
+  if (queue.enabled()) {
+    return post(hook, payload.delivery);
+  }
+  const retry = (attempt, err) => {
+    if (attempt > 3) {
+      return Promise.reject(err);
+    }
+    return delay(1000 * Math.pow(4, attempt - 1)).then(() => post(hook, payload.delivery))
+      .catch(err => retry(attempt + 1, err));
+  };
+  return post(hook, payload.delivery).catch(err => retry(1, err));
+}
+
+queue.handle('webhook', deliver, (payload, err) => {
+  console.log('Failed to deliver ' + payload.delivery.type + ' to ' + payload.url + ': ' + err);
+});
+
+// Sends a visit event to the webhooks of the encounter's tenant.  Failures
+// are logged rather than returned so that they don't break visits.
+exports.send = function(event) {
+  if (!event.encounterId || (!settings.webhooks && !settings.tenants)) {
+    return Promise.resolve();
+  }
+  return datastore.get(datastore.key(['Encounter', event.encounterId])).then(entity => {
+    const tenant = entity && entity.Tenant || tenants.DEFAULT;
+    const delivery = Object.assign({id: crypto.randomBytes(16).toString('hex'), tenant: tenant}, event);
+    return Promise.all(hooks(tenant).filter(hook => wanted(hook, event.type)).map(hook => {
+      return queue.enqueue('webhook', {url: hook.url, delivery: delivery}).catch(err => {
+        console.log('Failed to deliver ' + event.type + ' to ' + hook.url + ': ' + err);
+      });
+    }));
+  }).catch(err => {
+    console.log('Failed to send ' + event.type + ' to webhooks: ' + err);
+  });
+};
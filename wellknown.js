@@ -0,0 +1,100 @@
+/**
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Discovery documents describing the app to EHR app galleries, served from
+// /.well-known/ and generated from the settings: the JWK Set of the public
+// keys in settings.smartApp.publicKeys (PEM), used to authenticate as a SMART
+// backend service, the OAuth client metadata (RFC 7591) to register the app
+// with, and a manifest of its SMART launch configuration.  The app's URLs
+// are on the origin of the Google sign-in redirect.
+
+const ehr = require('./ehr.js');
+
+const settings = require('./settings.json');
+
+const crypto = require('crypto');
+
+function options() {
+  return settings.smartApp || {};
+}
+
+function origin() {
+  return new URL(settings.oauth2.redirectUri).origin;
+}
+
+// The RFC 7638 thumbprint of a JWK, used as its key ID.
+function thumbprint(jwk) {
+  const members = jwk.kty == 'EC' ? {crv: jwk.crv, kty: jwk.kty, x: jwk.x, y: jwk.y} : {e: jwk.e, kty: jwk.kty, n: jwk.n};
+  return crypto.createHash('sha256').update(JSON.stringify(members)).digest('base64url');
+}
+
+// SMART backend services use RS384 or ES384; other curves get their ECDSA
+// algorithm.
+const curveAlgorithms = {'P-256': 'ES256', 'P-384': 'ES384', 'P-521': 'ES512'};
+
+exports.jwks = function() {
+  return {
+    keys: (options().publicKeys || []).map(pem => {
+      const jwk = crypto.createPublicKey(pem).export({format: 'jwk'});
+      return Object.assign(jwk, {
+        kid: thumbprint(jwk),
+        use: 'sig',
+        alg: jwk.kty == 'EC' ? curveAlgorithms[jwk.crv] : 'RS384',
+      });
+    }),
+  };
+};
+
+function scope() {
+  return ehr.profile().scope.join(' ');
+}
+
+exports.clientMetadata = function() {
+  const metadata = {
+    client_name: options().name || 'Meet on FHIR',
+    client_uri: origin(),
+    redirect_uris: [origin() + '/'],
+    initiate_login_uri: origin() + '/launch.html',
+    grant_types: ['authorization_code'],
+    response_types: ['code'],
+    token_endpoint_auth_method: settings.fhirClientSecret ? 'client_secret_basic' : 'none',
+    scope: scope(),
+  };
+  if (options().logoUrl) {
+    metadata.logo_uri = new URL(options().logoUrl, origin()).href;
+  }
+  if (options().contacts) {
+    metadata.contacts = options().contacts;
+  }
+  if ((options().publicKeys || []).length) {
+    metadata.jwks_uri = origin() + '/.well-known/jwks.json';
+  }
+  return metadata;
+};
+
+exports.manifest = function() {
+  return {
+    name: options().name || 'Meet on FHIR',
+    description: options().description || 'Google Meet video visits launched from the EHR',
+    launch_url: origin() + '/launch.html',
+    redirect_urls: [origin() + '/'],
+    scopes: scope().split(' '),
+    fhir_versions: ['4.0.1'],
+    launch_contexts: ['ehr', 'standalone'],
+    client_metadata_uri: origin() + '/.well-known/oauth-client.json',
+    jwks_uri: (options().publicKeys || []).length ? origin() + '/.well-known/jwks.json' : undefined,
+  };
+};